@@ -67,6 +67,12 @@ func (cs compactionSet) maxLevel() int {
 	return len(cs) - 1
 }
 
+const (
+	tenantReportNone    = "none"
+	tenantReportLog     = "log"
+	tenantReportMetrics = "metrics"
+)
+
 func registerCompact(m map[string]setupFunc, app *kingpin.Application) {
 	cmd := app.Command(component.Compact.String(), "continuously compacts blocks in an object store bucket")
 
@@ -82,6 +88,7 @@ func registerCompact(m map[string]setupFunc, app *kingpin.Application) {
 		Default("./data").String()
 
 	objStoreConfig := regCommonObjStoreFlags(cmd, "", true)
+	objStoreMaxConcurrency := regObjStoreMaxConcurrencyFlag(cmd)
 
 	consistencyDelay := modelDuration(cmd.Flag("consistency-delay", fmt.Sprintf("Minimum age of fresh (non-compacted) blocks before they are being processed. Malformed blocks older than the maximum of consistency-delay and %s will be removed.", compact.MinimumAgeForRemoval)).
 		Default("30m"))
@@ -89,6 +96,8 @@ func registerCompact(m map[string]setupFunc, app *kingpin.Application) {
 	retentionRaw := modelDuration(cmd.Flag("retention.resolution-raw", "How long to retain raw samples in bucket. 0d - disables this retention").Default("0d"))
 	retention5m := modelDuration(cmd.Flag("retention.resolution-5m", "How long to retain samples of resolution 1 (5 minutes) in bucket. 0d - disables this retention").Default("0d"))
 	retention1h := modelDuration(cmd.Flag("retention.resolution-1h", "How long to retain samples of resolution 2 (1 hour) in bucket. 0d - disables this retention").Default("0d"))
+	retentionVerifyDownsampled := cmd.Flag("retention.verify-downsampled", "Delete raw blocks due to retention only if downsampled blocks with the same external labels cover their whole time range, to not lose data if downsampling failed or was disabled.").
+		Default("false").Bool()
 
 	wait := cmd.Flag("wait", "Do not exit after all compactions have been processed and wait for new work.").
 		Short('w').Bool()
@@ -100,16 +109,47 @@ func registerCompact(m map[string]setupFunc, app *kingpin.Application) {
 		"as querying long time ranges without non-downsampled data is not efficient and useful e.g it is not possible to render all samples for a human eye anyway").
 		Default("false").Bool()
 
+	downsampleSumSquares := regDownsampleSumSquaresFlag(cmd)
+
 	maxCompactionLevel := cmd.Flag("debug.max-compaction-level", fmt.Sprintf("Maximum compaction level, default is %d: %s", compactions.maxLevel(), compactions.String())).
 		Hidden().Default(strconv.Itoa(compactions.maxLevel())).Int()
 
 	blockSyncConcurrency := cmd.Flag("block-sync-concurrency", "Number of goroutines to use when syncing block metadata from object storage.").
 		Default("20").Int()
 
+	blockVerifyConcurrency := cmd.Flag("block-verify-concurrency", "Number of goroutines to use when verifying the indexes of the blocks downloaded for a compaction.").
+		Default("1").Int()
+
 	compactionConcurrency := cmd.Flag("compact.concurrency", "Number of goroutines to use when compacting groups.").
 		Default("1").Int()
 
+	maxConcurrencyPerGroup := cmd.Flag("compact.max-concurrency-per-group", "Maximum number of groups compacted concurrently that share the values of the compact.fair-scheduling-label labels, so that no tenant can occupy all compact.concurrency goroutines while others wait. 0 means no limit.").
+		Default("0").Int()
+
+	fairSchedulingLabels := cmd.Flag("compact.fair-scheduling-label", "External label whose values identify a tenant for compact.max-concurrency-per-group (repeated). By default blocks with the same external labels form one.").
+		PlaceHolder("<name>").Strings()
+
+	groupDropLabels := cmd.Flag("compact.group-drop-label", "External label to ignore when grouping blocks for compaction (repeated). Blocks whose external labels only differ in these labels are compacted together and the resulting blocks do not carry them. Such blocks must not overlap in time. By default blocks are grouped strictly by all external labels.").
+		PlaceHolder("<name>").Strings()
+
+	excludedSources := cmd.Flag("compact.exclude-source", "Source of blocks, as in their meta.json, to neither compact nor downsample (repeated), e.g. to leave blocks uploaded by receivers alone.").
+		PlaceHolder("<source>").Enums(string(metadata.SidecarSource), string(metadata.ReceiveSource), string(metadata.CompactorSource), string(metadata.CompactorRepairSource), string(metadata.RulerSource), string(metadata.BucketRepairSource))
+
+	detectReplicaLabels := cmd.Flag("compact.detect-replica-labels", "Log external labels that likely are replica labels after each compaction run. A label is reported if dropping it makes blocks with a similar number of series but different values of that label overlap in time. This is a heuristic to help finding labels for deduplication.").
+		Default("false").Bool()
+
+	tenantReport := cmd.Flag("compact.tenant-report", "Report the number of blocks and their series, samples and chunks per set of external labels after each compaction run, to track storage growth per tenant. Sizes in bytes are not reported. 'log' logs a line per tenant, 'metrics' exposes them as thanos_compact_tenant_* gauges. Failing to gather the report is logged without failing the run.").
+		Default(tenantReportNone).Enum(tenantReportNone, tenantReportLog, tenantReportMetrics)
+
+	deletionWebhookURL := cmd.Flag("compact.deletion-webhook-url", "URL to POST a JSON event with ID, reason and external labels of every block the compactor deletes to, e.g. for auditing. Failed calls are logged and counted by thanos_compact_deletion_webhook_failures_total, but do not stop the deletion. Empty disables it.").
+		Default("").String()
+
 	m[component.Compact.String()] = func(g *run.Group, logger log.Logger, reg *prometheus.Registry, tracer opentracing.Tracer, _ bool) error {
+		var excludedSourceTypes []metadata.SourceType
+		for _, s := range *excludedSources {
+			excludedSourceTypes = append(excludedSourceTypes, metadata.SourceType(s))
+		}
+
 		return runCompact(g, logger, reg,
 			*httpAddr,
 			*dataDir,
@@ -129,6 +169,17 @@ func registerCompact(m map[string]setupFunc, app *kingpin.Application) {
 			*maxCompactionLevel,
 			*blockSyncConcurrency,
 			*compactionConcurrency,
+			*groupDropLabels,
+			*downsampleSumSquares,
+			*detectReplicaLabels,
+			*objStoreMaxConcurrency,
+			*retentionVerifyDownsampled,
+			*maxConcurrencyPerGroup,
+			*fairSchedulingLabels,
+			*blockVerifyConcurrency,
+			excludedSourceTypes,
+			*tenantReport,
+			*deletionWebhookURL,
 		)
 	}
 }
@@ -151,6 +202,17 @@ func runCompact(
 	maxCompactionLevel int,
 	blockSyncConcurrency int,
 	concurrency int,
+	groupDropLabels []string,
+	downsampleSumSquares bool,
+	detectReplicaLabels bool,
+	objStoreMaxConcurrency int,
+	retentionVerifyDownsampled bool,
+	maxConcurrencyPerGroup int,
+	fairSchedulingLabels []string,
+	blockVerifyConcurrency int,
+	excludedSources []metadata.SourceType,
+	tenantReport string,
+	deletionWebhookURL string,
 ) error {
 	halted := prometheus.NewGauge(prometheus.GaugeOpts{
 		Name: "thanos_compactor_halted",
@@ -167,6 +229,12 @@ func runCompact(
 
 	downsampleMetrics := newDownsampleMetrics(reg)
 
+	var tenantStatsMetrics *compact.TenantStatsMetrics
+	if tenantReport == tenantReportMetrics {
+		tenantStatsMetrics = compact.NewTenantStatsMetrics(reg)
+	}
+	deletionNotifier := compact.NewDeletionNotifier(logger, reg, deletionWebhookURL)
+
 	statusProber := prober.NewProber(component, logger, prometheus.WrapRegistererWithPrefix("thanos_", reg))
 	// Initiate default HTTP listener providing metrics endpoint and readiness/liveness probes.
 	if err := scheduleHTTPServer(g, logger, reg, statusProber, httpBindAddr, nil, component); err != nil {
@@ -182,6 +250,7 @@ func runCompact(
 	if err != nil {
 		return err
 	}
+	bkt = objstore.BucketWithConcurrencyLimit(bkt, objStoreMaxConcurrency, reg)
 
 	// Ensure we close up everything properly.
 	defer func() {
@@ -191,7 +260,7 @@ func runCompact(
 	}()
 
 	sy, err := compact.NewSyncer(logger, reg, bkt, consistencyDelay,
-		blockSyncConcurrency, acceptMalformedIndex)
+		blockSyncConcurrency, acceptMalformedIndex, groupDropLabels, blockVerifyConcurrency, excludedSources, deletionNotifier)
 	if err != nil {
 		return errors.Wrap(err, "create syncer")
 	}
@@ -226,7 +295,7 @@ func runCompact(
 		return errors.Wrap(err, "clean working downsample directory")
 	}
 
-	compactor, err := compact.NewBucketCompactor(logger, sy, comp, compactDir, bkt, concurrency)
+	compactor, err := compact.NewBucketCompactor(logger, sy, comp, compactDir, bkt, concurrency, maxConcurrencyPerGroup, fairSchedulingLabels)
 	if err != nil {
 		cancel()
 		return errors.Wrap(err, "create bucket compactor")
@@ -248,6 +317,10 @@ func runCompact(
 		}
 		level.Info(logger).Log("msg", "compaction iterations done")
 
+		if detectReplicaLabels {
+			level.Info(logger).Log("msg", "detected likely replica labels", "labels", strings.Join(sy.ReplicaLabels(), ","))
+		}
+
 		// TODO(bplotka): Remove "disableDownsampling" once https://github.com/thanos-io/thanos/issues/297 is fixed.
 		if !disableDownsampling {
 			// After all compactions are done, work down the downsampling backlog.
@@ -255,13 +328,13 @@ func runCompact(
 			// for 5m downsamplings created in the first run.
 			level.Info(logger).Log("msg", "start first pass of downsampling")
 
-			if err := downsampleBucket(ctx, logger, downsampleMetrics, bkt, downsamplingDir); err != nil {
+			if err := downsampleBucket(ctx, logger, downsampleMetrics, bkt, downsamplingDir, downsampleSumSquares, excludedSources); err != nil {
 				return errors.Wrap(err, "first pass of downsampling failed")
 			}
 
 			level.Info(logger).Log("msg", "start second pass of downsampling")
 
-			if err := downsampleBucket(ctx, logger, downsampleMetrics, bkt, downsamplingDir); err != nil {
+			if err := downsampleBucket(ctx, logger, downsampleMetrics, bkt, downsamplingDir, downsampleSumSquares, excludedSources); err != nil {
 				return errors.Wrap(err, "second pass of downsampling failed")
 			}
 			level.Info(logger).Log("msg", "downsampling iterations done")
@@ -269,9 +342,21 @@ func runCompact(
 			level.Warn(logger).Log("msg", "downsampling was explicitly disabled")
 		}
 
-		if err := compact.ApplyRetentionPolicyByResolution(ctx, logger, bkt, retentionByResolution); err != nil {
+		if err := compact.ApplyRetentionPolicyByResolution(ctx, logger, bkt, retentionByResolution, retentionVerifyDownsampled, deletionNotifier); err != nil {
 			return errors.Wrap(err, fmt.Sprintf("retention failed"))
 		}
+
+		if tenantReport != tenantReportNone {
+			// The report is informational only, so failing to gather it must not fail the compaction run.
+			stats, err := compact.BucketTenantStats(ctx, logger, bkt)
+			if err != nil {
+				level.Warn(logger).Log("msg", "tenant report failed", "err", err)
+			} else if tenantStatsMetrics != nil {
+				tenantStatsMetrics.Set(stats)
+			} else {
+				compact.LogTenantStats(logger, stats)
+			}
+		}
 		return nil
 	}
 
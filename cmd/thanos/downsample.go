@@ -36,11 +36,20 @@ func registerDownsample(m map[string]setupFunc, app *kingpin.Application, name s
 
 	objStoreConfig := regCommonObjStoreFlags(cmd, "", true)
 
+	sumSquares := regDownsampleSumSquaresFlag(cmd)
+
 	m[name] = func(g *run.Group, logger log.Logger, reg *prometheus.Registry, tracer opentracing.Tracer, _ bool) error {
-		return runDownsample(g, logger, reg, *httpAddr, *dataDir, objStoreConfig)
+		return runDownsample(g, logger, reg, *httpAddr, *dataDir, objStoreConfig, *sumSquares)
 	}
 }
 
+func regDownsampleSumSquaresFlag(cmd *kingpin.CmdClause) *bool {
+	return cmd.Flag("downsampling.sum-squares", "Additionally store the sum of squares of raw samples in 5m downsampled blocks, "+
+		"which allows computing stddev_over_time and stdvar_over_time on downsampled data. It is carried over into 1h blocks "+
+		"downsampled from blocks that contain it.").
+		Default("false").Bool()
+}
+
 type DownsampleMetrics struct {
 	downsamples        *prometheus.CounterVec
 	downsampleFailures *prometheus.CounterVec
@@ -71,6 +80,7 @@ func runDownsample(
 	httpBindAddr string,
 	dataDir string,
 	objStoreConfig *pathOrContent,
+	sumSquares bool,
 ) error {
 	confContentYaml, err := objStoreConfig.Content()
 	if err != nil {
@@ -100,13 +110,13 @@ func runDownsample(
 
 			level.Info(logger).Log("msg", "start first pass of downsampling")
 
-			if err := downsampleBucket(ctx, logger, metrics, bkt, dataDir); err != nil {
+			if err := downsampleBucket(ctx, logger, metrics, bkt, dataDir, sumSquares, nil); err != nil {
 				return errors.Wrap(err, "downsampling failed")
 			}
 
 			level.Info(logger).Log("msg", "start second pass of downsampling")
 
-			if err := downsampleBucket(ctx, logger, metrics, bkt, dataDir); err != nil {
+			if err := downsampleBucket(ctx, logger, metrics, bkt, dataDir, sumSquares, nil); err != nil {
 				return errors.Wrap(err, "downsampling failed")
 			}
 
@@ -130,6 +140,8 @@ func downsampleBucket(
 	metrics *DownsampleMetrics,
 	bkt objstore.Bucket,
 	dir string,
+	sumSquares bool,
+	excludedSources []metadata.SourceType,
 ) error {
 	if err := os.RemoveAll(dir); err != nil {
 		return errors.Wrap(err, "clean working directory")
@@ -181,6 +193,9 @@ func downsampleBucket(
 	}
 
 	for _, m := range metas {
+		if compact.IsSourceExcluded(*m, excludedSources) {
+			continue
+		}
 		switch m.Thanos.Downsample.Resolution {
 		case 0:
 			missing := false
@@ -199,7 +214,7 @@ func downsampleBucket(
 			if m.MaxTime-m.MinTime < 40*60*60*1000 {
 				continue
 			}
-			if err := processDownsampling(ctx, logger, bkt, m, dir, 5*60*1000); err != nil {
+			if err := processDownsampling(ctx, logger, bkt, m, dir, 5*60*1000, sumSquares); err != nil {
 				metrics.downsampleFailures.WithLabelValues(compact.GroupKey(*m)).Inc()
 				return errors.Wrap(err, "downsampling to 5 min")
 			}
@@ -222,7 +237,7 @@ func downsampleBucket(
 			if m.MaxTime-m.MinTime < 10*24*60*60*1000 {
 				continue
 			}
-			if err := processDownsampling(ctx, logger, bkt, m, dir, 60*60*1000); err != nil {
+			if err := processDownsampling(ctx, logger, bkt, m, dir, 60*60*1000, sumSquares); err != nil {
 				metrics.downsampleFailures.WithLabelValues(compact.GroupKey(*m))
 				return errors.Wrap(err, "downsampling to 60 min")
 			}
@@ -232,7 +247,7 @@ func downsampleBucket(
 	return nil
 }
 
-func processDownsampling(ctx context.Context, logger log.Logger, bkt objstore.Bucket, m *metadata.Meta, dir string, resolution int64) error {
+func processDownsampling(ctx context.Context, logger log.Logger, bkt objstore.Bucket, m *metadata.Meta, dir string, resolution int64, sumSquares bool) error {
 	begin := time.Now()
 	bdir := filepath.Join(dir, m.ULID.String())
 
@@ -261,7 +276,7 @@ func processDownsampling(ctx context.Context, logger log.Logger, bkt objstore.Bu
 	}
 	defer runutil.CloseWithLogOnErr(log.With(logger, "outcome", "potential left mmap file handlers left"), b, "tsdb reader")
 
-	id, err := downsample.Downsample(logger, m, b, dir, resolution)
+	id, err := downsample.Downsample(logger, m, b, dir, resolution, sumSquares)
 	if err != nil {
 		return errors.Wrapf(err, "downsample block %s to window %d", m.ULID, resolution)
 	}
@@ -15,6 +15,8 @@ func regGRPCFlags(cmd *kingpin.CmdClause) (
 	grpcTLSSrvCert *string,
 	grpcTLSSrvKey *string,
 	grpcTLSSrvClientCA *string,
+	grpcTLSSrvMinVersion *string,
+	grpcTLSSrvCipherSuites *[]string,
 ) {
 	grpcBindAddr = cmd.Flag("grpc-address", "Listen ip:port address for gRPC endpoints (StoreAPI). Make sure this address is routable from other components.").
 		Default("0.0.0.0:10901").String()
@@ -22,11 +24,15 @@ func regGRPCFlags(cmd *kingpin.CmdClause) (
 	grpcTLSSrvCert = cmd.Flag("grpc-server-tls-cert", "TLS Certificate for gRPC server, leave blank to disable TLS").Default("").String()
 	grpcTLSSrvKey = cmd.Flag("grpc-server-tls-key", "TLS Key for the gRPC server, leave blank to disable TLS").Default("").String()
 	grpcTLSSrvClientCA = cmd.Flag("grpc-server-tls-client-ca", "TLS CA to verify clients against. If no client CA is specified, there is no client verification on server side. (tls.NoClientCert)").Default("").String()
+	grpcTLSSrvMinVersion = cmd.Flag("grpc-server-tls-min-version", "Minimum TLS version accepted by the gRPC server when TLS is enabled.").Default("1.2").Enum("1.0", "1.1", "1.2", "1.3")
+	grpcTLSSrvCipherSuites = cmd.Flag("grpc-server-tls-cipher-suite", "TLS cipher suite allowed by the gRPC server when TLS is enabled (repeated). If none is specified, Go defaults are used. Not applicable to TLS 1.3.").PlaceHolder("<suite>").Strings()
 
 	return grpcBindAddr,
 		grpcTLSSrvCert,
 		grpcTLSSrvKey,
-		grpcTLSSrvClientCA
+		grpcTLSSrvClientCA,
+		grpcTLSSrvMinVersion,
+		grpcTLSSrvCipherSuites
 }
 
 // TODO(povilasv): we don't need this anymore.
@@ -35,15 +41,19 @@ func regCommonServerFlags(cmd *kingpin.CmdClause) (
 	httpBindAddr *string,
 	grpcTLSSrvCert *string,
 	grpcTLSSrvKey *string,
-	grpcTLSSrvClientCA *string) {
+	grpcTLSSrvClientCA *string,
+	grpcTLSSrvMinVersion *string,
+	grpcTLSSrvCipherSuites *[]string) {
 	httpBindAddr = regHTTPAddrFlag(cmd)
-	grpcBindAddr, grpcTLSSrvCert, grpcTLSSrvKey, grpcTLSSrvClientCA = regGRPCFlags(cmd)
+	grpcBindAddr, grpcTLSSrvCert, grpcTLSSrvKey, grpcTLSSrvClientCA, grpcTLSSrvMinVersion, grpcTLSSrvCipherSuites = regGRPCFlags(cmd)
 
 	return grpcBindAddr,
 		httpBindAddr,
 		grpcTLSSrvCert,
 		grpcTLSSrvKey,
-		grpcTLSSrvClientCA
+		grpcTLSSrvClientCA,
+		grpcTLSSrvMinVersion,
+		grpcTLSSrvCipherSuites
 }
 
 func regHTTPAddrFlag(cmd *kingpin.CmdClause) *string {
@@ -114,6 +124,11 @@ func regCommonObjStoreFlags(cmd *kingpin.CmdClause, suffix string, required bool
 	}
 }
 
+func regObjStoreMaxConcurrencyFlag(cmd *kingpin.CmdClause) *int {
+	return cmd.Flag("objstore.max-concurrency", "Maximum number of concurrent operations against the object store. Further operations wait for their turn. 0 means no limit.").
+		Default("0").Int()
+}
+
 func regCommonTracingFlags(app *kingpin.Application) *pathOrContent {
 	fileFlagName := fmt.Sprintf("tracing.config-file")
 	contentFlagName := fmt.Sprintf("tracing.config")
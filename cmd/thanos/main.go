@@ -246,7 +246,7 @@ func registerMetrics(mux *http.ServeMux, g prometheus.Gatherer) {
 	mux.Handle("/metrics", promhttp.HandlerFor(g, promhttp.HandlerOpts{}))
 }
 
-func defaultGRPCServerOpts(logger log.Logger, cert, key, clientCA string) ([]grpc.ServerOption, error) {
+func defaultGRPCServerOpts(logger log.Logger, cert, key, clientCA, minVersion string, cipherSuites []string) ([]grpc.ServerOption, error) {
 	opts := []grpc.ServerOption{}
 
 	if key == "" && cert == "" {
@@ -262,17 +262,70 @@ func defaultGRPCServerOpts(logger log.Logger, cert, key, clientCA string) ([]grp
 		return nil, errors.New("both server key and certificate must be provided")
 	}
 
+	tlsCfg, err := newServerTLSConfig(cert, key, clientCA, minVersion, cipherSuites)
+	if err != nil {
+		return nil, err
+	}
+
+	level.Info(logger).Log("msg", "enabled gRPC server side TLS")
+	if clientCA != "" {
+		level.Info(logger).Log("msg", "gRPC server TLS client verification enabled")
+	}
+
+	return append(opts, grpc.Creds(credentials.NewTLS(tlsCfg))), nil
+}
+
+// tlsVersions maps the accepted values of the TLS min version flags to TLS versions.
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// tlsCipherSuites maps the accepted values of the TLS cipher suites flags to cipher suite IDs.
+// TLS 1.3 cipher suites are not configurable and always enabled when TLS 1.3 is negotiated.
+var tlsCipherSuites = map[string]uint16{
+	"TLS_RSA_WITH_AES_128_CBC_SHA":                  tls.TLS_RSA_WITH_AES_128_CBC_SHA,
+	"TLS_RSA_WITH_AES_256_CBC_SHA":                  tls.TLS_RSA_WITH_AES_256_CBC_SHA,
+	"TLS_RSA_WITH_AES_128_GCM_SHA256":               tls.TLS_RSA_WITH_AES_128_GCM_SHA256,
+	"TLS_RSA_WITH_AES_256_GCM_SHA384":               tls.TLS_RSA_WITH_AES_256_GCM_SHA384,
+	"TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA":          tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA,
+	"TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA":          tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
+	"TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA":            tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
+	"TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA":            tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
+	"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256":         tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256":       tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384":         tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	"TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384":       tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	"TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256":   tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+	"TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256": tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+}
+
+// newServerTLSConfig builds the server side TLS config from the given certificate, key, optional client CA,
+// minimum TLS version and optional cipher suite allowlist. Empty cipher suites mean Go defaults.
+func newServerTLSConfig(cert, key, clientCA, minVersion string, cipherSuites []string) (*tls.Config, error) {
+	version, ok := tlsVersions[minVersion]
+	if !ok {
+		return nil, errors.Errorf("unknown TLS version %q", minVersion)
+	}
+
 	tlsCfg := &tls.Config{
-		MinVersion: tls.VersionTLS12,
+		MinVersion: version,
+	}
+
+	for _, name := range cipherSuites {
+		id, ok := tlsCipherSuites[name]
+		if !ok {
+			return nil, errors.Errorf("unknown or unsupported TLS cipher suite %q", name)
+		}
+		tlsCfg.CipherSuites = append(tlsCfg.CipherSuites, id)
 	}
 
 	tlsCert, err := tls.LoadX509KeyPair(cert, key)
 	if err != nil {
 		return nil, errors.Wrap(err, "server credentials")
 	}
-
-	level.Info(logger).Log("msg", "enabled gRPC server side TLS")
-
 	tlsCfg.Certificates = []tls.Certificate{tlsCert}
 
 	if clientCA != "" {
@@ -287,11 +340,8 @@ func defaultGRPCServerOpts(logger log.Logger, cert, key, clientCA string) ([]grp
 		}
 		tlsCfg.ClientCAs = certPool
 		tlsCfg.ClientAuth = tls.RequireAndVerifyClientCert
-
-		level.Info(logger).Log("msg", "gRPC server TLS client verification enabled")
 	}
-
-	return append(opts, grpc.Creds(credentials.NewTLS(tlsCfg))), nil
+	return tlsCfg, nil
 }
 
 func newStoreGRPCServer(logger log.Logger, reg *prometheus.Registry, tracer opentracing.Tracer, srv storepb.StoreServer, opts []grpc.ServerOption) *grpc.Server {
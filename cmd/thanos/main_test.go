@@ -0,0 +1,91 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/thanos-io/thanos/pkg/testutil"
+)
+
+func writeSelfSignedCert(t *testing.T, dir string) (certFile, keyFile string) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	testutil.Ok(t, err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	testutil.Ok(t, err)
+
+	certFile = filepath.Join(dir, "server.crt")
+	keyFile = filepath.Join(dir, "server.key")
+	testutil.Ok(t, ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	testutil.Ok(t, ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}), 0600))
+	return certFile, keyFile
+}
+
+// handshake performs a TLS handshake between the given server config and a client configured with the given
+// max version and cipher suites. It returns the client side handshake error.
+func handshake(srvCfg *tls.Config, maxVersion uint16, cipherSuites []uint16) error {
+	srvConn, cliConn := net.Pipe()
+	defer srvConn.Close()
+	defer cliConn.Close()
+
+	go func() {
+		_ = tls.Server(srvConn, srvCfg).Handshake()
+		srvConn.Close()
+	}()
+
+	return tls.Client(cliConn, &tls.Config{
+		InsecureSkipVerify: true,
+		MaxVersion:         maxVersion,
+		CipherSuites:       cipherSuites,
+	}).Handshake()
+}
+
+func TestNewServerTLSConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-server-tls")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(dir)) }()
+
+	cert, key := writeSelfSignedCert(t, dir)
+
+	t.Run("cipher suite allowlist", func(t *testing.T) {
+		cfg, err := newServerTLSConfig(cert, key, "", "1.2", []string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"})
+		testutil.Ok(t, err)
+
+		testutil.Ok(t, handshake(cfg, tls.VersionTLS12, []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256}))
+		testutil.NotOk(t, handshake(cfg, tls.VersionTLS12, []uint16{tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384}))
+	})
+	t.Run("min version", func(t *testing.T) {
+		cfg, err := newServerTLSConfig(cert, key, "", "1.3", nil)
+		testutil.Ok(t, err)
+
+		testutil.Ok(t, handshake(cfg, tls.VersionTLS13, nil))
+		testutil.NotOk(t, handshake(cfg, tls.VersionTLS12, nil))
+	})
+	t.Run("invalid options", func(t *testing.T) {
+		_, err := newServerTLSConfig(cert, key, "", "1.4", nil)
+		testutil.NotOk(t, err)
+
+		_, err = newServerTLSConfig(cert, key, "", "1.2", []string{"TLS_NOT_A_CIPHER"})
+		testutil.NotOk(t, err)
+	})
+}
@@ -9,7 +9,9 @@ import (
 	"math"
 	"net"
 	"net/http"
+	"os"
 	"path"
+	"strings"
 	"time"
 
 	"github.com/go-kit/kit/log"
@@ -20,6 +22,7 @@ import (
 	opentracing "github.com/opentracing/opentracing-go"
 	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
 	"github.com/prometheus/common/route"
 	"github.com/prometheus/prometheus/discovery/file"
 	"github.com/prometheus/prometheus/discovery/targetgroup"
@@ -42,12 +45,17 @@ import (
 	kingpin "gopkg.in/alecthomas/kingpin.v2"
 )
 
+const (
+	dedupMissingReplicaMerge    = "merge"
+	dedupMissingReplicaSeparate = "separate"
+)
+
 // registerQuery registers a query command.
 func registerQuery(m map[string]setupFunc, app *kingpin.Application) {
 	comp := component.Query
 	cmd := app.Command(comp.String(), "query node exposing PromQL enabled Query API with data retrieved from multiple store nodes")
 
-	grpcBindAddr, httpBindAddr, srvCert, srvKey, srvClientCA := regCommonServerFlags(cmd)
+	grpcBindAddr, httpBindAddr, srvCert, srvKey, srvClientCA, srvTLSMinVersion, srvTLSCipherSuites := regCommonServerFlags(cmd)
 
 	secure := cmd.Flag("grpc-client-tls-secure", "Use TLS when talking to the gRPC server").Default("false").Bool()
 	cert := cmd.Flag("grpc-client-tls-cert", "TLS Certificates to use to identify this client to the server").Default("").String()
@@ -65,11 +73,64 @@ func registerQuery(m map[string]setupFunc, app *kingpin.Application) {
 	maxConcurrentQueries := cmd.Flag("query.max-concurrent", "Maximum number of queries processed concurrently by query node.").
 		Default("20").Int()
 
+	maxConcurrentInstantQueries := cmd.Flag("query.max-concurrent-instant", "Maximum number of instant queries processed concurrently, within the limit of --query.max-concurrent for all queries. 0 means no separate limit.").
+		Default("0").Int()
+
+	maxConcurrentRangeQueries := cmd.Flag("query.max-concurrent-range", "Maximum number of range queries processed concurrently, within the limit of --query.max-concurrent for all queries. A limit below it keeps slots free for instant queries during bursts of expensive range queries. 0 means no separate limit.").
+		Default("0").Int()
+
 	replicaLabels := cmd.Flag("query.replica-label", "Labels to treat as a replica indicator along which data is deduplicated. Still you will be able to query without deduplication using 'dedup=false' parameter.").
 		Strings()
 
+	labelValuesDedup := cmd.Flag("query.label-values-dedup", "Omit values of replica labels from label values API results when deduplication is enabled, as those labels are removed from deduplicated query results. Deduplication and replica labels are controlled with the 'dedup' and 'replicaLabels[]' parameters as for queries.").
+		Default("false").Bool()
+
+	dedupFillGaps := cmd.Flag("query.dedup-fill-gaps", "Fill gaps of a replica with samples of the other replicas during deduplication, so replicas covering different parts of the queried range are stitched together. By default samples of the other replicas right after a gap are skipped.").
+		Default("false").Bool()
+
+	dedupMissingReplica := cmd.Flag("query.dedup-missing-replica", "Policy for series without any replica label during deduplication. 'merge' deduplicates them with the replicas of the same series like another replica, 'separate' returns them as a series on their own next to the deduplicated replicas.").
+		Default(dedupMissingReplicaMerge).Enum(dedupMissingReplicaMerge, dedupMissingReplicaSeparate)
+
+	dedupCacheSize := cmd.Flag("query.dedup-cache-size", "Maximum size of deduplicated series of selects held in the cache, so identical selects of repeated queries, e.g. from dashboards, are served without fetching and deduplicating them again. Entries are invalidated when the blocks of the store APIs change. Selects overlapping the time range of store APIs still ingesting data, like sidecars and receivers, or not reporting their blocks are not cached. 0 disables the cache.").
+		Default("0").Bytes()
+
+	dedupDisagreementThreshold := cmd.Flag("query.dedup-disagreement-threshold", "Count samples of the same series and timestamp whose values differ between replicas by more than this fraction of the larger value during deduplication, e.g. 0.1 for 10%, in the thanos_query_dedup_replica_disagreements_total metric by metric name. This surfaces inconsistent HA replicas. 0 disables counting.").
+		Default("0").Float64()
+
 	instantDefaultMaxSourceResolution := modelDuration(cmd.Flag("query.instant.default.max_source_resolution", "default value for max_source_resolution for instant queries. If not set, defaults to 0s only taking raw resolution into account. 1h can be a good value if you use instant queries over time ranges that incorporate times outside of your raw-retention.").Default("0s").Hidden())
 
+	maxRangePerResolution := cmd.Flag("query.max-range-per-resolution", "Maximum time range of range queries allowed to use data up to the given max_source_resolution (repeated). The limit of the highest resolution not above the query's max_source_resolution applies, e.g. '0s=7d' and '1h=1y' cap raw queries at 7 days while allowing 1 year at 1h resolution.").
+		PlaceHolder("<resolution>=<range>").Strings()
+
+	tenantHeader := cmd.Flag("query.tenant-header", "HTTP header to determine tenant for query API requests.").Default("THANOS-TENANT").String()
+
+	tenantLabel := cmd.Flag("query.tenant-label", "Label enforced on every query, series and label request with the tenant from the tenant header as value, so that tenants can only read their own data. Requests without tenant are rejected. Disabled if empty.").
+		Default("").String()
+
+	allowedFunctions := cmd.Flag("query.allowed-function", "PromQL function queries are allowed to use (repeated). If given, queries using any other function are rejected.").
+		PlaceHolder("<function>").Strings()
+
+	deniedFunctions := cmd.Flag("query.denied-function", "PromQL function queries are not allowed to use (repeated), e.g. expensive ones like label_replace.").
+		PlaceHolder("<function>").Strings()
+
+	maxRegexMatchers := cmd.Flag("query.max-regex-matchers", "Maximum number of regex matchers (=~ and !~) a single selector of a query or series request may have. Requests exceeding it are rejected. 0 means no limit.").
+		Default("0").Int()
+
+	accessLogFile := cmd.Flag("query.access-log-file", "File to append an access log entry to for every query API request, as JSON object with the start time, client address, tenant, query, response status and duration. Disabled if empty.").
+		Default("").String()
+
+	coalesceQueries := cmd.Flag("query.coalesce-identical", "Make concurrent instant and range queries with identical parameters and tenant share a single evaluation and its result. The evaluation is bound to the first of these requests, so if it is canceled, all of them fail.").
+		Default("false").Bool()
+
+	maxPointsPerSeries := cmd.Flag("query.max-points-per-series", "Maximum number of points a single series of a range query result may have, given by its number of steps. Queries exceeding it are rejected before being evaluated. 0 means no limit besides the fixed 11,000 steps per query.").
+		Default("0").Int()
+
+	partialResponseStatus := cmd.Flag("query.partial-response-status", "Respond to instant and range queries with warnings, e.g. because some store APIs failed while partial response is enabled, with 206 Partial Content instead of 200 OK.").
+		Default("false").Bool()
+
+	requireInstantTime := cmd.Flag("query.require-instant-time", "Reject instant queries without time parameter instead of evaluating them at the current time, to surface clients that forget to pass it.").
+		Default("false").Bool()
+
 	selectorLabels := cmd.Flag("selector-label", "Query selector labels that will be exposed in info endpoint (repeated).").
 		PlaceHolder("<name>=\"<value>\"").Strings()
 
@@ -107,6 +168,11 @@ func registerQuery(m map[string]setupFunc, app *kingpin.Application) {
 			return errors.Wrap(err, "parse federation labels")
 		}
 
+		maxRanges, err := parseMaxRangePerResolution(*maxRangePerResolution)
+		if err != nil {
+			return errors.Wrap(err, "parse max range per resolution")
+		}
+
 		lookupStores := map[string]struct{}{}
 		for _, s := range *stores {
 			if _, ok := lookupStores[s]; ok {
@@ -136,6 +202,8 @@ func registerQuery(m map[string]setupFunc, app *kingpin.Application) {
 			*srvCert,
 			*srvKey,
 			*srvClientCA,
+			*srvTLSMinVersion,
+			*srvTLSCipherSuites,
 			*secure,
 			*cert,
 			*key,
@@ -149,6 +217,23 @@ func registerQuery(m map[string]setupFunc, app *kingpin.Application) {
 			time.Duration(*queryTimeout),
 			time.Duration(*storeResponseTimeout),
 			*replicaLabels,
+			*labelValuesDedup,
+			*dedupFillGaps,
+			*tenantHeader,
+			*tenantLabel,
+			*allowedFunctions,
+			*deniedFunctions,
+			*maxRegexMatchers,
+			*accessLogFile,
+			*coalesceQueries,
+			*maxPointsPerSeries,
+			*dedupMissingReplica == dedupMissingReplicaSeparate,
+			*partialResponseStatus,
+			*requireInstantTime,
+			uint64(*dedupCacheSize),
+			*maxConcurrentInstantQueries,
+			*maxConcurrentRangeQueries,
+			*dedupDisagreementThreshold,
 			selectorLset,
 			*stores,
 			*enableAutodownsampling,
@@ -158,6 +243,7 @@ func registerQuery(m map[string]setupFunc, app *kingpin.Application) {
 			*dnsSDResolver,
 			time.Duration(*unhealthyStoreTimeout),
 			time.Duration(*instantDefaultMaxSourceResolution),
+			maxRanges,
 			component.Query,
 		)
 	}
@@ -255,6 +341,8 @@ func runQuery(
 	srvCert string,
 	srvKey string,
 	srvClientCA string,
+	srvTLSMinVersion string,
+	srvTLSCipherSuites []string,
 	secure bool,
 	cert string,
 	key string,
@@ -268,6 +356,23 @@ func runQuery(
 	queryTimeout time.Duration,
 	storeResponseTimeout time.Duration,
 	replicaLabels []string,
+	labelValuesDedup bool,
+	dedupFillGaps bool,
+	tenantHeader string,
+	tenantLabel string,
+	allowedFunctions []string,
+	deniedFunctions []string,
+	maxRegexMatchers int,
+	accessLogFile string,
+	coalesceQueries bool,
+	maxPointsPerSeries int,
+	dedupSeparateMissingReplica bool,
+	partialResponseStatus bool,
+	requireInstantTime bool,
+	dedupCacheSizeBytes uint64,
+	maxConcurrentInstantQueries int,
+	maxConcurrentRangeQueries int,
+	dedupDisagreementThreshold float64,
 	selectorLset labels.Labels,
 	storeAddrs []string,
 	enableAutodownsampling bool,
@@ -277,6 +382,7 @@ func runQuery(
 	dnsSDResolver string,
 	unhealthyStoreTimeout time.Duration,
 	instantDefaultMaxSourceResolution time.Duration,
+	maxRangePerResolution map[time.Duration]time.Duration,
 	comp component.Component,
 ) error {
 	// TODO(bplotka in PR #513 review): Move arguments into struct.
@@ -315,8 +421,11 @@ func runQuery(
 			dialOpts,
 			unhealthyStoreTimeout,
 		)
+		dedupCache = query.NewDedupCache(reg, dedupCacheSizeBytes, func(mint, maxt int64) (string, bool) {
+			return query.BlockSetKey(stores.Get(), mint, maxt)
+		})
 		proxy            = store.NewProxyStore(logger, stores.Get, component.Query, selectorLset, storeResponseTimeout)
-		queryableCreator = query.NewQueryableCreator(logger, proxy)
+		queryableCreator = query.NewQueryableCreator(logger, proxy, dedupFillGaps, dedupSeparateMissingReplica, dedupCache, query.NewReplicaDisagreements(reg, dedupDisagreementThreshold))
 		engine           = promql.NewEngine(
 			promql.EngineOpts{
 				Logger:        logger,
@@ -388,6 +497,23 @@ func runQuery(
 			cancel()
 		})
 	}
+
+	var accessLogger log.Logger
+	if accessLogFile != "" {
+		f, err := os.OpenFile(accessLogFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return errors.Wrap(err, "open access log file")
+		}
+		accessLogger = log.NewJSONLogger(log.NewSyncWriter(f))
+
+		cancel := make(chan struct{})
+		g.Add(func() error {
+			<-cancel
+			return errors.Wrap(f.Close(), "close access log file")
+		}, func(error) {
+			close(cancel)
+		})
+	}
 	// Start query API + UI HTTP server.
 
 	statusProber := prober.NewProber(comp, logger, reg)
@@ -410,7 +536,7 @@ func runQuery(
 		ins := extpromhttp.NewInstrumentationMiddleware(reg)
 		ui.NewQueryUI(logger, reg, stores, flagsMap).Register(router.WithPrefix(webRoutePrefix), ins)
 
-		api := v1.NewAPI(logger, reg, engine, queryableCreator, enableAutodownsampling, enablePartialResponse, replicaLabels, instantDefaultMaxSourceResolution)
+		api := v1.NewAPI(logger, reg, engine, queryableCreator, enableAutodownsampling, enablePartialResponse, replicaLabels, instantDefaultMaxSourceResolution, maxRangePerResolution, labelValuesDedup, tenantHeader, tenantLabel, allowedFunctions, deniedFunctions, maxRegexMatchers, accessLogger, coalesceQueries, maxPointsPerSeries, partialResponseStatus, requireInstantTime, maxConcurrentInstantQueries, maxConcurrentRangeQueries, nil, stores.Get)
 
 		api.Register(router.WithPrefix(path.Join(webRoutePrefix, "/api/v1")), tracer, logger, ins)
 
@@ -427,7 +553,7 @@ func runQuery(
 		}
 		logger := log.With(logger, "component", component.Query.String())
 
-		opts, err := defaultGRPCServerOpts(logger, srvCert, srvKey, srvClientCA)
+		opts, err := defaultGRPCServerOpts(logger, srvCert, srvKey, srvClientCA, srvTLSMinVersion, srvTLSCipherSuites)
 		if err != nil {
 			return errors.Wrap(err, "build gRPC server")
 		}
@@ -446,6 +572,30 @@ func runQuery(
 	return nil
 }
 
+// parseMaxRangePerResolution parses <resolution>=<range> pairs into a map of resolution to maximum query range.
+func parseMaxRangePerResolution(s []string) (map[time.Duration]time.Duration, error) {
+	res := make(map[time.Duration]time.Duration, len(s))
+	for _, l := range s {
+		parts := strings.SplitN(l, "=", 2)
+		if len(parts) != 2 {
+			return nil, errors.Errorf("unrecognized max range %q, expected <resolution>=<range>", l)
+		}
+		resolution, err := model.ParseDuration(parts[0])
+		if err != nil {
+			return nil, errors.Wrapf(err, "parse resolution of %q", l)
+		}
+		maxRange, err := model.ParseDuration(parts[1])
+		if err != nil {
+			return nil, errors.Wrapf(err, "parse range of %q", l)
+		}
+		if _, ok := res[time.Duration(resolution)]; ok {
+			return nil, errors.Errorf("max range for resolution %s is duplicated", parts[0])
+		}
+		res[time.Duration(resolution)] = time.Duration(maxRange)
+	}
+	return res, nil
+}
+
 func removeDuplicateStoreSpecs(logger log.Logger, duplicatedStores prometheus.Counter, specs []query.StoreSpec) []query.StoreSpec {
 	set := make(map[string]query.StoreSpec)
 	for _, spec := range specs {
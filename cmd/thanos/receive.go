@@ -15,6 +15,7 @@ import (
 	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/common/model"
+	promlabels "github.com/prometheus/prometheus/pkg/labels"
 	"github.com/prometheus/prometheus/storage/tsdb"
 	"github.com/prometheus/prometheus/tsdb/labels"
 	"github.com/thanos-io/thanos/pkg/block/metadata"
@@ -31,7 +32,7 @@ import (
 func registerReceive(m map[string]setupFunc, app *kingpin.Application, name string) {
 	cmd := app.Command(name, "Accept Prometheus remote write API requests and write to local tsdb (EXPERIMENTAL, this may change drastically without notice)")
 
-	grpcBindAddr, cert, key, clientCA := regGRPCFlags(cmd)
+	grpcBindAddr, cert, key, clientCA, tlsMinVersion, tlsCipherSuites := regGRPCFlags(cmd)
 	httpMetricsBindAddr := regHTTPAddrFlag(cmd)
 
 	remoteWriteAddress := cmd.Flag("remote-write.address", "Address to listen on for remote write requests.").
@@ -60,8 +61,26 @@ func registerReceive(m map[string]setupFunc, app *kingpin.Application, name stri
 
 	replicationFactor := cmd.Flag("receive.replication-factor", "How many times to replicate incoming write requests.").Default("1").Uint64()
 
+	tenantSamplesRateLimit := cmd.Flag("receive.tenant-samples-rate-limit", "Maximum number of samples per second each tenant may write to this receiver, allowing bursts of up to one second worth of samples. Write requests exceeding it are rejected with 429 Too Many Requests and a Retry-After header. Requests forwarded by other receivers are not limited. 0 means no limit.").
+		Default("0").Float64()
+
 	tsdbBlockDuration := modelDuration(cmd.Flag("tsdb.block-duration", "Duration for local TSDB blocks").Default("2h").Hidden())
 
+	tsdbBlockOffset := modelDuration(cmd.Flag("tsdb.block-offset", "Offset of the boundaries local TSDB blocks are cut on from multiples of the block duration since the Unix epoch, e.g. to align blocks with midnight in a time zone other than UTC. Non-zero offsets shrink the head chunk range, and thus the window for accepting late samples, to the greatest common divisor of block duration and offset.").
+		Default("0s"))
+
+	flushOnShutdown := cmd.Flag("receive.flush-on-shutdown", "Flush the in-memory head to a block on shutdown and upload it if object storage is configured. This minimizes data loss and WAL replay time on restart.").
+		Default("false").Bool()
+
+	flushTimeout := modelDuration(cmd.Flag("receive.flush-timeout", "Maximum time to flush the head on shutdown and, separately, to upload the flushed block.").
+		Default("1m"))
+
+	duplicatePolicy := cmd.Flag("receive.duplicate-policy", "How to handle out-of-order samples and samples with an already ingested timestamp but a different value, e.g. from retried write requests. 'reject' fails the write request, 'ignore' drops such samples, 'last-wins' additionally ingests only the last sample of a series per timestamp within a write request.").
+		Default(string(receive.DuplicatePolicyReject)).Enum(receive.DuplicatePolicies...)
+
+	replicaLabelName := cmd.Flag("receive.replica-label", "Label set on all received series with the local endpoint as value, so the series of receivers accepting the same write requests, e.g. because of a replication factor above 1, can be deduplicated along it at query time. Empty disables it.").
+		Default("").String()
+
 	m[name] = func(g *run.Group, logger log.Logger, reg *prometheus.Registry, tracer opentracing.Tracer, _ bool) error {
 		lset, err := parseFlagLabels(*labelStrs)
 		if err != nil {
@@ -88,6 +107,11 @@ func registerReceive(m map[string]setupFunc, app *kingpin.Application, name stri
 			*local = fmt.Sprintf("http://%s:%s/api/v1/receive", hostname, port)
 		}
 
+		var replicaLabel promlabels.Label
+		if *replicaLabelName != "" {
+			replicaLabel = promlabels.Label{Name: *replicaLabelName, Value: *local}
+		}
+
 		return runReceive(
 			g,
 			logger,
@@ -97,6 +121,8 @@ func registerReceive(m map[string]setupFunc, app *kingpin.Application, name stri
 			*cert,
 			*key,
 			*clientCA,
+			*tlsMinVersion,
+			*tlsCipherSuites,
 			*httpMetricsBindAddr,
 			*remoteWriteAddress,
 			*dataDir,
@@ -109,6 +135,12 @@ func registerReceive(m map[string]setupFunc, app *kingpin.Application, name stri
 			*replicaHeader,
 			*replicationFactor,
 			*tsdbBlockDuration,
+			*flushOnShutdown,
+			time.Duration(*flushTimeout),
+			receive.DuplicatePolicy(*duplicatePolicy),
+			time.Duration(*tsdbBlockOffset),
+			*tenantSamplesRateLimit,
+			replicaLabel,
 		)
 	}
 }
@@ -122,6 +154,8 @@ func runReceive(
 	cert string,
 	key string,
 	clientCA string,
+	tlsMinVersion string,
+	tlsCipherSuites []string,
 	httpMetricsBindAddr string,
 	remoteWriteAddress string,
 	dataDir string,
@@ -134,6 +168,12 @@ func runReceive(
 	replicaHeader string,
 	replicationFactor uint64,
 	tsdbBlockDuration model.Duration,
+	flushOnShutdown bool,
+	flushTimeout time.Duration,
+	duplicatePolicy receive.DuplicatePolicy,
+	tsdbBlockOffset time.Duration,
+	tenantSamplesRateLimit float64,
+	replicaLabel promlabels.Label,
 ) error {
 	logger = log.With(logger, "component", "receive")
 	level.Warn(logger).Log("msg", "setting up receive; the Thanos receive component is EXPERIMENTAL, it may break significantly without notice")
@@ -145,29 +185,42 @@ func runReceive(
 		MaxBlockDuration:  tsdbBlockDuration,
 		WALCompression:    true,
 	}
+	// TSDB only cuts blocks on multiples of the block duration, so shifted blocks are cut by ourselves.
+	blockDuration := time.Duration(tsdbBlockDuration)
+	cutAlignedBlocks := tsdbBlockOffset%blockDuration != 0
+	if cutAlignedBlocks {
+		chunkRange := model.Duration(receive.AlignedChunkRange(blockDuration, tsdbBlockOffset))
+		tsdbCfg.MinBlockDuration = chunkRange
+		tsdbCfg.MaxBlockDuration = chunkRange
+	}
 
 	localStorage := &tsdb.ReadyStorage{}
-	receiver := receive.NewWriter(log.With(logger, "component", "receive-writer"), localStorage)
+	receiver := receive.NewWriter(log.With(logger, "component", "receive-writer"), localStorage, duplicatePolicy, replicaLabel)
 	webHandler := receive.NewHandler(log.With(logger, "component", "receive-handler"), &receive.Options{
-		Receiver:          receiver,
-		ListenAddress:     remoteWriteAddress,
-		Registry:          reg,
-		ReadyStorage:      localStorage,
-		Endpoint:          endpoint,
-		TenantHeader:      tenantHeader,
-		ReplicaHeader:     replicaHeader,
-		ReplicationFactor: replicationFactor,
+		Receiver:               receiver,
+		ListenAddress:          remoteWriteAddress,
+		Registry:               reg,
+		ReadyStorage:           localStorage,
+		Endpoint:               endpoint,
+		TenantHeader:           tenantHeader,
+		ReplicaHeader:          replicaHeader,
+		ReplicationFactor:      replicationFactor,
+		TenantSamplesRateLimit: tenantSamplesRateLimit,
 	})
 
 	// Start all components while we wait for TSDB to open but only load
 	// initial config and mark ourselves as ready after it completed.
 	dbOpen := make(chan struct{})
+	// flushed is closed once the TSDB is shut down and its head possibly flushed to a block.
+	flushed := make(chan struct{})
 	level.Debug(logger).Log("msg", "setting up tsdb")
 	{
 		// TSDB.
 		cancel := make(chan struct{})
 		g.Add(
 			func() error {
+				defer close(flushed)
+
 				level.Info(logger).Log("msg", "starting TSDB ...")
 				db, err := tsdb.Open(
 					dataDir,
@@ -181,17 +234,45 @@ func runReceive(
 				}
 				level.Info(logger).Log("msg", "tsdb started")
 
-				startTimeMargin := int64(2 * time.Duration(tsdbCfg.MinBlockDuration).Seconds() * 1000)
+				if cutAlignedBlocks {
+					db.DisableCompactions()
+				}
+
+				startTimeMargin := int64(2 * blockDuration.Seconds() * 1000)
 				localStorage.Set(db, startTimeMargin)
 				webHandler.StorageReady()
 				level.Info(logger).Log("msg", "server is ready to receive web requests.")
 				close(dbOpen)
+
+				if cutAlignedBlocks {
+					// Check as often as TSDB does for its own compactions.
+					_ = runutil.Repeat(time.Minute, cancel, func() error {
+						if _, err := receive.CutAlignedBlocks(context.Background(), log.With(logger, "component", "tsdb"), db, blockDuration, tsdbBlockOffset); err != nil {
+							level.Error(logger).Log("msg", "cutting aligned blocks failed", "err", err)
+						}
+						return nil
+					})
+				}
 				<-cancel
+
+				if !flushOnShutdown {
+					return nil
+				}
+				flushCtx, flushCancel := context.WithTimeout(context.Background(), flushTimeout)
+				defer flushCancel()
+
+				level.Info(logger).Log("msg", "flushing head before shutdown")
+				if _, err := receive.FlushAndClose(flushCtx, log.With(logger, "component", "flush"), db); err != nil {
+					level.Error(logger).Log("msg", "error flushing head", "err", err)
+				}
 				return nil
 			},
 			func(err error) {
-				if err := localStorage.Close(); err != nil {
-					level.Error(logger).Log("msg", "error stopping storage", "err", err)
+				// With flushing enabled the storage is closed after the flush.
+				if !flushOnShutdown {
+					if err := localStorage.Close(); err != nil {
+						level.Error(logger).Log("msg", "error stopping storage", "err", err)
+					}
 				}
 				close(cancel)
 			},
@@ -271,7 +352,7 @@ func runReceive(
 			db := localStorage.Get()
 			tsdbStore := store.NewTSDBStore(log.With(logger, "component", "thanos-tsdb-store"), reg, db, component.Receive, lset)
 
-			opts, err := defaultGRPCServerOpts(logger, cert, key, clientCA)
+			opts, err := defaultGRPCServerOpts(logger, cert, key, clientCA, tlsMinVersion, tlsCipherSuites)
 			if err != nil {
 				return errors.Wrap(err, "setup gRPC server")
 			}
@@ -330,13 +411,26 @@ func runReceive(
 		g.Add(func() error {
 			defer runutil.CloseWithLogOnErr(logger, bkt, "bucket client")
 
-			return runutil.Repeat(30*time.Second, ctx.Done(), func() error {
+			err := runutil.Repeat(30*time.Second, ctx.Done(), func() error {
 				if uploaded, err := s.Sync(ctx); err != nil {
 					level.Warn(logger).Log("err", err, "uploaded", uploaded)
 				}
 
 				return nil
 			})
+			if !flushOnShutdown {
+				return err
+			}
+
+			// Upload the block flushed on shutdown right away.
+			<-flushed
+			uploadCtx, uploadCancel := context.WithTimeout(context.Background(), flushTimeout)
+			defer uploadCancel()
+
+			if uploaded, err := s.Sync(uploadCtx); err != nil {
+				level.Warn(logger).Log("msg", "upload of flushed head failed", "err", err, "uploaded", uploaded)
+			}
+			return err
 		}, func(error) {
 			cancel()
 		})
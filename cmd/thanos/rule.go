@@ -57,7 +57,7 @@ import (
 func registerRule(m map[string]setupFunc, app *kingpin.Application, name string) {
 	cmd := app.Command(name, "ruler evaluating Prometheus rules against given Query nodes, exposing Store API and storing old blocks in bucket")
 
-	grpcBindAddr, httpBindAddr, cert, key, clientCA := regCommonServerFlags(cmd)
+	grpcBindAddr, httpBindAddr, cert, key, clientCA, tlsMinVersion, tlsCipherSuites := regCommonServerFlags(cmd)
 
 	labelStrs := cmd.Flag("label", "Labels to be applied to all generated metrics (repeated). Similar to external labels for Prometheus, used to identify ruler and its blocks as unique source.").
 		PlaceHolder("<name>=\"<value>\"").Strings()
@@ -154,6 +154,8 @@ func registerRule(m map[string]setupFunc, app *kingpin.Application, name string)
 			*cert,
 			*key,
 			*clientCA,
+			*tlsMinVersion,
+			*tlsCipherSuites,
 			*httpBindAddr,
 			*webRoutePrefix,
 			*webExternalPrefix,
@@ -187,6 +189,8 @@ func runRule(
 	cert string,
 	key string,
 	clientCA string,
+	tlsMinVersion string,
+	tlsCipherSuites []string,
 	httpBindAddr string,
 	webRoutePrefix string,
 	webExternalPrefix string,
@@ -492,7 +496,7 @@ func runRule(
 
 		store := store.NewTSDBStore(logger, reg, db, component.Rule, lset)
 
-		opts, err := defaultGRPCServerOpts(logger, cert, key, clientCA)
+		opts, err := defaultGRPCServerOpts(logger, cert, key, clientCA, tlsMinVersion, tlsCipherSuites)
 		if err != nil {
 			return errors.Wrap(err, "setup gRPC options")
 		}
@@ -34,7 +34,7 @@ const waitForExternalLabelsTimeout = 10 * time.Minute
 func registerSidecar(m map[string]setupFunc, app *kingpin.Application) {
 	cmd := app.Command(component.Sidecar.String(), "sidecar for Prometheus server")
 
-	grpcBindAddr, httpBindAddr, cert, key, clientCA := regCommonServerFlags(cmd)
+	grpcBindAddr, httpBindAddr, cert, key, clientCA, tlsMinVersion, tlsCipherSuites := regCommonServerFlags(cmd)
 
 	promURL := cmd.Flag("prometheus.url", "URL at which to reach Prometheus's API. For better performance use local network.").
 		Default("http://localhost:9090").URL()
@@ -52,6 +52,12 @@ func registerSidecar(m map[string]setupFunc, app *kingpin.Application) {
 
 	objStoreConfig := regCommonObjStoreFlags(cmd, "", false)
 
+	seriesCacheTTL := modelDuration(cmd.Flag("prometheus.series-cache-ttl", "Duration for which results of identical Series requests are served from memory instead of querying Prometheus again, e.g. for HA queriers. 0s disables caching.").
+		Default("0s"))
+
+	seriesCacheSize := cmd.Flag("prometheus.series-cache-size", "Maximum size of Series results cached in memory for prometheus.series-cache-ttl. The least recently used results are evicted first, and results larger than this are not cached.").
+		Default("100MB").Bytes()
+
 	uploadCompacted := cmd.Flag("shipper.upload-compacted", "[Experimental] If true sidecar will try to upload compacted blocks as well. Useful for migration purposes. Works only if compaction is disabled on Prometheus.").Default("false").Hidden().Bool()
 
 	m[component.Sidecar.String()] = func(g *run.Group, logger log.Logger, reg *prometheus.Registry, tracer opentracing.Tracer, _ bool) error {
@@ -71,8 +77,12 @@ func registerSidecar(m map[string]setupFunc, app *kingpin.Application) {
 			*cert,
 			*key,
 			*clientCA,
+			*tlsMinVersion,
+			*tlsCipherSuites,
 			*httpBindAddr,
 			*promURL,
+			time.Duration(*seriesCacheTTL),
+			uint64(*seriesCacheSize),
 			*dataDir,
 			objStoreConfig,
 			rl,
@@ -91,8 +101,12 @@ func runSidecar(
 	cert string,
 	key string,
 	clientCA string,
+	tlsMinVersion string,
+	tlsCipherSuites []string,
 	httpBindAddr string,
 	promURL *url.URL,
+	seriesCacheTTL time.Duration,
+	seriesCacheSizeBytes uint64,
 	dataDir string,
 	objStoreConfig *pathOrContent,
 	reloader *reloader.Reloader,
@@ -214,12 +228,12 @@ func runSidecar(
 		logger := log.With(logger, "component", component.Sidecar.String())
 
 		promStore, err := store.NewPrometheusStore(
-			logger, nil, promURL, component.Sidecar, m.Labels, m.Timestamps)
+			logger, nil, promURL, component.Sidecar, m.Labels, m.Timestamps, seriesCacheTTL, seriesCacheSizeBytes)
 		if err != nil {
 			return errors.Wrap(err, "create Prometheus store")
 		}
 
-		opts, err := defaultGRPCServerOpts(logger, cert, key, clientCA)
+		opts, err := defaultGRPCServerOpts(logger, cert, key, clientCA, tlsMinVersion, tlsCipherSuites)
 		if err != nil {
 			return errors.Wrap(err, "setup gRPC server")
 		}
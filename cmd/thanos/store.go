@@ -11,19 +11,28 @@ import (
 	opentracing "github.com/opentracing/opentracing-go"
 	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/prometheus/pkg/timestamp"
+	"github.com/thanos-io/thanos/pkg/compact/downsample"
 	"github.com/thanos-io/thanos/pkg/model"
+	"github.com/thanos-io/thanos/pkg/objstore"
 	"github.com/thanos-io/thanos/pkg/objstore/client"
 	"github.com/thanos-io/thanos/pkg/runutil"
 	"github.com/thanos-io/thanos/pkg/store"
 	storecache "github.com/thanos-io/thanos/pkg/store/cache"
+	"github.com/thanos-io/thanos/pkg/store/storepb"
 	kingpin "gopkg.in/alecthomas/kingpin.v2"
 )
 
+const (
+	blockSyncOrderBucket      = "bucket"
+	blockSyncOrderNewestFirst = "newest-first"
+)
+
 // registerStore registers a store command.
 func registerStore(m map[string]setupFunc, app *kingpin.Application, name string) {
 	cmd := app.Command(name, "store node giving access to blocks in a bucket provider. Now supported GCS, S3, Azure, Swift and Tencent COS.")
 
-	grpcBindAddr, httpBindAddr, cert, key, clientCA := regCommonServerFlags(cmd)
+	grpcBindAddr, httpBindAddr, cert, key, clientCA, tlsMinVersion, tlsCipherSuites := regCommonServerFlags(cmd)
 
 	dataDir := cmd.Flag("data-dir", "Data directory in which to cache remote blocks.").
 		Default("./data").String()
@@ -31,6 +40,9 @@ func registerStore(m map[string]setupFunc, app *kingpin.Application, name string
 	indexCacheSize := cmd.Flag("index-cache-size", "Maximum size of items held in the index cache.").
 		Default("250MB").Bytes()
 
+	indexCacheNoMatchTTL := cmd.Flag("index-cache-no-match-ttl", "How long to remember in the index cache that a matcher selects no label values of a block, so repeated requests for absent series do not scan all values of the label again. 0 disables it.").
+		Default("0s").Duration()
+
 	chunkPoolSize := cmd.Flag("chunk-pool-size", "Maximum size of concurrently allocatable bytes for chunks.").
 		Default("2GB").Bytes()
 
@@ -38,9 +50,23 @@ func registerStore(m map[string]setupFunc, app *kingpin.Application, name string
 		"Maximum amount of samples returned via a single Series call. 0 means no limit. NOTE: for efficiency we take 120 as the number of samples in chunk (it cannot be bigger than that), so the actual number of samples might be lower, even though the maximum could be hit.").
 		Default("0").Uint()
 
+	maxBlockCount := cmd.Flag("store.grpc.series-block-limit",
+		"Maximum amount of blocks a single Series call may touch. 0 means no limit. Exceeding it fails the call with ResourceExhausted.").
+		Default("0").Uint()
+
 	maxConcurrent := cmd.Flag("store.grpc.series-max-concurrency", "Maximum number of concurrent Series calls.").Default("20").Int()
 
+	postingsDecodeConcurrency := cmd.Flag("store.grpc.postings-decode-concurrency", "Number of goroutines decoding and merging the postings of a single block for each Series call. Values greater than 1 reduce the latency of queries with matchers selecting many postings at the cost of more CPU.").
+		Default("1").Int()
+
+	blockSeriesConcurrency := cmd.Flag("store.grpc.series-block-concurrency", "Maximum number of blocks read concurrently for each Series call. 0 reads all blocks touched by the call concurrently. Lower values bound the goroutines and parallel bucket requests of wide-range queries at the cost of their latency.").
+		Default("0").Int()
+
+	verifyChunkChecksums := cmd.Flag("store.grpc.verify-chunk-checksums", "Verify the checksums of chunks read from the bucket. Series calls touching a chunk whose data does not match its checksum fail, to not return silently corrupted data.").
+		Default("false").Bool()
+
 	objStoreConfig := regCommonObjStoreFlags(cmd, "", true)
+	objStoreMaxConcurrency := regObjStoreMaxConcurrencyFlag(cmd)
 
 	syncInterval := cmd.Flag("sync-block-duration", "Repeat interval for syncing the blocks between local and remote view.").
 		Default("3m").Duration()
@@ -48,18 +74,52 @@ func registerStore(m map[string]setupFunc, app *kingpin.Application, name string
 	blockSyncConcurrency := cmd.Flag("block-sync-concurrency", "Number of goroutines to use when syncing blocks from object storage.").
 		Default("20").Int()
 
+	blockSyncOrder := cmd.Flag("block-sync-order", "Order of loading new blocks when syncing. 'bucket' loads them in the order they are listed in, 'newest-first' in descending order of their max time, so blocks with recent data become queryable first.").
+		Default(blockSyncOrderBucket).Enum(blockSyncOrderBucket, blockSyncOrderNewestFirst)
+
+	blockSyncInitialWindow := cmd.Flag("block-sync-initial-window", "If not 0, start serving queries once the blocks with data within this duration before startup are loaded, and load the older blocks in the background. Until then, queries for older data return incomplete results.").
+		Default("0s").Duration()
+
 	minTime := model.TimeOrDuration(cmd.Flag("min-time", "Start of time range limit to serve. Thanos Store serves only metrics, which happened later than this value. Option can be a constant time in RFC3339 format or time duration relative to current time, such as -1d or 2h45m. Valid duration units are ms, s, m, h, d, w, y.").
 		Default("0000-01-01T00:00:00Z"))
 
 	maxTime := model.TimeOrDuration(cmd.Flag("max-time", "End of time range limit to serve. Thanos Store serves only blocks, which happened eariler than this value. Option can be a constant time in RFC3339 format or time duration relative to current time, such as -1d or 2h45m. Valid duration units are ms, s, m, h, d, w, y.").
 		Default("9999-12-31T23:59:59Z"))
 
+	resolutions := cmd.Flag("store.resolution", "Downsampling resolution of blocks to load and serve (repeated), e.g. to have separate store gateways for raw and downsampled data. By default blocks of all resolutions are served.").
+		PlaceHolder("<resolution>").Enums("raw", "5m", "1h")
+
+	preferRecentBlocks := cmd.Flag("store.prefer-recent-blocks", "If a block's queried time range is fully covered by a more recently created block of the same resolution, e.g. after a backfill, only query the more recent block. This avoids duplicate work, but data only present in the older block is not returned.").
+		Default("false").Bool()
+
+	warmupSelectors := cmd.Flag("store.index-cache-warmup-selector", "Series selector, e.g. 'up{job=\"node\"}', whose postings and series are fetched into the index cache from all blocks after the initial block sync (repeated). This avoids cold index cache latency of the first queries using it.").
+		PlaceHolder("<selector>").Strings()
+
 	m[name] = func(g *run.Group, logger log.Logger, reg *prometheus.Registry, tracer opentracing.Tracer, debugLogging bool) error {
 		if minTime.PrometheusTimestamp() > maxTime.PrometheusTimestamp() {
 			return errors.Errorf("invalid argument: --min-time '%s' can't be greater than --max-time '%s'",
 				minTime, maxTime)
 		}
 
+		resolutionMillis := map[string]int64{
+			"raw": downsample.ResLevel0,
+			"5m":  downsample.ResLevel1,
+			"1h":  downsample.ResLevel2,
+		}
+		var filterResolutions []int64
+		for _, res := range *resolutions {
+			filterResolutions = append(filterResolutions, resolutionMillis[res])
+		}
+
+		var warmup [][]storepb.LabelMatcher
+		for _, s := range *warmupSelectors {
+			sel, err := store.ParseSelector(s)
+			if err != nil {
+				return errors.Wrapf(err, "parse warmup selector %q", s)
+			}
+			warmup = append(warmup, sel)
+		}
+
 		return runStore(g,
 			logger,
 			reg,
@@ -70,6 +130,8 @@ func registerStore(m map[string]setupFunc, app *kingpin.Application, name string
 			*cert,
 			*key,
 			*clientCA,
+			*tlsMinVersion,
+			*tlsCipherSuites,
 			*httpBindAddr,
 			uint64(*indexCacheSize),
 			uint64(*chunkPoolSize),
@@ -80,9 +142,20 @@ func registerStore(m map[string]setupFunc, app *kingpin.Application, name string
 			*syncInterval,
 			*blockSyncConcurrency,
 			&store.FilterConfig{
-				MinTime: *minTime,
-				MaxTime: *maxTime,
+				MinTime:     *minTime,
+				MaxTime:     *maxTime,
+				Resolutions: filterResolutions,
 			},
+			*preferRecentBlocks,
+			uint64(*maxBlockCount),
+			*postingsDecodeConcurrency,
+			*objStoreMaxConcurrency,
+			warmup,
+			*verifyChunkChecksums,
+			*indexCacheNoMatchTTL,
+			*blockSyncOrder == blockSyncOrderNewestFirst,
+			*blockSyncInitialWindow,
+			*blockSeriesConcurrency,
 		)
 	}
 }
@@ -99,6 +172,8 @@ func runStore(
 	cert string,
 	key string,
 	clientCA string,
+	tlsMinVersion string,
+	tlsCipherSuites []string,
 	httpBindAddr string,
 	indexCacheSizeBytes uint64,
 	chunkPoolSizeBytes uint64,
@@ -109,6 +184,16 @@ func runStore(
 	syncInterval time.Duration,
 	blockSyncConcurrency int,
 	filterConf *store.FilterConfig,
+	preferRecentBlocks bool,
+	maxBlockCount uint64,
+	postingsDecodeConcurrency int,
+	objStoreMaxConcurrency int,
+	warmupSelectors [][]storepb.LabelMatcher,
+	verifyChunkChecksums bool,
+	indexCacheNoMatchTTL time.Duration,
+	syncNewestFirst bool,
+	blockSyncInitialWindow time.Duration,
+	blockSeriesConcurrency int,
 ) error {
 	{
 		confContentYaml, err := objStoreConfig.Content()
@@ -120,6 +205,7 @@ func runStore(
 		if err != nil {
 			return errors.Wrap(err, "create bucket client")
 		}
+		bkt = objstore.BucketWithConcurrencyLimit(bkt, objStoreMaxConcurrency, reg)
 
 		// Ensure we close up everything properly.
 		defer func() {
@@ -134,6 +220,7 @@ func runStore(
 		indexCache, err := storecache.NewIndexCache(logger, reg, storecache.Opts{
 			MaxSizeBytes:     indexCacheSizeBytes,
 			MaxItemSizeBytes: maxItemSizeBytes,
+			NoMatchTTL:       indexCacheNoMatchTTL,
 		})
 		if err != nil {
 			return errors.Wrap(err, "create index cache")
@@ -151,6 +238,12 @@ func runStore(
 			verbose,
 			blockSyncConcurrency,
 			filterConf,
+			preferRecentBlocks,
+			maxBlockCount,
+			postingsDecodeConcurrency,
+			verifyChunkChecksums,
+			syncNewestFirst,
+			blockSeriesConcurrency,
 		)
 		if err != nil {
 			return errors.Wrap(err, "create object storage store")
@@ -158,15 +251,38 @@ func runStore(
 
 		begin := time.Now()
 		level.Debug(logger).Log("msg", "initializing bucket store")
-		if err := bs.InitialSync(context.Background()); err != nil {
+		if blockSyncInitialWindow > 0 {
+			mint := timestamp.FromTime(begin.Add(-blockSyncInitialWindow))
+			if err := bs.SyncRecentBlocks(context.Background(), mint); err != nil {
+				return errors.Wrap(err, "bucket store initial sync of recent blocks")
+			}
+		} else if err := bs.InitialSync(context.Background()); err != nil {
 			return errors.Wrap(err, "bucket store initial sync")
 		}
 		level.Debug(logger).Log("msg", "bucket store ready", "init_duration", time.Since(begin).String())
 
+		if len(warmupSelectors) > 0 {
+			begin := time.Now()
+			if err := bs.Warmup(context.Background(), warmupSelectors); err != nil {
+				level.Warn(logger).Log("msg", "warming up index cache failed", "err", err)
+			} else {
+				level.Info(logger).Log("msg", "index cache warmed up", "duration", time.Since(begin).String())
+			}
+		}
+
 		ctx, cancel := context.WithCancel(context.Background())
 		g.Add(func() error {
 			defer runutil.CloseWithLogOnErr(logger, bkt, "bucket client")
 
+			if blockSyncInitialWindow > 0 {
+				// Load the older blocks and remove local blocks not present in the bucket anymore.
+				if err := bs.InitialSync(ctx); err != nil {
+					level.Warn(logger).Log("msg", "bucket store initial sync of older blocks failed", "err", err)
+				} else {
+					level.Info(logger).Log("msg", "bucket store loaded older blocks", "init_duration", time.Since(begin).String())
+				}
+			}
+
 			err := runutil.Repeat(syncInterval, ctx.Done(), func() error {
 				if err := bs.SyncBlocks(ctx); err != nil {
 					level.Warn(logger).Log("msg", "syncing blocks failed", "err", err)
@@ -185,7 +301,7 @@ func runStore(
 			return errors.Wrap(err, "listen API address")
 		}
 
-		opts, err := defaultGRPCServerOpts(logger, cert, key, clientCA)
+		opts, err := defaultGRPCServerOpts(logger, cert, key, clientCA, tlsMinVersion, tlsCipherSuites)
 		if err != nil {
 			return errors.Wrap(err, "grpc server options")
 		}
@@ -1,6 +1,7 @@
 package block
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"hash/crc32"
@@ -25,6 +26,7 @@ import (
 	"github.com/prometheus/prometheus/tsdb/index"
 	"github.com/prometheus/prometheus/tsdb/labels"
 	"github.com/thanos-io/thanos/pkg/runutil"
+	"golang.org/x/sync/errgroup"
 )
 
 const (
@@ -446,6 +448,56 @@ func GatherIndexIssueStats(logger log.Logger, fn string, minTime int64, maxTime
 	return stats, nil
 }
 
+// GatherBlocksIndexIssueStats gathers the index issue stats of the blocks in the given directories, each against the
+// time range of its meta file. Up to concurrency blocks are verified at once. The stats are returned in the order
+// of the directories. It fails if any of the indexes cannot be read at all.
+func GatherBlocksIndexIssueStats(ctx context.Context, logger log.Logger, dirs []string, concurrency int) ([]Stats, error) {
+	return gatherBlocksIndexIssueStats(ctx, dirs, concurrency, func(dir string) (Stats, error) {
+		meta, err := metadata.Read(dir)
+		if err != nil {
+			return Stats{}, errors.Wrap(err, "read meta")
+		}
+		return GatherIndexIssueStats(logger, filepath.Join(dir, IndexFilename), meta.MinTime, meta.MaxTime)
+	})
+}
+
+func gatherBlocksIndexIssueStats(ctx context.Context, dirs []string, concurrency int, gather func(dir string) (Stats, error)) ([]Stats, error) {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	stats := make([]Stats, len(dirs))
+
+	g, gctx := errgroup.WithContext(ctx)
+	sem := make(chan struct{}, concurrency)
+Loop:
+	for i, dir := range dirs {
+		select {
+		case sem <- struct{}{}:
+		case <-gctx.Done():
+			break Loop
+		}
+
+		i, dir := i, dir
+		g.Go(func() error {
+			defer func() { <-sem }()
+
+			s, err := gather(dir)
+			if err != nil {
+				return errors.Wrapf(err, "gather index issues for block %s", dir)
+			}
+			stats[i] = s
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
 type ignoreFnType func(mint, maxt int64, prev *chunks.Meta, curr *chunks.Meta) (bool, error)
 
 // Repair open the block with given id in dir and creates a new one with fixed data.
@@ -2,13 +2,18 @@ package block
 
 import (
 	"context"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/go-kit/kit/log"
 	"github.com/prometheus/prometheus/tsdb/labels"
+	"github.com/thanos-io/thanos/pkg/block/metadata"
 	"github.com/thanos-io/thanos/pkg/testutil"
 )
 
@@ -47,3 +52,90 @@ func TestWriteReadIndexCache(t *testing.T) {
 	testutil.Equals(t, []string{"1"}, vals)
 	testutil.Equals(t, 6, len(postings))
 }
+
+func TestGatherBlocksIndexIssueStats(t *testing.T) {
+	ctx := context.Background()
+
+	tmpDir, err := ioutil.TempDir("", "test-gather-blocks-index-issue-stats")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(tmpDir)) }()
+
+	var dirs []string
+	for i := 0; i < 4; i++ {
+		id, err := testutil.CreateBlock(ctx, tmpDir, []labels.Labels{
+			{{Name: "a", Value: "1"}},
+			{{Name: "a", Value: "2"}},
+		}, 100, 0, 1000, nil, 124)
+		testutil.Ok(t, err)
+		dirs = append(dirs, filepath.Join(tmpDir, id.String()))
+	}
+
+	// Narrow the time range of the second block's meta, so its chunks are outside of it.
+	meta, err := metadata.Read(dirs[1])
+	testutil.Ok(t, err)
+	meta.MaxTime = meta.MinTime + 10
+	testutil.Ok(t, metadata.Write(log.NewNopLogger(), dirs[1], meta))
+
+	stats, err := GatherBlocksIndexIssueStats(ctx, log.NewNopLogger(), dirs, 3)
+	testutil.Ok(t, err)
+	testutil.Equals(t, len(dirs), len(stats))
+	for i, s := range stats {
+		testutil.Equals(t, 2, s.TotalSeries)
+		if i == 1 {
+			testutil.NotOk(t, s.CriticalErr())
+			continue
+		}
+		testutil.Ok(t, s.AnyErr())
+	}
+
+	// Indexes that cannot be read at all fail the verification.
+	testutil.Ok(t, ioutil.WriteFile(filepath.Join(dirs[2], IndexFilename), []byte("corrupt"), 0666))
+	_, err = GatherBlocksIndexIssueStats(ctx, log.NewNopLogger(), dirs, 3)
+	testutil.NotOk(t, err)
+	testutil.Assert(t, strings.Contains(err.Error(), dirs[2]), "expected error to name the corrupt block, got %v", err)
+}
+
+func TestGatherBlocksIndexIssueStats_Concurrency(t *testing.T) {
+	var (
+		mtx              sync.Mutex
+		current, maxSeen int
+	)
+	gather := func(dir string) (Stats, error) {
+		mtx.Lock()
+		current++
+		if current > maxSeen {
+			maxSeen = current
+		}
+		mtx.Unlock()
+		defer func() {
+			mtx.Lock()
+			current--
+			mtx.Unlock()
+		}()
+
+		time.Sleep(20 * time.Millisecond)
+		if dir == "corrupt" {
+			return Stats{}, fmt.Errorf("corrupt index")
+		}
+		return Stats{TotalSeries: len(dir)}, nil
+	}
+
+	dirs := []string{"a", "bb", "ccc", "dddd", "eeeee", "ffffff", "ggggggg"}
+	stats, err := gatherBlocksIndexIssueStats(context.Background(), dirs, 3, gather)
+	testutil.Ok(t, err)
+	testutil.Equals(t, 3, maxSeen)
+	testutil.Equals(t, 0, current)
+	for i, s := range stats {
+		testutil.Equals(t, len(dirs[i]), s.TotalSeries)
+	}
+
+	// Blocks are verified one by one without concurrency.
+	maxSeen = 0
+	_, err = gatherBlocksIndexIssueStats(context.Background(), dirs, 0, gather)
+	testutil.Ok(t, err)
+	testutil.Equals(t, 1, maxSeen)
+
+	_, err = gatherBlocksIndexIssueStats(context.Background(), []string{"a", "corrupt", "ccc"}, 3, gather)
+	testutil.NotOk(t, err)
+	testutil.Equals(t, "gather index issues for block corrupt: corrupt index", err.Error())
+}
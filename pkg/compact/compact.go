@@ -8,6 +8,8 @@ import (
 	"path"
 	"path/filepath"
 	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -38,7 +40,7 @@ const (
 var blockTooFreshSentinelError = errors.New("Block too fresh")
 
 // Syncer syncronizes block metas from a bucket into a local directory.
-// It sorts them into compaction groups based on equal label sets.
+// It sorts them into compaction groups based on equal label sets, ignoring groupDropLabels.
 type Syncer struct {
 	logger               log.Logger
 	reg                  prometheus.Registerer
@@ -50,6 +52,17 @@ type Syncer struct {
 	blockSyncConcurrency int
 	metrics              *syncerMetrics
 	acceptMalformedIndex bool
+	groupDropLabels      []string
+	// blockVerifyConcurrency is the number of blocks planned for a compaction whose indexes are verified at once.
+	blockVerifyConcurrency int
+	// excludedSources are the sources whose blocks are never compacted.
+	excludedSources []metadata.SourceType
+	// deletionNotifier is notified of all blocks deleted by the syncer and its groups.
+	deletionNotifier *DeletionNotifier
+
+	// freshBlocks holds metas of blocks which are too fresh to be considered yet, so they are not downloaded again
+	// on each sync. Metas are immutable, so they can be used as is once the block matured.
+	freshBlocks map[ulid.ULID]*metadata.Meta
 }
 
 type syncerMetrics struct {
@@ -62,6 +75,9 @@ type syncerMetrics struct {
 	garbageCollectionDuration prometheus.Histogram
 	compactions               *prometheus.CounterVec
 	compactionFailures        *prometheus.CounterVec
+	downloadDuration          *prometheus.HistogramVec
+	compactionDuration        *prometheus.HistogramVec
+	uploadDuration            *prometheus.HistogramVec
 }
 
 func newSyncerMetrics(reg prometheus.Registerer) *syncerMetrics {
@@ -113,6 +129,28 @@ func newSyncerMetrics(reg prometheus.Registerer) *syncerMetrics {
 		Help: "Total number of failed group compactions.",
 	}, []string{"group"})
 
+	m.downloadDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "thanos_compact_group_download_duration_seconds",
+		Help: "Time it took to download and verify the blocks planned for a group compaction.",
+		Buckets: []float64{
+			1, 5, 15, 30, 60, 120, 300, 600, 1200, 1800, 3600,
+		},
+	}, []string{"resolution", "level"})
+	m.compactionDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "thanos_compact_group_compaction_duration_seconds",
+		Help: "Time it took to compact the planned blocks of a group.",
+		Buckets: []float64{
+			1, 5, 15, 30, 60, 120, 300, 600, 1200, 1800, 3600,
+		},
+	}, []string{"resolution", "level"})
+	m.uploadDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "thanos_compact_group_upload_duration_seconds",
+		Help: "Time it took to upload the block resulting from a group compaction.",
+		Buckets: []float64{
+			1, 5, 15, 30, 60, 120, 300, 600, 1200, 1800, 3600,
+		},
+	}, []string{"resolution", "level"})
+
 	if reg != nil {
 		reg.MustRegister(
 			m.syncMetas,
@@ -124,6 +162,9 @@ func newSyncerMetrics(reg prometheus.Registerer) *syncerMetrics {
 			m.garbageCollectionDuration,
 			m.compactions,
 			m.compactionFailures,
+			m.downloadDuration,
+			m.compactionDuration,
+			m.uploadDuration,
 		)
 	}
 	return &m
@@ -131,19 +172,27 @@ func newSyncerMetrics(reg prometheus.Registerer) *syncerMetrics {
 
 // NewSyncer returns a new Syncer for the given Bucket and directory.
 // Blocks must be at least as old as the sync delay for being considered.
-func NewSyncer(logger log.Logger, reg prometheus.Registerer, bkt objstore.Bucket, consistencyDelay time.Duration, blockSyncConcurrency int, acceptMalformedIndex bool) (*Syncer, error) {
+// Blocks are grouped strictly by their external labels, unless groupDropLabels is set. In that case
+// blocks whose external labels only differ in those labels are grouped and compacted together.
+// Blocks uploaded by any of the excludedSources are left alone. Deleted blocks are reported to the deletionNotifier.
+func NewSyncer(logger log.Logger, reg prometheus.Registerer, bkt objstore.Bucket, consistencyDelay time.Duration, blockSyncConcurrency int, acceptMalformedIndex bool, groupDropLabels []string, blockVerifyConcurrency int, excludedSources []metadata.SourceType, deletionNotifier *DeletionNotifier) (*Syncer, error) {
 	if logger == nil {
 		logger = log.NewNopLogger()
 	}
 	return &Syncer{
-		logger:               logger,
-		reg:                  reg,
-		consistencyDelay:     consistencyDelay,
-		blocks:               map[ulid.ULID]*metadata.Meta{},
-		bkt:                  bkt,
-		metrics:              newSyncerMetrics(reg),
-		blockSyncConcurrency: blockSyncConcurrency,
-		acceptMalformedIndex: acceptMalformedIndex,
+		logger:                 logger,
+		reg:                    reg,
+		consistencyDelay:       consistencyDelay,
+		blocks:                 map[ulid.ULID]*metadata.Meta{},
+		freshBlocks:            map[ulid.ULID]*metadata.Meta{},
+		bkt:                    bkt,
+		metrics:                newSyncerMetrics(reg),
+		blockSyncConcurrency:   blockSyncConcurrency,
+		acceptMalformedIndex:   acceptMalformedIndex,
+		groupDropLabels:        groupDropLabels,
+		blockVerifyConcurrency: blockVerifyConcurrency,
+		excludedSources:        excludedSources,
+		deletionNotifier:       deletionNotifier,
 	}, nil
 }
 
@@ -184,25 +233,35 @@ func (c *Syncer) syncMetas(ctx context.Context) error {
 				// Check if we already have this block cached locally.
 				c.blocksMtx.Lock()
 				_, seen := c.blocks[id]
+				meta, fresh := c.freshBlocks[id]
 				c.blocksMtx.Unlock()
 				if seen {
 					continue
 				}
 
-				meta, err := c.downloadMeta(workCtx, id)
-				if err == blockTooFreshSentinelError {
-					continue
-				}
-				if err != nil {
-					if removedOrIgnored := c.removeIfMetaMalformed(workCtx, id); removedOrIgnored {
+				if !fresh {
+					var err error
+					meta, err = c.downloadMeta(workCtx, id)
+					if err == blockTooFreshSentinelError {
 						continue
 					}
-					errChan <- err
-					return
+					if err != nil {
+						if removedOrIgnored := c.removeIfMetaMalformed(workCtx, id); removedOrIgnored {
+							continue
+						}
+						errChan <- err
+						return
+					}
 				}
 
 				c.blocksMtx.Lock()
-				c.blocks[id] = meta
+				if c.isTooFresh(meta) {
+					level.Debug(c.logger).Log("msg", "block is too fresh for now", "block", id)
+					c.freshBlocks[id] = meta
+				} else {
+					delete(c.freshBlocks, id)
+					c.blocks[id] = meta
+				}
 				c.blocksMtx.Unlock()
 			}
 		}()
@@ -244,6 +303,11 @@ func (c *Syncer) syncMetas(ctx context.Context) error {
 			delete(c.blocks, id)
 		}
 	}
+	for id := range c.freshBlocks {
+		if _, ok := remote[id]; !ok {
+			delete(c.freshBlocks, id)
+		}
+	}
 
 	return nil
 }
@@ -260,22 +324,21 @@ func (c *Syncer) downloadMeta(ctx context.Context, id ulid.ULID) (*metadata.Meta
 		return nil, errors.Wrapf(err, "downloading meta.json for %s", id)
 	}
 
-	// ULIDs contain a millisecond timestamp. We do not consider blocks that have been created too recently to
-	// avoid races when a block is only partially uploaded. This relates to all blocks, excluding:
-	// - repair created blocks
-	// - compactor created blocks
-	// NOTE: It is not safe to miss "old" block (even that it is newly created) in sync step. Compactor needs to aware of ALL old blocks.
-	// TODO(bplotka): https://github.com/thanos-io/thanos/issues/377
-	if ulid.Now()-id.Time() < uint64(c.consistencyDelay/time.Millisecond) &&
+	return &meta, nil
+}
+
+// isTooFresh reports whether the block must not be considered yet.
+// ULIDs contain a millisecond timestamp. We do not consider blocks that have been created too recently to
+// avoid races when a block is only partially uploaded. This relates to all blocks, excluding:
+// - repair created blocks
+// - compactor created blocks
+// NOTE: It is not safe to miss "old" block (even that it is newly created) in sync step. Compactor needs to aware of ALL old blocks.
+// TODO(bplotka): https://github.com/thanos-io/thanos/issues/377
+func (c *Syncer) isTooFresh(meta *metadata.Meta) bool {
+	return ulid.Now()-meta.ULID.Time() < uint64(c.consistencyDelay/time.Millisecond) &&
 		meta.Thanos.Source != metadata.BucketRepairSource &&
 		meta.Thanos.Source != metadata.CompactorSource &&
-		meta.Thanos.Source != metadata.CompactorRepairSource {
-
-		level.Debug(c.logger).Log("msg", "block is too fresh for now", "block", id)
-		return nil, blockTooFreshSentinelError
-	}
-
-	return &meta, nil
+		meta.Thanos.Source != metadata.CompactorRepairSource
 }
 
 // removeIfMalformed removes a block from the bucket if that block does not have a meta file.  It ignores blocks that
@@ -301,6 +364,7 @@ func (c *Syncer) removeIfMetaMalformed(ctx context.Context, id ulid.ULID) (remov
 		return false
 	}
 	level.Info(c.logger).Log("msg", "deleted malformed block", "block", id)
+	c.deletionNotifier.Notify(ctx, id, DeletionReasonMalformed, nil)
 
 	return true
 }
@@ -315,6 +379,32 @@ func groupKey(res int64, lbls labels.Labels) string {
 	return fmt.Sprintf("%d@%s", res, lbls)
 }
 
+// groupLabels returns the external labels of the block without the given labels which are
+// ignored for grouping.
+func groupLabels(meta metadata.Meta, dropLabels []string) labels.Labels {
+	if len(dropLabels) == 0 {
+		return labels.FromMap(meta.Thanos.Labels)
+	}
+	m := make(map[string]string, len(meta.Thanos.Labels))
+	for n, v := range meta.Thanos.Labels {
+		m[n] = v
+	}
+	for _, n := range dropLabels {
+		delete(m, n)
+	}
+	return labels.FromMap(m)
+}
+
+// IsSourceExcluded reports whether the block was uploaded by any of the given sources.
+func IsSourceExcluded(meta metadata.Meta, excludedSources []metadata.SourceType) bool {
+	for _, s := range excludedSources {
+		if meta.Thanos.Source == s {
+			return true
+		}
+	}
+	return false
+}
+
 // Groups returns the compaction groups for all blocks currently known to the syncer.
 // It creates all groups from the scratch on every call.
 func (c *Syncer) Groups() (res []*Group, err error) {
@@ -323,22 +413,34 @@ func (c *Syncer) Groups() (res []*Group, err error) {
 
 	groups := map[string]*Group{}
 	for _, m := range c.blocks {
-		g, ok := groups[GroupKey(*m)]
+		if IsSourceExcluded(*m, c.excludedSources) {
+			continue
+		}
+		lset := groupLabels(*m, c.groupDropLabels)
+		key := groupKey(m.Thanos.Downsample.Resolution, lset)
+
+		g, ok := groups[key]
 		if !ok {
 			g, err = newGroup(
-				log.With(c.logger, "compactionGroup", GroupKey(*m)),
+				log.With(c.logger, "compactionGroup", key),
 				c.bkt,
-				labels.FromMap(m.Thanos.Labels),
+				lset,
 				m.Thanos.Downsample.Resolution,
 				c.acceptMalformedIndex,
-				c.metrics.compactions.WithLabelValues(GroupKey(*m)),
-				c.metrics.compactionFailures.WithLabelValues(GroupKey(*m)),
+				c.groupDropLabels,
+				c.blockVerifyConcurrency,
+				c.metrics.compactions.WithLabelValues(key),
+				c.metrics.compactionFailures.WithLabelValues(key),
 				c.metrics.garbageCollectedBlocks,
+				c.metrics.downloadDuration,
+				c.metrics.compactionDuration,
+				c.metrics.uploadDuration,
+				c.deletionNotifier,
 			)
 			if err != nil {
 				return nil, errors.Wrap(err, "create compaction group")
 			}
-			groups[GroupKey(*m)] = g
+			groups[key] = g
 			res = append(res, g)
 		}
 		if err := g.Add(m); err != nil {
@@ -351,6 +453,81 @@ func (c *Syncer) Groups() (res []*Group, err error) {
 	return res, nil
 }
 
+// ReplicaLabels returns the names of external labels that likely are replica labels of the blocks
+// currently known to the syncer. See detectReplicaLabels for the heuristic used.
+func (c *Syncer) ReplicaLabels() []string {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	metas := make([]*metadata.Meta, 0, len(c.blocks))
+	for _, m := range c.blocks {
+		metas = append(metas, m)
+	}
+	return detectReplicaLabels(metas)
+}
+
+// detectReplicaLabels returns the sorted names of external labels that, when dropped, make blocks
+// with otherwise identical external labels and resolution but different values of that label overlap in time.
+// As replicas scrape the same targets, only blocks with a similar number of series are considered.
+// This is still only a heuristic, e.g. evenly sized shards overlap in the same way.
+func detectReplicaLabels(metas []*metadata.Meta) []string {
+	names := map[string]struct{}{}
+	for _, m := range metas {
+		for n := range m.Thanos.Labels {
+			names[n] = struct{}{}
+		}
+	}
+
+	var res []string
+	for n := range names {
+		groups := map[string][]*metadata.Meta{}
+		for _, m := range metas {
+			if _, ok := m.Thanos.Labels[n]; !ok {
+				continue
+			}
+			key := groupKey(m.Thanos.Downsample.Resolution, groupLabels(*m, []string{n}))
+			groups[key] = append(groups[key], m)
+		}
+		for _, g := range groups {
+			if overlapWithDifferentLabel(g, n) {
+				res = append(res, n)
+				break
+			}
+		}
+	}
+	sort.Strings(res)
+	return res
+}
+
+// overlapWithDifferentLabel returns true if any two of the given blocks with a similar number of series
+// overlap in time while having different values for the given label.
+func overlapWithDifferentLabel(metas []*metadata.Meta, name string) bool {
+	sort.Slice(metas, func(i, j int) bool {
+		return metas[i].MinTime < metas[j].MinTime
+	})
+	for i, m := range metas {
+		for _, o := range metas[i+1:] {
+			// Block ranges are half-open and sorted by start, so no later block can overlap either.
+			if o.MinTime >= m.MaxTime {
+				break
+			}
+			if o.Thanos.Labels[name] != m.Thanos.Labels[name] && similarSeriesCount(m, o) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// similarSeriesCount returns true if the blocks' number of series differ by at most 10%.
+func similarSeriesCount(a, b *metadata.Meta) bool {
+	x, y := a.Stats.NumSeries, b.Stats.NumSeries
+	if x > y {
+		x, y = y, x
+	}
+	return float64(x) >= 0.9*float64(y)
+}
+
 // GarbageCollect deletes blocks from the bucket if their data is available as part of a
 // block with a higher compaction level.
 func (c *Syncer) GarbageCollect(ctx context.Context) error {
@@ -454,10 +631,12 @@ func (c *Syncer) garbageCollect(ctx context.Context, resolution int64) error {
 		level.Info(c.logger).Log("msg", "deleting outdated block", "block", id)
 
 		err := block.Delete(delCtx, c.logger, c.bkt, id)
-		cancel()
 		if err != nil {
+			cancel()
 			return retry(errors.Wrapf(err, "delete block %s from bucket", id))
 		}
+		c.deletionNotifier.Notify(delCtx, id, DeletionReasonGarbage, c.blocks[id].Thanos.Labels)
+		cancel()
 
 		// Immediately update our in-memory state so no further call to SyncMetas is needed
 		/// after running garbage collection.
@@ -469,6 +648,7 @@ func (c *Syncer) garbageCollect(ctx context.Context, resolution int64) error {
 
 // Group captures a set of blocks that have the same origin labels and downsampling resolution.
 // Those blocks generally contain the same series and can thus efficiently be compacted.
+// Labels in dropLabels are ignored when matching blocks and are not carried by the compacted blocks.
 type Group struct {
 	logger                      log.Logger
 	bkt                         objstore.Bucket
@@ -477,9 +657,15 @@ type Group struct {
 	mtx                         sync.Mutex
 	blocks                      map[ulid.ULID]*metadata.Meta
 	acceptMalformedIndex        bool
+	dropLabels                  []string
+	blockVerifyConcurrency      int
 	compactions                 prometheus.Counter
 	compactionFailures          prometheus.Counter
 	groupGarbageCollectedBlocks prometheus.Counter
+	downloadDuration            *prometheus.HistogramVec
+	compactionDuration          *prometheus.HistogramVec
+	uploadDuration              *prometheus.HistogramVec
+	deletionNotifier            *DeletionNotifier
 }
 
 // newGroup returns a new compaction group.
@@ -489,9 +675,15 @@ func newGroup(
 	lset labels.Labels,
 	resolution int64,
 	acceptMalformedIndex bool,
+	dropLabels []string,
+	blockVerifyConcurrency int,
 	compactions prometheus.Counter,
 	compactionFailures prometheus.Counter,
 	groupGarbageCollectedBlocks prometheus.Counter,
+	downloadDuration *prometheus.HistogramVec,
+	compactionDuration *prometheus.HistogramVec,
+	uploadDuration *prometheus.HistogramVec,
+	deletionNotifier *DeletionNotifier,
 ) (*Group, error) {
 	if logger == nil {
 		logger = log.NewNopLogger()
@@ -503,9 +695,15 @@ func newGroup(
 		resolution:                  resolution,
 		blocks:                      map[ulid.ULID]*metadata.Meta{},
 		acceptMalformedIndex:        acceptMalformedIndex,
+		dropLabels:                  dropLabels,
+		blockVerifyConcurrency:      blockVerifyConcurrency,
 		compactions:                 compactions,
 		compactionFailures:          compactionFailures,
 		groupGarbageCollectedBlocks: groupGarbageCollectedBlocks,
+		downloadDuration:            downloadDuration,
+		compactionDuration:          compactionDuration,
+		uploadDuration:              uploadDuration,
+		deletionNotifier:            deletionNotifier,
 	}
 	return g, nil
 }
@@ -520,7 +718,7 @@ func (cg *Group) Add(meta *metadata.Meta) error {
 	cg.mtx.Lock()
 	defer cg.mtx.Unlock()
 
-	if !cg.labels.Equals(labels.FromMap(meta.Thanos.Labels)) {
+	if !cg.labels.Equals(groupLabels(*meta, cg.dropLabels)) {
 		return errors.New("block and group labels do not match")
 	}
 	if cg.resolution != meta.Thanos.Downsample.Resolution {
@@ -692,7 +890,7 @@ func (cg *Group) areBlocksOverlapping(include *metadata.Meta, excludeDirs ...str
 }
 
 // RepairIssue347 repairs the https://github.com/prometheus/tsdb/issues/347 issue when having issue347Error.
-func RepairIssue347(ctx context.Context, logger log.Logger, bkt objstore.Bucket, issue347Err error) error {
+func RepairIssue347(ctx context.Context, logger log.Logger, bkt objstore.Bucket, deletionNotifier *DeletionNotifier, issue347Err error) error {
 	ie, ok := errors.Cause(issue347Err).(Issue347Error)
 	if !ok {
 		return errors.Errorf("Given error is not an issue347 error: %v", issue347Err)
@@ -746,6 +944,7 @@ func RepairIssue347(ctx context.Context, logger log.Logger, bkt objstore.Bucket,
 	if err := block.Delete(delCtx, logger, bkt, ie.id); err != nil {
 		return errors.Wrapf(err, "deleting old block %s failed. You need to delete this block manually", ie.id)
 	}
+	deletionNotifier.Notify(delCtx, ie.id, DeletionReasonRepaired, meta.Thanos.Labels)
 
 	return nil
 }
@@ -788,14 +987,18 @@ func (cg *Group) compact(ctx context.Context, dir string, comp tsdb.Compactor) (
 	// Once we have a plan we need to download the actual data.
 	begin := time.Now()
 
+	// Compaction level of the resulting block, same as TSDB assigns it: one above the highest planned level.
+	var compLevel int
+
+	metas := make([]*metadata.Meta, 0, len(plan))
 	for _, pdir := range plan {
 		meta, err := metadata.Read(pdir)
 		if err != nil {
 			return false, ulid.ULID{}, errors.Wrapf(err, "read meta from %s", pdir)
 		}
 
-		if cg.Key() != GroupKey(*meta) {
-			return false, ulid.ULID{}, halt(errors.Wrapf(err, "compact planned compaction for mixed groups. group: %s, planned block's group: %s", cg.Key(), GroupKey(*meta)))
+		if metaKey := groupKey(meta.Thanos.Downsample.Resolution, groupLabels(*meta, cg.dropLabels)); cg.Key() != metaKey {
+			return false, ulid.ULID{}, halt(errors.Wrapf(err, "compact planned compaction for mixed groups. group: %s, planned block's group: %s", cg.Key(), metaKey))
 		}
 
 		for _, s := range meta.Compaction.Sources {
@@ -804,6 +1007,9 @@ func (cg *Group) compact(ctx context.Context, dir string, comp tsdb.Compactor) (
 			}
 			uniqueSources[s] = struct{}{}
 		}
+		if meta.Compaction.Level+1 > compLevel {
+			compLevel = meta.Compaction.Level + 1
+		}
 
 		id, err := ulid.Parse(filepath.Base(pdir))
 		if err != nil {
@@ -817,12 +1023,16 @@ func (cg *Group) compact(ctx context.Context, dir string, comp tsdb.Compactor) (
 		if err := block.Download(ctx, cg.logger, cg.bkt, id, pdir); err != nil {
 			return false, ulid.ULID{}, retry(errors.Wrapf(err, "download block %s", id))
 		}
+		metas = append(metas, meta)
+	}
 
-		// Ensure all input blocks are valid.
-		stats, err := block.GatherIndexIssueStats(cg.logger, filepath.Join(pdir, block.IndexFilename), meta.MinTime, meta.MaxTime)
-		if err != nil {
-			return false, ulid.ULID{}, errors.Wrapf(err, "gather index issues for block %s", pdir)
-		}
+	// Ensure all input blocks are valid.
+	blockStats, err := block.GatherBlocksIndexIssueStats(ctx, cg.logger, plan, cg.blockVerifyConcurrency)
+	if err != nil {
+		return false, ulid.ULID{}, err
+	}
+	for i, pdir := range plan {
+		meta, stats := metas[i], blockStats[i]
 
 		if err := stats.CriticalErr(); err != nil {
 			return false, ulid.ULID{}, halt(errors.Wrapf(err, "block with not healthy index found %s; Compaction level %v; Labels: %v", pdir, meta.Compaction.Level, meta.Thanos.Labels))
@@ -834,15 +1044,18 @@ func (cg *Group) compact(ctx context.Context, dir string, comp tsdb.Compactor) (
 
 		if err := stats.PrometheusIssue5372Err(); !cg.acceptMalformedIndex && err != nil {
 			return false, ulid.ULID{}, errors.Wrapf(err,
-				"block id %s, try running with --debug.accept-malformed-index", id)
+				"block id %s, try running with --debug.accept-malformed-index", meta.ULID)
 		}
 	}
+	durationLabels := []string{strconv.FormatInt(cg.resolution, 10), strconv.Itoa(compLevel)}
+	cg.downloadDuration.WithLabelValues(durationLabels...).Observe(time.Since(begin).Seconds())
 	level.Debug(cg.logger).Log("msg", "downloaded and verified blocks",
 		"blocks", fmt.Sprintf("%v", plan), "duration", time.Since(begin))
 
 	begin = time.Now()
 
 	compID, err = comp.Compact(dir, plan, nil)
+	cg.compactionDuration.WithLabelValues(durationLabels...).Observe(time.Since(begin).Seconds())
 	if err != nil {
 		return false, ulid.ULID{}, halt(errors.Wrapf(err, "compact blocks %v", plan))
 	}
@@ -856,7 +1069,7 @@ func (cg *Group) compact(ctx context.Context, dir string, comp tsdb.Compactor) (
 				continue
 			}
 			if meta.Stats.NumSamples == 0 {
-				if err := cg.deleteBlock(block); err != nil {
+				if err := cg.deleteBlock(block, DeletionReasonEmpty); err != nil {
 					level.Warn(cg.logger).Log("msg", "failed to delete empty block found during compaction", "block", block)
 				}
 			}
@@ -903,13 +1116,14 @@ func (cg *Group) compact(ctx context.Context, dir string, comp tsdb.Compactor) (
 	if err := block.Upload(ctx, cg.logger, cg.bkt, bdir); err != nil {
 		return false, ulid.ULID{}, retry(errors.Wrapf(err, "upload of %s failed", compID))
 	}
+	cg.uploadDuration.WithLabelValues(durationLabels...).Observe(time.Since(begin).Seconds())
 	level.Debug(cg.logger).Log("msg", "uploaded block", "result_block", compID, "duration", time.Since(begin))
 
 	// Delete the blocks we just compacted from the group and bucket so they do not get included
 	// into the next planning cycle.
 	// Eventually the block we just uploaded should get synced into the group again (including sync-delay).
 	for _, b := range plan {
-		if err := cg.deleteBlock(b); err != nil {
+		if err := cg.deleteBlock(b, DeletionReasonCompacted); err != nil {
 			return false, ulid.ULID{}, retry(errors.Wrapf(err, "delete old block from bucket"))
 		}
 		cg.groupGarbageCollectedBlocks.Inc()
@@ -918,7 +1132,8 @@ func (cg *Group) compact(ctx context.Context, dir string, comp tsdb.Compactor) (
 	return true, compID, nil
 }
 
-func (cg *Group) deleteBlock(b string) error {
+// deleteBlock deletes the given block of the group from disk and from the bucket.
+func (cg *Group) deleteBlock(b string, reason string) error {
 	id, err := ulid.Parse(filepath.Base(b))
 	if err != nil {
 		return errors.Wrapf(err, "plan dir %s", b)
@@ -935,6 +1150,12 @@ func (cg *Group) deleteBlock(b string) error {
 	if err := block.Delete(delCtx, cg.logger, cg.bkt, id); err != nil {
 		return errors.Wrapf(err, "delete block %s from bucket", id)
 	}
+
+	var lset map[string]string
+	if m, ok := cg.blocks[id]; ok {
+		lset = m.Thanos.Labels
+	}
+	cg.deletionNotifier.Notify(delCtx, id, reason, lset)
 	return nil
 }
 
@@ -946,6 +1167,10 @@ type BucketCompactor struct {
 	compactDir  string
 	bkt         objstore.Bucket
 	concurrency int
+	// maxConcurrencyPerGroup, if positive, limits the concurrent compactions of groups sharing the values of
+	// the fairSchedulingLabels, or all labels if there are none.
+	maxConcurrencyPerGroup int
+	fairSchedulingLabels   []string
 }
 
 // NewBucketCompactor creates a new bucket compactor.
@@ -956,20 +1181,75 @@ func NewBucketCompactor(
 	compactDir string,
 	bkt objstore.Bucket,
 	concurrency int,
+	maxConcurrencyPerGroup int,
+	fairSchedulingLabels []string,
 ) (*BucketCompactor, error) {
 	if concurrency <= 0 {
 		return nil, errors.Errorf("invalid concurrency level (%d), concurrency level must be > 0", concurrency)
 	}
 	return &BucketCompactor{
-		logger:      logger,
-		sy:          sy,
-		comp:        comp,
-		compactDir:  compactDir,
-		bkt:         bkt,
-		concurrency: concurrency,
+		logger:                 logger,
+		sy:                     sy,
+		comp:                   comp,
+		compactDir:             compactDir,
+		bkt:                    bkt,
+		concurrency:            concurrency,
+		maxConcurrencyPerGroup: maxConcurrencyPerGroup,
+		fairSchedulingLabels:   fairSchedulingLabels,
 	}, nil
 }
 
+// fairSchedulingKey returns the key of the fair scheduling group the given group belongs to.
+func (c *BucketCompactor) fairSchedulingKey(g *Group) string {
+	if len(c.fairSchedulingLabels) == 0 {
+		return g.Labels().String()
+	}
+	values := make([]string, 0, len(c.fairSchedulingLabels))
+	for _, name := range c.fairSchedulingLabels {
+		values = append(values, g.Labels().Get(name))
+	}
+	return strings.Join(values, ",")
+}
+
+// dispatchGroups sends the groups to the workers reading from groupc, which report every group they are done with
+// on donec. If maxPerKey is positive, at most maxPerKey groups with the same key are dispatched at once. Groups whose
+// key is at the limit are held back while those of other keys are dispatched. It returns early with the first error
+// received from errc.
+func dispatchGroups(groups []*Group, key func(*Group) string, maxPerKey int, groupc chan<- *Group, donec <-chan *Group, errc <-chan error) error {
+	pending := append([]*Group(nil), groups...)
+	running := map[string]int{}
+
+	for len(pending) > 0 {
+		next := -1
+		for i, g := range pending {
+			if maxPerKey <= 0 || running[key(g)] < maxPerKey {
+				next = i
+				break
+			}
+		}
+
+		// Only wait for a group to finish if all pending ones are held back.
+		var (
+			sendc chan<- *Group
+			g     *Group
+		)
+		if next >= 0 {
+			sendc, g = groupc, pending[next]
+		}
+
+		select {
+		case err := <-errc:
+			return err
+		case done := <-donec:
+			running[key(done)]--
+		case sendc <- g:
+			running[key(g)]++
+			pending = append(pending[:next], pending[next+1:]...)
+		}
+	}
+	return nil
+}
+
 // Compact runs compaction over bucket.
 func (c *BucketCompactor) Compact(ctx context.Context) error {
 	// Loop over bucket and compact until there's no work left.
@@ -978,6 +1258,7 @@ func (c *BucketCompactor) Compact(ctx context.Context) error {
 			wg                     sync.WaitGroup
 			workCtx, workCtxCancel = context.WithCancel(ctx)
 			groupChan              = make(chan *Group)
+			doneChan               chan *Group
 			errChan                = make(chan error, c.concurrency)
 			finishedAllGroups      = true
 			mtx                    sync.Mutex
@@ -992,6 +1273,7 @@ func (c *BucketCompactor) Compact(ctx context.Context) error {
 				defer wg.Done()
 				for g := range groupChan {
 					shouldRerunGroup, _, err := g.Compact(workCtx, c.compactDir, c.comp)
+					doneChan <- g
 					if err == nil {
 						if shouldRerunGroup {
 							mtx.Lock()
@@ -1002,7 +1284,7 @@ func (c *BucketCompactor) Compact(ctx context.Context) error {
 					}
 
 					if IsIssue347Error(err) {
-						if err := RepairIssue347(workCtx, c.logger, c.bkt, err); err == nil {
+						if err := RepairIssue347(workCtx, c.logger, c.bkt, c.sy.deletionNotifier, err); err == nil {
 							mtx.Lock()
 							finishedAllGroups = false
 							mtx.Unlock()
@@ -1040,14 +1322,8 @@ func (c *BucketCompactor) Compact(ctx context.Context) error {
 		}
 
 		// Send all groups found during this pass to the compaction workers.
-	groupLoop:
-		for _, g := range groups {
-			select {
-			case err = <-errChan:
-				break groupLoop
-			case groupChan <- g:
-			}
-		}
+		doneChan = make(chan *Group, len(groups))
+		err = dispatchGroups(groups, c.fairSchedulingKey, c.maxConcurrencyPerGroup, groupChan, doneChan, errChan)
 		close(groupChan)
 		wg.Wait()
 
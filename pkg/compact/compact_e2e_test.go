@@ -17,6 +17,7 @@ import (
 	"github.com/go-kit/kit/log"
 	"github.com/oklog/ulid"
 	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/prometheus/tsdb"
 	"github.com/prometheus/prometheus/tsdb/index"
 	"github.com/prometheus/prometheus/tsdb/labels"
@@ -32,7 +33,7 @@ func TestSyncer_SyncMetas_e2e(t *testing.T) {
 		ctx, cancel := context.WithTimeout(context.Background(), 120*time.Second)
 		defer cancel()
 
-		sy, err := NewSyncer(nil, nil, bkt, 0, 1, false)
+		sy, err := NewSyncer(nil, nil, bkt, 0, 1, false, nil, 1, nil, nil)
 		testutil.Ok(t, err)
 
 		// Generate 15 blocks. Initially the first 10 are synced into memory and only the last
@@ -134,7 +135,7 @@ func TestSyncer_GarbageCollect_e2e(t *testing.T) {
 		}
 
 		// Do one initial synchronization with the bucket.
-		sy, err := NewSyncer(nil, nil, bkt, 0, 1, false)
+		sy, err := NewSyncer(nil, nil, bkt, 0, 1, false, nil, 1, nil, nil)
 		testutil.Ok(t, err)
 		testutil.Ok(t, sy.SyncMetas(ctx))
 
@@ -238,16 +239,23 @@ func TestGroup_Compact_e2e(t *testing.T) {
 		testutil.Ok(t, err)
 		defer func() { testutil.Ok(t, os.RemoveAll(dir)) }()
 
-		metrics := newSyncerMetrics(nil)
+		reg := prometheus.NewRegistry()
+		metrics := newSyncerMetrics(reg)
 		g, err := newGroup(
 			nil,
 			bkt,
 			extLset,
 			124,
 			false,
+			nil,
+			2,
 			metrics.compactions.WithLabelValues(""),
 			metrics.compactionFailures.WithLabelValues(""),
 			metrics.garbageCollectedBlocks,
+			metrics.downloadDuration,
+			metrics.compactionDuration,
+			metrics.uploadDuration,
+			nil,
 		)
 		testutil.Ok(t, err)
 
@@ -299,6 +307,34 @@ func TestGroup_Compact_e2e(t *testing.T) {
 			return nil
 		})
 		testutil.Ok(t, err)
+
+		// Each phase of the group compaction should be observed once, labeled by resolution and resulting level.
+		mfs, err := reg.Gather()
+		testutil.Ok(t, err)
+
+		observed := map[string]uint64{}
+		for _, mf := range mfs {
+			switch mf.GetName() {
+			case "thanos_compact_group_download_duration_seconds",
+				"thanos_compact_group_compaction_duration_seconds",
+				"thanos_compact_group_upload_duration_seconds":
+			default:
+				continue
+			}
+			for _, m := range mf.GetMetric() {
+				lbls := map[string]string{}
+				for _, l := range m.GetLabel() {
+					lbls[l.GetName()] = l.GetValue()
+				}
+				testutil.Equals(t, map[string]string{"resolution": "124", "level": "2"}, lbls)
+				observed[mf.GetName()] = m.GetHistogram().GetSampleCount()
+			}
+		}
+		testutil.Equals(t, map[string]uint64{
+			"thanos_compact_group_download_duration_seconds":   1,
+			"thanos_compact_group_compaction_duration_seconds": 1,
+			"thanos_compact_group_upload_duration_seconds":     1,
+		}, observed)
 	})
 }
 
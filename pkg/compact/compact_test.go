@@ -3,13 +3,21 @@ package compact
 import (
 	"bytes"
 	"context"
+	"encoding/json"
+	"io"
 	"path"
+	"strconv"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/oklog/ulid"
 	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/tsdb"
 	terrors "github.com/prometheus/prometheus/tsdb/errors"
+	"github.com/prometheus/prometheus/tsdb/labels"
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/objstore"
 	"github.com/thanos-io/thanos/pkg/objstore/inmem"
 	"github.com/thanos-io/thanos/pkg/testutil"
 )
@@ -75,7 +83,7 @@ func TestSyncer_SyncMetas_HandlesMalformedBlocks(t *testing.T) {
 	defer cancel()
 
 	bkt := inmem.NewBucket()
-	sy, err := NewSyncer(nil, nil, bkt, 10*time.Second, 1, false)
+	sy, err := NewSyncer(nil, nil, bkt, 10*time.Second, 1, false, nil, 1, nil, nil)
 	testutil.Ok(t, err)
 
 	// Generate 1 block which is older than MinimumAgeForRemoval which has chunk data but no meta.  Compactor should delete it.
@@ -103,3 +111,311 @@ func TestSyncer_SyncMetas_HandlesMalformedBlocks(t *testing.T) {
 	testutil.Ok(t, err)
 	testutil.Equals(t, true, exists)
 }
+
+type metaReadCountingBucket struct {
+	objstore.Bucket
+
+	mtx   sync.Mutex
+	reads map[string]int
+}
+
+func (b *metaReadCountingBucket) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	if path.Base(name) == metadata.MetaFilename {
+		b.mtx.Lock()
+		b.reads[path.Dir(name)]++
+		b.mtx.Unlock()
+	}
+	return b.Bucket.Get(ctx, name)
+}
+
+func TestSyncer_SyncMetas_ReadsMetaOnce(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	bkt := &metaReadCountingBucket{Bucket: inmem.NewBucket(), reads: map[string]int{}}
+	sy, err := NewSyncer(nil, nil, bkt, time.Hour, 2, false, nil, 1, nil, nil)
+	testutil.Ok(t, err)
+
+	var ids []ulid.ULID
+	for _, created := range []time.Time{time.Now().Add(-2 * time.Hour), time.Now().Add(-90 * time.Minute), time.Now()} {
+		id, err := ulid.New(uint64(created.Unix()*1000), nil)
+		testutil.Ok(t, err)
+		ids = append(ids, id)
+
+		var meta metadata.Meta
+		meta.Version = 1
+		meta.ULID = id
+
+		var buf bytes.Buffer
+		testutil.Ok(t, json.NewEncoder(&buf).Encode(&meta))
+		testutil.Ok(t, bkt.Upload(ctx, path.Join(id.String(), metadata.MetaFilename), &buf))
+	}
+
+	for i := 0; i < 3; i++ {
+		testutil.Ok(t, sy.SyncMetas(ctx))
+
+		groups, err := sy.Groups()
+		testutil.Ok(t, err)
+		testutil.Equals(t, 1, len(groups))
+		testutil.Equals(t, ids[:2], groups[0].IDs())
+	}
+
+	// The fresh block is planned once it is old enough, without reading its meta again.
+	sy.consistencyDelay = 0
+	testutil.Ok(t, sy.SyncMetas(ctx))
+
+	groups, err := sy.Groups()
+	testutil.Ok(t, err)
+	testutil.Equals(t, 1, len(groups))
+	testutil.Equals(t, ids, groups[0].IDs())
+
+	for _, id := range ids {
+		testutil.Equals(t, 1, bkt.reads[id.String()])
+	}
+}
+
+func TestSyncer_Groups_DropLabels(t *testing.T) {
+	metas := []*metadata.Meta{
+		{BlockMeta: tsdb.BlockMeta{ULID: ulid.MustNew(1, nil)}, Thanos: metadata.Thanos{Labels: map[string]string{"a": "1", "replica": "r0"}}},
+		{BlockMeta: tsdb.BlockMeta{ULID: ulid.MustNew(2, nil)}, Thanos: metadata.Thanos{Labels: map[string]string{"a": "1", "replica": "r1"}}},
+		{BlockMeta: tsdb.BlockMeta{ULID: ulid.MustNew(3, nil)}, Thanos: metadata.Thanos{Labels: map[string]string{"a": "2", "replica": "r0"}}},
+	}
+
+	for _, tcase := range []struct {
+		dropLabels []string
+		expected   map[string][]ulid.ULID
+	}{
+		{
+			dropLabels: nil,
+			expected: map[string][]ulid.ULID{
+				`0@{a="1",replica="r0"}`: {metas[0].ULID},
+				`0@{a="1",replica="r1"}`: {metas[1].ULID},
+				`0@{a="2",replica="r0"}`: {metas[2].ULID},
+			},
+		},
+		{
+			dropLabels: []string{"replica"},
+			expected: map[string][]ulid.ULID{
+				`0@{a="1"}`: {metas[0].ULID, metas[1].ULID},
+				`0@{a="2"}`: {metas[2].ULID},
+			},
+		},
+	} {
+		t.Run("", func(t *testing.T) {
+			sy, err := NewSyncer(nil, nil, inmem.NewBucket(), 0, 1, false, tcase.dropLabels, 1, nil, nil)
+			testutil.Ok(t, err)
+			for _, m := range metas {
+				sy.blocks[m.ULID] = m
+			}
+
+			groups, err := sy.Groups()
+			testutil.Ok(t, err)
+
+			got := map[string][]ulid.ULID{}
+			for _, g := range groups {
+				got[g.Key()] = g.IDs()
+			}
+			testutil.Equals(t, tcase.expected, got)
+		})
+	}
+}
+
+func TestSyncer_Groups_ExcludedSources(t *testing.T) {
+	metas := []*metadata.Meta{
+		{BlockMeta: tsdb.BlockMeta{ULID: ulid.MustNew(1, nil)}, Thanos: metadata.Thanos{Labels: map[string]string{"a": "1"}, Source: metadata.SidecarSource}},
+		{BlockMeta: tsdb.BlockMeta{ULID: ulid.MustNew(2, nil)}, Thanos: metadata.Thanos{Labels: map[string]string{"a": "1"}, Source: metadata.ReceiveSource}},
+		{BlockMeta: tsdb.BlockMeta{ULID: ulid.MustNew(3, nil)}, Thanos: metadata.Thanos{Labels: map[string]string{"a": "1"}, Source: metadata.CompactorSource}},
+		{BlockMeta: tsdb.BlockMeta{ULID: ulid.MustNew(4, nil)}, Thanos: metadata.Thanos{Labels: map[string]string{"a": "2"}, Source: metadata.ReceiveSource}},
+	}
+
+	for _, tcase := range []struct {
+		excludedSources []metadata.SourceType
+		expected        map[string][]ulid.ULID
+	}{
+		{
+			excludedSources: nil,
+			expected: map[string][]ulid.ULID{
+				`0@{a="1"}`: {metas[0].ULID, metas[1].ULID, metas[2].ULID},
+				`0@{a="2"}`: {metas[3].ULID},
+			},
+		},
+		{
+			excludedSources: []metadata.SourceType{metadata.ReceiveSource},
+			expected: map[string][]ulid.ULID{
+				`0@{a="1"}`: {metas[0].ULID, metas[2].ULID},
+			},
+		},
+		{
+			excludedSources: []metadata.SourceType{metadata.SidecarSource, metadata.ReceiveSource},
+			expected: map[string][]ulid.ULID{
+				`0@{a="1"}`: {metas[2].ULID},
+			},
+		},
+	} {
+		t.Run("", func(t *testing.T) {
+			sy, err := NewSyncer(nil, nil, inmem.NewBucket(), 0, 1, false, nil, 1, tcase.excludedSources, nil)
+			testutil.Ok(t, err)
+			for _, m := range metas {
+				sy.blocks[m.ULID] = m
+			}
+
+			groups, err := sy.Groups()
+			testutil.Ok(t, err)
+
+			got := map[string][]ulid.ULID{}
+			for _, g := range groups {
+				got[g.Key()] = g.IDs()
+			}
+			testutil.Equals(t, tcase.expected, got)
+		})
+	}
+}
+
+func TestDetectReplicaLabels(t *testing.T) {
+	newMeta := func(id uint64, mint, maxt int64, numSeries uint64, lset map[string]string) *metadata.Meta {
+		return &metadata.Meta{
+			BlockMeta: tsdb.BlockMeta{
+				ULID:    ulid.MustNew(id, nil),
+				MinTime: mint,
+				MaxTime: maxt,
+				Stats:   tsdb.BlockStats{NumSeries: numSeries},
+			},
+			Thanos: metadata.Thanos{Labels: lset},
+		}
+	}
+
+	for _, tcase := range []struct {
+		metas    []*metadata.Meta
+		expected []string
+	}{
+		{
+			// Two HA replicas of the same cluster, one of them also covers an earlier time range.
+			// The other cluster overlaps as well, but has a different number of series.
+			metas: []*metadata.Meta{
+				newMeta(1, 0, 100, 1000, map[string]string{"cluster": "a", "replica": "0"}),
+				newMeta(2, 100, 200, 1000, map[string]string{"cluster": "a", "replica": "0"}),
+				newMeta(3, 150, 250, 1020, map[string]string{"cluster": "a", "replica": "1"}),
+				newMeta(4, 0, 100, 300, map[string]string{"cluster": "b", "replica": "0"}),
+			},
+			expected: []string{"replica"},
+		},
+		{
+			// Differently labeled blocks that follow each other in time, e.g. after relabeling, are no replicas.
+			metas: []*metadata.Meta{
+				newMeta(1, 0, 100, 1000, map[string]string{"cluster": "a", "env": "old"}),
+				newMeta(2, 100, 200, 1000, map[string]string{"cluster": "a", "env": "new"}),
+			},
+			expected: nil,
+		},
+		{
+			// Overlapping blocks with equal labels do not make a label a replica label.
+			metas: []*metadata.Meta{
+				newMeta(1, 0, 100, 1000, map[string]string{"cluster": "a", "replica": "0"}),
+				newMeta(2, 50, 150, 1000, map[string]string{"cluster": "a", "replica": "0"}),
+			},
+			expected: nil,
+		},
+		{
+			// Blocks of different resolutions are never compared.
+			metas: func() []*metadata.Meta {
+				ms := []*metadata.Meta{
+					newMeta(1, 0, 100, 1000, map[string]string{"cluster": "a", "replica": "0"}),
+					newMeta(2, 0, 100, 1000, map[string]string{"cluster": "a", "replica": "1"}),
+				}
+				ms[1].Thanos.Downsample.Resolution = 5 * 60 * 1000
+				return ms
+			}(),
+			expected: nil,
+		},
+	} {
+		t.Run("", func(t *testing.T) {
+			sy, err := NewSyncer(nil, nil, inmem.NewBucket(), 0, 1, false, nil, 1, nil, nil)
+			testutil.Ok(t, err)
+			for _, m := range tcase.metas {
+				sy.blocks[m.ULID] = m
+			}
+			testutil.Equals(t, tcase.expected, sy.ReplicaLabels())
+		})
+	}
+}
+
+func TestDispatchGroups_FairScheduling(t *testing.T) {
+	c := &BucketCompactor{fairSchedulingLabels: []string{"tenant"}}
+
+	var groups []*Group
+	for i := 0; i < 4; i++ {
+		groups = append(groups, &Group{labels: labels.FromStrings("tenant", "a", "shard", strconv.Itoa(i))})
+	}
+	for i := 0; i < 2; i++ {
+		groups = append(groups, &Group{labels: labels.FromStrings("tenant", "b", "shard", strconv.Itoa(i))})
+	}
+
+	var (
+		wg       sync.WaitGroup
+		mtx      sync.Mutex
+		running  = map[string]int{}
+		maxSeen  = map[string]int{}
+		started  []string
+		groupc   = make(chan *Group)
+		donec    = make(chan *Group, len(groups))
+		errc     = make(chan error, 3)
+		finished = map[string]int{}
+	)
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for g := range groupc {
+				key := c.fairSchedulingKey(g)
+
+				mtx.Lock()
+				running[key]++
+				if running[key] > maxSeen[key] {
+					maxSeen[key] = running[key]
+				}
+				started = append(started, key)
+				mtx.Unlock()
+
+				time.Sleep(10 * time.Millisecond)
+
+				mtx.Lock()
+				running[key]--
+				finished[key]++
+				mtx.Unlock()
+				donec <- g
+			}
+		}()
+	}
+
+	testutil.Ok(t, dispatchGroups(groups, c.fairSchedulingKey, 1, groupc, donec, errc))
+	close(groupc)
+	wg.Wait()
+
+	testutil.Equals(t, map[string]int{"a": 4, "b": 2}, finished)
+	testutil.Equals(t, map[string]int{"a": 1, "b": 1}, maxSeen)
+	// Groups of tenant b are not waiting for all of those of tenant a, although they come last.
+	lastB := 0
+	for i, key := range started {
+		if key == "b" {
+			lastB = i
+		}
+	}
+	testutil.Assert(t, lastB < 4, "expected groups of tenant b to start before the last ones of tenant a, got %v", started)
+}
+
+func TestDispatchGroups_Error(t *testing.T) {
+	groups := []*Group{
+		{labels: labels.FromStrings("tenant", "a")},
+		{labels: labels.FromStrings("tenant", "a")},
+	}
+	groupc := make(chan *Group)
+	errc := make(chan error, 1)
+	go func() {
+		<-groupc
+		errc <- errors.New("compaction failed")
+	}()
+
+	err := dispatchGroups(groups, func(g *Group) string { return g.Labels().String() }, 1, groupc, make(chan *Group), errc)
+	testutil.NotOk(t, err)
+	testutil.Equals(t, "compaction failed", err.Error())
+}
@@ -17,11 +17,16 @@ type AggrChunk []byte
 
 // EncodeAggrChunk encodes a new aggregate chunk from the array of chunks for each aggregate.
 // Each array entry corresponds to the respective AggrType number.
-func EncodeAggrChunk(chks [5]chunkenc.Chunk) *AggrChunk {
+// Trailing unset aggregates are omitted, so chunks without optional aggregates keep their previous encoding.
+func EncodeAggrChunk(chks [6]chunkenc.Chunk) *AggrChunk {
 	var b []byte
 	buf := [8]byte{}
 
-	for _, c := range chks {
+	num := len(chks)
+	for num > 0 && chks[num-1] == nil {
+		num--
+	}
+	for _, c := range chks[:num] {
 		// Unset aggregates are marked with a zero length entry.
 		if c == nil {
 			n := binary.PutUvarint(buf[:], 0)
@@ -71,6 +76,10 @@ func (c AggrChunk) Get(t AggrType) (chunkenc.Chunk, error) {
 	var x []byte
 
 	for i := AggrType(0); i <= t; i++ {
+		// Trailing unset aggregates may be omitted entirely.
+		if len(b) == 0 {
+			return nil, ErrAggrNotExist
+		}
 		l, n := binary.Uvarint(b)
 		if n < 1 || len(b[n:]) < int(l)+1 {
 			return nil, errors.New("invalid size")
@@ -99,6 +108,8 @@ const (
 	AggrMin
 	AggrMax
 	AggrCounter
+	// AggrSumSquares is optional and only present if enabled during downsampling.
+	AggrSumSquares
 )
 
 func (t AggrType) String() string {
@@ -113,6 +124,8 @@ func (t AggrType) String() string {
 		return "max"
 	case AggrCounter:
 		return "counter"
+	case AggrSumSquares:
+		return "sum_squares"
 	}
 	return "<unknown>"
 }
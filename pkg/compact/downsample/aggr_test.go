@@ -12,15 +12,16 @@ import (
 func TestAggrChunk(t *testing.T) {
 	defer leaktest.CheckTimeout(t, 10*time.Second)()
 
-	var input [5][]sample
+	var input [6][]sample
 
 	input[AggrCount] = []sample{{100, 30}, {200, 50}, {300, 60}, {400, 67}}
 	input[AggrSum] = []sample{{100, 130}, {200, 1000}, {300, 2000}, {400, 5555}}
 	input[AggrMin] = []sample{{100, 0}, {200, -10}, {300, 1000}, {400, -9.5}}
 	// Maximum is absent.
 	input[AggrCounter] = []sample{{100, 5}, {200, 10}, {300, 10.1}, {400, 15}, {400, 3}}
+	input[AggrSumSquares] = []sample{{100, 600}, {200, 25000}, {300, 70000}, {400, 500000}}
 
-	var chks [5]chunkenc.Chunk
+	var chks [6]chunkenc.Chunk
 
 	for i, smpls := range input {
 		if len(smpls) == 0 {
@@ -35,10 +36,10 @@ func TestAggrChunk(t *testing.T) {
 		}
 	}
 
-	var res [5][]sample
+	var res [6][]sample
 	ac := EncodeAggrChunk(chks)
 
-	for _, at := range []AggrType{AggrCount, AggrSum, AggrMin, AggrMax, AggrCounter} {
+	for _, at := range []AggrType{AggrCount, AggrSum, AggrMin, AggrMax, AggrCounter, AggrSumSquares} {
 		if c, err := ac.Get(at); err != ErrAggrNotExist {
 			testutil.Ok(t, err)
 			testutil.Ok(t, expandChunkIterator(c.Iterator(nil), &res[at]))
@@ -46,3 +47,20 @@ func TestAggrChunk(t *testing.T) {
 	}
 	testutil.Equals(t, input, res)
 }
+
+func TestAggrChunk_OptionalAggregatesOmitted(t *testing.T) {
+	var chks [6]chunkenc.Chunk
+	chks[AggrCount] = chunkenc.NewXORChunk()
+	a, err := chks[AggrCount].Appender()
+	testutil.Ok(t, err)
+	a.Append(100, 1)
+
+	ac := EncodeAggrChunk(chks)
+
+	// Unset trailing aggregates are not encoded at all but must still be reported as absent.
+	testutil.Equals(t, 1+1+len(chks[AggrCount].Bytes()), len(ac.Bytes()))
+	_, err = ac.Get(AggrCounter)
+	testutil.Equals(t, ErrAggrNotExist, err)
+	_, err = ac.Get(AggrSumSquares)
+	testutil.Equals(t, ErrAggrNotExist, err)
+}
@@ -8,6 +8,7 @@ import (
 	"time"
 
 	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
 	"github.com/oklog/ulid"
 	"github.com/pkg/errors"
 	"github.com/prometheus/prometheus/pkg/value"
@@ -29,12 +30,15 @@ const (
 )
 
 // Downsample downsamples the given block. It writes a new block into dir and returns its ID.
+// If sumSquares is set, raw data is additionally aggregated into a sum of squares, which allows
+// computing the standard deviation and variance of downsampled data.
 func Downsample(
 	logger log.Logger,
 	origMeta *metadata.Meta,
 	b tsdb.BlockReader,
 	dir string,
 	resolution int64,
+	sumSquares bool,
 ) (id ulid.ULID, err error) {
 	if origMeta.Thanos.Downsample.Resolution >= resolution {
 		return id, errors.New("target resolution not lower than existing one")
@@ -95,6 +99,7 @@ func Downsample(
 		chks       []chunks.Meta
 		lset       labels.Labels
 		reuseIt    chunkenc.Iterator
+		skipped    int
 	)
 	for postings.Next() {
 		lset = lset[:0]
@@ -117,6 +122,14 @@ func Downsample(
 			chks[i].Chunk = chk
 		}
 
+		// Series with chunks that cannot be downsampled, e.g. of encodings not known to the aggregation, are left out
+		// of the downsampled block instead of failing the whole block on every attempt.
+		if c, ok := unsupportedChunk(chks, origMeta.Thanos.Downsample.Resolution); ok {
+			level.Debug(logger).Log("msg", "skipping series with chunk that cannot be downsampled", "series", lset, "encoding", c.Chunk.Encoding(), "chunk", c.Ref)
+			skipped++
+			continue
+		}
+
 		// Raw and already downsampled data need different processing.
 		if origMeta.Thanos.Downsample.Resolution == 0 {
 			for _, c := range chks {
@@ -124,7 +137,7 @@ func Downsample(
 					return id, errors.Wrapf(err, "expand chunk %d, series %d", c.Ref, postings.At())
 				}
 			}
-			if err := streamedBlockWriter.WriteSeries(lset, downsampleRaw(all, resolution)); err != nil {
+			if err := streamedBlockWriter.WriteSeries(lset, downsampleRaw(all, resolution, sumSquares)); err != nil {
 				return id, errors.Wrapf(err, "downsample raw data, series: %d", postings.At())
 			}
 		} else {
@@ -151,11 +164,29 @@ func Downsample(
 	if postings.Err() != nil {
 		return id, errors.Wrap(postings.Err(), "iterate series set")
 	}
+	if skipped > 0 {
+		level.Warn(logger).Log("msg", "skipped series with chunks that cannot be downsampled", "block", origMeta.ULID, "series", skipped)
+	}
 
 	id = uid
 	return
 }
 
+// unsupportedChunk returns the first chunk that cannot be downsampled from a block of the given resolution.
+// Raw chunks must be XOR encoded, since aggregates are encoded as XOR chunks which can only hold float samples.
+// Downsampled blocks must only contain aggregate chunks.
+func unsupportedChunk(chks []chunks.Meta, resolution int64) (chunks.Meta, bool) {
+	for _, c := range chks {
+		if resolution == 0 && c.Chunk.Encoding() != chunkenc.EncXOR {
+			return c, true
+		}
+		if _, ok := c.Chunk.(*AggrChunk); resolution > 0 && !ok {
+			return c, true
+		}
+	}
+	return chunks.Meta{}, false
+}
+
 // currentWindow returns the end timestamp of the window that t falls into.
 func currentWindow(t, r int64) int64 {
 	// The next timestamp is the next number after s.t that's aligned with window.
@@ -193,20 +224,22 @@ func targetChunkCount(mint, maxt, inRes, outRes int64, count int) (x int) {
 
 // aggregator collects cumulative stats for a stream of values.
 type aggregator struct {
-	total   int     // total samples processed
-	count   int     // samples in current window
-	sum     float64 // value sum of current window
-	min     float64 // min of current window
-	max     float64 // max of current window
-	counter float64 // total counter state since beginning
-	resets  int     // number of counter resets since beginning
-	last    float64 // last added value
+	total      int     // total samples processed
+	count      int     // samples in current window
+	sum        float64 // value sum of current window
+	sumSquares float64 // sum of squared values of current window
+	min        float64 // min of current window
+	max        float64 // max of current window
+	counter    float64 // total counter state since beginning
+	resets     int     // number of counter resets since beginning
+	last       float64 // last added value
 }
 
 // reset the stats to start a new aggregation window.
 func (a *aggregator) reset() {
 	a.count = 0
 	a.sum = 0
+	a.sumSquares = 0
 	a.min = math.MaxFloat64
 	a.max = -math.MaxFloat64
 }
@@ -228,6 +261,7 @@ func (a *aggregator) add(v float64) {
 	a.last = v
 
 	a.sum += v
+	a.sumSquares += v * v
 	a.count++
 	a.total++
 
@@ -244,11 +278,11 @@ type aggrChunkBuilder struct {
 	mint, maxt int64
 	added      int
 
-	chunks [5]chunkenc.Chunk
-	apps   [5]chunkenc.Appender
+	chunks [6]chunkenc.Chunk
+	apps   [6]chunkenc.Appender
 }
 
-func newAggrChunkBuilder() *aggrChunkBuilder {
+func newAggrChunkBuilder(sumSquares bool) *aggrChunkBuilder {
 	b := &aggrChunkBuilder{
 		mint: math.MaxInt64,
 		maxt: math.MinInt64,
@@ -258,6 +292,9 @@ func newAggrChunkBuilder() *aggrChunkBuilder {
 	b.chunks[AggrMin] = chunkenc.NewXORChunk()
 	b.chunks[AggrMax] = chunkenc.NewXORChunk()
 	b.chunks[AggrCounter] = chunkenc.NewXORChunk()
+	if sumSquares {
+		b.chunks[AggrSumSquares] = chunkenc.NewXORChunk()
+	}
 
 	for i, c := range b.chunks {
 		if c != nil {
@@ -279,6 +316,9 @@ func (b *aggrChunkBuilder) add(t int64, aggr *aggregator) {
 	b.apps[AggrMax].Append(t, aggr.max)
 	b.apps[AggrCount].Append(t, float64(aggr.count))
 	b.apps[AggrCounter].Append(t, aggr.counter)
+	if b.apps[AggrSumSquares] != nil {
+		b.apps[AggrSumSquares].Append(t, aggr.sumSquares)
+	}
 
 	b.added++
 }
@@ -296,7 +336,7 @@ func (b *aggrChunkBuilder) encode() chunks.Meta {
 }
 
 // downsampleRaw create a series of aggregation chunks for the given sample data.
-func downsampleRaw(data []sample, resolution int64) []chunks.Meta {
+func downsampleRaw(data []sample, resolution int64, sumSquares bool) []chunks.Meta {
 	if len(data) == 0 {
 		return nil
 	}
@@ -321,7 +361,7 @@ func downsampleRaw(data []sample, resolution int64) []chunks.Meta {
 		for ; j < len(data) && data[j].t <= curW; j++ {
 		}
 
-		ab := newAggrChunkBuilder()
+		ab := newAggrChunkBuilder(sumSquares)
 		batch := data[:j]
 		data = data[j:]
 
@@ -480,6 +520,14 @@ func downsampleAggrBatch(chks []*AggrChunk, buf *[]sample, resolution int64) (ch
 	}); err != nil {
 		return chk, err
 	}
+	// A partial sum of squares would silently skew the variance, so only keep it if all chunks have it.
+	if hasAggr(chks, AggrSumSquares) {
+		if err := do(AggrSumSquares, func(a *aggregator) float64 {
+			return a.sum
+		}); err != nil {
+			return chk, err
+		}
+	}
 
 	// Handle counters by reading them properly.
 	acs := make([]chunkenc.Iterator, 0, len(chks))
@@ -521,6 +569,16 @@ func downsampleAggrBatch(chks []*AggrChunk, buf *[]sample, resolution int64) (ch
 	return ab.encode(), nil
 }
 
+// hasAggr returns true if all chunks contain the given aggregate.
+func hasAggr(chks []*AggrChunk, at AggrType) bool {
+	for _, c := range chks {
+		if _, err := c.Get(at); err != nil {
+			return false
+		}
+	}
+	return len(chks) > 0
+}
+
 type sample struct {
 	t int64
 	v float64
@@ -659,3 +717,68 @@ func (it *AverageChunkIterator) Err() error {
 	}
 	return it.err
 }
+
+// StddevChunkIterator emits an artificial series based on aggregate chunks with count, sum and sum of
+// squares aggregates. Each window is replaced by two samples, one at its preceding millisecond and one at
+// its timestamp, which have the same mean and population variance as the raw samples of the window.
+// Thus stddev_over_time and stdvar_over_time over windows of equal sample count match the raw result.
+type StddevChunkIterator struct {
+	cntIt chunkenc.Iterator
+	sumIt chunkenc.Iterator
+	sqIt  chunkenc.Iterator
+	t     int64
+	v     float64
+	// d is the deviation from the window mean, pending is set until the second sample of a window was emitted.
+	d       float64
+	pending bool
+	err     error
+}
+
+func NewStddevChunkIterator(cnt, sum, sumSquares chunkenc.Iterator) *StddevChunkIterator {
+	return &StddevChunkIterator{cntIt: cnt, sumIt: sum, sqIt: sumSquares}
+}
+
+func (it *StddevChunkIterator) Next() bool {
+	if it.pending {
+		it.t, it.v, it.pending = it.t+1, it.v+2*it.d, false
+		return true
+	}
+	cok, sok, qok := it.cntIt.Next(), it.sumIt.Next(), it.sqIt.Next()
+	if cok != sok || cok != qok {
+		it.err = errors.New("count, sum and sum of squares iterator not aligned")
+		return false
+	}
+	if !cok {
+		return false
+	}
+
+	cntT, cntV := it.cntIt.At()
+	sumT, sumV := it.sumIt.At()
+	sqT, sqV := it.sqIt.At()
+	if cntT != sumT || cntT != sqT {
+		it.err = errors.New("count, sum and sum of squares timestamps not aligned")
+		return false
+	}
+	mean := sumV / cntV
+	// Guard against a slightly negative variance caused by floating point cancellation.
+	d := math.Sqrt(math.Max(sqV/cntV-mean*mean, 0))
+	it.t, it.v, it.d, it.pending = cntT-1, mean-d, d, true
+	return true
+}
+
+func (it *StddevChunkIterator) At() (int64, float64) {
+	return it.t, it.v
+}
+
+func (it *StddevChunkIterator) Err() error {
+	if it.cntIt.Err() != nil {
+		return it.cntIt.Err()
+	}
+	if it.sumIt.Err() != nil {
+		return it.sumIt.Err()
+	}
+	if it.sqIt.Err() != nil {
+		return it.sqIt.Err()
+	}
+	return it.err
+}
@@ -60,7 +60,7 @@ func TestDownsampleRaw(t *testing.T) {
 			},
 		},
 	}
-	testDownsample(t, input, &metadata.Meta{BlockMeta: tsdb.BlockMeta{MinTime: 0, MaxTime: 250}}, 100)
+	testDownsample(t, input, &metadata.Meta{BlockMeta: tsdb.BlockMeta{MinTime: 0, MaxTime: 250}}, 100, false)
 }
 
 func TestDownsampleAggr(t *testing.T) {
@@ -87,13 +87,17 @@ func TestDownsampleAggr(t *testing.T) {
 					{599, 20}, {799, 50}, {999, 120}, {999, 50}, // chunk 2, no reset
 					{1099, 40}, {1199, 80}, {1299, 110}, // chunk 3, reset
 				},
+				AggrSumSquares: {
+					{199, 25}, {299, 1}, {399, 100}, {400, 9}, {499, 100}, {699, 0}, {999, 10000},
+				},
 			},
 			output: map[AggrType][]sample{
-				AggrCount:   {{499, 29}, {999, 100}},
-				AggrSum:     {{499, 29}, {999, 100}},
-				AggrMin:     {{499, -3}, {999, 0}},
-				AggrMax:     {{499, 10}, {999, 100}},
-				AggrCounter: {{499, 210}, {999, 320}, {1299, 430}, {1299, 110}},
+				AggrCount:      {{499, 29}, {999, 100}},
+				AggrSum:        {{499, 29}, {999, 100}},
+				AggrMin:        {{499, -3}, {999, 0}},
+				AggrMax:        {{499, 10}, {999, 100}},
+				AggrCounter:    {{499, 210}, {999, 320}, {1299, 430}, {1299, 110}},
+				AggrSumSquares: {{499, 235}, {999, 10000}},
 			},
 		},
 	}
@@ -101,11 +105,12 @@ func TestDownsampleAggr(t *testing.T) {
 	meta.Thanos.Downsample.Resolution = 10
 	meta.BlockMeta = tsdb.BlockMeta{MinTime: 99, MaxTime: 1300}
 
-	testDownsample(t, input, &meta, 500)
+	testDownsample(t, input, &meta, 500, false)
 }
 
 func encodeTestAggrSeries(v map[AggrType][]sample) chunks.Meta {
-	b := newAggrChunkBuilder()
+	_, sumSquares := v[AggrSumSquares]
+	b := newAggrChunkBuilder(sumSquares)
 
 	for at, d := range v {
 		for _, s := range d {
@@ -125,7 +130,7 @@ type downsampleTestSet struct {
 
 // testDownsample inserts the input into a block and invokes the downsampler with the given resolution.
 // The chunk ranges within the input block are aligned at 500 time units.
-func testDownsample(t *testing.T, data []*downsampleTestSet, meta *metadata.Meta, resolution int64) {
+func testDownsample(t *testing.T, data []*downsampleTestSet, meta *metadata.Meta, resolution int64, sumSquares bool) {
 	t.Helper()
 
 	dir, err := ioutil.TempDir("", "downsample-raw")
@@ -160,7 +165,7 @@ func testDownsample(t *testing.T, data []*downsampleTestSet, meta *metadata.Meta
 		mb.addSeries(ser)
 	}
 
-	id, err := Downsample(log.NewNopLogger(), meta, mb, dir, resolution)
+	id, err := Downsample(log.NewNopLogger(), meta, mb, dir, resolution, sumSquares)
 	testutil.Ok(t, err)
 
 	_, err = metadata.Read(filepath.Join(dir, id.String()))
@@ -197,7 +202,7 @@ func testDownsample(t *testing.T, data []*downsampleTestSet, meta *metadata.Meta
 			chk, err := chunkr.Chunk(c.Ref)
 			testutil.Ok(t, err)
 
-			for _, at := range []AggrType{AggrCount, AggrSum, AggrMin, AggrMax, AggrCounter} {
+			for _, at := range []AggrType{AggrCount, AggrSum, AggrMin, AggrMax, AggrCounter, AggrSumSquares} {
 				c, err := chk.(*AggrChunk).Get(at)
 				if err == ErrAggrNotExist {
 					continue
@@ -214,13 +219,207 @@ func testDownsample(t *testing.T, data []*downsampleTestSet, meta *metadata.Meta
 	testutil.Equals(t, len(exp), len(got))
 
 	for h, ser := range exp {
-		for _, at := range []AggrType{AggrCount, AggrSum, AggrMin, AggrMax, AggrCounter} {
+		for _, at := range []AggrType{AggrCount, AggrSum, AggrMin, AggrMax, AggrCounter, AggrSumSquares} {
 			t.Logf("series %d, type %s", h, at)
 			testutil.Equals(t, ser[at], got[h][at])
 		}
 	}
 }
 
+// unknownChunk is a chunk of an encoding that cannot be downsampled, e.g. a native histogram one.
+type unknownChunk struct {
+	chunkenc.Chunk
+}
+
+func (unknownChunk) Encoding() chunkenc.Encoding { return chunkenc.Encoding(0x10) }
+
+func TestDownsample_UnsupportedChunkEncoding(t *testing.T) {
+	defer leaktest.CheckTimeout(t, 10*time.Second)()
+
+	xor := chunkenc.NewXORChunk()
+	app, err := xor.Appender()
+	testutil.Ok(t, err)
+	app.Append(0, 1)
+
+	for _, tcase := range []struct {
+		resolution  int64
+		supported   chunkenc.Chunk
+		unsupported chunkenc.Chunk
+	}{
+		// Raw chunks must hold float samples.
+		{resolution: 0, supported: xor, unsupported: unknownChunk{Chunk: xor}},
+		// Downsampled blocks must only contain aggregate chunks.
+		{resolution: ResLevel1, supported: encodeTestAggrSeries(map[AggrType][]sample{
+			AggrCount: {{t: 0, v: 1}}, AggrSum: {{t: 0, v: 1}}, AggrMin: {{t: 0, v: 1}}, AggrMax: {{t: 0, v: 1}}, AggrCounter: {{t: 0, v: 1}},
+		}).Chunk, unsupported: xor},
+	} {
+		t.Run("", func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "downsample-unsupported")
+			testutil.Ok(t, err)
+			defer func() { testutil.Ok(t, os.RemoveAll(dir)) }()
+
+			mb := newMemBlock()
+			mb.addSeries(&series{
+				lset:   labels.FromStrings("__name__", "a"),
+				chunks: []chunks.Meta{{MinTime: 0, MaxTime: 0, Chunk: tcase.unsupported}},
+			})
+			mb.addSeries(&series{
+				lset:   labels.FromStrings("__name__", "b"),
+				chunks: []chunks.Meta{{MinTime: 0, MaxTime: 0, Chunk: tcase.supported}},
+			})
+
+			meta := &metadata.Meta{}
+			meta.Thanos.Downsample.Resolution = tcase.resolution
+
+			// The series that cannot be downsampled is left out, the others are downsampled.
+			id, err := Downsample(log.NewNopLogger(), meta, mb, dir, ResLevel2, false)
+			testutil.Ok(t, err)
+
+			indexr, err := index.NewFileReader(filepath.Join(dir, id.String(), block.IndexFilename))
+			testutil.Ok(t, err)
+			defer func() { testutil.Ok(t, indexr.Close()) }()
+
+			pall, err := indexr.Postings(index.AllPostingsKey())
+			testutil.Ok(t, err)
+
+			var names []string
+			for pall.Next() {
+				var lset labels.Labels
+				var chks []chunks.Meta
+				testutil.Ok(t, indexr.Series(pall.At(), &lset, &chks))
+				names = append(names, lset.Get("__name__"))
+			}
+			testutil.Ok(t, pall.Err())
+			testutil.Equals(t, []string{"b"}, names)
+		})
+	}
+}
+
+func TestDownsampleRaw_SumSquares(t *testing.T) {
+	defer leaktest.CheckTimeout(t, 10*time.Second)()
+
+	input := []*downsampleTestSet{
+		{
+			lset: labels.FromStrings("__name__", "a"),
+			inRaw: []sample{
+				{20, 1}, {40, 2}, {60, 3}, {80, 1}, {120, 5}, {180, 10}, {250, 1},
+			},
+			output: map[AggrType][]sample{
+				AggrCount:      {{99, 4}, {199, 2}, {250, 1}},
+				AggrSum:        {{99, 7}, {199, 15}, {250, 1}},
+				AggrMin:        {{99, 1}, {199, 5}, {250, 1}},
+				AggrMax:        {{99, 3}, {199, 10}, {250, 1}},
+				AggrCounter:    {{99, 4}, {199, 13}, {250, 14}, {250, 1}},
+				AggrSumSquares: {{99, 15}, {199, 125}, {250, 1}},
+			},
+		},
+	}
+	testDownsample(t, input, &metadata.Meta{BlockMeta: tsdb.BlockMeta{MinTime: 0, MaxTime: 250}}, 100, true)
+}
+
+// stddevOverTime computes the standard deviation the same way PromQL's stddev_over_time does.
+func stddevOverTime(data []sample, mint, maxt int64) float64 {
+	var count, mean, aux float64
+	for _, s := range data {
+		if s.t < mint || s.t > maxt {
+			continue
+		}
+		count++
+		delta := s.v - mean
+		mean += delta / count
+		aux += delta * (s.v - mean)
+	}
+	return math.Sqrt(aux / count)
+}
+
+func TestStddevChunkIterator_RawVsDownsampled(t *testing.T) {
+	defer leaktest.CheckTimeout(t, 10*time.Second)()
+
+	// Scrape every 15s for two days with a value that varies both within and across windows.
+	var raw []sample
+	for ts := int64(0); ts < 2*24*60*60*1000; ts += 15 * 1000 {
+		raw = append(raw, sample{t: ts, v: 100 + 50*math.Sin(float64(ts)/(7*60*1000)) + float64(ts%7)})
+	}
+
+	var res5m []*AggrChunk
+	for _, c := range downsampleRaw(raw, ResLevel1, true) {
+		res5m = append(res5m, c.Chunk.(*AggrChunk))
+	}
+	var buf []sample
+	chks1h, err := downsampleAggr(res5m, &buf, raw[0].t, raw[len(raw)-1].t, ResLevel1, ResLevel2)
+	testutil.Ok(t, err)
+
+	var res1h []*AggrChunk
+	for _, c := range chks1h {
+		res1h = append(res1h, c.Chunk.(*AggrChunk))
+	}
+
+	for _, tcase := range []struct {
+		mint, maxt int64
+	}{
+		{mint: 0, maxt: ResLevel2 - 1},
+		{mint: 5 * ResLevel2, maxt: 11*ResLevel2 - 1},
+		{mint: 0, maxt: raw[len(raw)-1].t},
+	} {
+		t.Run("", func(t *testing.T) {
+			exp := stddevOverTime(raw, tcase.mint, tcase.maxt)
+
+			for _, chks := range [][]*AggrChunk{res5m, res1h} {
+				var its []chunkenc.Iterator
+				for _, c := range chks {
+					it, err := newStddevIterator(c)
+					testutil.Ok(t, err)
+					its = append(its, it)
+				}
+				var emitted []sample
+				for _, it := range its {
+					for it.Next() {
+						t, v := it.At()
+						emitted = append(emitted, sample{t, v})
+					}
+					testutil.Ok(t, it.Err())
+				}
+				got := stddevOverTime(emitted, tcase.mint, tcase.maxt)
+				testutil.Assert(t, math.Abs(got-exp) < 1e-6*exp, "expected stddev %v, got %v", exp, got)
+			}
+		})
+	}
+
+	// Blocks downsampled without the sum of squares cannot be used.
+	plain := downsampleRaw(raw, ResLevel1, false)
+	_, err = newStddevIterator(plain[0].Chunk.(*AggrChunk))
+	testutil.NotOk(t, err)
+}
+
+func newStddevIterator(c *AggrChunk) (chunkenc.Iterator, error) {
+	var its [3]chunkenc.Iterator
+	for i, at := range []AggrType{AggrCount, AggrSum, AggrSumSquares} {
+		x, err := c.Get(at)
+		if err != nil {
+			return nil, err
+		}
+		its[i] = x.Iterator(nil)
+	}
+	return NewStddevChunkIterator(its[0], its[1], its[2]), nil
+}
+
+func TestStddevChunkIterator(t *testing.T) {
+	cnt := []sample{{100, 1}, {200, 4}}
+	sum := []sample{{100, 3}, {200, 8}}
+	sq := []sample{{100, 9}, {200, 32}}
+	exp := []sample{{99, 3}, {100, 3}, {199, 0}, {200, 4}}
+
+	x := NewStddevChunkIterator(newSampleIterator(cnt), newSampleIterator(sum), newSampleIterator(sq))
+
+	var res []sample
+	for x.Next() {
+		t, v := x.At()
+		res = append(res, sample{t, v})
+	}
+	testutil.Ok(t, x.Err())
+	testutil.Equals(t, exp, res)
+}
+
 func TestAverageChunkIterator(t *testing.T) {
 	sum := []sample{{100, 30}, {200, 40}, {300, 5}, {400, -10}}
 	cnt := []sample{{100, 1}, {200, 5}, {300, 2}, {400, 10}}
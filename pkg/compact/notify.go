@@ -0,0 +1,110 @@
+package compact
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/thanos-io/thanos/pkg/runutil"
+)
+
+// Reasons for deleting blocks given in deletion events.
+const (
+	DeletionReasonCompacted = "compacted"
+	DeletionReasonEmpty     = "empty"
+	DeletionReasonGarbage   = "garbage-collected"
+	DeletionReasonMalformed = "malformed"
+	DeletionReasonRepaired  = "repaired"
+	DeletionReasonRetention = "retention"
+)
+
+const (
+	deletionWebhookTimeout   = 10 * time.Second
+	deletionWebhookUserAgent = "Thanos-Compactor"
+)
+
+// DeletionEvent describes a block deleted from the bucket. Labels are the external labels of the block and are
+// empty if its meta file could not be read, e.g. for malformed blocks.
+type DeletionEvent struct {
+	ID     ulid.ULID         `json:"id"`
+	Reason string            `json:"reason"`
+	Labels map[string]string `json:"labels"`
+}
+
+// DeletionNotifier POSTs a deletion event as JSON to a webhook for every block the compactor deletes, e.g. for
+// auditing. Failing notifications are logged and counted, but do not fail the deletion.
+// A nil DeletionNotifier does not notify anything.
+type DeletionNotifier struct {
+	logger   log.Logger
+	url      string
+	client   *http.Client
+	failures prometheus.Counter
+}
+
+// NewDeletionNotifier returns a DeletionNotifier calling the webhook at the given URL, or nil if it is empty.
+func NewDeletionNotifier(logger log.Logger, reg prometheus.Registerer, url string) *DeletionNotifier {
+	if url == "" {
+		return nil
+	}
+	if logger == nil {
+		logger = log.NewNopLogger()
+	}
+	n := &DeletionNotifier{
+		logger: logger,
+		url:    url,
+		client: &http.Client{Timeout: deletionWebhookTimeout},
+		failures: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "thanos_compact_deletion_webhook_failures_total",
+			Help: "Total number of failed calls of the block deletion webhook.",
+		}),
+	}
+	if reg != nil {
+		reg.MustRegister(n.failures)
+	}
+	return n
+}
+
+// Notify calls the webhook with the deletion event of the given block.
+func (n *DeletionNotifier) Notify(ctx context.Context, id ulid.ULID, reason string, lset map[string]string) {
+	if n == nil {
+		return
+	}
+	if lset == nil {
+		lset = map[string]string{}
+	}
+	if err := n.post(ctx, DeletionEvent{ID: id, Reason: reason, Labels: lset}); err != nil {
+		n.failures.Inc()
+		level.Warn(n.logger).Log("msg", "failed to call block deletion webhook", "block", id, "reason", reason, "err", err)
+	}
+}
+
+func (n *DeletionNotifier) post(ctx context.Context, e DeletionEvent) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return errors.Wrap(err, "marshal deletion event")
+	}
+	req, err := http.NewRequest(http.MethodPost, n.url, bytes.NewReader(b))
+	if err != nil {
+		return errors.Wrap(err, "create request")
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", deletionWebhookUserAgent)
+
+	resp, err := n.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return errors.Wrap(err, "post deletion event")
+	}
+	defer runutil.CloseWithLogOnErr(n.logger, resp.Body, "deletion webhook response body")
+
+	if resp.StatusCode/100 != 2 {
+		return errors.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
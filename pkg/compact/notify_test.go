@@ -0,0 +1,99 @@
+package compact_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/oklog/ulid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/prometheus/tsdb"
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/compact"
+	"github.com/thanos-io/thanos/pkg/objstore/inmem"
+	"github.com/thanos-io/thanos/pkg/testutil"
+)
+
+func TestDeletionNotifier_Retention(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+
+	var (
+		mtx    sync.Mutex
+		events []compact.DeletionEvent
+		status = http.StatusOK
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		testutil.Equals(t, http.MethodPost, r.Method)
+		testutil.Equals(t, "application/json", r.Header.Get("Content-Type"))
+
+		b, err := ioutil.ReadAll(r.Body)
+		testutil.Ok(t, err)
+		var e compact.DeletionEvent
+		testutil.Ok(t, json.Unmarshal(b, &e))
+
+		mtx.Lock()
+		defer mtx.Unlock()
+		events = append(events, e)
+		w.WriteHeader(status)
+	}))
+	defer srv.Close()
+
+	bkt := inmem.NewBucket()
+	upload := func(id string, maxTime time.Time, lset map[string]string) {
+		meta := metadata.Meta{
+			BlockMeta: tsdb.BlockMeta{ULID: ulid.MustParse(id), MinTime: maxTime.Add(-2*time.Hour).Unix() * 1000, MaxTime: maxTime.Unix() * 1000, Version: 1},
+			Thanos:    metadata.Thanos{Labels: lset},
+		}
+		b, err := json.Marshal(meta)
+		testutil.Ok(t, err)
+		testutil.Ok(t, bkt.Upload(ctx, id+"/meta.json", bytes.NewReader(b)))
+		testutil.Ok(t, bkt.Upload(ctx, id+"/chunks/000001", strings.NewReader("@test-data@")))
+	}
+	upload("01CPHBEX20729MJQZXE3W0BW40", now.Add(-48*time.Hour), map[string]string{"cluster": "a", "replica": "0"})
+	upload("01CPHBEX20729MJQZXE3W0BW41", now.Add(-47*time.Hour), nil)
+	upload("01CPHBEX20729MJQZXE3W0BW42", now.Add(-time.Hour), map[string]string{"cluster": "a", "replica": "0"})
+
+	reg := prometheus.NewRegistry()
+	n := compact.NewDeletionNotifier(log.NewNopLogger(), reg, srv.URL)
+	retentionByResolution := map[compact.ResolutionLevel]time.Duration{compact.ResolutionLevelRaw: 24 * time.Hour}
+	testutil.Ok(t, compact.ApplyRetentionPolicyByResolution(ctx, log.NewNopLogger(), bkt, retentionByResolution, false, n))
+
+	testutil.Equals(t, []compact.DeletionEvent{
+		{ID: ulid.MustParse("01CPHBEX20729MJQZXE3W0BW40"), Reason: compact.DeletionReasonRetention, Labels: map[string]string{"cluster": "a", "replica": "0"}},
+		{ID: ulid.MustParse("01CPHBEX20729MJQZXE3W0BW41"), Reason: compact.DeletionReasonRetention, Labels: map[string]string{}},
+	}, events)
+
+	// Failing calls do not fail the deletion.
+	events = nil
+	status = http.StatusInternalServerError
+	upload("01CPHBEX20729MJQZXE3W0BW43", now.Add(-48*time.Hour), map[string]string{"cluster": "b"})
+	testutil.Ok(t, compact.ApplyRetentionPolicyByResolution(ctx, log.NewNopLogger(), bkt, retentionByResolution, false, n))
+	testutil.Equals(t, 1, len(events))
+
+	ok, err := bkt.Exists(ctx, "01CPHBEX20729MJQZXE3W0BW43/meta.json")
+	testutil.Ok(t, err)
+	testutil.Assert(t, !ok, "expected block to be deleted")
+
+	mfs, err := reg.Gather()
+	testutil.Ok(t, err)
+	testutil.Equals(t, 1, len(mfs))
+	testutil.Equals(t, "thanos_compact_deletion_webhook_failures_total", mfs[0].GetName())
+	testutil.Equals(t, 1.0, mfs[0].GetMetric()[0].GetCounter().GetValue())
+}
+
+func TestNewDeletionNotifier_Disabled(t *testing.T) {
+	n := compact.NewDeletionNotifier(nil, nil, "")
+	testutil.Assert(t, n == nil, "expected no notifier without URL")
+
+	// Notifying nil notifiers is a no-op.
+	n.Notify(context.Background(), ulid.MustParse("01CPHBEX20729MJQZXE3W0BW40"), compact.DeletionReasonCompacted, nil)
+}
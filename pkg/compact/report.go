@@ -0,0 +1,124 @@
+package compact
+
+import (
+	"context"
+	"sort"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/thanos-io/thanos/pkg/block"
+	"github.com/thanos-io/thanos/pkg/objstore"
+)
+
+// TenantStats summarizes the blocks of a tenant, i.e. of a set of external labels, across all resolutions.
+// The bucket does not expose sizes of objects, so sizes are given by the stats of the block metas.
+type TenantStats struct {
+	Labels     labels.Labels
+	Blocks     int
+	NumSeries  uint64
+	NumSamples uint64
+	NumChunks  uint64
+}
+
+// BucketTenantStats returns the stats of all tenants with blocks in the bucket, sorted by their labels.
+// Blocks without meta file, e.g. because they are still uploaded, are skipped.
+func BucketTenantStats(ctx context.Context, logger log.Logger, bkt objstore.Bucket) ([]TenantStats, error) {
+	tenants := map[string]*TenantStats{}
+	if err := bkt.Iter(ctx, "", func(name string) error {
+		id, ok := block.IsBlockDir(name)
+		if !ok {
+			return nil
+		}
+		m, err := block.DownloadMeta(ctx, logger, bkt, id)
+		if bkt.IsObjNotFoundErr(errors.Cause(err)) {
+			return nil
+		}
+		if err != nil {
+			return errors.Wrap(err, "download metadata")
+		}
+
+		lset := labels.FromMap(m.Thanos.Labels)
+		s, ok := tenants[lset.String()]
+		if !ok {
+			s = &TenantStats{Labels: lset}
+			tenants[lset.String()] = s
+		}
+		s.Blocks++
+		s.NumSeries += m.Stats.NumSeries
+		s.NumSamples += m.Stats.NumSamples
+		s.NumChunks += m.Stats.NumChunks
+		return nil
+	}); err != nil {
+		return nil, errors.Wrap(err, "tenant stats")
+	}
+
+	res := make([]TenantStats, 0, len(tenants))
+	for _, s := range tenants {
+		res = append(res, *s)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return labels.Compare(res[i].Labels, res[j].Labels) < 0
+	})
+	return res, nil
+}
+
+// LogTenantStats logs a line with the given stats of each tenant.
+func LogTenantStats(logger log.Logger, stats []TenantStats) {
+	for _, s := range stats {
+		level.Info(logger).Log("msg", "tenant block stats", "tenant", s.Labels.String(), "blocks", s.Blocks,
+			"series", s.NumSeries, "samples", s.NumSamples, "chunks", s.NumChunks)
+	}
+}
+
+// TenantStatsMetrics exposes stats of tenants as gauges with a tenant label holding their external labels.
+type TenantStatsMetrics struct {
+	blocks  *prometheus.GaugeVec
+	series  *prometheus.GaugeVec
+	samples *prometheus.GaugeVec
+	chunks  *prometheus.GaugeVec
+}
+
+// NewTenantStatsMetrics returns TenantStatsMetrics registered with the given registerer.
+func NewTenantStatsMetrics(reg prometheus.Registerer) *TenantStatsMetrics {
+	m := &TenantStatsMetrics{
+		blocks: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "thanos_compact_tenant_blocks",
+			Help: "Number of blocks in the bucket per set of external labels, as of the end of the last compaction run.",
+		}, []string{"tenant"}),
+		series: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "thanos_compact_tenant_series",
+			Help: "Sum of the number of series of the blocks in the bucket per set of external labels, as of the end of the last compaction run.",
+		}, []string{"tenant"}),
+		samples: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "thanos_compact_tenant_samples",
+			Help: "Number of samples in the bucket per set of external labels, as of the end of the last compaction run.",
+		}, []string{"tenant"}),
+		chunks: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "thanos_compact_tenant_chunks",
+			Help: "Number of chunks in the bucket per set of external labels, as of the end of the last compaction run.",
+		}, []string{"tenant"}),
+	}
+	if reg != nil {
+		reg.MustRegister(m.blocks, m.series, m.samples, m.chunks)
+	}
+	return m
+}
+
+// Set replaces the exposed stats with the given ones, so tenants without any blocks left disappear.
+func (m *TenantStatsMetrics) Set(stats []TenantStats) {
+	m.blocks.Reset()
+	m.series.Reset()
+	m.samples.Reset()
+	m.chunks.Reset()
+
+	for _, s := range stats {
+		tenant := s.Labels.String()
+		m.blocks.WithLabelValues(tenant).Set(float64(s.Blocks))
+		m.series.WithLabelValues(tenant).Set(float64(s.NumSeries))
+		m.samples.WithLabelValues(tenant).Set(float64(s.NumSamples))
+		m.chunks.WithLabelValues(tenant).Set(float64(s.NumChunks))
+	}
+}
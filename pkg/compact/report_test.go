@@ -0,0 +1,78 @@
+package compact_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/oklog/ulid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/tsdb"
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/compact"
+	"github.com/thanos-io/thanos/pkg/objstore/inmem"
+	"github.com/thanos-io/thanos/pkg/testutil"
+)
+
+func TestBucketTenantStats(t *testing.T) {
+	ctx := context.Background()
+	bkt := inmem.NewBucket()
+
+	upload := func(id uint64, lset map[string]string, res int64, stats tsdb.BlockStats) {
+		meta := metadata.Meta{
+			BlockMeta: tsdb.BlockMeta{ULID: ulid.MustNew(id, nil), Version: 1, Stats: stats},
+			Thanos:    metadata.Thanos{Labels: lset, Downsample: metadata.ThanosDownsample{Resolution: res}},
+		}
+		b, err := json.Marshal(meta)
+		testutil.Ok(t, err)
+		testutil.Ok(t, bkt.Upload(ctx, meta.ULID.String()+"/meta.json", bytes.NewReader(b)))
+		testutil.Ok(t, bkt.Upload(ctx, meta.ULID.String()+"/chunks/000001", strings.NewReader("@test-data@")))
+	}
+	upload(1, map[string]string{"tenant": "a"}, 0, tsdb.BlockStats{NumSeries: 10, NumSamples: 1000, NumChunks: 20})
+	upload(2, map[string]string{"tenant": "a"}, 0, tsdb.BlockStats{NumSeries: 12, NumSamples: 1200, NumChunks: 24})
+	upload(3, map[string]string{"tenant": "a"}, 300000, tsdb.BlockStats{NumSeries: 10, NumSamples: 100, NumChunks: 10})
+	upload(4, map[string]string{"tenant": "b"}, 0, tsdb.BlockStats{NumSeries: 5, NumSamples: 500, NumChunks: 5})
+	upload(5, map[string]string{"tenant": "a", "replica": "1"}, 0, tsdb.BlockStats{NumSeries: 1, NumSamples: 10, NumChunks: 1})
+	upload(6, nil, 0, tsdb.BlockStats{NumSeries: 2, NumSamples: 20, NumChunks: 2})
+
+	// A block still being uploaded has no meta yet.
+	testutil.Ok(t, bkt.Upload(ctx, ulid.MustNew(7, nil).String()+"/chunks/000001", strings.NewReader("@test-data@")))
+
+	stats, err := compact.BucketTenantStats(ctx, log.NewNopLogger(), bkt)
+	testutil.Ok(t, err)
+	testutil.Equals(t, []compact.TenantStats{
+		{Labels: labels.Labels{}, Blocks: 1, NumSeries: 2, NumSamples: 20, NumChunks: 2},
+		{Labels: labels.FromStrings("replica", "1", "tenant", "a"), Blocks: 1, NumSeries: 1, NumSamples: 10, NumChunks: 1},
+		{Labels: labels.FromStrings("tenant", "a"), Blocks: 3, NumSeries: 32, NumSamples: 2300, NumChunks: 54},
+		{Labels: labels.FromStrings("tenant", "b"), Blocks: 1, NumSeries: 5, NumSamples: 500, NumChunks: 5},
+	}, stats)
+
+	reg := prometheus.NewRegistry()
+	m := compact.NewTenantStatsMetrics(reg)
+	blocks := func() map[string]float64 {
+		mfs, err := reg.Gather()
+		testutil.Ok(t, err)
+
+		res := map[string]float64{}
+		for _, mf := range mfs {
+			if mf.GetName() != "thanos_compact_tenant_blocks" {
+				continue
+			}
+			for _, m := range mf.GetMetric() {
+				res[m.GetLabel()[0].GetValue()] = m.GetGauge().GetValue()
+			}
+		}
+		return res
+	}
+
+	m.Set(stats)
+	testutil.Equals(t, map[string]float64{`{}`: 1, `{replica="1", tenant="a"}`: 1, `{tenant="a"}`: 3, `{tenant="b"}`: 1}, blocks())
+
+	// Tenants without blocks left are not exposed anymore.
+	m.Set(stats[3:])
+	testutil.Equals(t, map[string]float64{`{tenant="b"}`: 1}, blocks())
+}
@@ -2,19 +2,27 @@ package compact
 
 import (
 	"context"
+	"sort"
 	"time"
 
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
 	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/pkg/labels"
 	"github.com/thanos-io/thanos/pkg/block"
+	"github.com/thanos-io/thanos/pkg/block/metadata"
 	"github.com/thanos-io/thanos/pkg/objstore"
 )
 
 // ApplyRetentionPolicyByResolution removes blocks depending on the specified retentionByResolution based on blocks MaxTime.
 // A value of 0 disables the retention for its resolution.
-func ApplyRetentionPolicyByResolution(ctx context.Context, logger log.Logger, bkt objstore.Bucket, retentionByResolution map[ResolutionLevel]time.Duration) error {
+// If verifyDownsampled is set, raw blocks are only removed if downsampled blocks with the same labels, which are kept,
+// cover their whole time range. This guards against losing data if downsampling failed or was disabled.
+// Deleted blocks are reported to the deletionNotifier.
+func ApplyRetentionPolicyByResolution(ctx context.Context, logger log.Logger, bkt objstore.Bucket, retentionByResolution map[ResolutionLevel]time.Duration, verifyDownsampled bool, deletionNotifier *DeletionNotifier) error {
 	level.Info(logger).Log("msg", "start optional retention")
+
+	var metas []*metadata.Meta
 	if err := bkt.Iter(ctx, "", func(name string) error {
 		id, ok := block.IsBlockDir(name)
 		if !ok {
@@ -24,25 +32,73 @@ func ApplyRetentionPolicyByResolution(ctx context.Context, logger log.Logger, bk
 		if err != nil {
 			return errors.Wrap(err, "download metadata")
 		}
+		metas = append(metas, &m)
+		return nil
+	}); err != nil {
+		return errors.Wrap(err, "retention")
+	}
 
+	expired := func(m *metadata.Meta) bool {
 		retentionDuration := retentionByResolution[ResolutionLevel(m.Thanos.Downsample.Resolution)]
 		if retentionDuration.Seconds() == 0 {
-			return nil
+			return false
 		}
-
 		maxTime := time.Unix(m.MaxTime/1000, 0)
-		if time.Now().After(maxTime.Add(retentionDuration)) {
-			level.Info(logger).Log("msg", "applying retention: deleting block", "id", id, "maxTime", maxTime.String())
-			if err := block.Delete(ctx, logger, bkt, id); err != nil {
-				return errors.Wrap(err, "delete block")
+		return time.Now().After(maxTime.Add(retentionDuration))
+	}
+
+	// Time ranges of the downsampled blocks surviving retention by their labels.
+	downsampled := map[string][]*metadata.Meta{}
+	if verifyDownsampled {
+		for _, m := range metas {
+			if ResolutionLevel(m.Thanos.Downsample.Resolution) != ResolutionLevelRaw && !expired(m) {
+				key := labels.FromMap(m.Thanos.Labels).String()
+				downsampled[key] = append(downsampled[key], m)
 			}
 		}
+	}
 
-		return nil
-	}); err != nil {
-		return errors.Wrap(err, "retention")
+	for _, m := range metas {
+		if !expired(m) {
+			continue
+		}
+		maxTime := time.Unix(m.MaxTime/1000, 0)
+
+		if verifyDownsampled && ResolutionLevel(m.Thanos.Downsample.Resolution) == ResolutionLevelRaw &&
+			!coversRange(downsampled[labels.FromMap(m.Thanos.Labels).String()], m.MinTime, m.MaxTime) {
+			level.Warn(logger).Log("msg", "applying retention: keeping raw block not covered by downsampled blocks", "id", m.ULID, "maxTime", maxTime.String())
+			continue
+		}
+
+		level.Info(logger).Log("msg", "applying retention: deleting block", "id", m.ULID, "maxTime", maxTime.String())
+		if err := block.Delete(ctx, logger, bkt, m.ULID); err != nil {
+			return errors.Wrap(errors.Wrap(err, "delete block"), "retention")
+		}
+		deletionNotifier.Notify(ctx, m.ULID, DeletionReasonRetention, m.Thanos.Labels)
 	}
 
 	level.Info(logger).Log("msg", "optional retention apply done")
 	return nil
 }
+
+// coversRange returns true if the union of the time ranges of the given blocks contains [mint, maxt).
+func coversRange(metas []*metadata.Meta, mint, maxt int64) bool {
+	sorted := make([]*metadata.Meta, len(metas))
+	copy(sorted, metas)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].MinTime < sorted[j].MinTime
+	})
+
+	for _, m := range sorted {
+		if mint >= maxt {
+			break
+		}
+		if m.MinTime > mint {
+			return false
+		}
+		if m.MaxTime > mint {
+			mint = m.MaxTime
+		}
+	}
+	return mint >= maxt
+}
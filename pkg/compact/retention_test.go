@@ -236,7 +236,7 @@ func TestApplyRetentionPolicyByResolution(t *testing.T) {
 			for _, b := range tt.blocks {
 				uploadMockBlock(t, bkt, b.id, b.minTime, b.maxTime, int64(b.resolution))
 			}
-			if err := compact.ApplyRetentionPolicyByResolution(ctx, logger, bkt, tt.retentionByResolution); (err != nil) != tt.wantErr {
+			if err := compact.ApplyRetentionPolicyByResolution(ctx, logger, bkt, tt.retentionByResolution, false, nil); (err != nil) != tt.wantErr {
 				t.Errorf("ApplyRetentionPolicyByResolution() error = %v, wantErr %v", err, tt.wantErr)
 			}
 
@@ -251,6 +251,51 @@ func TestApplyRetentionPolicyByResolution(t *testing.T) {
 	}
 }
 
+func TestApplyRetentionPolicyByResolution_VerifyDownsampled(t *testing.T) {
+	logger := log.NewNopLogger()
+	ctx := context.TODO()
+
+	retentionByResolution := map[compact.ResolutionLevel]time.Duration{
+		compact.ResolutionLevelRaw: 24 * time.Hour,
+		compact.ResolutionLevel5m:  7 * 24 * time.Hour,
+	}
+	now := time.Now()
+
+	bkt := inmem.NewBucket()
+	// Covered by a single downsampled block.
+	uploadMockBlock(t, bkt, "01CPHBEX20729MJQZXE3W0BW40", now.Add(-4*24*time.Hour), now.Add(-3*24*time.Hour), int64(compact.ResolutionLevelRaw))
+	uploadMockBlock(t, bkt, "01CPHBEX20729MJQZXE3W0BW41", now.Add(-4*24*time.Hour), now.Add(-3*24*time.Hour), int64(compact.ResolutionLevel5m))
+	// Covered by two adjacent downsampled blocks.
+	uploadMockBlock(t, bkt, "01CPHBEX20729MJQZXE3W0BW42", now.Add(-3*24*time.Hour), now.Add(-2*24*time.Hour), int64(compact.ResolutionLevelRaw))
+	uploadMockBlock(t, bkt, "01CPHBEX20729MJQZXE3W0BW43", now.Add(-3*24*time.Hour), now.Add(-60*time.Hour), int64(compact.ResolutionLevel5m))
+	uploadMockBlock(t, bkt, "01CPHBEX20729MJQZXE3W0BW44", now.Add(-60*time.Hour), now.Add(-2*24*time.Hour), int64(compact.ResolutionLevel1h))
+	// Only partially covered.
+	uploadMockBlock(t, bkt, "01CPHBEX20729MJQZXE3W0BW45", now.Add(-2*24*time.Hour), now.Add(-36*time.Hour), int64(compact.ResolutionLevelRaw))
+	uploadMockBlock(t, bkt, "01CPHBEX20729MJQZXE3W0BW46", now.Add(-2*24*time.Hour), now.Add(-40*time.Hour), int64(compact.ResolutionLevel5m))
+	// Not covered at all.
+	uploadMockBlock(t, bkt, "01CPHBEX20729MJQZXE3W0BW47", now.Add(-36*time.Hour), now.Add(-30*time.Hour), int64(compact.ResolutionLevelRaw))
+	// Covered only by a downsampled block deleted by retention itself.
+	uploadMockBlock(t, bkt, "01CPHBEX20729MJQZXE3W0BW48", now.Add(-10*24*time.Hour), now.Add(-9*24*time.Hour), int64(compact.ResolutionLevelRaw))
+	uploadMockBlock(t, bkt, "01CPHBEX20729MJQZXE3W0BW49", now.Add(-10*24*time.Hour), now.Add(-9*24*time.Hour), int64(compact.ResolutionLevel5m))
+
+	testutil.Ok(t, compact.ApplyRetentionPolicyByResolution(ctx, logger, bkt, retentionByResolution, true, nil))
+
+	got := []string{}
+	testutil.Ok(t, bkt.Iter(ctx, "", func(name string) error {
+		got = append(got, name)
+		return nil
+	}))
+	testutil.Equals(t, []string{
+		"01CPHBEX20729MJQZXE3W0BW41/",
+		"01CPHBEX20729MJQZXE3W0BW43/",
+		"01CPHBEX20729MJQZXE3W0BW44/",
+		"01CPHBEX20729MJQZXE3W0BW45/",
+		"01CPHBEX20729MJQZXE3W0BW46/",
+		"01CPHBEX20729MJQZXE3W0BW47/",
+		"01CPHBEX20729MJQZXE3W0BW48/",
+	}, got)
+}
+
 func uploadMockBlock(t *testing.T, bkt objstore.Bucket, id string, minTime, maxTime time.Time, resolutionLevel int64) {
 	t.Helper()
 	meta1 := metadata.Meta{
@@ -0,0 +1,170 @@
+package objstore
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/prometheus/pkg/gate"
+)
+
+// BucketWithConcurrencyLimit returns a bucket that runs at most maxConcurrent operations against the given
+// bucket at once. Further operations wait for their turn. Reads hold their turn until the returned reader
+// is closed. Iter only holds it while listing, but not while calling back, so callbacks may use the bucket as well.
+// The bucket is returned as is if maxConcurrent is 0.
+func BucketWithConcurrencyLimit(b Bucket, maxConcurrent int, r prometheus.Registerer) Bucket {
+	if maxConcurrent <= 0 {
+		return b
+	}
+
+	bkt := &limitedBucket{
+		bkt:  b,
+		gate: gate.New(maxConcurrent),
+
+		inflight: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name:        "thanos_objstore_bucket_operations_in_flight",
+			Help:        "Number of operations against a bucket that are currently in flight.",
+			ConstLabels: prometheus.Labels{"bucket": b.Name()},
+		}),
+		waitDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:        "thanos_objstore_bucket_operation_wait_duration_seconds",
+			Help:        "Duration operations waited for their turn because of the bucket's concurrency limit.",
+			ConstLabels: prometheus.Labels{"bucket": b.Name()},
+			Buckets:     []float64{0.001, 0.005, 0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30},
+		}, []string{"operation"}),
+	}
+	if r != nil {
+		r.MustRegister(bkt.inflight, bkt.waitDuration)
+	}
+	return bkt
+}
+
+type limitedBucket struct {
+	bkt  Bucket
+	gate *gate.Gate
+
+	inflight     prometheus.Gauge
+	waitDuration *prometheus.HistogramVec
+}
+
+func (b *limitedBucket) start(ctx context.Context, op string) error {
+	begin := time.Now()
+	if err := b.gate.Start(ctx); err != nil {
+		return err
+	}
+	b.waitDuration.WithLabelValues(op).Observe(time.Since(begin).Seconds())
+	b.inflight.Inc()
+	return nil
+}
+
+func (b *limitedBucket) done() {
+	b.inflight.Dec()
+	b.gate.Done()
+}
+
+func (b *limitedBucket) Iter(ctx context.Context, dir string, f func(name string) error) error {
+	const op = "iter"
+	if err := b.start(ctx, op); err != nil {
+		return err
+	}
+	started := true
+	defer func() {
+		if started {
+			b.done()
+		}
+	}()
+
+	return b.bkt.Iter(ctx, dir, func(name string) error {
+		b.done()
+		started = false
+
+		ferr := f(name)
+		if err := b.start(ctx, op); err != nil {
+			if ferr != nil {
+				return ferr
+			}
+			return err
+		}
+		started = true
+		return ferr
+	})
+}
+
+func (b *limitedBucket) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	if err := b.start(ctx, "get"); err != nil {
+		return nil, err
+	}
+	rc, err := b.bkt.Get(ctx, name)
+	if err != nil {
+		b.done()
+		return nil, err
+	}
+	return &doneReadCloser{ReadCloser: rc, done: b.done}, nil
+}
+
+func (b *limitedBucket) GetRange(ctx context.Context, name string, off, length int64) (io.ReadCloser, error) {
+	if err := b.start(ctx, "get_range"); err != nil {
+		return nil, err
+	}
+	rc, err := b.bkt.GetRange(ctx, name, off, length)
+	if err != nil {
+		b.done()
+		return nil, err
+	}
+	return &doneReadCloser{ReadCloser: rc, done: b.done}, nil
+}
+
+func (b *limitedBucket) Exists(ctx context.Context, name string) (bool, error) {
+	if err := b.start(ctx, "exists"); err != nil {
+		return false, err
+	}
+	defer b.done()
+
+	return b.bkt.Exists(ctx, name)
+}
+
+func (b *limitedBucket) Upload(ctx context.Context, name string, r io.Reader) error {
+	if err := b.start(ctx, "upload"); err != nil {
+		return err
+	}
+	defer b.done()
+
+	return b.bkt.Upload(ctx, name, r)
+}
+
+func (b *limitedBucket) Delete(ctx context.Context, name string) error {
+	if err := b.start(ctx, "delete"); err != nil {
+		return err
+	}
+	defer b.done()
+
+	return b.bkt.Delete(ctx, name)
+}
+
+func (b *limitedBucket) IsObjNotFoundErr(err error) bool {
+	return b.bkt.IsObjNotFoundErr(err)
+}
+
+func (b *limitedBucket) Close() error {
+	return b.bkt.Close()
+}
+
+func (b *limitedBucket) Name() string {
+	return b.bkt.Name()
+}
+
+// doneReadCloser calls done once when closed.
+type doneReadCloser struct {
+	io.ReadCloser
+
+	once sync.Once
+	done func()
+}
+
+func (rc *doneReadCloser) Close() error {
+	err := rc.ReadCloser.Close()
+	rc.once.Do(rc.done)
+	return err
+}
@@ -0,0 +1,176 @@
+package objstore_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/thanos-io/thanos/pkg/objstore"
+	"github.com/thanos-io/thanos/pkg/objstore/inmem"
+	"github.com/thanos-io/thanos/pkg/testutil"
+)
+
+// concurrencyTrackingBucket records the maximum number of operations running at once.
+type concurrencyTrackingBucket struct {
+	objstore.Bucket
+
+	mtx              sync.Mutex
+	current, maxSeen int
+}
+
+func (b *concurrencyTrackingBucket) begin() {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	b.current++
+	if b.current > b.maxSeen {
+		b.maxSeen = b.current
+	}
+}
+
+func (b *concurrencyTrackingBucket) end() {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	b.current--
+}
+
+func (b *concurrencyTrackingBucket) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	b.begin()
+	rc, err := b.Bucket.Get(ctx, name)
+	if err != nil {
+		b.end()
+		return nil, err
+	}
+	return &endReadCloser{ReadCloser: rc, end: b.end}, nil
+}
+
+func (b *concurrencyTrackingBucket) Exists(ctx context.Context, name string) (bool, error) {
+	b.begin()
+	defer b.end()
+	time.Sleep(5 * time.Millisecond)
+	return b.Bucket.Exists(ctx, name)
+}
+
+func (b *concurrencyTrackingBucket) Upload(ctx context.Context, name string, r io.Reader) error {
+	b.begin()
+	defer b.end()
+	time.Sleep(5 * time.Millisecond)
+	return b.Bucket.Upload(ctx, name, r)
+}
+
+type endReadCloser struct {
+	io.ReadCloser
+	end func()
+}
+
+func (rc *endReadCloser) Close() error {
+	rc.end()
+	return rc.ReadCloser.Close()
+}
+
+func TestBucketWithConcurrencyLimit(t *testing.T) {
+	ctx := context.Background()
+
+	tracked := &concurrencyTrackingBucket{Bucket: inmem.NewBucket()}
+	reg := prometheus.NewRegistry()
+	bkt := objstore.BucketWithConcurrencyLimit(tracked, 3, reg)
+
+	var wg sync.WaitGroup
+	errc := make(chan error, 60)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			name := fmt.Sprintf("obj-%d", i)
+			if err := bkt.Upload(ctx, name, bytes.NewBufferString("data")); err != nil {
+				errc <- err
+				return
+			}
+			if _, err := bkt.Exists(ctx, name); err != nil {
+				errc <- err
+				return
+			}
+
+			// Reads are running until the reader is closed.
+			rc, err := bkt.Get(ctx, name)
+			if err != nil {
+				errc <- err
+				return
+			}
+			time.Sleep(5 * time.Millisecond)
+			if _, err := ioutil.ReadAll(rc); err != nil {
+				errc <- err
+			}
+			errc <- rc.Close()
+		}(i)
+	}
+	wg.Wait()
+	close(errc)
+	for err := range errc {
+		testutil.Ok(t, err)
+	}
+
+	testutil.Assert(t, tracked.maxSeen <= 3, "expected at most 3 concurrent operations, got %d", tracked.maxSeen)
+	testutil.Equals(t, 3, tracked.maxSeen)
+	testutil.Equals(t, 0, tracked.current)
+
+	mfs, err := reg.Gather()
+	testutil.Ok(t, err)
+	testutil.Equals(t, 2, len(mfs))
+	for _, mf := range mfs {
+		if mf.GetName() == "thanos_objstore_bucket_operations_in_flight" {
+			testutil.Equals(t, 0.0, mf.GetMetric()[0].GetGauge().GetValue())
+		}
+	}
+}
+
+func TestBucketWithConcurrencyLimit_IterCallback(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	tracked := &concurrencyTrackingBucket{Bucket: inmem.NewBucket()}
+	bkt := objstore.BucketWithConcurrencyLimit(tracked, 1, nil)
+	for _, name := range []string{"a", "b", "c"} {
+		testutil.Ok(t, bkt.Upload(ctx, name, bytes.NewBufferString(name)))
+	}
+
+	// Callbacks can use the bucket without exceeding the limit or waiting for the iteration.
+	var seen []string
+	testutil.Ok(t, bkt.Iter(ctx, "", func(name string) error {
+		rc, err := bkt.Get(ctx, name)
+		if err != nil {
+			return err
+		}
+		defer func() { testutil.Ok(t, rc.Close()) }()
+
+		b, err := ioutil.ReadAll(rc)
+		seen = append(seen, string(b))
+		return err
+	}))
+	testutil.Equals(t, []string{"a", "b", "c"}, seen)
+	testutil.Equals(t, 1, tracked.maxSeen)
+
+	// Waiting for a turn is aborted with the context.
+	rc, err := bkt.Get(ctx, "a")
+	testutil.Ok(t, err)
+
+	cctx, ccancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer ccancel()
+	_, err = bkt.Exists(cctx, "a")
+	testutil.NotOk(t, err)
+	testutil.Ok(t, rc.Close())
+
+	_, err = bkt.Exists(ctx, "a")
+	testutil.Ok(t, err)
+}
+
+func TestBucketWithConcurrencyLimit_Disabled(t *testing.T) {
+	b := inmem.NewBucket()
+	testutil.Equals(t, objstore.Bucket(b), objstore.BucketWithConcurrencyLimit(b, 0, nil))
+}
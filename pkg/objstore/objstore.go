@@ -180,7 +180,7 @@ func Exists(ctx context.Context, bkt Bucket, src string) (bool, error) {
 }
 
 // BucketWithMetrics takes a bucket and registers metrics with the given registry for
-// operations run against the bucket.
+// operations run against the bucket. The duration of reads lasts until their reader is closed.
 func BucketWithMetrics(name string, b Bucket, r prometheus.Registerer) Bucket {
 	bkt := &metricBucket{
 		bkt: b,
@@ -208,6 +208,12 @@ func BucketWithMetrics(name string, b Bucket, r prometheus.Registerer) Bucket {
 			Help: "Second timestamp of the last successful upload to the bucket.",
 		}, []string{"bucket"}),
 	}
+	// Initialize the metrics of all operations with 0.
+	for _, op := range []string{"iter", "get", "get_range", "exists", "upload", "delete"} {
+		bkt.ops.WithLabelValues(op)
+		bkt.opsFailures.WithLabelValues(op)
+		bkt.opsDuration.WithLabelValues(op)
+	}
 	if r != nil {
 		r.MustRegister(bkt.ops, bkt.opsFailures, bkt.opsDuration, bkt.lastSuccessfullUploadTime)
 	}
@@ -225,28 +231,33 @@ type metricBucket struct {
 
 func (b *metricBucket) Iter(ctx context.Context, dir string, f func(name string) error) error {
 	const op = "iter"
+	start := time.Now()
 
 	err := b.bkt.Iter(ctx, dir, f)
 	if err != nil {
 		b.opsFailures.WithLabelValues(op).Inc()
 	}
 	b.ops.WithLabelValues(op).Inc()
+	b.opsDuration.WithLabelValues(op).Observe(time.Since(start).Seconds())
 
 	return err
 }
 
 func (b *metricBucket) Get(ctx context.Context, name string) (io.ReadCloser, error) {
 	const op = "get"
+	start := time.Now()
 	b.ops.WithLabelValues(op).Inc()
 
 	rc, err := b.bkt.Get(ctx, name)
 	if err != nil {
 		b.opsFailures.WithLabelValues(op).Inc()
+		b.opsDuration.WithLabelValues(op).Observe(time.Since(start).Seconds())
 		return nil, err
 	}
 	rc = newTimingReadCloser(
 		rc,
 		op,
+		start,
 		b.opsDuration,
 		b.opsFailures,
 	)
@@ -256,16 +267,19 @@ func (b *metricBucket) Get(ctx context.Context, name string) (io.ReadCloser, err
 
 func (b *metricBucket) GetRange(ctx context.Context, name string, off, length int64) (io.ReadCloser, error) {
 	const op = "get_range"
+	start := time.Now()
 	b.ops.WithLabelValues(op).Inc()
 
 	rc, err := b.bkt.GetRange(ctx, name, off, length)
 	if err != nil {
 		b.opsFailures.WithLabelValues(op).Inc()
+		b.opsDuration.WithLabelValues(op).Observe(time.Since(start).Seconds())
 		return nil, err
 	}
 	rc = newTimingReadCloser(
 		rc,
 		op,
+		start,
 		b.opsDuration,
 		b.opsFailures,
 	)
@@ -340,14 +354,11 @@ type timingReadCloser struct {
 	failed   *prometheus.CounterVec
 }
 
-func newTimingReadCloser(rc io.ReadCloser, op string, dur *prometheus.HistogramVec, failed *prometheus.CounterVec) *timingReadCloser {
-	// Initialize the metrics with 0.
-	dur.WithLabelValues(op)
-	failed.WithLabelValues(op)
+func newTimingReadCloser(rc io.ReadCloser, op string, start time.Time, dur *prometheus.HistogramVec, failed *prometheus.CounterVec) *timingReadCloser {
 	return &timingReadCloser{
 		ReadCloser: rc,
 		ok:         true,
-		start:      time.Now(),
+		start:      start,
 		op:         op,
 		duration:   dur,
 		failed:     failed,
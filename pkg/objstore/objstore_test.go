@@ -0,0 +1,90 @@
+package objstore_test
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/thanos-io/thanos/pkg/objstore"
+	"github.com/thanos-io/thanos/pkg/objstore/inmem"
+	"github.com/thanos-io/thanos/pkg/testutil"
+)
+
+func TestBucketWithMetrics(t *testing.T) {
+	ctx := context.Background()
+	reg := prometheus.NewRegistry()
+	bkt := objstore.BucketWithMetrics("test", inmem.NewBucket(), reg)
+
+	// operations returns the number of operations, failures and observed durations by operation.
+	operations := func() map[string][3]int {
+		mfs, err := reg.Gather()
+		testutil.Ok(t, err)
+
+		res := map[string][3]int{}
+		for _, mf := range mfs {
+			for _, m := range mf.GetMetric() {
+				var op string
+				for _, l := range m.GetLabel() {
+					if l.GetName() == "operation" {
+						op = l.GetValue()
+					}
+				}
+				c := res[op]
+				switch mf.GetName() {
+				case "thanos_objstore_bucket_operations_total":
+					c[0] += int(m.GetCounter().GetValue())
+				case "thanos_objstore_bucket_operation_failures_total":
+					c[1] += int(m.GetCounter().GetValue())
+				case "thanos_objstore_bucket_operation_duration_seconds":
+					c[2] += int(m.GetHistogram().GetSampleCount())
+				default:
+					continue
+				}
+				res[op] = c
+			}
+		}
+		return res
+	}
+
+	// All operations are exposed before being used.
+	testutil.Equals(t, map[string][3]int{
+		"iter": {}, "get": {}, "get_range": {}, "exists": {}, "upload": {}, "delete": {},
+	}, operations())
+
+	testutil.Ok(t, bkt.Upload(ctx, "obj", bytes.NewBufferString("data")))
+	ok, err := bkt.Exists(ctx, "obj")
+	testutil.Ok(t, err)
+	testutil.Assert(t, ok, "expected object to exist")
+	testutil.Ok(t, bkt.Iter(ctx, "", func(string) error { return nil }))
+
+	// Reads are observed once their reader is closed.
+	rc, err := bkt.Get(ctx, "obj")
+	testutil.Ok(t, err)
+	_, err = ioutil.ReadAll(rc)
+	testutil.Ok(t, err)
+	testutil.Equals(t, [3]int{1, 0, 0}, operations()["get"])
+	testutil.Ok(t, rc.Close())
+
+	rc, err = bkt.GetRange(ctx, "obj", 1, 2)
+	testutil.Ok(t, err)
+	testutil.Ok(t, rc.Close())
+
+	_, err = bkt.Get(ctx, "missing")
+	testutil.NotOk(t, err)
+	_, err = bkt.GetRange(ctx, "missing", 1, 2)
+	testutil.NotOk(t, err)
+
+	testutil.Ok(t, bkt.Delete(ctx, "obj"))
+	testutil.NotOk(t, bkt.Delete(ctx, "obj"))
+
+	testutil.Equals(t, map[string][3]int{
+		"iter":      {1, 0, 1},
+		"get":       {2, 1, 2},
+		"get_range": {2, 1, 2},
+		"exists":    {1, 0, 1},
+		"upload":    {1, 0, 1},
+		"delete":    {2, 1, 2},
+	}, operations())
+}
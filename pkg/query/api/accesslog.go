@@ -0,0 +1,52 @@
+package v1
+
+import (
+	"net/http"
+	"time"
+)
+
+// withAccessLog logs every request to the given endpoint with its start time, client, tenant, query, response status
+// and duration to the given logger. The handler is returned as is if the logger is nil.
+func (api *API) withAccessLog(name string, next http.Handler) http.Handler {
+	if api.accessLogger == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Parse the form upfront, as the handler consumes the body of POST requests.
+		_ = parseForm(r)
+
+		begin := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+
+		var tenant string
+		if api.tenantHeader != "" {
+			tenant = r.Header.Get(api.tenantHeader)
+		}
+		_ = api.accessLogger.Log(
+			"ts", begin.UTC().Format(time.RFC3339Nano),
+			"endpoint", name,
+			"request_id", RequestID(r.Context()),
+			"client", r.RemoteAddr,
+			"tenant", tenant,
+			"query", r.Form.Get("query"),
+			"status", rec.status,
+			"duration", time.Since(begin).String(),
+		)
+	})
+}
+
+// statusRecorder records the status code of a response. It keeps the response flushable for Server-Sent Events.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusRecorder) WriteHeader(code int) {
+	w.status = code
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusRecorder) Flush() {
+	flush(w.ResponseWriter)
+}
@@ -0,0 +1,86 @@
+package v1
+
+import (
+	"context"
+	"net/http"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// coalescer lets concurrent identical requests share a single evaluation.
+type coalescer struct {
+	mtx   sync.Mutex
+	calls map[string]*coalescedCall
+}
+
+type coalescedCall struct {
+	done chan struct{}
+	// waiters is the number of requests waiting for the call besides the one evaluating it.
+	waiters int
+
+	data     interface{}
+	warnings []error
+	apiErr   *ApiError
+}
+
+// do evaluates f, unless an evaluation for the same key is already in flight, in which case it waits for
+// that one and returns its result instead. Waiting stops once the given context is done.
+func (c *coalescer) do(ctx context.Context, key string, f func() (interface{}, []error, *ApiError)) (interface{}, []error, *ApiError) {
+	c.mtx.Lock()
+	if c.calls == nil {
+		c.calls = map[string]*coalescedCall{}
+	}
+	if call, ok := c.calls[key]; ok {
+		call.waiters++
+		c.mtx.Unlock()
+
+		select {
+		case <-call.done:
+			return call.data, call.warnings, call.apiErr
+		case <-ctx.Done():
+			c.mtx.Lock()
+			call.waiters--
+			c.mtx.Unlock()
+
+			if ctx.Err() == context.DeadlineExceeded {
+				return nil, nil, &ApiError{errorTimeout, errors.Wrap(ctx.Err(), "waiting for coalesced query")}
+			}
+			return nil, nil, &ApiError{errorCanceled, errors.Wrap(ctx.Err(), "waiting for coalesced query")}
+		}
+	}
+	call := &coalescedCall{done: make(chan struct{})}
+	c.calls[key] = call
+	c.mtx.Unlock()
+
+	defer func() {
+		c.mtx.Lock()
+		delete(c.calls, key)
+		c.mtx.Unlock()
+		close(call.done)
+	}()
+	call.data, call.warnings, call.apiErr = f()
+	return call.data, call.warnings, call.apiErr
+}
+
+// withCoalescing makes concurrent requests to the given endpoint with identical parameters and tenant share a single
+// evaluation and its result. The request evaluating it is the first one, so its cancellation applies to all of them,
+// while the others stop waiting for it once they are canceled themselves. The function is returned as is if coalescing is disabled.
+func (api *API) withCoalescing(name string, f ApiFunc) ApiFunc {
+	if api.coalescer == nil {
+		return f
+	}
+	return func(r *http.Request) (interface{}, []error, *ApiError) {
+		if err := parseForm(r); err != nil {
+			return nil, nil, &ApiError{errorBadData, err}
+		}
+
+		var tenant string
+		if api.tenantHeader != "" {
+			tenant = r.Header.Get(api.tenantHeader)
+		}
+		// Encoding sorts the parameters by name, so their order does not matter.
+		key := name + "\xff" + tenant + "\xff" + r.Form.Encode()
+		return api.coalescer.do(r.Context(), key, func() (interface{}, []error, *ApiError) { return f(r) })
+	}
+}
@@ -0,0 +1,77 @@
+package v1
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/storage"
+)
+
+// Engines queries can select with the engine parameter.
+const (
+	EnginePrometheus = "prometheus"
+	EngineThanos     = "thanos"
+)
+
+// ErrUnsupportedQuery is returned by a QueryEngine for queries it cannot evaluate. Such queries are evaluated by
+// the Prometheus engine instead.
+var ErrUnsupportedQuery = errors.New("query not supported by engine")
+
+// QueryEngine creates queries evaluated by a PromQL engine, like *promql.Engine does.
+type QueryEngine interface {
+	NewInstantQuery(q storage.Queryable, qs string, ts time.Time) (promql.Query, error)
+	NewRangeQuery(q storage.Queryable, qs string, start, end time.Time, interval time.Duration) (promql.Query, error)
+}
+
+func (api *API) parseEngineParam(r *http.Request) (engine string, _ *ApiError) {
+	const engineParam = "engine"
+
+	switch val := r.FormValue(engineParam); val {
+	case "", EnginePrometheus:
+		return EnginePrometheus, nil
+	case EngineThanos:
+		return EngineThanos, nil
+	default:
+		return "", &ApiError{errorBadData, errors.Errorf("unknown '%s' parameter %q, expected %q or %q", engineParam, val, EnginePrometheus, EngineThanos)}
+	}
+}
+
+// queryEngineFor returns the engine selected by the engine parameter. The Prometheus engine is returned if the
+// Thanos engine is not available, see engineWarnings.
+func (api *API) queryEngineFor(engine string) QueryEngine {
+	if engine == EngineThanos && api.thanosEngine != nil {
+		return api.thanosEngine
+	}
+	return api.queryEngine
+}
+
+// engineWarnings returns the given warnings of a query evaluated with the given engine, with a warning added if
+// the Thanos engine was selected but is not available, so the query was evaluated by the Prometheus engine.
+func (api *API) engineWarnings(engine string, warnings []error) []error {
+	if engine == EngineThanos && api.thanosEngine == nil {
+		return append(warnings, errors.Errorf("no %q engine configured, query evaluated by the %q engine", EngineThanos, EnginePrometheus))
+	}
+	return warnings
+}
+
+// newInstantQuery creates an instant query with the given engine, falling back to the Prometheus engine if the
+// query is not supported by it.
+func (api *API) newInstantQuery(engine string, q storage.Queryable, qs string, ts time.Time) (promql.Query, error) {
+	qry, err := api.queryEngineFor(engine).NewInstantQuery(q, qs, ts)
+	if errors.Cause(err) == ErrUnsupportedQuery {
+		return api.queryEngine.NewInstantQuery(q, qs, ts)
+	}
+	return qry, err
+}
+
+// newRangeQuery creates a range query with the given engine, falling back to the Prometheus engine if the query
+// is not supported by it.
+func (api *API) newRangeQuery(engine string, q storage.Queryable, qs string, start, end time.Time, step time.Duration) (promql.Query, error) {
+	qry, err := api.queryEngineFor(engine).NewRangeQuery(q, qs, start, end, step)
+	if errors.Cause(err) == ErrUnsupportedQuery {
+		return api.queryEngine.NewRangeQuery(q, qs, start, end, step)
+	}
+	return qry, err
+}
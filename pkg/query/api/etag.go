@@ -0,0 +1,67 @@
+package v1
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+
+	"github.com/prometheus/prometheus/pkg/timestamp"
+	"github.com/thanos-io/thanos/pkg/query"
+)
+
+// queryETag returns the ETag of a GET request to the query or query_range endpoint, which is known before evaluating
+// it. It is derived from the parameters and tenant of the request and the blocks of the stores having data up to
+// the evaluation time, see query.BlockSetKey. An empty ETag is returned if the result may change without that, i.e.
+// the evaluation time is not given or lies within the range of a store still ingesting data, like Prometheus behind
+// a sidecar or a receiver, or of a store not reporting its blocks.
+func (api *API) queryETag(name string, r *http.Request) string {
+	if api.stores == nil || r.Method != http.MethodGet {
+		return ""
+	}
+	if err := parseForm(r); err != nil {
+		return ""
+	}
+
+	endParam := "time"
+	if name == "query_range" {
+		endParam = "end"
+	}
+	t := r.FormValue(endParam)
+	if t == "" {
+		return ""
+	}
+	end, err := parseTime(t)
+	if err != nil {
+		return ""
+	}
+	maxt := timestamp.FromTime(end)
+
+	blockSet, ok := query.BlockSetKey(api.stores(), math.MinInt64, maxt)
+	if !ok {
+		return ""
+	}
+
+	var tenant string
+	if api.tenantHeader != "" {
+		tenant = r.Header.Get(api.tenantHeader)
+	}
+	// Encoding sorts the parameters by name, so their order does not matter.
+	h := sha256.Sum256([]byte(name + "\xff" + tenant + "\xff" + r.Form.Encode() + "\xff" + blockSet))
+	return fmt.Sprintf(`W/"%x"`, h)
+}
+
+// etagMatches reports whether the given If-None-Match header value matches the etag using weak comparison.
+func etagMatches(ifNoneMatch, etag string) bool {
+	if ifNoneMatch == "" {
+		return false
+	}
+	for _, t := range strings.Split(ifNoneMatch, ",") {
+		t = strings.TrimSpace(t)
+		if t == "*" || strings.TrimPrefix(t, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
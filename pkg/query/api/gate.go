@@ -0,0 +1,45 @@
+package v1
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+)
+
+// queryGate limits the number of queries of a kind evaluated concurrently, on top of the limit of the engine
+// applying to all queries. A nil queryGate does not limit anything.
+type queryGate struct {
+	slots chan struct{}
+}
+
+// newQueryGate returns a queryGate admitting at most maxConcurrent queries at once, or nil if maxConcurrent is 0.
+func newQueryGate(maxConcurrent int) *queryGate {
+	if maxConcurrent <= 0 {
+		return nil
+	}
+	return &queryGate{slots: make(chan struct{}, maxConcurrent)}
+}
+
+// start waits until the query may be evaluated. Every successful start must be followed by a call to done.
+func (g *queryGate) start(ctx context.Context) *ApiError {
+	if g == nil {
+		return nil
+	}
+	select {
+	case g.slots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		if ctx.Err() == context.DeadlineExceeded {
+			return &ApiError{errorTimeout, errors.Wrap(ctx.Err(), "waiting for a query slot")}
+		}
+		return &ApiError{errorCanceled, errors.Wrap(ctx.Err(), "waiting for a query slot")}
+	}
+}
+
+// done releases the slot taken by start.
+func (g *queryGate) done() {
+	if g == nil {
+		return
+	}
+	<-g.slots
+}
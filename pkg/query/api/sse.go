@@ -0,0 +1,147 @@
+package v1
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/storage"
+)
+
+// eventStreamContentType is the content type of Server-Sent Events. Requests accepting it get periodic progress
+// events before the final result event.
+const eventStreamContentType = "text/event-stream"
+
+const (
+	progressEventType = "progress"
+	resultEventType   = "result"
+)
+
+// progress tracks how far the evaluation of a request got.
+type progress struct {
+	series int64
+}
+
+type progressKey struct{}
+
+type progressEvent struct {
+	ElapsedSeconds  float64 `json:"elapsedSeconds"`
+	SeriesProcessed int64   `json:"seriesProcessed"`
+}
+
+func acceptsEventStream(r *http.Request) bool {
+	for _, t := range strings.Split(r.Header.Get("Accept"), ",") {
+		if strings.TrimSpace(strings.SplitN(t, ";", 2)[0]) == eventStreamContentType {
+			return true
+		}
+	}
+	return false
+}
+
+// respondEventStream evaluates f and writes its response as Server-Sent Events. Until the response is ready, a progress
+// event with the elapsed time and the number of series processed so far is emitted every interval. The response
+// follows as the data of a single result event. As the status code is sent upfront, errors are only reported there.
+func respondEventStream(w http.ResponseWriter, r *http.Request, f ApiFunc, interval time.Duration) {
+	p := &progress{}
+	r = r.WithContext(context.WithValue(r.Context(), progressKey{}, p))
+
+	resc := make(chan *response, 1)
+	go func() {
+		data, warnings, apiErr := f(r)
+		if apiErr != nil {
+			resc <- errorResponse(apiErr, data)
+			return
+		}
+		resc <- successResponse(data, warnings)
+	}()
+
+	w.Header().Set("Content-Type", eventStreamContentType)
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flush(w)
+
+	begin := time.Now()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			writeEvent(w, progressEventType, &progressEvent{
+				ElapsedSeconds:  time.Since(begin).Seconds(),
+				SeriesProcessed: atomic.LoadInt64(&p.series),
+			})
+		case resp := <-resc:
+			writeEvent(w, resultEventType, resp)
+			return
+		}
+	}
+}
+
+func writeEvent(w http.ResponseWriter, typ string, data interface{}) {
+	b, err := json.Marshal(data)
+	if err != nil {
+		b, _ = json.Marshal(errorResponse(&ApiError{ErrorInternal, err}, nil))
+	}
+	_, _ = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", typ, b)
+	flush(w)
+}
+
+func flush(w http.ResponseWriter) {
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// withProgress makes the given queryable count the series it selects, if the context belongs to a request tracking its progress.
+func withProgress(ctx context.Context, q storage.Queryable) storage.Queryable {
+	p, ok := ctx.Value(progressKey{}).(*progress)
+	if !ok {
+		return q
+	}
+	return &progressQueryable{Queryable: q, p: p}
+}
+
+type progressQueryable struct {
+	storage.Queryable
+	p *progress
+}
+
+func (q *progressQueryable) Querier(ctx context.Context, mint, maxt int64) (storage.Querier, error) {
+	querier, err := q.Queryable.Querier(ctx, mint, maxt)
+	if err != nil {
+		return nil, err
+	}
+	return &progressQuerier{Querier: querier, p: q.p}, nil
+}
+
+type progressQuerier struct {
+	storage.Querier
+	p *progress
+}
+
+func (q *progressQuerier) Select(params *storage.SelectParams, ms ...*labels.Matcher) (storage.SeriesSet, storage.Warnings, error) {
+	set, warnings, err := q.Querier.Select(params, ms...)
+	if err != nil {
+		return nil, warnings, err
+	}
+	return &progressSeriesSet{SeriesSet: set, p: q.p}, warnings, nil
+}
+
+type progressSeriesSet struct {
+	storage.SeriesSet
+	p *progress
+}
+
+func (s *progressSeriesSet) Next() bool {
+	if !s.SeriesSet.Next() {
+		return false
+	}
+	atomic.AddInt64(&s.p.series, 1)
+	return true
+}
@@ -17,16 +17,23 @@
 package v1
 
 import (
+	"bytes"
 	"context"
+	"crypto/rand"
 	"encoding/json"
 	"fmt"
 	"math"
+	"mime"
 	"net/http"
+	"net/url"
+	"sort"
 	"strconv"
 	"time"
 
 	"github.com/NYTimes/gziphandler"
 	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/oklog/ulid"
 	"github.com/opentracing/opentracing-go"
 	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
@@ -39,6 +46,7 @@ import (
 	extpromhttp "github.com/thanos-io/thanos/pkg/extprom/http"
 	"github.com/thanos-io/thanos/pkg/query"
 	"github.com/thanos-io/thanos/pkg/runutil"
+	"github.com/thanos-io/thanos/pkg/store"
 	"github.com/thanos-io/thanos/pkg/tracing"
 )
 
@@ -61,10 +69,10 @@ const (
 )
 
 var corsHeaders = map[string]string{
-	"Access-Control-Allow-Headers":  "Accept, Accept-Encoding, Authorization, Content-Type, Origin",
+	"Access-Control-Allow-Headers":  "Accept, Accept-Encoding, Authorization, Content-Type, Origin, X-Request-Id",
 	"Access-Control-Allow-Methods":  "GET, OPTIONS",
 	"Access-Control-Allow-Origin":   "*",
-	"Access-Control-Expose-Headers": "Date",
+	"Access-Control-Expose-Headers": "Date, X-Request-Id",
 }
 
 type ApiError struct {
@@ -105,6 +113,38 @@ type API struct {
 	replicaLabels                          []string
 	reg                                    prometheus.Registerer
 	defaultInstantQueryMaxSourceResolution time.Duration
+	// maxRangePerResolution maps a minimum max_source_resolution to the longest range a range query can span with it.
+	maxRangePerResolution map[time.Duration]time.Duration
+	// enableLabelValuesDedup makes label values requests honour the dedup and replicaLabels[] parameters.
+	enableLabelValuesDedup bool
+	// tenantLabel, if not empty, is enforced on all requests with the value of the tenantHeader request header.
+	tenantHeader string
+	tenantLabel  string
+	// allowedFunctions, if not empty, are the only PromQL functions queries may use. Functions in deniedFunctions are never allowed.
+	allowedFunctions map[string]struct{}
+	deniedFunctions  map[string]struct{}
+	// maxRegexMatchers, if positive, is the maximum number of regex matchers a single selector may have.
+	maxRegexMatchers int
+	// maxPointsPerSeries, if positive, is the maximum number of points a single series of a range query result may have.
+	maxPointsPerSeries int
+	// accessLogger, if not nil, gets an entry for every request, see withAccessLog.
+	accessLogger log.Logger
+	// coalescer, if not nil, makes concurrent identical queries share a single evaluation, see withCoalescing.
+	coalescer *coalescer
+	// requireInstantTime makes instant queries without time parameter fail instead of being evaluated now.
+	requireInstantTime bool
+	// partialResponseStatus makes responses with warnings use 206 Partial Content instead of 200 OK.
+	partialResponseStatus bool
+	// instantQueryGate and rangeQueryGate, if not nil, limit the number of concurrently evaluated queries of each kind,
+	// so a burst of expensive range queries cannot take all slots of the engine.
+	instantQueryGate *queryGate
+	rangeQueryGate   *queryGate
+	// thanosEngine, if not nil, evaluates queries selecting the thanos engine with the engine parameter.
+	thanosEngine QueryEngine
+	// progressInterval is the interval of progress events sent to clients accepting Server-Sent Events.
+	progressInterval time.Duration
+	// stores, if not nil, returns the queried stores to derive ETags of query responses from.
+	stores func() []store.Client
 
 	now func() time.Time
 }
@@ -119,7 +159,27 @@ func NewAPI(
 	enablePartialResponse bool,
 	replicaLabels []string,
 	defaultInstantQueryMaxSourceResolution time.Duration,
+	maxRangePerResolution map[time.Duration]time.Duration,
+	enableLabelValuesDedup bool,
+	tenantHeader string,
+	tenantLabel string,
+	allowedFunctions []string,
+	deniedFunctions []string,
+	maxRegexMatchers int,
+	accessLogger log.Logger,
+	coalesceQueries bool,
+	maxPointsPerSeries int,
+	partialResponseStatus bool,
+	requireInstantTime bool,
+	maxConcurrentInstantQueries int,
+	maxConcurrentRangeQueries int,
+	thanosEngine QueryEngine,
+	stores func() []store.Client,
 ) *API {
+	var qc *coalescer
+	if coalesceQueries {
+		qc = &coalescer{}
+	}
 	return &API{
 		logger:                                 logger,
 		queryEngine:                            qe,
@@ -129,34 +189,107 @@ func NewAPI(
 		replicaLabels:                          replicaLabels,
 		reg:                                    reg,
 		defaultInstantQueryMaxSourceResolution: defaultInstantQueryMaxSourceResolution,
+		maxRangePerResolution:                  maxRangePerResolution,
+		enableLabelValuesDedup:                 enableLabelValuesDedup,
+		tenantHeader:                           tenantHeader,
+		tenantLabel:                            tenantLabel,
+		allowedFunctions:                       stringSet(allowedFunctions),
+		deniedFunctions:                        stringSet(deniedFunctions),
+		maxRegexMatchers:                       maxRegexMatchers,
+		accessLogger:                           accessLogger,
+		coalescer:                              qc,
+		maxPointsPerSeries:                     maxPointsPerSeries,
+		partialResponseStatus:                  partialResponseStatus,
+		requireInstantTime:                     requireInstantTime,
+		instantQueryGate:                       newQueryGate(maxConcurrentInstantQueries),
+		rangeQueryGate:                         newQueryGate(maxConcurrentRangeQueries),
+		thanosEngine:                           thanosEngine,
+		progressInterval:                       time.Second,
+		stores:                                 stores,
 
 		now: time.Now,
 	}
 }
 
+// RequestIDHeader is the HTTP header carrying the ID of an API request. It is generated when absent
+// and always echoed in the response.
+const RequestIDHeader = "X-Request-Id"
+
+type requestIDKey struct{}
+
+// RequestID returns the ID of the API request the given context belongs to, or an empty string if there is none.
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// withRequestID sets the ID of the request from its RequestIDHeader, generating one if absent, in the request context
+// and the response headers.
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reqID := r.Header.Get(RequestIDHeader)
+		if reqID == "" {
+			reqID = ulid.MustNew(ulid.Now(), rand.Reader).String()
+		}
+		w.Header().Set(RequestIDHeader, reqID)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, reqID)))
+	})
+}
+
 // Register the API's endpoints in the given router.
 func (api *API) Register(r *route.Router, tracer opentracing.Tracer, logger log.Logger, ins extpromhttp.InstrumentationMiddleware) {
 	instr := func(name string, f ApiFunc) http.HandlerFunc {
 		hf := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			SetCORS(w)
+
+			if acceptsEventStream(r) {
+				respondEventStream(w, r, f, api.progressInterval)
+				return
+			}
+			if name == "query" || name == "query_range" {
+				if etag := api.queryETag(name, r); etag != "" {
+					w.Header().Set("ETag", etag)
+					if etagMatches(r.Header.Get("If-None-Match"), etag) {
+						// The result did not change, so the query is not evaluated at all.
+						w.WriteHeader(http.StatusNotModified)
+						return
+					}
+				}
+			}
 			if data, warnings, err := f(r); err != nil {
+				level.Debug(logger).Log("msg", "API request failed", "endpoint", name, "request_id", RequestID(r.Context()), "err", err)
 				RespondError(w, err, data)
 			} else if data != nil {
-				Respond(w, data, warnings)
+				code := http.StatusOK
+				if api.partialResponseStatus && len(warnings) > 0 {
+					code = http.StatusPartialContent
+				}
+				respond(w, r, data, warnings, code)
 			} else {
 				w.WriteHeader(http.StatusNoContent)
 			}
 		})
-		return ins.NewHandler(name, tracing.HTTPMiddleware(tracer, name, logger, gziphandler.GzipHandler(hf)))
+		logged := withRequestID(api.withAccessLog(name, hf))
+		gzipped := gziphandler.GzipHandler(logged)
+		return ins.NewHandler(name, tracing.HTTPMiddleware(tracer, name, logger, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// Compression buffers small responses and ignores flushes until then, which would hold back progress events.
+			if acceptsEventStream(r) {
+				logged.ServeHTTP(w, r)
+				return
+			}
+			gzipped.ServeHTTP(w, r)
+		})))
 	}
 
 	r.Options("/*path", instr("options", api.options))
 
-	r.Get("/query", instr("query", api.query))
-	r.Post("/query", instr("query", api.query))
+	query := api.withCoalescing("query", api.query)
+	r.Get("/query", instr("query", query))
+	r.Post("/query", instr("query", query))
 
-	r.Get("/query_range", instr("query_range", api.queryRange))
-	r.Post("/query_range", instr("query_range", api.queryRange))
+	queryRange := api.withCoalescing("query_range", api.queryRange)
+	r.Get("/query_range", instr("query_range", queryRange))
+	r.Post("/query_range", instr("query_range", queryRange))
 
 	r.Get("/label/:name/values", instr("label_values", api.labelValues))
 
@@ -172,6 +305,86 @@ type queryData struct {
 
 	// Additional Thanos Response field.
 	Warnings []error `json:"warnings,omitempty"`
+	// EvalTime is the resolved evaluation timestamp of an instant query in seconds, if requested.
+	EvalTime *float64 `json:"evalTime,omitempty"`
+	// Stats holds details on how the query was evaluated, if requested.
+	Stats *queryStats `json:"stats,omitempty"`
+}
+
+type queryStats struct {
+	// ReplicaLabels are the replica labels the query was deduplicated by, after resolving the defaults and request parameters.
+	// It is empty if deduplication was disabled.
+	ReplicaLabels []string `json:"replicaLabels"`
+}
+
+// newQueryStats returns the stats of a query evaluated with the given deduplication parameters, if requested.
+func newQueryStats(include, enableDedup bool, replicaLabels []string) *queryStats {
+	if !include {
+		return nil
+	}
+	stats := &queryStats{ReplicaLabels: []string{}}
+	if enableDedup {
+		stats.ReplicaLabels = append(stats.ReplicaLabels, replicaLabels...)
+	}
+	return stats
+}
+
+// parseForm parses the parameters of the request like http.Request.ParseForm does. Additionally, the body of POST requests
+// with an application/json Content-Type is accepted as a JSON object whose fields are the parameters, given as string,
+// number, boolean or array of those. They take precedence over URL query parameters of the same name.
+func parseForm(r *http.Request) error {
+	if r.Form != nil || r.Method != http.MethodPost {
+		return r.ParseForm()
+	}
+	if ct, _, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err != nil || ct != "application/json" {
+		return r.ParseForm()
+	}
+
+	var body map[string]interface{}
+	dec := json.NewDecoder(r.Body)
+	dec.UseNumber()
+	if err := dec.Decode(&body); err != nil {
+		return errors.Wrap(err, "decode JSON body")
+	}
+
+	r.PostForm = make(url.Values, len(body))
+	for name, v := range body {
+		vals, err := jsonFormValues(v)
+		if err != nil {
+			return errors.Wrapf(err, "JSON body field %q", name)
+		}
+		r.PostForm[name] = vals
+	}
+	r.Form = r.URL.Query()
+	for name, vals := range r.PostForm {
+		r.Form[name] = vals
+	}
+	return nil
+}
+
+func jsonFormValues(v interface{}) ([]string, error) {
+	switch v := v.(type) {
+	case string:
+		return []string{v}, nil
+	case json.Number:
+		return []string{v.String()}, nil
+	case bool:
+		return []string{strconv.FormatBool(v)}, nil
+	case []interface{}:
+		var vals []string
+		for _, e := range v {
+			if _, ok := e.([]interface{}); ok {
+				return nil, errors.New("nested arrays are not supported")
+			}
+			ev, err := jsonFormValues(e)
+			if err != nil {
+				return nil, err
+			}
+			vals = append(vals, ev...)
+		}
+		return vals, nil
+	}
+	return nil, errors.Errorf("unsupported value %v", v)
 }
 
 func (api *API) parseEnableDedupParam(r *http.Request) (enableDeduplication bool, _ *ApiError) {
@@ -203,6 +416,127 @@ func (api *API) parseReplicaLabelsParam(r *http.Request) (replicaLabels []string
 	return replicaLabels, nil
 }
 
+// parseTenantMatchers returns the matchers which have to be enforced on all selectors of the request
+// to restrict it to the tenant's data.
+func (api *API) parseTenantMatchers(r *http.Request) ([]*labels.Matcher, *ApiError) {
+	if api.tenantLabel == "" {
+		return nil, nil
+	}
+
+	tenant := r.Header.Get(api.tenantHeader)
+	if tenant == "" {
+		return nil, &ApiError{errorBadData, errors.Errorf("missing tenant in %s header", api.tenantHeader)}
+	}
+
+	m, err := labels.NewMatcher(labels.MatchEqual, api.tenantLabel, tenant)
+	if err != nil {
+		return nil, &ApiError{ErrorInternal, err}
+	}
+	return []*labels.Matcher{m}, nil
+}
+
+// enforceMatchers adds the given matchers to all selectors of the query. Client provided matchers are kept
+// as they can only narrow down the result further.
+func enforceMatchers(query string, matchers []*labels.Matcher) (string, error) {
+	if len(matchers) == 0 {
+		return query, nil
+	}
+
+	expr, err := promql.ParseExpr(query)
+	if err != nil {
+		return "", err
+	}
+	promql.Inspect(expr, func(node promql.Node, _ []promql.Node) error {
+		switch n := node.(type) {
+		case *promql.VectorSelector:
+			n.LabelMatchers = append(append([]*labels.Matcher{}, n.LabelMatchers...), matchers...)
+		case *promql.MatrixSelector:
+			n.LabelMatchers = append(append([]*labels.Matcher{}, n.LabelMatchers...), matchers...)
+		}
+		return nil
+	})
+	return expr.String(), nil
+}
+
+func stringSet(l []string) map[string]struct{} {
+	if len(l) == 0 {
+		return nil
+	}
+	s := make(map[string]struct{}, len(l))
+	for _, e := range l {
+		s[e] = struct{}{}
+	}
+	return s
+}
+
+// checkFunctions returns an error if the query uses a PromQL function that is not allowed.
+func (api *API) checkFunctions(query string) error {
+	if len(api.allowedFunctions) == 0 && len(api.deniedFunctions) == 0 {
+		return nil
+	}
+
+	expr, err := promql.ParseExpr(query)
+	if err != nil {
+		return err
+	}
+	var denied error
+	promql.Inspect(expr, func(node promql.Node, _ []promql.Node) error {
+		call, ok := node.(*promql.Call)
+		if !ok {
+			return nil
+		}
+		_, isDenied := api.deniedFunctions[call.Func.Name]
+		_, isAllowed := api.allowedFunctions[call.Func.Name]
+		if isDenied || (len(api.allowedFunctions) > 0 && !isAllowed) {
+			denied = errors.Errorf("function %q is not allowed", call.Func.Name)
+		}
+		// Stop at the first denied function.
+		return denied
+	})
+	return denied
+}
+
+// checkRegexMatchers returns an error if a selector of the query has more regex matchers than allowed.
+func (api *API) checkRegexMatchers(query string) error {
+	if api.maxRegexMatchers <= 0 {
+		return nil
+	}
+
+	expr, err := promql.ParseExpr(query)
+	if err != nil {
+		return err
+	}
+	var exceeded error
+	promql.Inspect(expr, func(node promql.Node, _ []promql.Node) error {
+		switch n := node.(type) {
+		case *promql.VectorSelector:
+			exceeded = api.checkSelectorRegexMatchers(n.LabelMatchers)
+		case *promql.MatrixSelector:
+			exceeded = api.checkSelectorRegexMatchers(n.LabelMatchers)
+		}
+		return exceeded
+	})
+	return exceeded
+}
+
+// checkSelectorRegexMatchers returns an error if the matchers of a single selector contain more regex matchers than allowed.
+func (api *API) checkSelectorRegexMatchers(matchers []*labels.Matcher) error {
+	if api.maxRegexMatchers <= 0 {
+		return nil
+	}
+
+	var n int
+	for _, m := range matchers {
+		if m.Type == labels.MatchRegexp || m.Type == labels.MatchNotRegexp {
+			n++
+		}
+	}
+	if n > api.maxRegexMatchers {
+		return errors.Errorf("selector has %d regex matchers, exceeding the limit of %d", n, api.maxRegexMatchers)
+	}
+	return nil
+}
+
 func (api *API) parseDownsamplingParamMillis(r *http.Request, defaultVal time.Duration) (maxResolutionMillis int64, _ *ApiError) {
 	const maxSourceResolutionParam = "max_source_resolution"
 	maxSourceResolution := 0 * time.Second
@@ -241,11 +575,56 @@ func (api *API) parsePartialResponseParam(r *http.Request) (enablePartialRespons
 	return enablePartialResponse, nil
 }
 
+// parseValidateReplicaLabelsParam returns whether the request asks for a warning about replica labels
+// that are missing from all deduplicated series.
+func (api *API) parseValidateReplicaLabelsParam(r *http.Request) (validateReplicaLabels bool, _ *ApiError) {
+	const validateReplicaLabelsParam = "validate_replica_labels"
+
+	if val := r.FormValue(validateReplicaLabelsParam); val != "" {
+		var err error
+		validateReplicaLabels, err = strconv.ParseBool(val)
+		if err != nil {
+			return false, &ApiError{errorBadData, errors.Wrapf(err, "'%s' parameter", validateReplicaLabelsParam)}
+		}
+	}
+	return validateReplicaLabels, nil
+}
+
+func (api *API) parseIncludeEvalTimeParam(r *http.Request) (includeEvalTime bool, _ *ApiError) {
+	const includeEvalTimeParam = "include_eval_time"
+
+	if val := r.FormValue(includeEvalTimeParam); val != "" {
+		var err error
+		includeEvalTime, err = strconv.ParseBool(val)
+		if err != nil {
+			return false, &ApiError{errorBadData, errors.Wrapf(err, "'%s' parameter", includeEvalTimeParam)}
+		}
+	}
+	return includeEvalTime, nil
+}
+
+func (api *API) parseIncludeReplicaLabelsParam(r *http.Request) (includeReplicaLabels bool, _ *ApiError) {
+	const includeReplicaLabelsParam = "include_replica_labels"
+
+	if val := r.FormValue(includeReplicaLabelsParam); val != "" {
+		var err error
+		includeReplicaLabels, err = strconv.ParseBool(val)
+		if err != nil {
+			return false, &ApiError{errorBadData, errors.Wrapf(err, "'%s' parameter", includeReplicaLabelsParam)}
+		}
+	}
+	return includeReplicaLabels, nil
+}
+
 func (api *API) options(r *http.Request) (interface{}, []error, *ApiError) {
 	return nil, nil, nil
 }
 
 func (api *API) query(r *http.Request) (interface{}, []error, *ApiError) {
+	if err := parseForm(r); err != nil {
+		return nil, nil, &ApiError{errorBadData, err}
+	}
+
 	var ts time.Time
 	if t := r.FormValue("time"); t != "" {
 		var err error
@@ -253,6 +632,8 @@ func (api *API) query(r *http.Request) (interface{}, []error, *ApiError) {
 		if err != nil {
 			return nil, nil, &ApiError{errorBadData, err}
 		}
+	} else if api.requireInstantTime {
+		return nil, nil, &ApiError{errorBadData, errors.New("missing time parameter")}
 	} else {
 		ts = api.now()
 	}
@@ -279,6 +660,11 @@ func (api *API) query(r *http.Request) (interface{}, []error, *ApiError) {
 		return nil, nil, apiErr
 	}
 
+	validateReplicaLabels, apiErr := api.parseValidateReplicaLabelsParam(r)
+	if apiErr != nil {
+		return nil, nil, apiErr
+	}
+
 	enablePartialResponse, apiErr := api.parsePartialResponseParam(r)
 	if apiErr != nil {
 		return nil, nil, apiErr
@@ -289,11 +675,47 @@ func (api *API) query(r *http.Request) (interface{}, []error, *ApiError) {
 		return nil, nil, apiErr
 	}
 
+	tenantMatchers, apiErr := api.parseTenantMatchers(r)
+	if apiErr != nil {
+		return nil, nil, apiErr
+	}
+
+	includeEvalTime, apiErr := api.parseIncludeEvalTimeParam(r)
+	if apiErr != nil {
+		return nil, nil, apiErr
+	}
+
+	includeReplicaLabels, apiErr := api.parseIncludeReplicaLabelsParam(r)
+	if apiErr != nil {
+		return nil, nil, apiErr
+	}
+
+	engine, apiErr := api.parseEngineParam(r)
+	if apiErr != nil {
+		return nil, nil, apiErr
+	}
+
+	query, err := enforceMatchers(r.FormValue("query"), tenantMatchers)
+	if err != nil {
+		return nil, nil, &ApiError{errorBadData, err}
+	}
+	if err := api.checkFunctions(query); err != nil {
+		return nil, nil, &ApiError{errorBadData, err}
+	}
+	if err := api.checkRegexMatchers(query); err != nil {
+		return nil, nil, &ApiError{errorBadData, err}
+	}
+
 	// We are starting promQL tracing span here, because we have no control over promQL code.
 	span, ctx := tracing.StartSpan(ctx, "promql_instant_query")
 	defer span.Finish()
 
-	qry, err := api.queryEngine.NewInstantQuery(api.queryableCreate(enableDedup, replicaLabels, maxSourceResolution, enablePartialResponse), r.FormValue("query"), ts)
+	if apiErr := api.instantQueryGate.start(ctx); apiErr != nil {
+		return nil, nil, apiErr
+	}
+	defer api.instantQueryGate.done()
+
+	qry, err := api.newInstantQuery(engine, withProgress(ctx, api.queryableCreate(enableDedup, replicaLabels, maxSourceResolution, enablePartialResponse, validateReplicaLabels)), query, ts)
 	if err != nil {
 		return nil, nil, &ApiError{errorBadData, err}
 	}
@@ -311,13 +733,24 @@ func (api *API) query(r *http.Request) (interface{}, []error, *ApiError) {
 		return nil, nil, &ApiError{errorExec, res.Err}
 	}
 
-	return &queryData{
+	data := &queryData{
 		ResultType: res.Value.Type(),
 		Result:     res.Value,
-	}, res.Warnings, nil
+		Stats:      newQueryStats(includeReplicaLabels, enableDedup, replicaLabels),
+	}
+	if includeEvalTime {
+		// The engine evaluates at millisecond precision, so report exactly the timestamp it used.
+		evalTime := float64(timestamp.FromTime(ts)) / 1000
+		data.EvalTime = &evalTime
+	}
+	return data, api.engineWarnings(engine, res.Warnings), nil
 }
 
 func (api *API) queryRange(r *http.Request) (interface{}, []error, *ApiError) {
+	if err := parseForm(r); err != nil {
+		return nil, nil, &ApiError{errorBadData, err}
+	}
+
 	start, err := parseTime(r.FormValue("start"))
 	if err != nil {
 		return nil, nil, &ApiError{errorBadData, err}
@@ -347,6 +780,11 @@ func (api *API) queryRange(r *http.Request) (interface{}, []error, *ApiError) {
 		err := errors.Errorf("exceeded maximum resolution of 11,000 points per timeseries. Try decreasing the query resolution (?step=XX)")
 		return nil, nil, &ApiError{errorBadData, err}
 	}
+	if points := int64(end.Sub(start)/step) + 1; api.maxPointsPerSeries > 0 && points > int64(api.maxPointsPerSeries) {
+		err := errors.Errorf("query would return %d points per series, exceeding the maximum of %d points per series. Try decreasing the query resolution (?step=XX) or range",
+			points, api.maxPointsPerSeries)
+		return nil, nil, &ApiError{errorBadData, err}
+	}
 
 	ctx := r.Context()
 	if to := r.FormValue("timeout"); to != "" {
@@ -370,24 +808,67 @@ func (api *API) queryRange(r *http.Request) (interface{}, []error, *ApiError) {
 		return nil, nil, apiErr
 	}
 
+	validateReplicaLabels, apiErr := api.parseValidateReplicaLabelsParam(r)
+	if apiErr != nil {
+		return nil, nil, apiErr
+	}
+
 	// If no max_source_resolution is specified fit at least 5 samples between steps.
 	maxSourceResolution, apiErr := api.parseDownsamplingParamMillis(r, step/5)
 	if apiErr != nil {
 		return nil, nil, apiErr
 	}
 
+	if maxRange, ok := api.maxRange(maxSourceResolution); ok && end.Sub(start) > maxRange {
+		err := errors.Errorf("exceeded maximum query range of %s for max_source_resolution %s. Try a shorter range or a higher max_source_resolution",
+			model.Duration(maxRange), model.Duration(time.Duration(maxSourceResolution)*time.Millisecond))
+		return nil, nil, &ApiError{errorBadData, err}
+	}
+
 	enablePartialResponse, apiErr := api.parsePartialResponseParam(r)
 	if apiErr != nil {
 		return nil, nil, apiErr
 	}
 
+	tenantMatchers, apiErr := api.parseTenantMatchers(r)
+	if apiErr != nil {
+		return nil, nil, apiErr
+	}
+
+	includeReplicaLabels, apiErr := api.parseIncludeReplicaLabelsParam(r)
+	if apiErr != nil {
+		return nil, nil, apiErr
+	}
+
+	engine, apiErr := api.parseEngineParam(r)
+	if apiErr != nil {
+		return nil, nil, apiErr
+	}
+
+	query, err := enforceMatchers(r.FormValue("query"), tenantMatchers)
+	if err != nil {
+		return nil, nil, &ApiError{errorBadData, err}
+	}
+	if err := api.checkFunctions(query); err != nil {
+		return nil, nil, &ApiError{errorBadData, err}
+	}
+	if err := api.checkRegexMatchers(query); err != nil {
+		return nil, nil, &ApiError{errorBadData, err}
+	}
+
 	// We are starting promQL tracing span here, because we have no control over promQL code.
 	span, ctx := tracing.StartSpan(ctx, "promql_range_query")
 	defer span.Finish()
 
-	qry, err := api.queryEngine.NewRangeQuery(
-		api.queryableCreate(enableDedup, replicaLabels, maxSourceResolution, enablePartialResponse),
-		r.FormValue("query"),
+	if apiErr := api.rangeQueryGate.start(ctx); apiErr != nil {
+		return nil, nil, apiErr
+	}
+	defer api.rangeQueryGate.done()
+
+	qry, err := api.newRangeQuery(
+		engine,
+		withProgress(ctx, api.queryableCreate(enableDedup, replicaLabels, maxSourceResolution, enablePartialResponse, validateReplicaLabels)),
+		query,
 		start,
 		end,
 		step,
@@ -410,7 +891,27 @@ func (api *API) queryRange(r *http.Request) (interface{}, []error, *ApiError) {
 	return &queryData{
 		ResultType: res.Value.Type(),
 		Result:     res.Value,
-	}, res.Warnings, nil
+		Stats:      newQueryStats(includeReplicaLabels, enableDedup, replicaLabels),
+	}, api.engineWarnings(engine, res.Warnings), nil
+}
+
+// maxRange returns the maximum range a range query can span when using data up to the given resolution.
+// The limit configured for the highest resolution not above maxSourceResolutionMillis applies.
+func (api *API) maxRange(maxSourceResolutionMillis int64) (time.Duration, bool) {
+	var (
+		found      bool
+		resolution time.Duration
+		maxRange   time.Duration
+	)
+	for res, r := range api.maxRangePerResolution {
+		if int64(res/time.Millisecond) > maxSourceResolutionMillis {
+			continue
+		}
+		if !found || res > resolution {
+			found, resolution, maxRange = true, res, r
+		}
+	}
+	return maxRange, found
 }
 
 func (api *API) labelValues(r *http.Request) (interface{}, []error, *ApiError) {
@@ -426,12 +927,58 @@ func (api *API) labelValues(r *http.Request) (interface{}, []error, *ApiError) {
 		return nil, nil, apiErr
 	}
 
-	q, err := api.queryableCreate(true, nil, 0, enablePartialResponse).Querier(ctx, math.MinInt64, math.MaxInt64)
+	var (
+		enableDedup   = true
+		replicaLabels []string
+	)
+	if api.enableLabelValuesDedup {
+		enableDedup, apiErr = api.parseEnableDedupParam(r)
+		if apiErr != nil {
+			return nil, nil, apiErr
+		}
+
+		replicaLabels, apiErr = api.parseReplicaLabelsParam(r)
+		if apiErr != nil {
+			return nil, nil, apiErr
+		}
+	}
+
+	tenantMatchers, apiErr := api.parseTenantMatchers(r)
+	if apiErr != nil {
+		return nil, nil, apiErr
+	}
+
+	mint, maxt, apiErr := api.parseLabelsTimeRange(r)
+	if apiErr != nil {
+		return nil, nil, apiErr
+	}
+
+	q, err := api.queryableCreate(enableDedup, replicaLabels, 0, enablePartialResponse, false).Querier(ctx, mint, maxt)
 	if err != nil {
 		return nil, nil, &ApiError{errorExec, err}
 	}
 	defer runutil.CloseWithLogOnErr(api.logger, q, "queryable labelValues")
 
+	if len(tenantMatchers) > 0 {
+		lsets, warnings, err := selectLabelSets(q, mint, maxt, tenantMatchers)
+		if err != nil {
+			return nil, nil, &ApiError{errorExec, err}
+		}
+
+		uniq := map[string]struct{}{}
+		for _, lset := range lsets {
+			if v := lset.Get(name); v != "" {
+				uniq[v] = struct{}{}
+			}
+		}
+		vals := make([]string, 0, len(uniq))
+		for v := range uniq {
+			vals = append(vals, v)
+		}
+		sort.Strings(vals)
+		return vals, warnings, nil
+	}
+
 	// TODO(fabxc): add back request context.
 
 	vals, warnings, err := q.LabelValues(name)
@@ -478,13 +1025,21 @@ func (api *API) series(r *http.Request) (interface{}, []error, *ApiError) {
 		end = maxTime
 	}
 
+	tenantMatchers, apiErr := api.parseTenantMatchers(r)
+	if apiErr != nil {
+		return nil, nil, apiErr
+	}
+
 	var matcherSets [][]*labels.Matcher
 	for _, s := range r.Form["match[]"] {
 		matchers, err := promql.ParseMetricSelector(s)
 		if err != nil {
 			return nil, nil, &ApiError{errorBadData, err}
 		}
-		matcherSets = append(matcherSets, matchers)
+		if err := api.checkSelectorRegexMatchers(matchers); err != nil {
+			return nil, nil, &ApiError{errorBadData, err}
+		}
+		matcherSets = append(matcherSets, append(matchers, tenantMatchers...))
 	}
 
 	enableDedup, apiErr := api.parseEnableDedupParam(r)
@@ -497,13 +1052,18 @@ func (api *API) series(r *http.Request) (interface{}, []error, *ApiError) {
 		return nil, nil, apiErr
 	}
 
+	validateReplicaLabels, apiErr := api.parseValidateReplicaLabelsParam(r)
+	if apiErr != nil {
+		return nil, nil, apiErr
+	}
+
 	enablePartialResponse, apiErr := api.parsePartialResponseParam(r)
 	if apiErr != nil {
 		return nil, nil, apiErr
 	}
 
 	// TODO(bwplotka): Support downsampling?
-	q, err := api.queryableCreate(enableDedup, replicaLabels, 0, enablePartialResponse).Querier(r.Context(), timestamp.FromTime(start), timestamp.FromTime(end))
+	q, err := api.queryableCreate(enableDedup, replicaLabels, 0, enablePartialResponse, validateReplicaLabels).Querier(r.Context(), timestamp.FromTime(start), timestamp.FromTime(end))
 	if err != nil {
 		return nil, nil, &ApiError{errorExec, err}
 	}
@@ -533,18 +1093,75 @@ func (api *API) series(r *http.Request) (interface{}, []error, *ApiError) {
 	return metrics, warnings, nil
 }
 
-func Respond(w http.ResponseWriter, data interface{}, warnings []error) {
+// defaultLabelsLookback is the time range label requests select series from if they have no start parameter.
+const defaultLabelsLookback = 24 * time.Hour
+
+// parseLabelsTimeRange returns the time range of a label request given by its start and end parameters. It defaults
+// to defaultLabelsLookback before end, which defaults to now.
+func (api *API) parseLabelsTimeRange(r *http.Request) (mint, maxt int64, _ *ApiError) {
+	end := api.now()
+	if t := r.FormValue("end"); t != "" {
+		var err error
+		end, err = parseTime(t)
+		if err != nil {
+			return 0, 0, &ApiError{errorBadData, err}
+		}
+	}
+
+	start := end.Add(-defaultLabelsLookback)
+	if t := r.FormValue("start"); t != "" {
+		var err error
+		start, err = parseTime(t)
+		if err != nil {
+			return 0, 0, &ApiError{errorBadData, err}
+		}
+	}
+
+	if end.Before(start) {
+		return 0, 0, &ApiError{errorBadData, errors.New("end timestamp must not be before start time")}
+	}
+	return timestamp.FromTime(start), timestamp.FromTime(end), nil
+}
+
+// selectLabelSets returns the label sets of all series matching the given matchers within [mint, maxt]. It is used
+// to answer label requests that have to be restricted by matchers, as the label requests of the StoreAPI do not
+// support them. Only labels are selected, no chunks.
+func selectLabelSets(q storage.Querier, mint, maxt int64, matchers []*labels.Matcher) ([]labels.Labels, storage.Warnings, error) {
+	set, warnings, err := q.Select(&storage.SelectParams{Start: mint, End: maxt, Func: "series"}, matchers...)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var lsets []labels.Labels
+	for set.Next() {
+		lsets = append(lsets, set.At().Labels())
+	}
+	return lsets, warnings, set.Err()
+}
+
+// Respond writes a successful API response. If an ETag header was set already, e.g. because it is known from the
+// request before evaluating it, and the If-None-Match header of the GET request matches it, only 304 Not Modified
+// is written.
+func Respond(w http.ResponseWriter, r *http.Request, data interface{}, warnings []error) {
+	respond(w, r, data, warnings, http.StatusOK)
+}
+
+// respond is like Respond, but writes the given status code instead of 200 OK.
+func respond(w http.ResponseWriter, r *http.Request, data interface{}, warnings []error, code int) {
 	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
 
-	resp := &response{
-		Status: statusSuccess,
-		Data:   data,
+	var b bytes.Buffer
+	if err := json.NewEncoder(&b).Encode(successResponse(data, warnings)); err != nil {
+		RespondError(w, &ApiError{ErrorInternal, errors.Wrap(err, "encode response")}, nil)
+		return
 	}
-	for _, warn := range warnings {
-		resp.Warnings = append(resp.Warnings, warn.Error())
+
+	if etag := w.Header().Get("ETag"); etag != "" && r != nil && r.Method == http.MethodGet && etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
 	}
-	_ = json.NewEncoder(w).Encode(resp)
+	w.WriteHeader(code)
+	_, _ = w.Write(b.Bytes())
 }
 
 func RespondError(w http.ResponseWriter, apiErr *ApiError, data interface{}) {
@@ -565,12 +1182,27 @@ func RespondError(w http.ResponseWriter, apiErr *ApiError, data interface{}) {
 	}
 	w.WriteHeader(code)
 
-	_ = json.NewEncoder(w).Encode(&response{
+	_ = json.NewEncoder(w).Encode(errorResponse(apiErr, data))
+}
+
+func successResponse(data interface{}, warnings []error) *response {
+	resp := &response{
+		Status: statusSuccess,
+		Data:   data,
+	}
+	for _, warn := range warnings {
+		resp.Warnings = append(resp.Warnings, warn.Error())
+	}
+	return resp
+}
+
+func errorResponse(apiErr *ApiError, data interface{}) *response {
+	return &response{
 		Status:    statusError,
 		ErrorType: apiErr.Typ,
 		Error:     apiErr.Err.Error(),
 		Data:      data,
-	})
+	}
 }
 
 func parseTime(s string) (time.Time, error) {
@@ -606,12 +1238,42 @@ func (api *API) labelNames(r *http.Request) (interface{}, []error, *ApiError) {
 		return nil, nil, apiErr
 	}
 
-	q, err := api.queryableCreate(true, nil, 0, enablePartialResponse).Querier(ctx, math.MinInt64, math.MaxInt64)
+	tenantMatchers, apiErr := api.parseTenantMatchers(r)
+	if apiErr != nil {
+		return nil, nil, apiErr
+	}
+
+	mint, maxt, apiErr := api.parseLabelsTimeRange(r)
+	if apiErr != nil {
+		return nil, nil, apiErr
+	}
+
+	q, err := api.queryableCreate(true, nil, 0, enablePartialResponse, false).Querier(ctx, mint, maxt)
 	if err != nil {
 		return nil, nil, &ApiError{errorExec, err}
 	}
 	defer runutil.CloseWithLogOnErr(api.logger, q, "queryable labelNames")
 
+	if len(tenantMatchers) > 0 {
+		lsets, warnings, err := selectLabelSets(q, mint, maxt, tenantMatchers)
+		if err != nil {
+			return nil, nil, &ApiError{errorExec, err}
+		}
+
+		uniq := map[string]struct{}{}
+		for _, lset := range lsets {
+			for _, l := range lset {
+				uniq[l.Name] = struct{}{}
+			}
+		}
+		names := make([]string, 0, len(uniq))
+		for n := range uniq {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return names, warnings, nil
+	}
+
 	names, warnings, err := q.LabelNames()
 	if err != nil {
 		return nil, nil, &ApiError{errorExec, err}
@@ -14,18 +14,23 @@
 package v1
 
 import (
+	"bufio"
+	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math"
 	"math/rand"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"reflect"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -36,15 +41,57 @@ import (
 	"github.com/prometheus/prometheus/pkg/labels"
 	"github.com/prometheus/prometheus/pkg/timestamp"
 	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/storage"
 	tsdb_labels "github.com/prometheus/prometheus/tsdb/labels"
 	"github.com/thanos-io/thanos/pkg/compact"
 	"github.com/thanos-io/thanos/pkg/component"
 	extpromhttp "github.com/thanos-io/thanos/pkg/extprom/http"
 	"github.com/thanos-io/thanos/pkg/query"
+	"github.com/thanos-io/thanos/pkg/runutil"
 	"github.com/thanos-io/thanos/pkg/store"
+	"github.com/thanos-io/thanos/pkg/store/storepb"
 	"github.com/thanos-io/thanos/pkg/testutil"
 )
 
+// callFreeEngine is a QueryEngine supporting only queries without function calls, counting the queries it creates.
+type callFreeEngine struct {
+	*promql.Engine
+	queries int
+}
+
+func (e *callFreeEngine) checkQuery(qs string) error {
+	expr, err := promql.ParseExpr(qs)
+	if err != nil {
+		return err
+	}
+	var hasCall bool
+	promql.Inspect(expr, func(node promql.Node, _ []promql.Node) error {
+		if _, ok := node.(*promql.Call); ok {
+			hasCall = true
+		}
+		return nil
+	})
+	if hasCall {
+		return ErrUnsupportedQuery
+	}
+	e.queries++
+	return nil
+}
+
+func (e *callFreeEngine) NewInstantQuery(q storage.Queryable, qs string, ts time.Time) (promql.Query, error) {
+	if err := e.checkQuery(qs); err != nil {
+		return nil, err
+	}
+	return e.Engine.NewInstantQuery(q, qs, ts)
+}
+
+func (e *callFreeEngine) NewRangeQuery(q storage.Queryable, qs string, start, end time.Time, interval time.Duration) (promql.Query, error) {
+	if err := e.checkQuery(qs); err != nil {
+		return nil, err
+	}
+	return e.Engine.NewRangeQuery(q, qs, start, end, interval)
+}
+
 func TestEndpoints(t *testing.T) {
 	defer leaktest.CheckTimeout(t, 10*time.Second)()
 
@@ -98,7 +145,7 @@ func TestEndpoints(t *testing.T) {
 
 	now := time.Now()
 	api := &API{
-		queryableCreate: query.NewQueryableCreator(nil, store.NewTSDBStore(nil, nil, db, component.Query, nil)),
+		queryableCreate: query.NewQueryableCreator(nil, store.NewTSDBStore(nil, nil, db, component.Query, nil), false, false, nil, nil),
 		queryEngine: promql.NewEngine(promql.EngineOpts{
 			Logger:        nil,
 			Reg:           nil,
@@ -106,16 +153,37 @@ func TestEndpoints(t *testing.T) {
 			MaxSamples:    10000,
 			Timeout:       100 * time.Second,
 		}),
-		now: func() time.Time { return now },
+		maxRangePerResolution: map[time.Duration]time.Duration{
+			0:         7 * 24 * time.Hour,
+			time.Hour: 365 * 24 * time.Hour,
+		},
+		enableLabelValuesDedup: true,
+		deniedFunctions:        map[string]struct{}{"label_replace": {}},
+		maxRegexMatchers:       2,
+		maxPointsPerSeries:     10,
+		now:                    func() time.Time { return now },
 	}
+	api.thanosEngine = &callFreeEngine{Engine: api.queryEngine}
+	strictAPI := *api
+	strictAPI.requireInstantTime = true
 
 	start := time.Unix(0, 0)
 
+	evalTime := func(t float64) *float64 { return &t }
+
+	var dailyPoints []promql.Point
+	for i := 0; i <= 8; i++ {
+		d := time.Duration(i) * 24 * time.Hour
+		dailyPoints = append(dailyPoints, promql.Point{V: d.Seconds(), T: timestamp.FromTime(start.Add(d))})
+	}
+
 	var tests = []struct {
 		endpoint ApiFunc
 		params   map[string]string
 		query    url.Values
 		method   string
+		// jsonBody, if set, is posted with an application/json Content-Type instead of the query.
+		jsonBody string
 		response interface{}
 		errType  ErrorType
 	}{
@@ -161,6 +229,286 @@ func TestEndpoints(t *testing.T) {
 				},
 			},
 		},
+		// Denied functions.
+		{
+			endpoint: api.query,
+			query: url.Values{
+				"query": []string{`label_replace(test_metric1, "foo", "baz", "", "")`},
+				"time":  []string{"123.4"},
+			},
+			errType: errorBadData,
+		},
+		{
+			endpoint: api.queryRange,
+			query: url.Values{
+				"query": []string{`sum(label_replace(test_metric1, "foo", "baz", "", ""))`},
+				"start": []string{"0"},
+				"end":   []string{"2"},
+				"step":  []string{"1"},
+			},
+			errType: errorBadData,
+		},
+		// Regex matchers limit.
+		{
+			endpoint: api.query,
+			query: url.Values{
+				"query": []string{`scalar(count(test_metric1{foo=~"b.+", foo!~"x"}))`},
+				"time":  []string{"123.4"},
+			},
+			response: &queryData{
+				ResultType: promql.ValueTypeScalar,
+				Result: promql.Scalar{
+					V: 2,
+					T: timestamp.FromTime(start.Add(123*time.Second + 400*time.Millisecond)),
+				},
+			},
+		},
+		{
+			endpoint: api.query,
+			query: url.Values{
+				"query": []string{`test_metric1{foo=~"b.+", foo!~"x", foo=~".*o"}`},
+				"time":  []string{"123.4"},
+			},
+			errType: errorBadData,
+		},
+		{
+			endpoint: api.queryRange,
+			query: url.Values{
+				"query": []string{`sum(rate(test_metric1{foo=~"b.+", foo!~"x", foo=~".*o"}[1m]))`},
+				"start": []string{"0"},
+				"end":   []string{"2"},
+				"step":  []string{"1"},
+			},
+			errType: errorBadData,
+		},
+		{
+			endpoint: api.series,
+			query: url.Values{
+				"match[]": []string{`test_metric1{foo=~"b.+", foo!~"x", foo=~".*o"}`},
+			},
+			errType: errorBadData,
+		},
+		{
+			endpoint: api.query,
+			query: url.Values{
+				"query": []string{"scalar(vector(2))"},
+				"time":  []string{"123.4"},
+			},
+			response: &queryData{
+				ResultType: promql.ValueTypeScalar,
+				Result: promql.Scalar{
+					V: 2,
+					T: timestamp.FromTime(start.Add(123*time.Second + 400*time.Millisecond)),
+				},
+			},
+		},
+		// Parameters given as JSON body.
+		{
+			endpoint: api.query,
+			jsonBody: `{"query": "scalar(vector(2))", "time": 123.4}`,
+			response: &queryData{
+				ResultType: promql.ValueTypeScalar,
+				Result: promql.Scalar{
+					V: 2,
+					T: timestamp.FromTime(start.Add(123*time.Second + 400*time.Millisecond)),
+				},
+			},
+		},
+		// JSON body fields take precedence over URL query parameters.
+		{
+			endpoint: api.query,
+			query: url.Values{
+				"query": []string{"1"},
+				"time":  []string{"1"},
+			},
+			jsonBody: `{"query": "2", "include_eval_time": true}`,
+			response: &queryData{
+				ResultType: promql.ValueTypeScalar,
+				Result: promql.Scalar{
+					V: 2,
+					T: timestamp.FromTime(start.Add(time.Second)),
+				},
+				EvalTime: evalTime(1),
+			},
+		},
+		{
+			endpoint: api.query,
+			jsonBody: `{"query": "2", "time": {"seconds": 1}}`,
+			errType:  errorBadData,
+		},
+		{
+			endpoint: api.query,
+			jsonBody: `{"query": "2"`,
+			errType:  errorBadData,
+		},
+		// Resolved evaluation timestamp of instant queries.
+		{
+			endpoint: api.query,
+			query: url.Values{
+				"query":             []string{"0.333"},
+				"time":              []string{"1970-01-01T01:02:03.4+01:00"},
+				"include_eval_time": []string{"true"},
+			},
+			response: &queryData{
+				ResultType: promql.ValueTypeScalar,
+				Result: promql.Scalar{
+					V: 0.333,
+					T: timestamp.FromTime(start.Add(123*time.Second + 400*time.Millisecond)),
+				},
+				EvalTime: evalTime(123.4),
+			},
+		},
+		{
+			endpoint: api.query,
+			query: url.Values{
+				"query":             []string{"2"},
+				"include_eval_time": []string{"1"},
+			},
+			response: &queryData{
+				ResultType: promql.ValueTypeScalar,
+				Result: promql.Scalar{
+					V: 2,
+					T: timestamp.FromTime(now),
+				},
+				EvalTime: evalTime(float64(timestamp.FromTime(now)) / 1000),
+			},
+		},
+		{
+			endpoint: api.query,
+			query: url.Values{
+				"query":             []string{"2"},
+				"include_eval_time": []string{"maybe"},
+			},
+			errType: errorBadData,
+		},
+		// Instant queries without time are evaluated now, unless an explicit time is required.
+		{
+			endpoint: api.query,
+			query: url.Values{
+				"query": []string{"2"},
+			},
+			response: &queryData{
+				ResultType: promql.ValueTypeScalar,
+				Result: promql.Scalar{
+					V: 2,
+					T: timestamp.FromTime(now),
+				},
+			},
+		},
+		{
+			endpoint: strictAPI.query,
+			query: url.Values{
+				"query": []string{"2"},
+			},
+			errType: errorBadData,
+		},
+		{
+			endpoint: strictAPI.query,
+			jsonBody: `{"query": "2"}`,
+			errType:  errorBadData,
+		},
+		{
+			endpoint: strictAPI.query,
+			query: url.Values{
+				"query": []string{"2"},
+				"time":  []string{"123.4"},
+			},
+			response: &queryData{
+				ResultType: promql.ValueTypeScalar,
+				Result: promql.Scalar{
+					V: 2,
+					T: timestamp.FromTime(start.Add(123*time.Second + 400*time.Millisecond)),
+				},
+			},
+		},
+		// Both engines give the same results, queries unsupported by the thanos engine fall back to the prometheus one.
+		{
+			endpoint: api.query,
+			query: url.Values{
+				"query":  []string{"2"},
+				"time":   []string{"123.4"},
+				"engine": []string{"prometheus"},
+			},
+			response: &queryData{
+				ResultType: promql.ValueTypeScalar,
+				Result: promql.Scalar{
+					V: 2,
+					T: timestamp.FromTime(start.Add(123*time.Second + 400*time.Millisecond)),
+				},
+			},
+		},
+		{
+			endpoint: api.query,
+			query: url.Values{
+				"query":  []string{"2"},
+				"time":   []string{"123.4"},
+				"engine": []string{"thanos"},
+			},
+			response: &queryData{
+				ResultType: promql.ValueTypeScalar,
+				Result: promql.Scalar{
+					V: 2,
+					T: timestamp.FromTime(start.Add(123*time.Second + 400*time.Millisecond)),
+				},
+			},
+		},
+		{
+			endpoint: api.query,
+			query: url.Values{
+				"query":  []string{"scalar(vector(2))"},
+				"time":   []string{"123.4"},
+				"engine": []string{"thanos"},
+			},
+			response: &queryData{
+				ResultType: promql.ValueTypeScalar,
+				Result: promql.Scalar{
+					V: 2,
+					T: timestamp.FromTime(start.Add(123*time.Second + 400*time.Millisecond)),
+				},
+			},
+		},
+		{
+			endpoint: api.queryRange,
+			query: url.Values{
+				"query":  []string{"2"},
+				"start":  []string{"0"},
+				"end":    []string{"2"},
+				"step":   []string{"1"},
+				"engine": []string{"thanos"},
+			},
+			response: &queryData{
+				ResultType: promql.ValueTypeMatrix,
+				Result: promql.Matrix{
+					promql.Series{
+						Points: []promql.Point{
+							{V: 2, T: timestamp.FromTime(start.Add(0 * time.Second))},
+							{V: 2, T: timestamp.FromTime(start.Add(1 * time.Second))},
+							{V: 2, T: timestamp.FromTime(start.Add(2 * time.Second))},
+						},
+						Metric: nil,
+					},
+				},
+			},
+		},
+		{
+			endpoint: api.query,
+			query: url.Values{
+				"query":  []string{"2"},
+				"engine": []string{"promql"},
+			},
+			errType: errorBadData,
+		},
+		{
+			endpoint: api.queryRange,
+			query: url.Values{
+				"query":  []string{"2"},
+				"start":  []string{"0"},
+				"end":    []string{"2"},
+				"step":   []string{"1"},
+				"engine": []string{"promql"},
+			},
+			errType: errorBadData,
+		},
 		// Query endpoint without deduplication.
 		{
 			endpoint: api.query,
@@ -410,24 +758,122 @@ func TestEndpoints(t *testing.T) {
 				},
 			},
 		},
-		// Missing query params in range queries.
+		// Range above the limit for raw resolution.
 		{
 			endpoint: api.queryRange,
 			query: url.Values{
 				"query": []string{"time()"},
-				"end":   []string{"2"},
-				"step":  []string{"1"},
+				"start": []string{"0"},
+				"end":   []string{"691200"},
+				"step":  []string{"86400"},
 			},
 			errType: errorBadData,
 		},
+		// Same range is allowed when 1h downsampled data can be used.
 		{
 			endpoint: api.queryRange,
 			query: url.Values{
-				"query": []string{"time()"},
-				"start": []string{"0"},
-				"step":  []string{"1"},
+				"query":                 []string{"time()"},
+				"start":                 []string{"0"},
+				"end":                   []string{"691200"},
+				"step":                  []string{"86400"},
+				"max_source_resolution": []string{"1h"},
+			},
+			response: &queryData{
+				ResultType: promql.ValueTypeMatrix,
+				Result: promql.Matrix{
+					promql.Series{
+						Points: dailyPoints,
+						Metric: nil,
+					},
+				},
 			},
-			errType: errorBadData,
+		},
+		// Series with more points than allowed.
+		{
+			endpoint: api.queryRange,
+			query: url.Values{
+				"query": []string{"time()"},
+				"start": []string{"0"},
+				"end":   []string{"10"},
+				"step":  []string{"1"},
+			},
+			errType: errorBadData,
+		},
+		// The limit is checked against the number of steps before evaluation, even if fewer points are present.
+		{
+			endpoint: api.queryRange,
+			query: url.Values{
+				"query": []string{"vector(time()) < 2"},
+				"start": []string{"0"},
+				"end":   []string{"10"},
+				"step":  []string{"1"},
+			},
+			errType: errorBadData,
+		},
+		// Exactly as many steps as allowed.
+		{
+			endpoint: api.queryRange,
+			query: url.Values{
+				"query": []string{"vector(time()) < 2"},
+				"start": []string{"0"},
+				"end":   []string{"9"},
+				"step":  []string{"1"},
+			},
+			response: &queryData{
+				ResultType: promql.ValueTypeMatrix,
+				Result: promql.Matrix{
+					promql.Series{
+						Points: []promql.Point{
+							{V: 0, T: timestamp.FromTime(start)},
+							{V: 1, T: timestamp.FromTime(start.Add(1 * time.Second))},
+						},
+						Metric: labels.Labels{},
+					},
+				},
+			},
+		},
+		// Range query parameters given as JSON body.
+		{
+			endpoint: api.queryRange,
+			jsonBody: `{"query": "time()", "start": "0", "end": 2, "step": 1, "dedup": true, "replicaLabels[]": ["replica"]}`,
+			response: &queryData{
+				ResultType: promql.ValueTypeMatrix,
+				Result: promql.Matrix{
+					promql.Series{
+						Points: []promql.Point{
+							{V: 0, T: timestamp.FromTime(start)},
+							{V: 1, T: timestamp.FromTime(start.Add(1 * time.Second))},
+							{V: 2, T: timestamp.FromTime(start.Add(2 * time.Second))},
+						},
+						Metric: nil,
+					},
+				},
+			},
+		},
+		{
+			endpoint: api.queryRange,
+			jsonBody: `{"query": "time()", "start": 0, "end": 2, "step": 1, "dedup": "sdfsf-json"}`,
+			errType:  errorBadData,
+		},
+		// Missing query params in range queries.
+		{
+			endpoint: api.queryRange,
+			query: url.Values{
+				"query": []string{"time()"},
+				"end":   []string{"2"},
+				"step":  []string{"1"},
+			},
+			errType: errorBadData,
+		},
+		{
+			endpoint: api.queryRange,
+			query: url.Values{
+				"query": []string{"time()"},
+				"start": []string{"0"},
+				"step":  []string{"1"},
+			},
+			errType: errorBadData,
 		},
 		{
 			endpoint: api.queryRange,
@@ -523,6 +969,31 @@ func TestEndpoints(t *testing.T) {
 				"boo",
 			},
 		},
+		// Replica label values are omitted with deduplication.
+		{
+			endpoint: api.labelValues,
+			params: map[string]string{
+				"name": "replica",
+			},
+			query: url.Values{
+				"replicaLabels[]": []string{"replica"},
+			},
+			response: []string(nil),
+		},
+		{
+			endpoint: api.labelValues,
+			params: map[string]string{
+				"name": "replica",
+			},
+			query: url.Values{
+				"replicaLabels[]": []string{"replica"},
+				"dedup":           []string{"false"},
+			},
+			response: []string{
+				"a",
+				"b",
+			},
+		},
 		// Bad name parameter.
 		{
 			endpoint: api.labelValues,
@@ -797,7 +1268,13 @@ func TestEndpoints(t *testing.T) {
 			params := test.query.Encode()
 
 			var body io.Reader
-			if test.method == http.MethodPost {
+			contentType := "application/x-www-form-urlencoded"
+			if test.jsonBody != "" {
+				test.method = http.MethodPost
+				body = strings.NewReader(test.jsonBody)
+				contentType = "application/json"
+				reqURL += "?" + params
+			} else if test.method == http.MethodPost {
 				body = strings.NewReader(params)
 			} else if test.method == "" {
 				test.method = "ANY"
@@ -810,7 +1287,7 @@ func TestEndpoints(t *testing.T) {
 			}
 
 			if body != nil {
-				req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+				req.Header.Set("Content-Type", contentType)
 			}
 
 			resp, _, apiErr := test.endpoint(req.WithContext(ctx))
@@ -837,9 +1314,146 @@ func TestEndpoints(t *testing.T) {
 	}
 }
 
+func TestEndpoints_TenantMatchers(t *testing.T) {
+	db, err := testutil.NewTSDB()
+	defer func() { testutil.Ok(t, db.Close()) }()
+	testutil.Ok(t, err)
+
+	app := db.Appender()
+	for _, lbl := range []tsdb_labels.Labels{
+		tsdb_labels.FromStrings("__name__", "up", "tenant", "foo", "job", "a"),
+		tsdb_labels.FromStrings("__name__", "up", "tenant", "bar", "job", "b"),
+		tsdb_labels.FromStrings("__name__", "down", "tenant", "bar", "instance", "c"),
+	} {
+		_, err := app.Add(lbl, 0, 1)
+		testutil.Ok(t, err)
+	}
+	testutil.Ok(t, app.Commit())
+
+	api := &API{
+		queryableCreate: query.NewQueryableCreator(nil, store.NewTSDBStore(nil, nil, db, component.Query, nil), false, false, nil, nil),
+		queryEngine: promql.NewEngine(promql.EngineOpts{
+			MaxConcurrent: 20,
+			MaxSamples:    10000,
+			Timeout:       100 * time.Second,
+		}),
+		tenantHeader: "THANOS-TENANT",
+		tenantLabel:  "tenant",
+		now:          func() time.Time { return time.Unix(0, 0) },
+	}
+
+	upFoo := labels.FromStrings("__name__", "up", "job", "a", "tenant", "foo")
+	for _, tcase := range []struct {
+		endpoint ApiFunc
+		params   map[string]string
+		query    url.Values
+		tenant   string
+		response interface{}
+		errType  ErrorType
+	}{
+		{
+			endpoint: api.query,
+			query:    url.Values{"query": []string{"up"}, "time": []string{"0"}},
+			tenant:   "foo",
+			response: &queryData{
+				ResultType: promql.ValueTypeVector,
+				Result:     promql.Vector{{Metric: upFoo, Point: promql.Point{T: 0, V: 1}}},
+			},
+		},
+		// Client matchers can not override the enforced one.
+		{
+			endpoint: api.query,
+			query:    url.Values{"query": []string{`sum(up{tenant="bar"}) or count_over_time(up{tenant=~".+"}[1m])`}, "time": []string{"0"}},
+			tenant:   "foo",
+			response: &queryData{
+				ResultType: promql.ValueTypeVector,
+				Result:     promql.Vector{{Metric: labels.FromStrings("job", "a", "tenant", "foo"), Point: promql.Point{T: 0, V: 1}}},
+			},
+		},
+		{
+			endpoint: api.queryRange,
+			query:    url.Values{"query": []string{"up"}, "start": []string{"0"}, "end": []string{"0"}, "step": []string{"1"}},
+			tenant:   "foo",
+			response: &queryData{
+				ResultType: promql.ValueTypeMatrix,
+				Result:     promql.Matrix{{Metric: upFoo, Points: []promql.Point{{T: 0, V: 1}}}},
+			},
+		},
+		{
+			endpoint: api.series,
+			query:    url.Values{"match[]": []string{`{__name__=~".+"}`, `{tenant="bar"}`}},
+			tenant:   "foo",
+			response: []labels.Labels{upFoo},
+		},
+		{
+			endpoint: api.labelValues,
+			params:   map[string]string{"name": "tenant"},
+			tenant:   "foo",
+			response: []string{"foo"},
+		},
+		{
+			endpoint: api.labelValues,
+			params:   map[string]string{"name": "__name__"},
+			tenant:   "bar",
+			response: []string{"down", "up"},
+		},
+		{
+			endpoint: api.labelNames,
+			tenant:   "foo",
+			response: []string{"__name__", "job", "tenant"},
+		},
+		// Only series within the requested time range are considered.
+		{
+			endpoint: api.labelNames,
+			query:    url.Values{"start": []string{"10"}, "end": []string{"20"}},
+			tenant:   "foo",
+			response: []string{},
+		},
+		{
+			endpoint: api.labelValues,
+			params:   map[string]string{"name": "__name__"},
+			query:    url.Values{"start": []string{"20"}, "end": []string{"10"}},
+			tenant:   "bar",
+			errType:  errorBadData,
+		},
+		// Requests without tenant are rejected.
+		{
+			endpoint: api.query,
+			query:    url.Values{"query": []string{"up"}, "time": []string{"0"}},
+			errType:  errorBadData,
+		},
+		{
+			endpoint: api.labelNames,
+			errType:  errorBadData,
+		},
+	} {
+		t.Run("", func(t *testing.T) {
+			ctx := context.Background()
+			for p, v := range tcase.params {
+				ctx = route.WithParam(ctx, p, v)
+			}
+
+			req, err := http.NewRequest("GET", "http://example.com?"+tcase.query.Encode(), nil)
+			testutil.Ok(t, err)
+			if tcase.tenant != "" {
+				req.Header.Set("THANOS-TENANT", tcase.tenant)
+			}
+
+			resp, _, apiErr := tcase.endpoint(req.WithContext(ctx))
+			if tcase.errType != errorNone {
+				testutil.Assert(t, apiErr != nil, "expected error")
+				testutil.Equals(t, tcase.errType, apiErr.Typ)
+				return
+			}
+			testutil.Assert(t, apiErr == nil, "unexpected error: %v", apiErr)
+			testutil.Equals(t, tcase.response, resp)
+		})
+	}
+}
+
 func TestRespondSuccess(t *testing.T) {
 	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		Respond(w, "test", nil)
+		Respond(w, r, "test", nil)
 	}))
 	defer s.Close()
 
@@ -1047,57 +1661,792 @@ func TestOptionsMethod(t *testing.T) {
 	}
 }
 
-func BenchmarkQueryResultEncoding(b *testing.B) {
-	var mat promql.Matrix
-	for i := 0; i < 1000; i++ {
-		lset := labels.FromStrings(
-			"__name__", "my_test_metric_name",
-			"instance", fmt.Sprintf("abcdefghijklmnopqrstuvxyz-%d", i),
-			"job", "test-test",
-			"method", "ABCD",
-			"status", "199",
-			"namespace", "something",
-			"long-label", "34grnt83j0qxj309je9rgt9jf2jd-92jd-92jf9wrfjre",
-		)
-		var points []promql.Point
-		for j := 0; j < b.N/1000; j++ {
-			points = append(points, promql.Point{
-				T: int64(j * 10000),
-				V: rand.Float64(),
-			})
+func TestRequestID(t *testing.T) {
+	var buf bytes.Buffer
+	r := route.New()
+	api := &API{}
+	api.Register(r, &opentracing.NoopTracer{}, log.NewLogfmtLogger(log.NewSyncWriter(&buf)), extpromhttp.NewNopInstrumentationMiddleware())
+
+	s := httptest.NewServer(r)
+	defer s.Close()
+
+	do := func(method, path, reqID string) *http.Response {
+		req, err := http.NewRequest(method, s.URL+path, nil)
+		testutil.Ok(t, err)
+		if reqID != "" {
+			req.Header.Set(RequestIDHeader, reqID)
 		}
-		mat = append(mat, promql.Series{
-			Metric: lset,
-			Points: points,
-		})
+		resp, err := http.DefaultClient.Do(req)
+		testutil.Ok(t, err)
+		testutil.Ok(t, resp.Body.Close())
+		return resp
 	}
-	input := &queryData{
-		ResultType: promql.ValueTypeMatrix,
-		Result:     mat,
+
+	// Incoming request ID is echoed.
+	resp := do("OPTIONS", "/any_path", "my-request-id")
+	testutil.Equals(t, "my-request-id", resp.Header.Get(RequestIDHeader))
+
+	// Request ID is generated if absent.
+	resp = do("OPTIONS", "/any_path", "")
+	generated := resp.Header.Get(RequestIDHeader)
+	testutil.Assert(t, generated != "", "expected generated request ID")
+	testutil.Assert(t, generated != do("OPTIONS", "/any_path", "").Header.Get(RequestIDHeader), "expected unique request IDs")
+
+	// Request ID is echoed and logged on failed requests.
+	resp = do("GET", "/query?time=invalid", "failed-request-id")
+	testutil.Equals(t, http.StatusBadRequest, resp.StatusCode)
+	testutil.Equals(t, "failed-request-id", resp.Header.Get(RequestIDHeader))
+	testutil.Assert(t, strings.Contains(buf.String(), "request_id=failed-request-id"), "request ID not logged: %s", buf.String())
+}
+
+func TestAccessLog(t *testing.T) {
+	var buf bytes.Buffer
+	r := route.New()
+	api := &API{tenantHeader: "THANOS-TENANT", accessLogger: log.NewJSONLogger(log.NewSyncWriter(&buf))}
+	api.Register(r, &opentracing.NoopTracer{}, log.NewNopLogger(), extpromhttp.NewNopInstrumentationMiddleware())
+
+	s := httptest.NewServer(r)
+	defer s.Close()
+
+	req, err := http.NewRequest("GET", s.URL+"/query?query=up&time=invalid", nil)
+	testutil.Ok(t, err)
+	req.Header.Set(RequestIDHeader, "get-request-id")
+	req.Header.Set("THANOS-TENANT", "team-a")
+	resp, err := http.DefaultClient.Do(req)
+	testutil.Ok(t, err)
+	testutil.Ok(t, resp.Body.Close())
+
+	// Parameters of POST requests are logged as well.
+	req, err = http.NewRequest("POST", s.URL+"/query", strings.NewReader("query=rate(up[5m])&time=invalid"))
+	testutil.Ok(t, err)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set(RequestIDHeader, "post-request-id")
+	resp, err = http.DefaultClient.Do(req)
+	testutil.Ok(t, err)
+	testutil.Ok(t, resp.Body.Close())
+
+	req, err = http.NewRequest("OPTIONS", s.URL+"/any_path", nil)
+	testutil.Ok(t, err)
+	resp, err = http.DefaultClient.Do(req)
+	testutil.Ok(t, err)
+	testutil.Ok(t, resp.Body.Close())
+
+	var entries []map[string]interface{}
+	dec := json.NewDecoder(&buf)
+	for dec.More() {
+		var e map[string]interface{}
+		testutil.Ok(t, dec.Decode(&e))
+		entries = append(entries, e)
 	}
-	b.ResetTimer()
+	testutil.Equals(t, 3, len(entries))
 
-	c, err := json.Marshal(&input)
-	testutil.Ok(b, err)
-	fmt.Println(len(c))
+	for i, exp := range []map[string]interface{}{
+		{"endpoint": "query", "request_id": "get-request-id", "tenant": "team-a", "query": "up", "status": float64(http.StatusBadRequest)},
+		{"endpoint": "query", "request_id": "post-request-id", "tenant": "", "query": "rate(up[5m])", "status": float64(http.StatusBadRequest)},
+		{"endpoint": "options", "tenant": "", "query": "", "status": float64(http.StatusNoContent)},
+	} {
+		e := entries[i]
+		for k, v := range exp {
+			testutil.Equals(t, v, e[k])
+		}
+		_, err := time.Parse(time.RFC3339Nano, e["ts"].(string))
+		testutil.Ok(t, err)
+		_, err = time.ParseDuration(e["duration"].(string))
+		testutil.Ok(t, err)
+		testutil.Assert(t, strings.HasPrefix(e["client"].(string), "127.0.0.1:"), "unexpected client %v", e["client"])
+	}
 }
 
-func TestParseDownsamplingParamMillis(t *testing.T) {
-	var tests = []struct {
-		maxSourceResolutionParam string
-		result                   int64
-		step                     time.Duration
-		fail                     bool
-		enableAutodownsampling   bool
-	}{
-		{
-			maxSourceResolutionParam: "0s",
-			enableAutodownsampling:   false,
-			step:                     time.Hour,
-			result:                   int64(compact.ResolutionLevelRaw),
-			fail:                     false,
+// testStoreClient is a store client with the given address and time range.
+type testStoreClient struct {
+	store.Client
+
+	addr       string
+	mint, maxt int64
+	blockSet   string
+}
+
+func (c *testStoreClient) Addr() string                  { return c.addr }
+func (c *testStoreClient) TimeRange() (int64, int64)     { return c.mint, c.maxt }
+func (c *testStoreClient) LabelSets() []storepb.LabelSet { return nil }
+func (c *testStoreClient) BlockSetID() string            { return c.blockSet }
+
+func TestQueryETag(t *testing.T) {
+	db, err := testutil.NewTSDB()
+	defer func() { testutil.Ok(t, db.Close()) }()
+	testutil.Ok(t, err)
+
+	app := db.Appender()
+	_, err = app.Add(tsdb_labels.FromStrings("__name__", "up", "job", "a"), 0, 1)
+	testutil.Ok(t, err)
+	testutil.Ok(t, app.Commit())
+
+	var (
+		queries int
+		stores  = []store.Client{&testStoreClient{addr: "a", mint: 0, maxt: 1000, blockSet: "1"}}
+		qc      = query.NewQueryableCreator(nil, store.NewTSDBStore(nil, nil, db, component.Query, nil), false, false, nil, nil)
+	)
+	r := route.New()
+	api := &API{
+		queryableCreate: func(deduplicate bool, replicaLabels []string, maxResolutionMillis int64, partialResponse, validateReplicaLabels bool) storage.Queryable {
+			queries++
+			return qc(deduplicate, replicaLabels, maxResolutionMillis, partialResponse, validateReplicaLabels)
 		},
-		{
+		queryEngine: promql.NewEngine(promql.EngineOpts{
+			MaxConcurrent: 20,
+			MaxSamples:    10000,
+			Timeout:       100 * time.Second,
+		}),
+		stores: func() []store.Client { return stores },
+		now:    func() time.Time { return time.Unix(0, 0) },
+	}
+	api.Register(r, &opentracing.NoopTracer{}, log.NewNopLogger(), extpromhttp.NewNopInstrumentationMiddleware())
+
+	s := httptest.NewServer(r)
+	defer s.Close()
+
+	do := func(method, query, etag string) (*http.Response, []byte) {
+		req, err := http.NewRequest(method, s.URL+"/query?"+query, nil)
+		testutil.Ok(t, err)
+		if etag != "" {
+			req.Header.Set("If-None-Match", etag)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		testutil.Ok(t, err)
+		defer func() { testutil.Ok(t, resp.Body.Close()) }()
+		body, err := ioutil.ReadAll(resp.Body)
+		testutil.Ok(t, err)
+		return resp, body
+	}
+
+	resp, _ := do("GET", "query=up&time=0", "")
+	testutil.Equals(t, http.StatusOK, resp.StatusCode)
+	etag := resp.Header.Get("ETag")
+	testutil.Assert(t, etag != "", "expected ETag header")
+	testutil.Equals(t, 1, queries)
+
+	// Repeated identical query with a matching ETag is not modified and not evaluated.
+	resp, cached := do("GET", "time=0&query=up", etag)
+	testutil.Equals(t, http.StatusNotModified, resp.StatusCode)
+	testutil.Equals(t, etag, resp.Header.Get("ETag"))
+	testutil.Equals(t, 0, len(cached))
+	testutil.Equals(t, 1, queries)
+
+	resp, _ = do("GET", "query=up&time=0", `"other", `+etag)
+	testutil.Equals(t, http.StatusNotModified, resp.StatusCode)
+
+	// A different query has a different ETag.
+	resp, _ = do("GET", "query=up*2&time=0", etag)
+	testutil.Equals(t, http.StatusOK, resp.StatusCode)
+	testutil.Assert(t, etag != resp.Header.Get("ETag"), "expected different ETag for different query")
+
+	// POST requests and queries evaluated now are never cached.
+	resp, _ = do("POST", "query=up&time=0", etag)
+	testutil.Equals(t, http.StatusOK, resp.StatusCode)
+	testutil.Equals(t, "", resp.Header.Get("ETag"))
+	resp, _ = do("GET", "query=up", etag)
+	testutil.Equals(t, http.StatusOK, resp.StatusCode)
+	testutil.Equals(t, "", resp.Header.Get("ETag"))
+
+	// Stores without data up to the evaluation time are irrelevant.
+	stores = append(stores, &testStoreClient{addr: "b", mint: 2000, maxt: math.MaxInt64})
+	resp, _ = do("GET", "query=up&time=0", etag)
+	testutil.Equals(t, http.StatusNotModified, resp.StatusCode)
+
+	// Replaced blocks change the ETag, even if the time range of the store stays the same.
+	stores[0] = &testStoreClient{addr: "a", mint: 0, maxt: 1000, blockSet: "2"}
+	resp, _ = do("GET", "query=up&time=0", etag)
+	testutil.Equals(t, http.StatusOK, resp.StatusCode)
+	testutil.Assert(t, etag != resp.Header.Get("ETag"), "expected different ETag for replaced blocks")
+	etag = resp.Header.Get("ETag")
+
+	// New blocks change the ETag.
+	stores[0] = &testStoreClient{addr: "a", mint: 0, maxt: 2000, blockSet: "3"}
+	resp, _ = do("GET", "query=up&time=0", etag)
+	testutil.Equals(t, http.StatusOK, resp.StatusCode)
+	testutil.Assert(t, etag != resp.Header.Get("ETag"), "expected different ETag for changed blocks")
+
+	// Queries of stores not reporting their blocks are never cached.
+	stores[0] = &testStoreClient{addr: "a", mint: 0, maxt: 2000}
+	resp, _ = do("GET", "query=up&time=0", etag)
+	testutil.Equals(t, http.StatusOK, resp.StatusCode)
+	testutil.Equals(t, "", resp.Header.Get("ETag"))
+
+	// Queries of stores still ingesting data are never cached.
+	resp, _ = do("GET", "query=up&time=3", etag)
+	testutil.Equals(t, http.StatusOK, resp.StatusCode)
+	testutil.Equals(t, "", resp.Header.Get("ETag"))
+}
+
+// warningQueryable adds a warning to the result of selects with a matcher on the "partial" label, as a store API
+// failing during a query with partial response enabled would.
+type warningQueryable struct {
+	storage.Queryable
+}
+
+func (q *warningQueryable) Querier(ctx context.Context, mint, maxt int64) (storage.Querier, error) {
+	querier, err := q.Queryable.Querier(ctx, mint, maxt)
+	if err != nil {
+		return nil, err
+	}
+	return &warningQuerier{Querier: querier}, nil
+}
+
+type warningQuerier struct {
+	storage.Querier
+}
+
+func (q *warningQuerier) Select(params *storage.SelectParams, ms ...*labels.Matcher) (storage.SeriesSet, storage.Warnings, error) {
+	set, warnings, err := q.Querier.Select(params, ms...)
+	for _, m := range ms {
+		if m.Name == "partial" {
+			warnings = append(warnings, errors.New("store unavailable"))
+		}
+	}
+	return set, warnings, err
+}
+
+func TestQuery_PartialResponseStatus(t *testing.T) {
+	db, err := testutil.NewTSDB()
+	defer func() { testutil.Ok(t, db.Close()) }()
+	testutil.Ok(t, err)
+
+	app := db.Appender()
+	_, err = app.Add(tsdb_labels.FromStrings("__name__", "up", "job", "a"), 0, 1)
+	testutil.Ok(t, err)
+	testutil.Ok(t, app.Commit())
+
+	qc := query.NewQueryableCreator(nil, store.NewTSDBStore(nil, nil, db, component.Query, nil), false, false, nil, nil)
+	for _, tcase := range []struct {
+		partialResponseStatus bool
+		query                 string
+		expCode               int
+	}{
+		{partialResponseStatus: true, query: `up`, expCode: http.StatusOK},
+		{partialResponseStatus: true, query: `up{partial=""}`, expCode: http.StatusPartialContent},
+		{partialResponseStatus: false, query: `up{partial=""}`, expCode: http.StatusOK},
+	} {
+		t.Run("", func(t *testing.T) {
+			r := route.New()
+			api := &API{
+				queryableCreate: func(deduplicate bool, replicaLabels []string, maxResolutionMillis int64, partialResponse, validateReplicaLabels bool) storage.Queryable {
+					return &warningQueryable{Queryable: qc(deduplicate, replicaLabels, maxResolutionMillis, partialResponse, validateReplicaLabels)}
+				},
+				queryEngine: promql.NewEngine(promql.EngineOpts{
+					MaxConcurrent: 20,
+					MaxSamples:    10000,
+					Timeout:       100 * time.Second,
+				}),
+				partialResponseStatus: tcase.partialResponseStatus,
+				now:                   func() time.Time { return time.Unix(0, 0) },
+			}
+			api.Register(r, &opentracing.NoopTracer{}, log.NewNopLogger(), extpromhttp.NewNopInstrumentationMiddleware())
+
+			s := httptest.NewServer(r)
+			defer s.Close()
+
+			for _, path := range []string{
+				"/query?" + url.Values{"query": []string{tcase.query}, "time": []string{"0"}}.Encode(),
+				"/query_range?" + url.Values{"query": []string{tcase.query}, "start": []string{"0"}, "end": []string{"10"}, "step": []string{"1"}}.Encode(),
+			} {
+				resp, err := http.Get(s.URL + path)
+				testutil.Ok(t, err)
+				body, err := ioutil.ReadAll(resp.Body)
+				testutil.Ok(t, err)
+				testutil.Ok(t, resp.Body.Close())
+				testutil.Equals(t, tcase.expCode, resp.StatusCode)
+
+				var res response
+				testutil.Ok(t, json.Unmarshal(body, &res))
+				testutil.Equals(t, statusSuccess, res.Status)
+			}
+		})
+	}
+}
+
+type slowQueryable struct {
+	storage.Queryable
+	delay time.Duration
+}
+
+func (q *slowQueryable) Querier(ctx context.Context, mint, maxt int64) (storage.Querier, error) {
+	querier, err := q.Queryable.Querier(ctx, mint, maxt)
+	if err != nil {
+		return nil, err
+	}
+	return &slowQuerier{Querier: querier, delay: q.delay}, nil
+}
+
+type slowQuerier struct {
+	storage.Querier
+	delay time.Duration
+}
+
+func (q *slowQuerier) Select(params *storage.SelectParams, ms ...*labels.Matcher) (storage.SeriesSet, storage.Warnings, error) {
+	set, warnings, err := q.Querier.Select(params, ms...)
+	if err != nil {
+		return nil, warnings, err
+	}
+	return &slowSeriesSet{SeriesSet: set, delay: q.delay}, warnings, nil
+}
+
+type slowSeriesSet struct {
+	storage.SeriesSet
+	delay time.Duration
+}
+
+func (s *slowSeriesSet) Next() bool {
+	time.Sleep(s.delay)
+	return s.SeriesSet.Next()
+}
+
+func TestQueryRange_EventStream(t *testing.T) {
+	db, err := testutil.NewTSDB()
+	defer func() { testutil.Ok(t, db.Close()) }()
+	testutil.Ok(t, err)
+
+	app := db.Appender()
+	for _, job := range []string{"a", "b", "c"} {
+		_, err := app.Add(tsdb_labels.FromStrings("__name__", "up", "job", job), 0, 1)
+		testutil.Ok(t, err)
+	}
+	testutil.Ok(t, app.Commit())
+
+	r := route.New()
+	queryableCreate := query.NewQueryableCreator(nil, store.NewTSDBStore(nil, nil, db, component.Query, nil), false, false, nil, nil)
+	api := &API{
+		queryableCreate: func(deduplicate bool, replicaLabels []string, maxResolutionMillis int64, partialResponse, validateReplicaLabels bool) storage.Queryable {
+			return &slowQueryable{Queryable: queryableCreate(deduplicate, replicaLabels, maxResolutionMillis, partialResponse, validateReplicaLabels), delay: 50 * time.Millisecond}
+		},
+		queryEngine: promql.NewEngine(promql.EngineOpts{
+			MaxConcurrent: 20,
+			MaxSamples:    10000,
+			Timeout:       100 * time.Second,
+		}),
+		progressInterval: 10 * time.Millisecond,
+		now:              func() time.Time { return time.Unix(0, 0) },
+	}
+	api.Register(r, &opentracing.NoopTracer{}, log.NewNopLogger(), extpromhttp.NewNopInstrumentationMiddleware())
+
+	s := httptest.NewServer(r)
+	defer s.Close()
+
+	events := func(query string) (types []string, data []string) {
+		req, err := http.NewRequest("GET", s.URL+"/query_range?"+query, nil)
+		testutil.Ok(t, err)
+		req.Header.Set("Accept", "text/event-stream")
+
+		resp, err := http.DefaultClient.Do(req)
+		testutil.Ok(t, err)
+		defer func() { testutil.Ok(t, resp.Body.Close()) }()
+		testutil.Equals(t, http.StatusOK, resp.StatusCode)
+		testutil.Equals(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+		body, err := ioutil.ReadAll(resp.Body)
+		testutil.Ok(t, err)
+		for _, e := range strings.Split(strings.TrimSuffix(string(body), "\n\n"), "\n\n") {
+			lines := strings.Split(e, "\n")
+			testutil.Equals(t, 2, len(lines))
+			types = append(types, strings.TrimPrefix(lines[0], "event: "))
+			data = append(data, strings.TrimPrefix(lines[1], "data: "))
+		}
+		return types, data
+	}
+
+	types, data := events("query=up&start=0&end=1&step=1")
+	testutil.Assert(t, len(types) > 1, "expected progress events, got %v", types)
+
+	// Progress events precede the final result and report increasing numbers of processed series.
+	var lastSeries int64
+	for i, typ := range types[:len(types)-1] {
+		testutil.Equals(t, "progress", typ)
+
+		var p progressEvent
+		testutil.Ok(t, json.Unmarshal([]byte(data[i]), &p))
+		testutil.Assert(t, p.SeriesProcessed >= lastSeries, "series processed decreased from %d to %d", lastSeries, p.SeriesProcessed)
+		testutil.Assert(t, p.SeriesProcessed <= 3, "unexpected series processed %d", p.SeriesProcessed)
+		lastSeries = p.SeriesProcessed
+	}
+	testutil.Assert(t, lastSeries > 0, "expected processed series to be reported")
+
+	testutil.Equals(t, "result", types[len(types)-1])
+	var res struct {
+		Status string `json:"status"`
+		Data   struct {
+			ResultType string            `json:"resultType"`
+			Result     []json.RawMessage `json:"result"`
+		} `json:"data"`
+	}
+	testutil.Ok(t, json.Unmarshal([]byte(data[len(data)-1]), &res))
+	testutil.Equals(t, "success", res.Status)
+	testutil.Equals(t, "matrix", res.Data.ResultType)
+	testutil.Equals(t, 3, len(res.Data.Result))
+
+	// Errors are reported in the result event.
+	types, data = events("query=up&start=1&end=0&step=1")
+	testutil.Equals(t, "result", types[len(types)-1])
+	var errRes response
+	testutil.Ok(t, json.Unmarshal([]byte(data[len(data)-1]), &errRes))
+	testutil.Equals(t, statusError, errRes.Status)
+	testutil.Equals(t, errorBadData, errRes.ErrorType)
+}
+
+func TestQueryRange_EventStreamGzip(t *testing.T) {
+	db, err := testutil.NewTSDB()
+	defer func() { testutil.Ok(t, db.Close()) }()
+	testutil.Ok(t, err)
+
+	release := make(chan struct{})
+	r := route.New()
+	queryableCreate := query.NewQueryableCreator(nil, store.NewTSDBStore(nil, nil, db, component.Query, nil), false, false, nil, nil)
+	api := &API{
+		queryableCreate: func(deduplicate bool, replicaLabels []string, maxResolutionMillis int64, partialResponse, validateReplicaLabels bool) storage.Queryable {
+			return &blockingQueryable{Queryable: queryableCreate(deduplicate, replicaLabels, maxResolutionMillis, partialResponse, validateReplicaLabels), release: release}
+		},
+		queryEngine: promql.NewEngine(promql.EngineOpts{
+			MaxConcurrent: 20,
+			MaxSamples:    10000,
+			Timeout:       100 * time.Second,
+		}),
+		progressInterval: 10 * time.Millisecond,
+		now:              func() time.Time { return time.Unix(0, 0) },
+	}
+	api.Register(r, &opentracing.NoopTracer{}, log.NewNopLogger(), extpromhttp.NewNopInstrumentationMiddleware())
+
+	s := httptest.NewServer(r)
+	defer s.Close()
+
+	req, err := http.NewRequest("GET", s.URL+"/query_range?query=up&start=0&end=1&step=1", nil)
+	testutil.Ok(t, err)
+	req.Header.Set("Accept", "text/event-stream")
+	req.Header.Set("Accept-Encoding", "gzip")
+
+	// A progress event arrives while the query is still being evaluated, although the client accepts gzip.
+	type result struct {
+		resp *http.Response
+		br   *bufio.Reader
+		line string
+		err  error
+	}
+	resc := make(chan result, 1)
+	go func() {
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			resc <- result{err: err}
+			return
+		}
+		br := bufio.NewReader(resp.Body)
+		line, err := br.ReadString('\n')
+		resc <- result{resp: resp, br: br, line: line, err: err}
+	}()
+	var res result
+	select {
+	case res = <-resc:
+		close(release)
+	case <-time.After(5 * time.Second):
+		close(release)
+		t.Fatal("no progress event received while the query is evaluated")
+	}
+	testutil.Ok(t, res.err)
+	defer func() { testutil.Ok(t, res.resp.Body.Close()) }()
+	testutil.Equals(t, "", res.resp.Header.Get("Content-Encoding"))
+	testutil.Equals(t, "event: progress\n", res.line)
+
+	rest, err := ioutil.ReadAll(res.br)
+	testutil.Ok(t, err)
+	testutil.Assert(t, strings.Contains(string(rest), "event: result\n"), "expected result event, got %q", rest)
+}
+
+func BenchmarkQueryResultEncoding(b *testing.B) {
+	var mat promql.Matrix
+	for i := 0; i < 1000; i++ {
+		lset := labels.FromStrings(
+			"__name__", "my_test_metric_name",
+			"instance", fmt.Sprintf("abcdefghijklmnopqrstuvxyz-%d", i),
+			"job", "test-test",
+			"method", "ABCD",
+			"status", "199",
+			"namespace", "something",
+			"long-label", "34grnt83j0qxj309je9rgt9jf2jd-92jd-92jf9wrfjre",
+		)
+		var points []promql.Point
+		for j := 0; j < b.N/1000; j++ {
+			points = append(points, promql.Point{
+				T: int64(j * 10000),
+				V: rand.Float64(),
+			})
+		}
+		mat = append(mat, promql.Series{
+			Metric: lset,
+			Points: points,
+		})
+	}
+	input := &queryData{
+		ResultType: promql.ValueTypeMatrix,
+		Result:     mat,
+	}
+	b.ResetTimer()
+
+	c, err := json.Marshal(&input)
+	testutil.Ok(b, err)
+	fmt.Println(len(c))
+}
+
+func TestQuery_ValidateReplicaLabels(t *testing.T) {
+	db, err := testutil.NewTSDB()
+	defer func() { testutil.Ok(t, db.Close()) }()
+	testutil.Ok(t, err)
+
+	app := db.Appender()
+	for _, replica := range []string{"r0", "r1"} {
+		_, err := app.Add(tsdb_labels.FromStrings("__name__", "up", "job", "a", "replica", replica), 0, 1)
+		testutil.Ok(t, err)
+	}
+	testutil.Ok(t, app.Commit())
+
+	api := &API{
+		queryableCreate: query.NewQueryableCreator(nil, store.NewTSDBStore(nil, nil, db, component.Query, nil), false, false, nil, nil),
+		queryEngine: promql.NewEngine(promql.EngineOpts{
+			MaxConcurrent: 20,
+			MaxSamples:    10000,
+			Timeout:       100 * time.Second,
+		}),
+		now: func() time.Time { return time.Unix(0, 0) },
+	}
+
+	for _, tcase := range []struct {
+		query       url.Values
+		expWarnings []string
+	}{
+		{
+			query: url.Values{"query": []string{"up"}, "time": []string{"0"}, "replicaLabels[]": []string{"replcia"}},
+		},
+		{
+			query: url.Values{"query": []string{"up"}, "time": []string{"0"}, "replicaLabels[]": []string{"replica"}, "validate_replica_labels": []string{"true"}},
+		},
+		{
+			query:       url.Values{"query": []string{"up"}, "time": []string{"0"}, "replicaLabels[]": []string{"replcia"}, "validate_replica_labels": []string{"true"}},
+			expWarnings: []string{`replica label "replcia" is not present on any of the 2 selected series, deduplication along it has no effect`},
+		},
+	} {
+		t.Run("", func(t *testing.T) {
+			req, err := http.NewRequest("GET", "http://example.com?"+tcase.query.Encode(), nil)
+			testutil.Ok(t, err)
+
+			_, warnings, apiErr := api.query(req)
+			testutil.Assert(t, apiErr == nil, "unexpected error %v", apiErr)
+
+			var got []string
+			for _, w := range warnings {
+				got = append(got, w.Error())
+			}
+			testutil.Equals(t, tcase.expWarnings, got)
+		})
+	}
+}
+
+func TestQuery_ReplicaLabelsStats(t *testing.T) {
+	db, err := testutil.NewTSDB()
+	defer func() { testutil.Ok(t, db.Close()) }()
+	testutil.Ok(t, err)
+
+	app := db.Appender()
+	_, err = app.Add(tsdb_labels.FromStrings("__name__", "up", "job", "a", "replica", "r0"), 0, 1)
+	testutil.Ok(t, err)
+	testutil.Ok(t, app.Commit())
+
+	api := &API{
+		queryableCreate: query.NewQueryableCreator(nil, store.NewTSDBStore(nil, nil, db, component.Query, nil), false, false, nil, nil),
+		queryEngine: promql.NewEngine(promql.EngineOpts{
+			MaxConcurrent: 20,
+			MaxSamples:    10000,
+			Timeout:       100 * time.Second,
+		}),
+		replicaLabels: []string{"replica", "rule_replica"},
+		now:           func() time.Time { return time.Unix(0, 0) },
+	}
+
+	for _, endpoint := range []struct {
+		f     ApiFunc
+		query url.Values
+	}{
+		{f: api.query, query: url.Values{"query": []string{"up"}, "time": []string{"0"}}},
+		{f: api.queryRange, query: url.Values{"query": []string{"up"}, "start": []string{"0"}, "end": []string{"1"}, "step": []string{"1"}}},
+	} {
+		for _, tcase := range []struct {
+			params   url.Values
+			expStats *queryStats
+			expErr   bool
+		}{
+			// Not requested.
+			{},
+			{
+				params: url.Values{"include_replica_labels": []string{"false"}},
+			},
+			// Defaults of the replica labels flag.
+			{
+				params:   url.Values{"include_replica_labels": []string{"true"}},
+				expStats: &queryStats{ReplicaLabels: []string{"replica", "rule_replica"}},
+			},
+			// Request parameters overwrite the defaults.
+			{
+				params:   url.Values{"include_replica_labels": []string{"1"}, "replicaLabels[]": []string{"replica1", "replica2"}},
+				expStats: &queryStats{ReplicaLabels: []string{"replica1", "replica2"}},
+			},
+			// No replica labels are applied without deduplication.
+			{
+				params:   url.Values{"include_replica_labels": []string{"true"}, "dedup": []string{"false"}},
+				expStats: &queryStats{ReplicaLabels: []string{}},
+			},
+			{
+				params:   url.Values{"include_replica_labels": []string{"true"}, "replicaLabels[]": []string{"replica1"}, "dedup": []string{"false"}},
+				expStats: &queryStats{ReplicaLabels: []string{}},
+			},
+			{
+				params: url.Values{"include_replica_labels": []string{"maybe"}},
+				expErr: true,
+			},
+		} {
+			t.Run("", func(t *testing.T) {
+				q := url.Values{}
+				for k, v := range endpoint.query {
+					q[k] = v
+				}
+				for k, v := range tcase.params {
+					q[k] = v
+				}
+				req, err := http.NewRequest("GET", "http://example.com?"+q.Encode(), nil)
+				testutil.Ok(t, err)
+
+				data, _, apiErr := endpoint.f(req)
+				if tcase.expErr {
+					testutil.Assert(t, apiErr != nil, "expected error")
+					testutil.Equals(t, errorBadData, apiErr.Typ)
+					return
+				}
+				testutil.Assert(t, apiErr == nil, "unexpected error %v", apiErr)
+				testutil.Equals(t, tcase.expStats, data.(*queryData).Stats)
+			})
+		}
+	}
+
+	// Reported labels are not affected by later changes to the defaults.
+	req, err := http.NewRequest("GET", "http://example.com?query=up&time=0&include_replica_labels=true", nil)
+	testutil.Ok(t, err)
+	data, _, apiErr := api.query(req)
+	testutil.Assert(t, apiErr == nil, "unexpected error %v", apiErr)
+	api.replicaLabels[0] = "changed"
+	testutil.Equals(t, []string{"replica", "rule_replica"}, data.(*queryData).Stats.ReplicaLabels)
+}
+
+func TestQuery_EngineSelection(t *testing.T) {
+	db, err := testutil.NewTSDB()
+	defer func() { testutil.Ok(t, db.Close()) }()
+	testutil.Ok(t, err)
+
+	qe := promql.NewEngine(promql.EngineOpts{
+		MaxConcurrent: 20,
+		MaxSamples:    10000,
+		Timeout:       100 * time.Second,
+	})
+	thanosEngine := &callFreeEngine{Engine: qe}
+	api := &API{
+		queryableCreate: query.NewQueryableCreator(nil, store.NewTSDBStore(nil, nil, db, component.Query, nil), false, false, nil, nil),
+		queryEngine:     qe,
+		thanosEngine:    thanosEngine,
+		now:             func() time.Time { return time.Unix(0, 0) },
+	}
+
+	for _, tcase := range []struct {
+		engine     string
+		query      string
+		expQueries int
+	}{
+		{engine: "", query: "1 + 1"},
+		{engine: EnginePrometheus, query: "1 + 1"},
+		{engine: EngineThanos, query: "1 + 1", expQueries: 1},
+		// Unsupported by the thanos engine, so evaluated by the prometheus one.
+		{engine: EngineThanos, query: "scalar(vector(2))"},
+	} {
+		t.Run(tcase.engine+" "+tcase.query, func(t *testing.T) {
+			thanosEngine.queries = 0
+
+			req, err := http.NewRequest("GET", "http://example.com?"+url.Values{"query": []string{tcase.query}, "time": []string{"1"}, "engine": []string{tcase.engine}}.Encode(), nil)
+			testutil.Ok(t, err)
+
+			res, _, apiErr := api.query(req)
+			testutil.Assert(t, apiErr == nil, "unexpected error %v", apiErr)
+			testutil.Equals(t, promql.Scalar{V: 2, T: 1000}, res.(*queryData).Result)
+			testutil.Equals(t, tcase.expQueries, thanosEngine.queries)
+		})
+	}
+
+	// Without a thanos engine, as in production by default, queries selecting it are evaluated by the prometheus
+	// one with a warning.
+	api.thanosEngine = nil
+	for _, tcase := range []struct {
+		endpoint ApiFunc
+		params   string
+	}{
+		{endpoint: api.query, params: "query=1%2B1&time=1&engine=thanos"},
+		{endpoint: api.queryRange, params: "query=1%2B1&start=1&end=1&step=1&engine=thanos"},
+	} {
+		req, err := http.NewRequest("GET", "http://example.com?"+tcase.params, nil)
+		testutil.Ok(t, err)
+		_, warnings, apiErr := tcase.endpoint(req)
+		testutil.Assert(t, apiErr == nil, "unexpected error %v", apiErr)
+		testutil.Equals(t, 1, len(warnings))
+	}
+
+	req, err := http.NewRequest("GET", "http://example.com?query=1%2B1&time=1&engine=prometheus", nil)
+	testutil.Ok(t, err)
+	res, warnings, apiErr := api.query(req)
+	testutil.Assert(t, apiErr == nil, "unexpected error %v", apiErr)
+	testutil.Equals(t, promql.Scalar{V: 2, T: 1000}, res.(*queryData).Result)
+	testutil.Equals(t, 0, len(warnings))
+}
+
+func TestCheckFunctions(t *testing.T) {
+	for _, tcase := range []struct {
+		allowed, denied []string
+		query           string
+		expErr          bool
+	}{
+		{query: `label_replace(up, "a", "b", "", "")`},
+		{denied: []string{"label_replace"}, query: `rate(up[5m])`},
+		{denied: []string{"label_replace"}, query: `sum(label_replace(up, "a", "b", "", ""))`, expErr: true},
+		{allowed: []string{"rate"}, query: `sum(rate(up[5m]))`},
+		{allowed: []string{"rate"}, query: `sum(rate(up[5m])) / scalar(up)`, expErr: true},
+		{allowed: []string{"rate", "irate"}, denied: []string{"irate"}, query: `irate(up[5m])`, expErr: true},
+	} {
+		t.Run("", func(t *testing.T) {
+			api := NewAPI(nil, nil, nil, nil, false, false, nil, 0, nil, false, "", "", tcase.allowed, tcase.denied, 0, nil, false, 0, false, false, 0, 0, nil, nil)
+			err := api.checkFunctions(tcase.query)
+			if tcase.expErr {
+				testutil.NotOk(t, err)
+			} else {
+				testutil.Ok(t, err)
+			}
+		})
+	}
+}
+
+func TestParseDownsamplingParamMillis(t *testing.T) {
+	var tests = []struct {
+		maxSourceResolutionParam string
+		result                   int64
+		step                     time.Duration
+		fail                     bool
+		enableAutodownsampling   bool
+	}{
+		{
+			maxSourceResolutionParam: "0s",
+			enableAutodownsampling:   false,
+			step:                     time.Hour,
+			result:                   int64(compact.ResolutionLevelRaw),
+			fail:                     false,
+		},
+		{
 			maxSourceResolutionParam: "5m",
 			step:                     time.Hour,
 			enableAutodownsampling:   false,
@@ -1150,3 +2499,259 @@ func TestParseDownsamplingParamMillis(t *testing.T) {
 
 	}
 }
+
+// blockingQueryable counts the queriers created for evaluations and blocks their creation until released.
+type blockingQueryable struct {
+	storage.Queryable
+	release <-chan struct{}
+	calls   int64
+}
+
+func (q *blockingQueryable) Querier(ctx context.Context, mint, maxt int64) (storage.Querier, error) {
+	atomic.AddInt64(&q.calls, 1)
+	<-q.release
+	return q.Queryable.Querier(ctx, mint, maxt)
+}
+
+func TestQuery_Coalescing(t *testing.T) {
+	db, err := testutil.NewTSDB()
+	defer func() { testutil.Ok(t, db.Close()) }()
+	testutil.Ok(t, err)
+
+	app := db.Appender()
+	for _, job := range []string{"a", "b", "c"} {
+		_, err := app.Add(tsdb_labels.FromStrings("__name__", "up", "job", job), 0, 1)
+		testutil.Ok(t, err)
+	}
+	testutil.Ok(t, app.Commit())
+
+	release := make(chan struct{})
+	queryable := &blockingQueryable{
+		Queryable: query.NewQueryableCreator(nil, store.NewTSDBStore(nil, nil, db, component.Query, nil), false, false, nil, nil)(false, nil, 0, false, false),
+		release:   release,
+	}
+
+	r := route.New()
+	api := &API{
+		queryableCreate: func(bool, []string, int64, bool, bool) storage.Queryable { return queryable },
+		queryEngine: promql.NewEngine(promql.EngineOpts{
+			MaxConcurrent: 20,
+			MaxSamples:    10000,
+			Timeout:       100 * time.Second,
+		}),
+		tenantHeader: "THANOS-TENANT",
+		coalescer:    &coalescer{},
+		now:          func() time.Time { return time.Unix(0, 0) },
+	}
+	api.Register(r, &opentracing.NoopTracer{}, log.NewNopLogger(), extpromhttp.NewNopInstrumentationMiddleware())
+
+	s := httptest.NewServer(r)
+	defer s.Close()
+
+	get := func(query string) (int, string, error) {
+		req, err := http.NewRequest("GET", s.URL+"/query_range?"+query, nil)
+		if err != nil {
+			return 0, "", err
+		}
+		req.Header.Set("THANOS-TENANT", "team-a")
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return 0, "", err
+		}
+		defer func() { _ = resp.Body.Close() }()
+
+		b, err := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, string(b), err
+	}
+
+	const n = 5
+	var wg sync.WaitGroup
+	bodies := make([]string, n)
+	errs := make([]error, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			// Parameters are equal regardless of their order.
+			q := "query=up&start=0&end=1&step=1"
+			if i%2 == 1 {
+				q = "step=1&end=1&start=0&query=up"
+			}
+			var status int
+			status, bodies[i], errs[i] = get(q)
+			if errs[i] == nil && status != http.StatusOK {
+				errs[i] = fmt.Errorf("unexpected status %d: %s", status, bodies[i])
+			}
+		}(i)
+	}
+
+	// Release the evaluation only once all other requests are waiting for it.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	testutil.Ok(t, runutil.Retry(10*time.Millisecond, ctx.Done(), func() error {
+		api.coalescer.mtx.Lock()
+		defer api.coalescer.mtx.Unlock()
+
+		if len(api.coalescer.calls) != 1 {
+			return fmt.Errorf("expected 1 call in flight, got %d", len(api.coalescer.calls))
+		}
+		for _, c := range api.coalescer.calls {
+			if c.waiters != n-1 {
+				return fmt.Errorf("expected %d waiters, got %d", n-1, c.waiters)
+			}
+		}
+		return nil
+	}))
+	close(release)
+	wg.Wait()
+
+	for i := 0; i < n; i++ {
+		testutil.Ok(t, errs[i])
+		testutil.Equals(t, bodies[0], bodies[i])
+	}
+	testutil.Assert(t, strings.Contains(bodies[0], `"resultType":"matrix"`), "unexpected response %s", bodies[0])
+	testutil.Equals(t, int64(1), atomic.LoadInt64(&queryable.calls))
+	testutil.Equals(t, 0, len(api.coalescer.calls))
+
+	// Subsequent requests are evaluated again.
+	status, _, err := get("query=up&start=0&end=1&step=1")
+	testutil.Ok(t, err)
+	testutil.Equals(t, http.StatusOK, status)
+	testutil.Equals(t, int64(2), atomic.LoadInt64(&queryable.calls))
+}
+
+func TestCoalescer_WaiterCanceled(t *testing.T) {
+	c := &coalescer{}
+
+	release := make(chan struct{})
+	leaderDone := make(chan struct{})
+	go func() {
+		defer close(leaderDone)
+		_, _, _ = c.do(context.Background(), "key", func() (interface{}, []error, *ApiError) {
+			<-release
+			return "result", nil, nil
+		})
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	testutil.Ok(t, runutil.Retry(10*time.Millisecond, ctx.Done(), func() error {
+		c.mtx.Lock()
+		defer c.mtx.Unlock()
+
+		if len(c.calls) != 1 {
+			return fmt.Errorf("expected 1 call in flight, got %d", len(c.calls))
+		}
+		return nil
+	}))
+
+	// A canceled waiter returns without waiting for the evaluation in flight.
+	waiterCtx, waiterCancel := context.WithCancel(context.Background())
+	waiterCancel()
+	_, _, apiErr := c.do(waiterCtx, "key", func() (interface{}, []error, *ApiError) {
+		t.Fatal("unexpected evaluation")
+		return nil, nil, nil
+	})
+	testutil.Assert(t, apiErr != nil, "expected error")
+	testutil.Equals(t, errorCanceled, apiErr.Typ)
+
+	waiterCtx, waiterCancel = context.WithTimeout(context.Background(), time.Millisecond)
+	defer waiterCancel()
+	_, _, apiErr = c.do(waiterCtx, "key", nil)
+	testutil.Assert(t, apiErr != nil, "expected error")
+	testutil.Equals(t, errorTimeout, apiErr.Typ)
+
+	c.mtx.Lock()
+	for _, call := range c.calls {
+		testutil.Equals(t, 0, call.waiters)
+	}
+	c.mtx.Unlock()
+
+	// Waiters still receive the result of the evaluation.
+	var data interface{}
+	waiterDone := make(chan struct{})
+	go func() {
+		defer close(waiterDone)
+		data, _, apiErr = c.do(context.Background(), "key", nil)
+	}()
+	testutil.Ok(t, runutil.Retry(10*time.Millisecond, ctx.Done(), func() error {
+		c.mtx.Lock()
+		defer c.mtx.Unlock()
+
+		for _, call := range c.calls {
+			if call.waiters != 1 {
+				return fmt.Errorf("expected 1 waiter, got %d", call.waiters)
+			}
+		}
+		return nil
+	}))
+	close(release)
+	<-waiterDone
+	testutil.Assert(t, apiErr == nil, "unexpected error %v", apiErr)
+	testutil.Equals(t, "result", data)
+	<-leaderDone
+}
+
+func TestQuery_MaxConcurrentRangeQueries(t *testing.T) {
+	db, err := testutil.NewTSDB()
+	defer func() { testutil.Ok(t, db.Close()) }()
+	testutil.Ok(t, err)
+
+	app := db.Appender()
+	_, err = app.Add(tsdb_labels.FromStrings("__name__", "up", "job", "a"), 0, 1)
+	testutil.Ok(t, err)
+	testutil.Ok(t, app.Commit())
+
+	r := route.New()
+	api := &API{
+		queryableCreate: query.NewQueryableCreator(nil, store.NewTSDBStore(nil, nil, db, component.Query, nil), false, false, nil, nil),
+		queryEngine: promql.NewEngine(promql.EngineOpts{
+			MaxConcurrent: 20,
+			MaxSamples:    10000,
+			Timeout:       100 * time.Second,
+		}),
+		rangeQueryGate: newQueryGate(2),
+		now:            func() time.Time { return time.Unix(0, 0) },
+	}
+	api.Register(r, &opentracing.NoopTracer{}, log.NewNopLogger(), extpromhttp.NewNopInstrumentationMiddleware())
+
+	s := httptest.NewServer(r)
+	defer s.Close()
+
+	get := func(path string) (int, response) {
+		resp, err := http.Get(s.URL + path)
+		testutil.Ok(t, err)
+		body, err := ioutil.ReadAll(resp.Body)
+		testutil.Ok(t, err)
+		testutil.Ok(t, resp.Body.Close())
+
+		var res response
+		testutil.Ok(t, json.Unmarshal(body, &res))
+		return resp.StatusCode, res
+	}
+	const (
+		instantQuery = "/query?query=up&time=0"
+		rangeQuery   = "/query_range?query=up&start=0&end=10&step=1&timeout=100ms"
+	)
+
+	// Saturate the range query slots as long-running range queries would.
+	for i := 0; i < 2; i++ {
+		testutil.Assert(t, api.rangeQueryGate.start(context.Background()) == nil, "expected free range query slot")
+	}
+
+	code, res := get(rangeQuery)
+	testutil.Equals(t, http.StatusServiceUnavailable, code)
+	testutil.Equals(t, errorTimeout, res.ErrorType)
+
+	// Instant queries are still evaluated.
+	code, res = get(instantQuery)
+	testutil.Equals(t, http.StatusOK, code)
+	testutil.Equals(t, statusSuccess, res.Status)
+
+	api.rangeQueryGate.done()
+	code, res = get(rangeQuery)
+	testutil.Equals(t, http.StatusOK, code)
+	testutil.Equals(t, statusSuccess, res.Status)
+}
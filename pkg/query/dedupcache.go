@@ -0,0 +1,269 @@
+package query
+
+import (
+	"container/list"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/storage"
+	"github.com/thanos-io/thanos/pkg/store"
+)
+
+// DedupCache caches deduplicated series of selects, so that identical selects of repeated queries, e.g. from
+// dashboards, neither fetch nor deduplicate them again. Entries are only used as long as the block set they were
+// selected from did not change. Selects with warnings and selects of data that may still change, because they
+// overlap the time range of a store still ingesting data, are not cached.
+type DedupCache struct {
+	maxBytes uint64
+	blockSet func(mint, maxt int64) (string, bool)
+
+	mtx      sync.Mutex
+	curBytes uint64
+	lru      *list.List
+	entries  map[string]*list.Element
+
+	requests prometheus.Counter
+	hits     prometheus.Counter
+}
+
+type dedupCacheEntry struct {
+	key      string
+	blockSet string
+	series   []*cachedSeries
+	size     uint64
+}
+
+// NewDedupCache returns a DedupCache holding at most maxBytes of deduplicated series, evicting the least recently
+// used selects. blockSet returns an identifier of the blocks available to selects of the given time range, which
+// changes whenever they do, and false if their data may still change, e.g. BlockSetKey of the queried stores.
+// Caching is disabled if maxBytes is 0, in which case nil is returned.
+func NewDedupCache(reg prometheus.Registerer, maxBytes uint64, blockSet func(mint, maxt int64) (string, bool)) *DedupCache {
+	if maxBytes == 0 {
+		return nil
+	}
+	c := &DedupCache{
+		maxBytes: maxBytes,
+		blockSet: blockSet,
+		lru:      list.New(),
+		entries:  map[string]*list.Element{},
+
+		requests: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "thanos_query_dedup_cache_requests_total",
+			Help: "Total number of deduplicated selects looked up in the deduplication cache.",
+		}),
+		hits: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "thanos_query_dedup_cache_hits_total",
+			Help: "Total number of deduplicated selects served from the deduplication cache.",
+		}),
+	}
+	if reg != nil {
+		reg.MustRegister(c.requests, c.hits)
+	}
+	return c
+}
+
+// BlockSetKey returns an identifier of the blocks the given stores expose within [mint, maxt], based on the block set
+// IDs they report along with their addresses, time ranges and labels. False is returned if the range overlaps the one
+// of a store whose data may change without the key changing: one still ingesting data, i.e. whose maximum time is
+// open-ended like the one of a sidecar or receiver, or one not reporting its block set ID.
+func BlockSetKey(stores []store.Client, mint, maxt int64) (string, bool) {
+	keys := make([]string, 0, len(stores))
+	for _, s := range stores {
+		smint, smaxt := s.TimeRange()
+		if smint > maxt || smaxt < mint {
+			continue
+		}
+		id := s.BlockSetID()
+		if smaxt == math.MaxInt64 || id == "" {
+			return "", false
+		}
+		keys = append(keys, fmt.Sprintf("%s/%d/%d/%v/%s", s.Addr(), smint, smaxt, s.LabelSets(), id))
+	}
+	sort.Strings(keys)
+	return strings.Join(keys, ","), true
+}
+
+// get returns the cached series of the given key, unless they were cached from another block set.
+func (c *DedupCache) get(key, blockSet string) (storage.SeriesSet, bool) {
+	c.requests.Inc()
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	e, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := e.Value.(*dedupCacheEntry)
+	if entry.blockSet != blockSet {
+		c.remove(e)
+		return nil, false
+	}
+	c.lru.MoveToFront(e)
+	c.hits.Inc()
+	return &cachedSeriesSet{series: entry.series, i: -1}, true
+}
+
+// set returns a set of the series of the given one, which were selected from the given block set. They are cached
+// under the given key once the returned set is fully consumed, unless they exceed the maximum size of the cache,
+// in which case series are no longer buffered as soon as that is known.
+func (c *DedupCache) set(key, blockSet string, set storage.SeriesSet) storage.SeriesSet {
+	return &cachingSeriesSet{SeriesSet: set, cache: c, key: key, blockSet: blockSet, caching: true}
+}
+
+// add caches the given series under the given key and evicts the least recently used entries beyond the maximum size.
+func (c *DedupCache) add(key, blockSet string, series []*cachedSeries, size uint64) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if e, ok := c.entries[key]; ok {
+		c.remove(e)
+	}
+	c.entries[key] = c.lru.PushFront(&dedupCacheEntry{key: key, blockSet: blockSet, series: series, size: size})
+	c.curBytes += size
+	for c.curBytes > c.maxBytes {
+		c.remove(c.lru.Back())
+	}
+}
+
+func (c *DedupCache) remove(e *list.Element) {
+	entry := e.Value.(*dedupCacheEntry)
+	c.lru.Remove(e)
+	delete(c.entries, entry.key)
+	c.curBytes -= entry.size
+}
+
+// cachingSeriesSet buffers the series of the wrapped set while they are consumed and caches them at its end.
+type cachingSeriesSet struct {
+	storage.SeriesSet
+
+	cache    *DedupCache
+	key      string
+	blockSet string
+
+	// caching is false once the series turned out to be too large to be cached or could not be read.
+	caching bool
+	series  []*cachedSeries
+	size    uint64
+	cur     storage.Series
+	err     error
+}
+
+func (s *cachingSeriesSet) Next() bool {
+	if s.err != nil {
+		return false
+	}
+	if !s.SeriesSet.Next() {
+		if s.caching && s.SeriesSet.Err() == nil {
+			s.cache.add(s.key, s.blockSet, s.series, s.size)
+		}
+		s.caching, s.series = false, nil
+		return false
+	}
+	if !s.caching {
+		s.cur = s.SeriesSet.At()
+		return true
+	}
+
+	cs, err := readSeries(s.SeriesSet.At())
+	if err != nil {
+		s.err = err
+		s.caching, s.series = false, nil
+		return false
+	}
+	s.cur = cs
+	s.size += cs.size()
+	if s.size > s.cache.maxBytes {
+		// Series already returned keep being used by the caller, but no further ones are buffered.
+		s.caching, s.series = false, nil
+		return true
+	}
+	s.series = append(s.series, cs)
+	return true
+}
+
+func (s *cachingSeriesSet) At() storage.Series { return s.cur }
+
+func (s *cachingSeriesSet) Err() error {
+	if s.err != nil {
+		return s.err
+	}
+	return s.SeriesSet.Err()
+}
+
+// readSeries reads all samples of the given series into memory.
+func readSeries(s storage.Series) (*cachedSeries, error) {
+	cs := &cachedSeries{lset: s.Labels()}
+
+	it := s.Iterator()
+	for it.Next() {
+		t, v := it.At()
+		cs.ts = append(cs.ts, t)
+		cs.vs = append(cs.vs, v)
+	}
+	return cs, it.Err()
+}
+
+type cachedSeries struct {
+	lset labels.Labels
+	ts   []int64
+	vs   []float64
+}
+
+func (s *cachedSeries) Labels() labels.Labels { return s.lset }
+
+// size returns the approximate number of bytes the series takes in memory.
+func (s *cachedSeries) size() uint64 {
+	size := uint64(16 * len(s.ts))
+	for _, l := range s.lset {
+		size += uint64(len(l.Name) + len(l.Value))
+	}
+	return size
+}
+
+func (s *cachedSeries) Iterator() storage.SeriesIterator {
+	return &cachedSeriesIterator{s: s, i: -1}
+}
+
+type cachedSeriesSet struct {
+	series []*cachedSeries
+	i      int
+}
+
+func (s *cachedSeriesSet) Next() bool {
+	s.i++
+	return s.i < len(s.series)
+}
+
+func (s *cachedSeriesSet) At() storage.Series { return s.series[s.i] }
+
+func (s *cachedSeriesSet) Err() error { return nil }
+
+type cachedSeriesIterator struct {
+	s *cachedSeries
+	i int
+}
+
+func (it *cachedSeriesIterator) Seek(t int64) bool {
+	if it.i < 0 {
+		it.i = 0
+	}
+	it.i += sort.Search(len(it.s.ts)-it.i, func(j int) bool {
+		return it.s.ts[it.i+j] >= t
+	})
+	return it.i < len(it.s.ts)
+}
+
+func (it *cachedSeriesIterator) At() (int64, float64) { return it.s.ts[it.i], it.s.vs[it.i] }
+
+func (it *cachedSeriesIterator) Next() bool {
+	it.i++
+	return it.i < len(it.s.ts)
+}
+
+func (it *cachedSeriesIterator) Err() error { return nil }
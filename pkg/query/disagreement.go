@@ -0,0 +1,61 @@
+package query
+
+import (
+	"math"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/prometheus/pkg/labels"
+)
+
+// ReplicaDisagreements counts samples of the same series and timestamp on which replicas disagree during
+// deduplication, which usually indicates a problem with the data of one of them, e.g. a replica that missed
+// a restart of the scraped target. Values disagree if they differ by more than the threshold relative to the
+// larger one of them. A nil ReplicaDisagreements does not count anything.
+type ReplicaDisagreements struct {
+	threshold float64
+	total     *prometheus.CounterVec
+}
+
+// NewReplicaDisagreements returns ReplicaDisagreements for the given relative threshold, e.g. 0.1 for values
+// differing by more than 10%. Counting is disabled if threshold is 0, in which case nil is returned.
+func NewReplicaDisagreements(reg prometheus.Registerer, threshold float64) *ReplicaDisagreements {
+	if threshold <= 0 {
+		return nil
+	}
+	d := &ReplicaDisagreements{
+		threshold: threshold,
+		total: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "thanos_query_dedup_replica_disagreements_total",
+			Help: "Total number of samples on which replicas disagreed during deduplication, by metric name.",
+		}, []string{"metric"}),
+	}
+	if reg != nil {
+		reg.MustRegister(d.total)
+	}
+	return d
+}
+
+// forSeries returns the function checking samples of replicas of the given series, or nil if d is nil.
+func (d *ReplicaDisagreements) forSeries(lset labels.Labels) func(a, b float64) {
+	if d == nil {
+		return nil
+	}
+	var c prometheus.Counter
+	return func(a, b float64) {
+		if !d.disagree(a, b) {
+			return
+		}
+		if c == nil {
+			c = d.total.WithLabelValues(lset.Get(labels.MetricName))
+		}
+		c.Inc()
+	}
+}
+
+func (d *ReplicaDisagreements) disagree(a, b float64) bool {
+	// Stale markers and other NaNs are never compared.
+	if math.IsNaN(a) || math.IsNaN(b) {
+		return false
+	}
+	return math.Abs(a-b) > d.threshold*math.Max(math.Abs(a), math.Abs(b))
+}
@@ -186,6 +186,21 @@ func (s *chunkSeries) Iterator() storage.SeriesIterator {
 			}
 		}
 		sit = newChunkSeriesIterator(its)
+	case resAggrStddev:
+		for _, c := range s.chunks {
+			switch {
+			case c.Raw != nil:
+				its = append(its, getFirstIterator(c.Raw))
+			case c.SumSquares != nil:
+				sum, cnt, sq := getFirstIterator(c.Sum), getFirstIterator(c.Count), getFirstIterator(c.SumSquares)
+				its = append(its, downsample.NewStddevChunkIterator(cnt, sum, sq))
+			default:
+				// Blocks downsampled without the sum of squares only allow approximating by averages.
+				sum, cnt := getFirstIterator(c.Sum), getFirstIterator(c.Count)
+				its = append(its, downsample.NewAverageChunkIterator(cnt, sum))
+			}
+		}
+		sit = newChunkSeriesIterator(its)
 	default:
 		return errSeriesIterator{err: errors.Errorf("unexpected result aggregate type %v", s.aggr)}
 	}
@@ -329,15 +344,25 @@ func (it *chunkSeriesIterator) Err() error {
 type dedupSeriesSet struct {
 	set           storage.SeriesSet
 	replicaLabels map[string]struct{}
+	fillGaps      bool
+	// separateMissing keeps series without any replica label apart from the replicas of the same series.
+	separateMissing bool
+	disagreements   *ReplicaDisagreements
 
-	replicas []storage.Series
-	lset     labels.Labels
-	peek     storage.Series
-	ok       bool
-}
-
-func newDedupSeriesSet(set storage.SeriesSet, replicaLabels map[string]struct{}) storage.SeriesSet {
-	s := &dedupSeriesSet{set: set, replicaLabels: replicaLabels}
+	replicas   []storage.Series
+	lset       labels.Labels
+	hasReplica bool
+	peek       storage.Series
+	ok         bool
+}
+
+// newDedupSeriesSet returns a set that merges series differing only in replica labels. If fillGaps is true,
+// gaps in the data of one replica are filled with all samples of another replica within them.
+// A series without any replica label is merged with the replicas of the same series like another replica,
+// unless separateMissing is true, in which case it is returned on its own.
+// Samples replicas disagree on are counted by disagreements, if not nil.
+func newDedupSeriesSet(set storage.SeriesSet, replicaLabels map[string]struct{}, fillGaps, separateMissing bool, disagreements *ReplicaDisagreements) storage.SeriesSet {
+	s := &dedupSeriesSet{set: set, replicaLabels: replicaLabels, fillGaps: fillGaps, separateMissing: separateMissing, disagreements: disagreements}
 	s.ok = s.set.Next()
 	if s.ok {
 		s.peek = s.set.At()
@@ -351,27 +376,27 @@ func (s *dedupSeriesSet) Next() bool {
 	}
 	// Set the label set we are currently gathering to the peek element
 	// without the replica label if it exists.
-	s.lset = s.peekLset()
+	s.lset, s.hasReplica = s.peekLset()
 	s.replicas = append(s.replicas[:0], s.peek)
 	return s.next()
 }
 
 // peekLset returns the label set of the current peek element stripped from the
-// replica label if it exists
-func (s *dedupSeriesSet) peekLset() labels.Labels {
+// replica label if it exists and whether any replica label was present.
+func (s *dedupSeriesSet) peekLset() (labels.Labels, bool) {
 	lset := s.peek.Labels()
 	if len(s.replicaLabels) == 0 {
-		return lset
+		return lset, false
 	}
 	// Check how many replica labels are present so that these are removed.
 	var totalToRemove int
-	for index := 0; index < len(s.replicaLabels); index++ {
+	for index := 0; index < len(s.replicaLabels) && index < len(lset); index++ {
 		if _, ok := s.replicaLabels[lset[len(lset)-index-1].Name]; ok {
 			totalToRemove++
 		}
 	}
 	// Strip all present replica labels.
-	return lset[:len(lset)-totalToRemove]
+	return lset[:len(lset)-totalToRemove], totalToRemove > 0
 }
 
 func (s *dedupSeriesSet) next() bool {
@@ -382,13 +407,16 @@ func (s *dedupSeriesSet) next() bool {
 		return len(s.replicas) > 0
 	}
 	s.peek = s.set.At()
-	nextLset := s.peekLset()
+	nextLset, nextHasReplica := s.peekLset()
 
 	// If the label set modulo the replica label is equal to the current label set
 	// look for more replicas, otherwise a series is complete.
 	if !labels.Equal(s.lset, nextLset) {
 		return true
 	}
+	if s.separateMissing && s.hasReplica != nextHasReplica {
+		return true
+	}
 	s.replicas = append(s.replicas, s.peek)
 	return s.next()
 }
@@ -401,7 +429,7 @@ func (s *dedupSeriesSet) At() storage.Series {
 	// before advancing.
 	repl := make([]storage.Series, len(s.replicas))
 	copy(repl, s.replicas)
-	return newDedupSeries(s.lset, repl...)
+	return newDedupSeries(s.lset, s.fillGaps, s.disagreements, repl...)
 }
 
 func (s *dedupSeriesSet) Err() error {
@@ -416,12 +444,14 @@ type seriesWithLabels struct {
 func (s seriesWithLabels) Labels() labels.Labels { return s.lset }
 
 type dedupSeries struct {
-	lset     labels.Labels
-	replicas []storage.Series
+	lset          labels.Labels
+	replicas      []storage.Series
+	fillGaps      bool
+	disagreements *ReplicaDisagreements
 }
 
-func newDedupSeries(lset labels.Labels, replicas ...storage.Series) *dedupSeries {
-	return &dedupSeries{lset: lset, replicas: replicas}
+func newDedupSeries(lset labels.Labels, fillGaps bool, disagreements *ReplicaDisagreements, replicas ...storage.Series) *dedupSeries {
+	return &dedupSeries{lset: lset, replicas: replicas, fillGaps: fillGaps, disagreements: disagreements}
 }
 
 func (s *dedupSeries) Labels() labels.Labels {
@@ -429,9 +459,10 @@ func (s *dedupSeries) Labels() labels.Labels {
 }
 
 func (s *dedupSeries) Iterator() (it storage.SeriesIterator) {
+	disagree := s.disagreements.forSeries(s.lset)
 	it = s.replicas[0].Iterator()
 	for _, o := range s.replicas[1:] {
-		it = newDedupSeriesIterator(it, o.Iterator())
+		it = newDedupSeriesIterator(it, o.Iterator(), s.fillGaps, disagree)
 	}
 	return it
 }
@@ -443,38 +474,57 @@ type dedupSeriesIterator struct {
 	lastT      int64
 	penA, penB int64
 	useA       bool
+	// fillGaps makes the other series fill gaps of the current one, see fillGapsPenalty.
+	fillGaps bool
+	// lastDelta is the delta of the last two returned samples, 0 if not known yet.
+	lastDelta int64
+	// disagree, if not nil, is called with the values of both series for samples with the same timestamp.
+	disagree func(a, b float64)
 }
 
-func newDedupSeriesIterator(a, b storage.SeriesIterator) *dedupSeriesIterator {
+func newDedupSeriesIterator(a, b storage.SeriesIterator, fillGaps bool, disagree func(a, b float64)) *dedupSeriesIterator {
 	return &dedupSeriesIterator{
-		a:     a,
-		b:     b,
-		lastT: math.MinInt64,
-		aok:   true,
-		bok:   true,
+		a:        a,
+		b:        b,
+		lastT:    math.MinInt64,
+		aok:      true,
+		bok:      true,
+		fillGaps: fillGaps,
+		disagree: disagree,
 	}
 }
 
 func (it *dedupSeriesIterator) Next() bool {
+	penA, penB := it.penA, it.penB
+	if it.fillGaps {
+		if it.useA {
+			penB = it.fillGapsPenalty(it.a, &it.aok, penB)
+		} else {
+			penA = it.fillGapsPenalty(it.b, &it.bok, penA)
+		}
+	}
+
 	// Advance both iterators to at least the next highest timestamp plus the potential penalty.
 	if it.aok {
-		it.aok = it.a.Seek(it.lastT + 1 + it.penA)
+		it.aok = it.a.Seek(it.lastT + 1 + penA)
 	}
 	if it.bok {
-		it.bok = it.b.Seek(it.lastT + 1 + it.penB)
+		it.bok = it.b.Seek(it.lastT + 1 + penB)
 	}
 	// Handle basic cases where one iterator is exhausted before the other.
 	if !it.aok {
 		it.useA = false
 		if it.bok {
-			it.lastT, _ = it.b.At()
+			tb, _ := it.b.At()
+			it.setLastT(tb)
 			it.penB = 0
 		}
 		return it.bok
 	}
 	if !it.bok {
 		it.useA = true
-		it.lastT, _ = it.a.At()
+		ta, _ := it.a.At()
+		it.setLastT(ta)
 		it.penA = 0
 		return true
 	}
@@ -482,10 +532,13 @@ func (it *dedupSeriesIterator) Next() bool {
 	// with the smaller timestamp.
 	// The applied penalty potentially already skipped potential samples already
 	// that would have resulted in exaggerated sampling frequency.
-	ta, _ := it.a.At()
-	tb, _ := it.b.At()
+	ta, va := it.a.At()
+	tb, vb := it.b.At()
 
 	it.useA = ta <= tb
+	if ta == tb && it.disagree != nil {
+		it.disagree(va, vb)
+	}
 
 	// For the series we didn't pick, add a penalty twice as high as the delta of the last two
 	// samples to the next seek against it.
@@ -503,7 +556,7 @@ func (it *dedupSeriesIterator) Next() bool {
 			it.penB = initialPenality
 		}
 		it.penA = 0
-		it.lastT = ta
+		it.setLastT(ta)
 		return true
 	}
 	if it.lastT != math.MinInt64 {
@@ -512,10 +565,38 @@ func (it *dedupSeriesIterator) Next() bool {
 		it.penA = initialPenality
 	}
 	it.penB = 0
-	it.lastT = tb
+	it.setLastT(tb)
 	return true
 }
 
+func (it *dedupSeriesIterator) setLastT(t int64) {
+	if it.lastT != math.MinInt64 {
+		it.lastDelta = t - it.lastT
+	}
+	it.lastT = t
+}
+
+// fillGapsPenalty advances the current series and returns the penalty for the other series, so that the other
+// series is not advanced beyond the next sample of the current one and can still fill a gap after it. If the current
+// series is exhausted or its next sample is more than two deltas away, the other series fills the gap from half a delta
+// after the last sample on, which still keeps the sample frequency from increasing.
+func (it *dedupSeriesIterator) fillGapsPenalty(cur storage.SeriesIterator, ok *bool, pen int64) int64 {
+	if *ok {
+		*ok = cur.Seek(it.lastT + 1)
+	}
+	if !*ok {
+		return it.lastDelta / 2
+	}
+	t, _ := cur.At()
+	if it.lastDelta > 0 && t > it.lastT+2*it.lastDelta {
+		return it.lastDelta / 2
+	}
+	if it.lastT != math.MinInt64 && t-it.lastT-1 < pen {
+		return t - it.lastT - 1
+	}
+	return pen
+}
+
 func (it *dedupSeriesIterator) Seek(t int64) bool {
 	for {
 		ts, _ := it.At()
@@ -2,6 +2,7 @@ package query
 
 import (
 	"context"
+	"fmt"
 	"sort"
 	"strings"
 
@@ -19,46 +20,66 @@ import (
 // replicaLabels at query time.
 // maxResolutionMillis controls downsampling resolution that is allowed (specified in milliseconds).
 // partialResponse controls `partialResponseDisabled` option of StoreAPI and partial response behaviour of proxy.
-type QueryableCreator func(deduplicate bool, replicaLabels []string, maxResolutionMillis int64, partialResponse bool) storage.Queryable
+// validateReplicaLabels adds a warning for each replica label that is missing from all series selected for deduplication.
+type QueryableCreator func(deduplicate bool, replicaLabels []string, maxResolutionMillis int64, partialResponse, validateReplicaLabels bool) storage.Queryable
 
 // NewQueryableCreator creates QueryableCreator.
-func NewQueryableCreator(logger log.Logger, proxy storepb.StoreServer) QueryableCreator {
-	return func(deduplicate bool, replicaLabels []string, maxResolutionMillis int64, partialResponse bool) storage.Queryable {
+// fillDedupGaps makes deduplication fill gaps in the data of one replica with all samples of another replica within them.
+// separateMissingReplica makes deduplication keep series without any replica label apart from the replicas of the same series.
+// dedupCache, if not nil, caches deduplicated series of selects for identical ones.
+// disagreements, if not nil, counts samples replicas disagree on during deduplication.
+func NewQueryableCreator(logger log.Logger, proxy storepb.StoreServer, fillDedupGaps, separateMissingReplica bool, dedupCache *DedupCache, disagreements *ReplicaDisagreements) QueryableCreator {
+	return func(deduplicate bool, replicaLabels []string, maxResolutionMillis int64, partialResponse, validateReplicaLabels bool) storage.Queryable {
 		return &queryable{
-			logger:              logger,
-			replicaLabels:       replicaLabels,
-			proxy:               proxy,
-			deduplicate:         deduplicate,
-			maxResolutionMillis: maxResolutionMillis,
-			partialResponse:     partialResponse,
+			logger:                 logger,
+			replicaLabels:          replicaLabels,
+			proxy:                  proxy,
+			deduplicate:            deduplicate,
+			maxResolutionMillis:    maxResolutionMillis,
+			partialResponse:        partialResponse,
+			validateReplicaLabels:  validateReplicaLabels,
+			fillDedupGaps:          fillDedupGaps,
+			separateMissingReplica: separateMissingReplica,
+			dedupCache:             dedupCache,
+			disagreements:          disagreements,
 		}
 	}
 }
 
 type queryable struct {
-	logger              log.Logger
-	replicaLabels       []string
-	proxy               storepb.StoreServer
-	deduplicate         bool
-	maxResolutionMillis int64
-	partialResponse     bool
+	logger                 log.Logger
+	replicaLabels          []string
+	proxy                  storepb.StoreServer
+	deduplicate            bool
+	maxResolutionMillis    int64
+	partialResponse        bool
+	validateReplicaLabels  bool
+	fillDedupGaps          bool
+	separateMissingReplica bool
+	dedupCache             *DedupCache
+	disagreements          *ReplicaDisagreements
 }
 
 // Querier returns a new storage querier against the underlying proxy store API.
 func (q *queryable) Querier(ctx context.Context, mint, maxt int64) (storage.Querier, error) {
-	return newQuerier(ctx, q.logger, mint, maxt, q.replicaLabels, q.proxy, q.deduplicate, int64(q.maxResolutionMillis), q.partialResponse), nil
+	return newQuerier(ctx, q.logger, mint, maxt, q.replicaLabels, q.proxy, q.deduplicate, int64(q.maxResolutionMillis), q.partialResponse, q.validateReplicaLabels, q.fillDedupGaps, q.separateMissingReplica, q.dedupCache, q.disagreements), nil
 }
 
 type querier struct {
-	ctx                 context.Context
-	logger              log.Logger
-	cancel              func()
-	mint, maxt          int64
-	replicaLabels       map[string]struct{}
-	proxy               storepb.StoreServer
-	deduplicate         bool
-	maxResolutionMillis int64
-	partialResponse     bool
+	ctx                    context.Context
+	logger                 log.Logger
+	cancel                 func()
+	mint, maxt             int64
+	replicaLabels          map[string]struct{}
+	proxy                  storepb.StoreServer
+	deduplicate            bool
+	maxResolutionMillis    int64
+	partialResponse        bool
+	validateReplicaLabels  bool
+	fillDedupGaps          bool
+	separateMissingReplica bool
+	dedupCache             *DedupCache
+	disagreements          *ReplicaDisagreements
 }
 
 // newQuerier creates implementation of storage.Querier that fetches data from the proxy
@@ -72,6 +93,11 @@ func newQuerier(
 	deduplicate bool,
 	maxResolutionMillis int64,
 	partialResponse bool,
+	validateReplicaLabels bool,
+	fillDedupGaps bool,
+	separateMissingReplica bool,
+	dedupCache *DedupCache,
+	disagreements *ReplicaDisagreements,
 ) *querier {
 	if logger == nil {
 		logger = log.NewNopLogger()
@@ -83,16 +109,21 @@ func newQuerier(
 		rl[replicaLabel] = struct{}{}
 	}
 	return &querier{
-		ctx:                 ctx,
-		logger:              logger,
-		cancel:              cancel,
-		mint:                mint,
-		maxt:                maxt,
-		replicaLabels:       rl,
-		proxy:               proxy,
-		deduplicate:         deduplicate,
-		maxResolutionMillis: maxResolutionMillis,
-		partialResponse:     partialResponse,
+		ctx:                    ctx,
+		logger:                 logger,
+		cancel:                 cancel,
+		mint:                   mint,
+		maxt:                   maxt,
+		replicaLabels:          rl,
+		proxy:                  proxy,
+		deduplicate:            deduplicate,
+		maxResolutionMillis:    maxResolutionMillis,
+		partialResponse:        partialResponse,
+		validateReplicaLabels:  validateReplicaLabels,
+		fillDedupGaps:          fillDedupGaps,
+		separateMissingReplica: separateMissingReplica,
+		dedupCache:             dedupCache,
+		disagreements:          disagreements,
 	}
 }
 
@@ -135,6 +166,7 @@ const (
 	resAggrMin
 	resAggrMax
 	resAggrCounter
+	resAggrStddev
 )
 
 // aggrsFromFunc infers aggregates of the underlying data based on the wrapping
@@ -156,6 +188,9 @@ func aggrsFromFunc(f string) ([]storepb.Aggr, resAggr) {
 	if f == "increase" || f == "rate" {
 		return []storepb.Aggr{storepb.Aggr_COUNTER}, resAggrCounter
 	}
+	if f == "stddev_over_time" || f == "stdvar_over_time" {
+		return []storepb.Aggr{storepb.Aggr_COUNT, storepb.Aggr_SUM, storepb.Aggr_SUM_SQUARES}, resAggrStddev
+	}
 	// In the default case, we retrieve count and sum to compute an average.
 	return []storepb.Aggr{storepb.Aggr_COUNT, storepb.Aggr_SUM}, resAggrAvg
 }
@@ -170,6 +205,20 @@ func (q *querier) Select(params *storage.SelectParams, ms ...*labels.Matcher) (s
 	}
 
 	queryAggrs, resAggr := aggrsFromFunc(params.Func)
+	// Selects of the series function only need the labels of the series, not their samples.
+	skipChunks := params.Func == "series"
+
+	var cacheKey, blockSet string
+	if q.isDedupEnabled() && q.dedupCache != nil {
+		// The block set is determined before fetching series, so that changes while doing so bust the entry.
+		var ok bool
+		if blockSet, ok = q.dedupCache.blockSet(q.mint, q.maxt); ok {
+			cacheKey = q.dedupCacheKey(queryAggrs, skipChunks, ms)
+			if set, ok := q.dedupCache.get(cacheKey, blockSet); ok {
+				return set, nil, nil
+			}
+		}
+	}
 
 	resp := &seriesServer{ctx: ctx}
 	if err := q.proxy.Series(&storepb.SeriesRequest{
@@ -179,6 +228,7 @@ func (q *querier) Select(params *storage.SelectParams, ms ...*labels.Matcher) (s
 		MaxResolutionWindow:     q.maxResolutionMillis,
 		Aggregates:              queryAggrs,
 		PartialResponseDisabled: !q.partialResponse,
+		SkipChunks:              skipChunks,
 	}, resp); err != nil {
 		return nil, nil, errors.Wrap(err, "proxy Series()")
 	}
@@ -198,6 +248,10 @@ func (q *querier) Select(params *storage.SelectParams, ms ...*labels.Matcher) (s
 		}, warns, nil
 	}
 
+	if q.validateReplicaLabels {
+		warns = append(warns, missingReplicaLabelsWarnings(resp.seriesSet, q.replicaLabels)...)
+	}
+
 	// TODO(fabxc): this could potentially pushed further down into the store API
 	// to make true streaming possible.
 	sortDedupLabels(resp.seriesSet, q.replicaLabels)
@@ -212,7 +266,56 @@ func (q *querier) Select(params *storage.SelectParams, ms ...*labels.Matcher) (s
 	// The merged series set assembles all potentially-overlapping time ranges
 	// of the same series into a single one. The series are ordered so that equal series
 	// from different replicas are sequential. We can now deduplicate those.
-	return newDedupSeriesSet(set, q.replicaLabels), warns, nil
+	dedupSet := newDedupSeriesSet(set, q.replicaLabels, q.fillDedupGaps, q.separateMissingReplica, q.disagreements)
+	if cacheKey == "" || len(warns) > 0 {
+		return dedupSet, warns, nil
+	}
+	return q.dedupCache.set(cacheKey, blockSet, dedupSet), warns, nil
+}
+
+// dedupCacheKey returns the key of the deduplicated series selected with the given aggregates and matchers.
+func (q *querier) dedupCacheKey(aggrs []storepb.Aggr, skipChunks bool, ms []*labels.Matcher) string {
+	replicaLabels := make([]string, 0, len(q.replicaLabels))
+	for name := range q.replicaLabels {
+		replicaLabels = append(replicaLabels, name)
+	}
+	sort.Strings(replicaLabels)
+
+	return fmt.Sprintf("%d/%d/%d/%v/%v/%v/%v/%v/%v/%v", q.mint, q.maxt, q.maxResolutionMillis, aggrs, skipChunks, ms,
+		q.partialResponse, replicaLabels, q.fillDedupGaps, q.separateMissingReplica)
+}
+
+// missingReplicaLabelsWarnings returns a warning for each replica label that none of the given series has,
+// as deduplication along it has no effect. This usually hints at a misspelled replica label.
+func missingReplicaLabelsWarnings(set []storepb.Series, replicaLabels map[string]struct{}) (warns storage.Warnings) {
+	if len(set) == 0 {
+		return nil
+	}
+
+	found := make(map[string]struct{}, len(replicaLabels))
+	for _, s := range set {
+		for _, l := range s.Labels {
+			if _, ok := replicaLabels[l.Name]; ok {
+				found[l.Name] = struct{}{}
+			}
+		}
+		if len(found) == len(replicaLabels) {
+			return nil
+		}
+	}
+
+	missing := make([]string, 0, len(replicaLabels)-len(found))
+	for name := range replicaLabels {
+		if _, ok := found[name]; !ok {
+			missing = append(missing, name)
+		}
+	}
+	sort.Strings(missing)
+
+	for _, name := range missing {
+		warns = append(warns, errors.Errorf("replica label %q is not present on any of the %d selected series, deduplication along it has no effect", name, len(set)))
+	}
+	return warns
 }
 
 // sortDedupLabels re-sorts the set so that the same series with different replica
@@ -238,10 +341,16 @@ func sortDedupLabels(set []storepb.Series, replicaLabels map[string]struct{}) {
 }
 
 // LabelValues returns all potential values for a label name.
+// If deduplication is enabled, values of replica labels are not returned as those labels are removed from
+// deduplicated series.
 func (q *querier) LabelValues(name string) ([]string, storage.Warnings, error) {
 	span, ctx := tracing.StartSpan(q.ctx, "querier_label_values")
 	defer span.Finish()
 
+	if _, ok := q.replicaLabels[name]; ok && q.isDedupEnabled() {
+		return nil, nil, nil
+	}
+
 	resp, err := q.proxy.LabelValues(ctx, &storepb.LabelValuesRequest{Label: name, PartialResponseDisabled: !q.partialResponse})
 	if err != nil {
 		return nil, nil, errors.Wrap(err, "proxy LabelValues()")
@@ -14,10 +14,12 @@ import (
 
 	"github.com/fortytw2/leaktest"
 	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/prometheus/pkg/labels"
 	"github.com/prometheus/prometheus/promql"
 	"github.com/prometheus/prometheus/storage"
 	"github.com/prometheus/prometheus/tsdb/chunkenc"
+	"github.com/thanos-io/thanos/pkg/store"
 	"github.com/thanos-io/thanos/pkg/store/storepb"
 	"github.com/thanos-io/thanos/pkg/testutil"
 )
@@ -25,10 +27,10 @@ import (
 func TestQueryableCreator_MaxResolution(t *testing.T) {
 	defer leaktest.CheckTimeout(t, 10*time.Second)()
 	testProxy := &storeServer{resps: []*storepb.SeriesResponse{}}
-	queryableCreator := NewQueryableCreator(nil, testProxy)
+	queryableCreator := NewQueryableCreator(nil, testProxy, false, false, nil, nil)
 
 	oneHourMillis := int64(1*time.Hour) / int64(time.Millisecond)
-	queryable := queryableCreator(false, nil, oneHourMillis, false)
+	queryable := queryableCreator(false, nil, oneHourMillis, false, false)
 
 	q, err := queryable.Querier(context.Background(), 0, 42)
 	testutil.Ok(t, err)
@@ -55,7 +57,7 @@ func TestQuerier_DownsampledData(t *testing.T) {
 		},
 	}
 
-	q := NewQueryableCreator(nil, testProxy)(false, nil, 9999999, false)
+	q := NewQueryableCreator(nil, testProxy, false, false, nil, nil)(false, nil, 9999999, false, false)
 
 	engine := promql.NewEngine(
 		promql.EngineOpts{
@@ -158,6 +160,84 @@ func TestQuerier_DownsampledData(t *testing.T) {
 	}
 }
 
+func TestQuerier_DownsampledStddev(t *testing.T) {
+	defer leaktest.CheckTimeout(t, 10*time.Second)()
+
+	// Scrape every 15s for an hour and aggregate into 5m windows like the compactor does.
+	var raw []sample
+	for ts := int64(0); ts < 60*60*1000; ts += 15 * 1000 {
+		raw = append(raw, sample{t: ts, v: 100 + 50*math.Sin(float64(ts)/(7*60*1000)) + float64(ts%7)})
+	}
+	var cnt, sum, sq []sample
+	for i := 0; i < len(raw); i += 20 {
+		var c, s, q float64
+		for _, smpl := range raw[i : i+20] {
+			c, s, q = c+1, s+smpl.v, q+smpl.v*smpl.v
+		}
+		ts := raw[i+19].t
+		cnt, sum, sq = append(cnt, sample{ts, c}), append(sum, sample{ts, s}), append(sq, sample{ts, q})
+	}
+	xorChunk := func(smpls []sample) *storepb.Chunk {
+		c := chunkenc.NewXORChunk()
+		a, err := c.Appender()
+		testutil.Ok(t, err)
+		for _, smpl := range smpls {
+			a.Append(smpl.t, smpl.v)
+		}
+		return &storepb.Chunk{Type: storepb.Chunk_XOR, Data: c.Bytes()}
+	}
+	downsampled := storepb.NewSeriesResponse(&storepb.Series{
+		Labels: []storepb.Label{{Name: "__name__", Value: "a"}, {Name: "res", Value: "5m"}},
+		Chunks: []storepb.AggrChunk{{
+			MinTime:    cnt[0].t,
+			MaxTime:    cnt[len(cnt)-1].t,
+			Count:      xorChunk(cnt),
+			Sum:        xorChunk(sum),
+			SumSquares: xorChunk(sq),
+		}},
+	})
+
+	testProxy := &storeServer{
+		resps: []*storepb.SeriesResponse{
+			storeSeriesResponse(t, labels.FromStrings("__name__", "a", "res", "raw"), raw),
+			downsampled,
+		},
+	}
+	q := NewQueryableCreator(nil, testProxy, false, false, nil, nil)(false, nil, 9999999, false, false)
+
+	engine := promql.NewEngine(
+		promql.EngineOpts{
+			MaxConcurrent: 10,
+			MaxSamples:    math.MaxInt32,
+			Timeout:       10 * time.Second,
+		},
+	)
+
+	for _, tcase := range []struct {
+		query string
+	}{
+		{query: "stddev_over_time(a[1h])"},
+		{query: "stdvar_over_time(a[1h])"},
+	} {
+		t.Run(tcase.query, func(t *testing.T) {
+			qry, err := engine.NewInstantQuery(q, tcase.query, time.Unix(0, 0).Add(time.Hour-time.Millisecond))
+			testutil.Ok(t, err)
+
+			res := qry.Exec(context.Background())
+			testutil.Ok(t, res.Err)
+			v, err := res.Vector()
+			testutil.Ok(t, err)
+			testutil.Equals(t, 2, len(v))
+
+			exp, got := v[0].V, v[1].V
+			if v[0].Metric.Get("res") != "raw" {
+				exp, got = got, exp
+			}
+			testutil.Assert(t, math.Abs(got-exp) < 1e-6*exp, "expected %v, got %v", exp, got)
+		})
+	}
+}
+
 func TestQuerier_Series(t *testing.T) {
 	defer leaktest.CheckTimeout(t, 10*time.Second)()
 
@@ -176,7 +256,7 @@ func TestQuerier_Series(t *testing.T) {
 
 	// Querier clamps the range to [1,300], which should drop some samples of the result above.
 	// The store API allows endpoints to send more data then initially requested.
-	q := newQuerier(context.Background(), nil, 1, 300, []string{""}, testProxy, false, 0, true)
+	q := newQuerier(context.Background(), nil, 1, 300, []string{""}, testProxy, false, 0, true, false, false, false, nil, nil)
 	defer func() { testutil.Ok(t, q.Close()) }()
 
 	res, _, err := q.Select(&storage.SelectParams{})
@@ -217,6 +297,225 @@ func TestQuerier_Series(t *testing.T) {
 	testutil.Equals(t, len(expected), i)
 }
 
+func TestQuerier_LabelValues(t *testing.T) {
+	defer leaktest.CheckTimeout(t, 10*time.Second)()
+
+	testProxy := &storeServer{
+		labelValues: map[string][]string{
+			"a":       {"1", "2"},
+			"replica": {"r0", "r1"},
+		},
+	}
+
+	for _, tcase := range []struct {
+		dedup         bool
+		replicaLabels []string
+		name          string
+		expected      []string
+	}{
+		{dedup: true, replicaLabels: []string{"replica"}, name: "replica", expected: nil},
+		{dedup: true, replicaLabels: []string{"replica"}, name: "a", expected: []string{"1", "2"}},
+		{dedup: false, replicaLabels: []string{"replica"}, name: "replica", expected: []string{"r0", "r1"}},
+		{dedup: true, replicaLabels: nil, name: "replica", expected: []string{"r0", "r1"}},
+	} {
+		t.Run("", func(t *testing.T) {
+			q := newQuerier(context.Background(), nil, 0, 100, tcase.replicaLabels, testProxy, tcase.dedup, 0, true, false, false, false, nil, nil)
+			defer func() { testutil.Ok(t, q.Close()) }()
+
+			vals, _, err := q.LabelValues(tcase.name)
+			testutil.Ok(t, err)
+			testutil.Equals(t, tcase.expected, vals)
+		})
+	}
+}
+
+func TestQuerier_Select_ValidateReplicaLabels(t *testing.T) {
+	defer leaktest.CheckTimeout(t, 10*time.Second)()
+
+	testProxy := &storeServer{
+		resps: []*storepb.SeriesResponse{
+			storeSeriesResponse(t, labels.FromStrings("a", "1", "replica", "r0"), []sample{{1, 1}}),
+			storeSeriesResponse(t, labels.FromStrings("a", "1", "replica", "r1"), []sample{{1, 1}}),
+			storeSeriesResponse(t, labels.FromStrings("a", "2"), []sample{{1, 1}}),
+		},
+	}
+
+	for _, tcase := range []struct {
+		replicaLabels []string
+		validate      bool
+		expected      []string
+	}{
+		{replicaLabels: []string{"replica"}, validate: true},
+		{replicaLabels: []string{"replica", "rule_replica"}, validate: false},
+		{
+			replicaLabels: []string{"rule_replica", "replica", "prometheus_replica"},
+			validate:      true,
+			expected: []string{
+				`replica label "prometheus_replica" is not present on any of the 3 selected series, deduplication along it has no effect`,
+				`replica label "rule_replica" is not present on any of the 3 selected series, deduplication along it has no effect`,
+			},
+		},
+	} {
+		t.Run("", func(t *testing.T) {
+			q := newQuerier(context.Background(), nil, 0, 100, tcase.replicaLabels, testProxy, true, 0, true, tcase.validate, false, false, nil, nil)
+			defer func() { testutil.Ok(t, q.Close()) }()
+
+			set, warns, err := q.Select(&storage.SelectParams{})
+			testutil.Ok(t, err)
+
+			var got []string
+			for _, w := range warns {
+				got = append(got, w.Error())
+			}
+			testutil.Equals(t, tcase.expected, got)
+
+			// Deduplication works regardless of the validation.
+			var lsets []labels.Labels
+			for set.Next() {
+				lsets = append(lsets, set.At().Labels())
+			}
+			testutil.Ok(t, set.Err())
+			testutil.Equals(t, []labels.Labels{labels.FromStrings("a", "1"), labels.FromStrings("a", "2")}, lsets)
+		})
+	}
+}
+
+func TestQuerier_Select_DedupCache(t *testing.T) {
+	defer leaktest.CheckTimeout(t, 10*time.Second)()
+
+	testProxy := &storeServer{
+		resps: []*storepb.SeriesResponse{
+			storeSeriesResponse(t, labels.FromStrings("a", "1", "replica", "r0"), []sample{{10000, 1}, {20000, 2}}),
+			storeSeriesResponse(t, labels.FromStrings("a", "1", "replica", "r1"), []sample{{10000, 1}, {20000, 2}}),
+			storeSeriesResponse(t, labels.FromStrings("a", "2", "replica", "r0"), []sample{{10000, 3}}),
+		},
+	}
+	stores := []store.Client{
+		&testStoreClient{addr: "store0", mint: 0, maxt: 50000, blockSet: "b0"},
+	}
+	cache := NewDedupCache(nil, 1<<20, func(mint, maxt int64) (string, bool) { return BlockSetKey(stores, mint, maxt) })
+
+	type series struct {
+		lset    labels.Labels
+		samples []sample
+	}
+	selectSeries := func(mint, maxt int64, dedup bool) []series {
+		q := newQuerier(context.Background(), nil, mint, maxt, []string{"replica"}, testProxy, dedup, 0, true, false, false, false, cache, nil)
+		defer func() { testutil.Ok(t, q.Close()) }()
+
+		m, err := labels.NewMatcher(labels.MatchRegexp, "a", ".+")
+		testutil.Ok(t, err)
+		set, _, err := q.Select(&storage.SelectParams{}, m)
+		testutil.Ok(t, err)
+
+		var res []series
+		for set.Next() {
+			res = append(res, series{lset: set.At().Labels(), samples: expandSeries(t, set.At().Iterator())})
+		}
+		testutil.Ok(t, set.Err())
+		return res
+	}
+	exp := []series{
+		{lset: labels.FromStrings("a", "1"), samples: []sample{{10000, 1}, {20000, 2}}},
+		{lset: labels.FromStrings("a", "2"), samples: []sample{{10000, 3}}},
+	}
+
+	testutil.Equals(t, exp, selectSeries(1, 100000, true))
+	testutil.Equals(t, 1, testProxy.seriesCalls)
+
+	// Identical selects are served from the cache.
+	testutil.Equals(t, exp, selectSeries(1, 100000, true))
+	testutil.Equals(t, 1, testProxy.seriesCalls)
+
+	// Selects of other time ranges or without deduplication are not.
+	selectSeries(15000, 100000, true)
+	testutil.Equals(t, 2, testProxy.seriesCalls)
+	selectSeries(1, 100000, false)
+	testutil.Equals(t, 3, testProxy.seriesCalls)
+
+	// A changed block set busts the entry.
+	stores = append(stores, &testStoreClient{addr: "store1", mint: 50000, maxt: 100000, blockSet: "b1"})
+	testutil.Equals(t, exp, selectSeries(1, 100000, true))
+	testutil.Equals(t, 4, testProxy.seriesCalls)
+	testutil.Equals(t, exp, selectSeries(1, 100000, true))
+	testutil.Equals(t, 4, testProxy.seriesCalls)
+
+	// So does replacing a block, e.g. by compaction, although the time ranges of the stores stay the same.
+	stores[0] = &testStoreClient{addr: "store0", mint: 0, maxt: 50000, blockSet: "b2"}
+	testutil.Equals(t, exp, selectSeries(1, 100000, true))
+	testutil.Equals(t, 5, testProxy.seriesCalls)
+	testutil.Equals(t, exp, selectSeries(1, 100000, true))
+	testutil.Equals(t, 5, testProxy.seriesCalls)
+
+	// Selects touching data of a store still ingesting it, like head data behind a sidecar, are never cached.
+	stores = append(stores, &testStoreClient{addr: "sidecar", mint: 90000, maxt: math.MaxInt64})
+	testutil.Equals(t, exp, selectSeries(1, 100000, true))
+	testutil.Equals(t, 6, testProxy.seriesCalls)
+	testutil.Equals(t, exp, selectSeries(1, 100000, true))
+	testutil.Equals(t, 7, testProxy.seriesCalls)
+
+	// Selects before its time range still are.
+	selectSeries(1, 80000, true)
+	testutil.Equals(t, 8, testProxy.seriesCalls)
+	selectSeries(1, 80000, true)
+	testutil.Equals(t, 8, testProxy.seriesCalls)
+
+	// Neither are selects touching data of a store not reporting its block set.
+	stores[1] = &testStoreClient{addr: "store1", mint: 50000, maxt: 100000}
+	selectSeries(1, 80000, true)
+	testutil.Equals(t, 9, testProxy.seriesCalls)
+	selectSeries(1, 80000, true)
+	testutil.Equals(t, 10, testProxy.seriesCalls)
+}
+
+func TestQuerier_Select_DedupCacheSize(t *testing.T) {
+	defer leaktest.CheckTimeout(t, 10*time.Second)()
+
+	testProxy := &storeServer{
+		resps: []*storepb.SeriesResponse{
+			storeSeriesResponse(t, labels.FromStrings("a", "1", "replica", "r0"), []sample{{10000, 1}, {20000, 2}}),
+			storeSeriesResponse(t, labels.FromStrings("a", "2", "replica", "r0"), []sample{{10000, 3}}),
+		},
+	}
+	selectSeries := func(cache *DedupCache, mint int64) {
+		q := newQuerier(context.Background(), nil, mint, 100000, []string{"replica"}, testProxy, true, 0, true, false, false, false, cache, nil)
+		defer func() { testutil.Ok(t, q.Close()) }()
+
+		m, err := labels.NewMatcher(labels.MatchRegexp, "a", ".+")
+		testutil.Ok(t, err)
+		set, _, err := q.Select(&storage.SelectParams{}, m)
+		testutil.Ok(t, err)
+
+		var n int
+		for set.Next() {
+			expandSeries(t, set.At().Iterator())
+			n++
+		}
+		testutil.Ok(t, set.Err())
+		testutil.Equals(t, 2, n)
+	}
+	blockSet := func(int64, int64) (string, bool) { return "", true }
+
+	// The series take 52 bytes: 4 bytes of labels and 16 bytes per sample.
+	cache := NewDedupCache(nil, 51, blockSet)
+	selectSeries(cache, 1)
+	selectSeries(cache, 1)
+	testutil.Equals(t, 2, testProxy.seriesCalls)
+
+	// Least recently used selects are evicted once the cache exceeds its size.
+	testProxy.seriesCalls = 0
+	cache = NewDedupCache(nil, 104, blockSet)
+	selectSeries(cache, 1)
+	selectSeries(cache, 2)
+	selectSeries(cache, 1)
+	testutil.Equals(t, 2, testProxy.seriesCalls)
+	selectSeries(cache, 3)
+	selectSeries(cache, 1)
+	testutil.Equals(t, 3, testProxy.seriesCalls)
+	selectSeries(cache, 2)
+	testutil.Equals(t, 4, testProxy.seriesCalls)
+}
+
 func TestSortReplicaLabel(t *testing.T) {
 	defer leaktest.CheckTimeout(t, 10*time.Second)()
 
@@ -549,7 +848,7 @@ func TestDedupSeriesSet(t *testing.T) {
 				maxt: math.MaxInt64,
 				set:  newStoreSeriesSet(series),
 			}
-			dedupSet := newDedupSeriesSet(set, test.dedupLabels)
+			dedupSet := newDedupSeriesSet(set, test.dedupLabels, false, false, nil)
 
 			i := 0
 			for dedupSet.Next() {
@@ -563,6 +862,169 @@ func TestDedupSeriesSet(t *testing.T) {
 	}
 }
 
+func TestDedupSeriesSet_MissingReplica(t *testing.T) {
+	defer leaktest.CheckTimeout(t, 10*time.Second)()
+
+	input := []struct {
+		lset []storepb.Label
+		vals []sample
+	}{
+		{
+			lset: []storepb.Label{{Name: "a", Value: "1"}},
+			vals: []sample{{10000, 1}, {20000, 2}},
+		},
+		{
+			lset: []storepb.Label{{Name: "a", Value: "1"}, {Name: "replica", Value: "replica-1"}},
+			vals: []sample{{10000, 3}, {20000, 4}},
+		},
+		{
+			lset: []storepb.Label{{Name: "a", Value: "1"}, {Name: "replica", Value: "replica-2"}},
+			vals: []sample{{10000, 5}, {20000, 6}},
+		},
+		{
+			lset: []storepb.Label{{Name: "b", Value: "1"}},
+			vals: []sample{{10000, 7}},
+		},
+		{
+			lset: []storepb.Label{{Name: "c", Value: "1"}, {Name: "replica", Value: "replica-1"}},
+			vals: []sample{{10000, 8}},
+		},
+		{
+			lset: []storepb.Label{{Name: "c", Value: "1"}, {Name: "replica", Value: "replica-2"}},
+			vals: []sample{{10000, 9}},
+		},
+	}
+	type series struct {
+		lset labels.Labels
+		vals []sample
+	}
+
+	for _, tcase := range []struct {
+		separateMissing bool
+		exp             []series
+	}{
+		{
+			// The series without replica label is just another replica.
+			separateMissing: false,
+			exp: []series{
+				{lset: labels.Labels{{Name: "a", Value: "1"}}, vals: []sample{{10000, 1}, {20000, 2}}},
+				{lset: labels.Labels{{Name: "b", Value: "1"}}, vals: []sample{{10000, 7}}},
+				{lset: labels.Labels{{Name: "c", Value: "1"}}, vals: []sample{{10000, 8}}},
+			},
+		},
+		{
+			separateMissing: true,
+			exp: []series{
+				{lset: labels.Labels{{Name: "a", Value: "1"}}, vals: []sample{{10000, 1}, {20000, 2}}},
+				{lset: labels.Labels{{Name: "a", Value: "1"}}, vals: []sample{{10000, 3}, {20000, 4}}},
+				{lset: labels.Labels{{Name: "b", Value: "1"}}, vals: []sample{{10000, 7}}},
+				{lset: labels.Labels{{Name: "c", Value: "1"}}, vals: []sample{{10000, 8}}},
+			},
+		},
+	} {
+		t.Run(fmt.Sprintf("separateMissing=%v", tcase.separateMissing), func(t *testing.T) {
+			var in []storepb.Series
+			for _, c := range input {
+				chk := chunkenc.NewXORChunk()
+				app, _ := chk.Appender()
+				for _, s := range c.vals {
+					app.Append(s.t, s.v)
+				}
+				in = append(in, storepb.Series{
+					Labels: c.lset,
+					Chunks: []storepb.AggrChunk{
+						{Raw: &storepb.Chunk{Type: storepb.Chunk_XOR, Data: chk.Bytes()}},
+					},
+				})
+			}
+			set := &promSeriesSet{
+				mint: 1,
+				maxt: math.MaxInt64,
+				set:  newStoreSeriesSet(in),
+			}
+			dedupSet := newDedupSeriesSet(set, map[string]struct{}{"replica": {}}, false, tcase.separateMissing, nil)
+
+			var res []series
+			for dedupSet.Next() {
+				res = append(res, series{lset: dedupSet.At().Labels(), vals: expandSeries(t, dedupSet.At().Iterator())})
+			}
+			testutil.Ok(t, dedupSet.Err())
+			testutil.Equals(t, tcase.exp, res)
+		})
+	}
+}
+
+func TestDedupSeriesSet_ReplicaDisagreements(t *testing.T) {
+	input := []struct {
+		lset []storepb.Label
+		vals []sample
+	}{
+		{
+			lset: []storepb.Label{{Name: "__name__", Value: "other"}, {Name: "replica", Value: "replica-1"}},
+			vals: []sample{{10000, 1}, {20000, 2}},
+		},
+		{
+			lset: []storepb.Label{{Name: "__name__", Value: "other"}, {Name: "replica", Value: "replica-2"}},
+			vals: []sample{{10000, 10}, {20000, 20}},
+		},
+		{
+			lset: []storepb.Label{{Name: "__name__", Value: "up"}, {Name: "replica", Value: "replica-1"}},
+			vals: []sample{{10000, 1}, {20000, 1}, {30000, 1}, {40000, math.NaN()}},
+		},
+		{
+			lset: []storepb.Label{{Name: "__name__", Value: "up"}, {Name: "replica", Value: "replica-2"}},
+			vals: []sample{{10000, 1}, {20000, 5}, {30000, 1.05}, {40000, 1}},
+		},
+		{
+			lset: []storepb.Label{{Name: "__name__", Value: "up"}, {Name: "replica", Value: "replica-3"}},
+			vals: []sample{{10000, 0}, {40000, 1}},
+		},
+	}
+	var in []storepb.Series
+	for _, c := range input {
+		chk := chunkenc.NewXORChunk()
+		app, _ := chk.Appender()
+		for _, s := range c.vals {
+			app.Append(s.t, s.v)
+		}
+		in = append(in, storepb.Series{
+			Labels: c.lset,
+			Chunks: []storepb.AggrChunk{
+				{Raw: &storepb.Chunk{Type: storepb.Chunk_XOR, Data: chk.Bytes()}},
+			},
+		})
+	}
+	set := &promSeriesSet{
+		mint: 1,
+		maxt: math.MaxInt64,
+		set:  newStoreSeriesSet(in),
+	}
+	reg := prometheus.NewRegistry()
+	dedupSet := newDedupSeriesSet(set, map[string]struct{}{"replica": {}}, false, false, NewReplicaDisagreements(reg, 0.1))
+
+	var res [][]sample
+	for dedupSet.Next() {
+		res = append(res, expandSeries(t, dedupSet.At().Iterator()))
+	}
+	testutil.Ok(t, dedupSet.Err())
+	// Results are not affected by disagreements.
+	testutil.Equals(t, 2, len(res))
+	testutil.Equals(t, []sample{{10000, 1}, {20000, 2}}, res[0])
+	testutil.Equals(t, 4, len(res[1]))
+
+	mfs, err := reg.Gather()
+	testutil.Ok(t, err)
+	testutil.Equals(t, 1, len(mfs))
+	testutil.Equals(t, "thanos_query_dedup_replica_disagreements_total", mfs[0].GetName())
+
+	disagreements := map[string]float64{}
+	for _, m := range mfs[0].GetMetric() {
+		disagreements[m.GetLabel()[0].GetValue()] = m.GetCounter().GetValue()
+	}
+	// Differences within 10% and NaNs are no disagreements.
+	testutil.Equals(t, map[string]float64{"other": 2, "up": 2}, disagreements)
+}
+
 func TestDedupSeriesIterator(t *testing.T) {
 	defer leaktest.CheckTimeout(t, 10*time.Second)()
 
@@ -603,17 +1065,75 @@ func TestDedupSeriesIterator(t *testing.T) {
 		it := newDedupSeriesIterator(
 			&SampleIterator{l: c.a, i: -1},
 			&SampleIterator{l: c.b, i: -1},
+			false,
+			nil,
 		)
 		res := expandSeries(t, it)
 		testutil.Equals(t, c.exp, res)
 	}
 }
 
+func TestDedupSeriesIterator_FillGaps(t *testing.T) {
+	defer leaktest.CheckTimeout(t, 10*time.Second)()
+
+	cases := []struct {
+		a, b, exp []sample
+	}{
+		{ // Replicas covering complementary halves of the range are stitched without gap.
+			a:   []sample{{10000, 1}, {20000, 1}, {30000, 1}, {40000, 1}},
+			b:   []sample{{50000, 2}, {60000, 2}, {70000, 2}, {80000, 2}},
+			exp: []sample{{10000, 1}, {20000, 1}, {30000, 1}, {40000, 1}, {50000, 2}, {60000, 2}, {70000, 2}, {80000, 2}},
+		},
+		{
+			a:   []sample{{50000, 1}, {60000, 1}, {70000, 1}, {80000, 1}},
+			b:   []sample{{10000, 2}, {20000, 2}, {30000, 2}, {40000, 2}},
+			exp: []sample{{10000, 2}, {20000, 2}, {30000, 2}, {40000, 2}, {50000, 1}, {60000, 1}, {70000, 1}, {80000, 1}},
+		},
+		{ // Samples of both replicas are not mixed without gap.
+			a:   []sample{{10000, 10}, {20000, 11}, {30000, 12}, {40000, 13}},
+			b:   []sample{{10000, 20}, {20000, 21}, {30000, 22}, {40000, 23}},
+			exp: []sample{{10000, 10}, {20000, 11}, {30000, 12}, {40000, 13}},
+		},
+		{ // Gaps within 2 deltas are not filled.
+			a:   []sample{{10000, 1}, {20000, 1}, {40000, 1}},
+			b:   []sample{{15000, 2}, {25000, 2}, {35000, 2}, {45000, 2}},
+			exp: []sample{{10000, 1}, {20000, 1}, {40000, 1}},
+		},
+		{ // Gaps bigger than 2 deltas are filled with all samples of the other replica.
+			a:   []sample{{10000, 1}, {20000, 1}, {30000, 1}, {60000, 1}, {70000, 1}},
+			b:   []sample{{10100, 2}, {20100, 2}, {30100, 2}, {40100, 2}, {50100, 2}, {60100, 2}},
+			exp: []sample{{10000, 1}, {20000, 1}, {30000, 1}, {40100, 2}, {50100, 2}, {60100, 2}, {70000, 1}},
+		},
+	}
+	for i, c := range cases {
+		t.Logf("case %d:", i)
+		it := newDedupSeriesIterator(
+			&SampleIterator{l: c.a, i: -1},
+			&SampleIterator{l: c.b, i: -1},
+			true,
+			nil,
+		)
+		res := expandSeries(t, it)
+		testutil.Equals(t, c.exp, res)
+
+		// Without filling gaps, the samples right after the switch are skipped.
+		it = newDedupSeriesIterator(
+			&SampleIterator{l: c.a, i: -1},
+			&SampleIterator{l: c.b, i: -1},
+			false,
+			nil,
+		)
+		testutil.Assert(t, len(expandSeries(t, it)) <= len(c.exp), "expected no more samples without filling gaps")
+	}
+}
+
 func BenchmarkDedupSeriesIterator(b *testing.B) {
 	run := func(b *testing.B, s1, s2 []sample) {
 		it := newDedupSeriesIterator(
 			&SampleIterator{l: s1, i: -1},
 			&SampleIterator{l: s2, i: -1},
+			false,
+			nil,
 		)
 		b.ResetTimer()
 		var total int64
@@ -704,10 +1224,17 @@ type storeServer struct {
 	// This field just exist to pseudo-implement the unused methods of the interface.
 	storepb.StoreServer
 
-	resps []*storepb.SeriesResponse
+	resps       []*storepb.SeriesResponse
+	labelValues map[string][]string
+	seriesCalls int
+}
+
+func (s *storeServer) LabelValues(_ context.Context, r *storepb.LabelValuesRequest) (*storepb.LabelValuesResponse, error) {
+	return &storepb.LabelValuesResponse{Values: s.labelValues[r.Label]}, nil
 }
 
 func (s *storeServer) Series(r *storepb.SeriesRequest, srv storepb.Store_SeriesServer) error {
+	s.seriesCalls++
 	for _, resp := range s.resps {
 		err := srv.Send(resp)
 		if err != nil {
@@ -744,3 +1271,16 @@ func storeSeriesResponse(t testing.TB, lset labels.Labels, smplChunks ...[]sampl
 	}
 	return storepb.NewSeriesResponse(&s)
 }
+
+type testStoreClient struct {
+	store.Client
+
+	addr       string
+	mint, maxt int64
+	blockSet   string
+}
+
+func (c *testStoreClient) Addr() string                  { return c.addr }
+func (c *testStoreClient) LabelSets() []storepb.LabelSet { return nil }
+func (c *testStoreClient) BlockSetID() string            { return c.blockSet }
+func (c *testStoreClient) TimeRange() (mint, maxt int64) { return c.mint, c.maxt }
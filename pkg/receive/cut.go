@@ -0,0 +1,125 @@
+package receive
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/tsdb"
+	"github.com/prometheus/prometheus/tsdb/chunks"
+	"github.com/prometheus/prometheus/tsdb/labels"
+)
+
+// AlignedChunkRange returns the block duration to open a TSDB with, whose head is cut into blocks by
+// CutAlignedBlocks with the given block duration and offset. As TSDB cuts head chunks on multiples of its
+// block duration, the returned one divides both, so chunks are never crossing aligned block boundaries.
+// Late samples are accepted within half of it.
+func AlignedChunkRange(blockDuration, offset time.Duration) time.Duration {
+	a, b := blockDuration, offset%blockDuration
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return a
+}
+
+// CutAlignedBlocks persists the data of the head of the given database into blocks of the given duration, whose
+// boundaries are multiples of the duration since the Unix epoch shifted by offset. TSDB itself always cuts blocks
+// on unshifted boundaries, so automatic compactions of the database must be disabled. The database must be opened
+// with a block duration of AlignedChunkRange.
+// Like TSDB, a block is only cut once the head spans half a block duration beyond its end, so late samples can
+// still be appended until then. It returns the IDs of the created blocks.
+func CutAlignedBlocks(ctx context.Context, logger log.Logger, db *tsdb.DB, blockDuration, offset time.Duration) (ids []ulid.ULID, err error) {
+	if logger == nil {
+		logger = log.NewNopLogger()
+	}
+	width := int64(blockDuration / time.Millisecond)
+	if width <= 0 {
+		return nil, errors.Errorf("invalid block duration %s", blockDuration)
+	}
+	off := int64(offset/time.Millisecond) % width
+
+	compactor, err := tsdb.NewLeveledCompactor(ctx, nil, logger, []int64{width}, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "create compactor")
+	}
+
+	head := db.Head()
+	for head.NumSeries() > 0 {
+		mint := head.MinTime()
+		maxt := alignedBlockEnd(mint, width, off)
+		if head.MaxTime() < maxt+width/2 {
+			break
+		}
+
+		uid, err := compactor.Write(db.Dir(), &rangeHead{Head: head, mint: mint, maxt: maxt}, mint, maxt, nil)
+		if err != nil {
+			return ids, errors.Wrap(err, "write block")
+		}
+
+		if (uid == ulid.ULID{}) {
+			// Nothing was written, so reloading would not truncate the head.
+			if err := head.Truncate(maxt); err != nil {
+				return ids, errors.Wrap(err, "truncate head")
+			}
+			continue
+		}
+		ids = append(ids, uid)
+		level.Info(logger).Log("msg", "cut aligned block", "block", uid, "mint", mint, "maxt", maxt)
+
+		// Cleaning tombstones is the only way to make the database reload its blocks, which
+		// also truncates the head up to the new block. It does not rewrite blocks without tombstones.
+		if err := db.CleanTombstones(); err != nil {
+			return ids, errors.Wrap(err, "reload blocks")
+		}
+	}
+	return ids, nil
+}
+
+// alignedBlockEnd returns the end of the block range containing t, given blocks of the width
+// that start at multiples of the width shifted by offset.
+func alignedBlockEnd(t, width, offset int64) int64 {
+	d := (t - offset) % width
+	if d < 0 {
+		d += width
+	}
+	return t - d + width
+}
+
+// rangeHead exposes only the chunks of the head within [mint, maxt). The head of a database opened with
+// AlignedChunkRange has no chunks crossing the range boundaries.
+type rangeHead struct {
+	*tsdb.Head
+	mint, maxt int64
+}
+
+func (h *rangeHead) Index() (tsdb.IndexReader, error) {
+	ir, err := h.Head.Index()
+	if err != nil {
+		return nil, err
+	}
+	return &rangeIndexReader{IndexReader: ir, mint: h.mint, maxt: h.maxt}, nil
+}
+
+type rangeIndexReader struct {
+	tsdb.IndexReader
+	mint, maxt int64
+}
+
+func (r *rangeIndexReader) Series(ref uint64, lset *labels.Labels, chks *[]chunks.Meta) error {
+	if err := r.IndexReader.Series(ref, lset, chks); err != nil {
+		return err
+	}
+
+	res := (*chks)[:0]
+	for _, c := range *chks {
+		// Block ranges are half-open, chunk ranges are closed.
+		if c.OverlapsClosedInterval(r.mint, r.maxt-1) {
+			res = append(res, c)
+		}
+	}
+	*chks = res
+	return nil
+}
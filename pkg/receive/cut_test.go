@@ -0,0 +1,121 @@
+package receive
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/prometheus/prometheus/tsdb"
+	"github.com/prometheus/prometheus/tsdb/labels"
+	"github.com/thanos-io/thanos/pkg/testutil"
+)
+
+func TestCutAlignedBlocks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "receive-cut")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(dir)) }()
+
+	const minute = int64(time.Minute / time.Millisecond)
+
+	chunkRange := AlignedChunkRange(2*time.Hour, 30*time.Minute)
+	testutil.Equals(t, 30*time.Minute, chunkRange)
+
+	db, err := tsdb.Open(dir, nil, nil, &tsdb.Options{
+		BlockRanges: []int64{int64(chunkRange / time.Millisecond)},
+		NoLockfile:  true,
+	})
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, db.Close()) }()
+	db.DisableCompactions()
+
+	// One sample per minute for 5h.
+	app := db.Appender()
+	for i := int64(0); i < 300; i++ {
+		_, err := app.Add(labels.FromStrings("a", "1"), i*minute, float64(i))
+		testutil.Ok(t, err)
+	}
+	testutil.Ok(t, app.Commit())
+
+	ids, err := CutAlignedBlocks(context.Background(), nil, db, 2*time.Hour, 30*time.Minute)
+	testutil.Ok(t, err)
+	testutil.Equals(t, 2, len(ids))
+
+	// The block ending at 4h30m is not cut until the head reaches 5h30m.
+	blocks := db.Blocks()
+	testutil.Equals(t, 2, len(blocks))
+	for i, exp := range []struct {
+		mint, maxt int64
+		samples    uint64
+	}{
+		{mint: 0, maxt: 30 * minute, samples: 30},
+		{mint: 30 * minute, maxt: 150 * minute, samples: 120},
+	} {
+		meta := blocks[i].Meta()
+		testutil.Equals(t, ids[i], meta.ULID)
+		testutil.Equals(t, exp.mint, meta.MinTime)
+		testutil.Equals(t, exp.maxt, meta.MaxTime)
+		testutil.Equals(t, exp.samples, meta.Stats.NumSamples)
+	}
+	testutil.Equals(t, 150*minute, db.Head().MinTime())
+
+	// No samples are lost or duplicated across blocks and head.
+	q, err := db.Querier(0, 300*minute)
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, q.Close()) }()
+
+	set, err := q.Select(labels.NewEqualMatcher("a", "1"))
+	testutil.Ok(t, err)
+	testutil.Assert(t, set.Next(), "expected series")
+
+	var i int64
+	it := set.At().Iterator()
+	for ; it.Next(); i++ {
+		ts, v := it.At()
+		testutil.Equals(t, i*minute, ts)
+		testutil.Equals(t, float64(i), v)
+	}
+	testutil.Ok(t, it.Err())
+	testutil.Equals(t, int64(300), i)
+
+	// Nothing more to cut.
+	ids, err = CutAlignedBlocks(context.Background(), nil, db, 2*time.Hour, 30*time.Minute)
+	testutil.Ok(t, err)
+	testutil.Equals(t, 0, len(ids))
+}
+
+func TestAlignedBlockEnd(t *testing.T) {
+	for _, tcase := range []struct {
+		t, offset, exp int64
+	}{
+		{t: 0, offset: 0, exp: 10},
+		{t: 9, offset: 0, exp: 10},
+		{t: 10, offset: 0, exp: 20},
+		{t: 0, offset: 3, exp: 3},
+		{t: 3, offset: 3, exp: 13},
+		{t: 12, offset: 3, exp: 13},
+		{t: -1, offset: 3, exp: 3},
+		{t: -8, offset: 3, exp: -7},
+	} {
+		t.Run("", func(t *testing.T) {
+			testutil.Equals(t, tcase.exp, alignedBlockEnd(tcase.t, 10, tcase.offset))
+		})
+	}
+}
+
+func TestAlignedChunkRange(t *testing.T) {
+	for _, tcase := range []struct {
+		blockDuration, offset, exp time.Duration
+	}{
+		{blockDuration: 2 * time.Hour, offset: 0, exp: 2 * time.Hour},
+		{blockDuration: 2 * time.Hour, offset: 4 * time.Hour, exp: 2 * time.Hour},
+		{blockDuration: 2 * time.Hour, offset: 30 * time.Minute, exp: 30 * time.Minute},
+		{blockDuration: 24 * time.Hour, offset: 5 * time.Hour, exp: time.Hour},
+		{blockDuration: 24 * time.Hour, offset: 26 * time.Hour, exp: 2 * time.Hour},
+	} {
+		t.Run("", func(t *testing.T) {
+			testutil.Equals(t, tcase.exp, AlignedChunkRange(tcase.blockDuration, tcase.offset))
+		})
+	}
+}
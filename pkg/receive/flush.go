@@ -0,0 +1,68 @@
+package receive
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/tsdb"
+	terrors "github.com/prometheus/prometheus/tsdb/errors"
+)
+
+// FlushAndClose writes all samples currently held in the head of the given database into a new
+// block within the database directory, so it can be shipped like any other block, and closes the database.
+// Once the block is written, the WAL is removed so its data is neither replayed nor compacted again on restart.
+// Writes must have stopped before. If samples were still appended while flushing, the block is removed
+// again and the WAL is kept instead. It returns the ID of the flushed block, which is zero if nothing was flushed.
+func FlushAndClose(ctx context.Context, logger log.Logger, db *tsdb.DB) (id ulid.ULID, err error) {
+	if logger == nil {
+		logger = log.NewNopLogger()
+	}
+	// Wait for in-flight head compactions and keep new ones from writing the same data concurrently.
+	db.DisableCompactions()
+
+	head := db.Head()
+	mint, maxt, numSeries := head.MinTime(), head.MaxTime(), head.NumSeries()
+	if numSeries == 0 || mint > maxt {
+		level.Info(logger).Log("msg", "head is empty, nothing to flush")
+		return id, db.Close()
+	}
+
+	id, err = writeHead(ctx, logger, db.Dir(), head, mint, maxt)
+	if err != nil {
+		var merr terrors.MultiError
+		merr.Add(errors.Wrap(err, "flush head"))
+		merr.Add(db.Close())
+		return ulid.ULID{}, merr.Err()
+	}
+	if err := db.Close(); err != nil {
+		return id, errors.Wrap(err, "close db")
+	}
+
+	if head.MaxTime() != maxt || head.NumSeries() != numSeries {
+		level.Warn(logger).Log("msg", "samples were appended while flushing head, keeping WAL instead", "block", id)
+		if err := os.RemoveAll(filepath.Join(db.Dir(), id.String())); err != nil {
+			return ulid.ULID{}, errors.Wrap(err, "remove flushed block")
+		}
+		return ulid.ULID{}, nil
+	}
+	if err := os.RemoveAll(filepath.Join(db.Dir(), "wal")); err != nil {
+		return id, errors.Wrap(err, "remove WAL")
+	}
+	level.Info(logger).Log("msg", "flushed head", "block", id, "mint", mint, "maxt", maxt)
+	return id, nil
+}
+
+func writeHead(ctx context.Context, logger log.Logger, dir string, head *tsdb.Head, mint, maxt int64) (ulid.ULID, error) {
+	compactor, err := tsdb.NewLeveledCompactor(ctx, nil, logger, tsdb.DefaultOptions.BlockRanges, nil)
+	if err != nil {
+		return ulid.ULID{}, errors.Wrap(err, "create compactor")
+	}
+	// Block intervals are half-open, so the last sample must be strictly before maxt.
+	// The compactor aborts writing once ctx is done.
+	return compactor.Write(dir, head, mint, maxt+1, nil)
+}
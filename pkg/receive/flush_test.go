@@ -0,0 +1,100 @@
+package receive
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/oklog/ulid"
+	"github.com/prometheus/prometheus/tsdb"
+	"github.com/prometheus/prometheus/tsdb/labels"
+	"github.com/thanos-io/thanos/pkg/block"
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/objstore/inmem"
+	"github.com/thanos-io/thanos/pkg/shipper"
+	"github.com/thanos-io/thanos/pkg/testutil"
+)
+
+func TestFlushAndClose(t *testing.T) {
+	dir, err := ioutil.TempDir("", "receive-flush")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(dir)) }()
+
+	ctx := context.Background()
+	opts := &tsdb.Options{
+		BlockRanges: []int64{int64(2 * time.Hour / time.Millisecond)},
+		NoLockfile:  true,
+	}
+
+	db, err := tsdb.Open(dir, nil, nil, opts)
+	testutil.Ok(t, err)
+
+	app := db.Appender()
+	for i := int64(0); i < 100; i++ {
+		_, err := app.Add(labels.FromStrings("a", "1"), i*1000, float64(i))
+		testutil.Ok(t, err)
+		_, err = app.Add(labels.FromStrings("a", "2"), i*1000, float64(i))
+		testutil.Ok(t, err)
+	}
+	testutil.Ok(t, app.Commit())
+
+	id, err := FlushAndClose(ctx, log.NewNopLogger(), db)
+	testutil.Ok(t, err)
+	testutil.Assert(t, id != ulid.ULID{}, "expected head to be flushed into a block")
+
+	meta, err := metadata.Read(filepath.Join(dir, id.String()))
+	testutil.Ok(t, err)
+	testutil.Equals(t, int64(0), meta.MinTime)
+	testutil.Equals(t, int64(99001), meta.MaxTime)
+	testutil.Equals(t, uint64(200), meta.Stats.NumSamples)
+
+	_, err = os.Stat(filepath.Join(dir, "wal"))
+	testutil.Assert(t, os.IsNotExist(err), "expected WAL to be removed, got %v", err)
+
+	// The flushed block is picked up by the shipper like any other block.
+	bkt := inmem.NewBucket()
+	s := shipper.New(nil, nil, dir, bkt, func() labels.Labels { return labels.FromStrings("replica", "1") }, metadata.ReceiveSource)
+	uploaded, err := s.Sync(ctx)
+	testutil.Ok(t, err)
+	testutil.Equals(t, 1, uploaded)
+
+	exists, err := bkt.Exists(ctx, filepath.Join(id.String(), block.MetaFilename))
+	testutil.Ok(t, err)
+	testutil.Assert(t, exists, "expected flushed block to be uploaded")
+
+	// On restart, the data is served from the block only and the head starts empty.
+	db, err = tsdb.Open(dir, nil, nil, opts)
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, db.Close()) }()
+
+	testutil.Equals(t, uint64(0), db.Head().NumSeries())
+	testutil.Equals(t, 1, len(db.Blocks()))
+	testutil.Equals(t, id, db.Blocks()[0].Meta().ULID)
+}
+
+func TestFlushAndClose_EmptyHead(t *testing.T) {
+	dir, err := ioutil.TempDir("", "receive-flush")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(dir)) }()
+
+	db, err := tsdb.Open(dir, nil, nil, &tsdb.Options{
+		BlockRanges: []int64{int64(2 * time.Hour / time.Millisecond)},
+		NoLockfile:  true,
+	})
+	testutil.Ok(t, err)
+
+	id, err := FlushAndClose(context.Background(), nil, db)
+	testutil.Ok(t, err)
+	testutil.Equals(t, ulid.ULID{}, id)
+
+	files, err := ioutil.ReadDir(dir)
+	testutil.Ok(t, err)
+	for _, f := range files {
+		_, ok := block.IsBlockDir(f.Name())
+		testutil.Assert(t, !ok, "unexpected block %s", f.Name())
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	stdlog "log"
+	"math"
 	"net"
 	"net/http"
 	"strconv"
@@ -39,6 +40,9 @@ type Options struct {
 	TenantHeader      string
 	ReplicaHeader     string
 	ReplicationFactor uint64
+	// TenantSamplesRateLimit, if positive, is the number of samples per second each tenant may write to this receiver.
+	// Write requests exceeding it are rejected with 429 Too Many Requests. Requests forwarded by other receivers are not limited.
+	TenantSamplesRateLimit float64
 }
 
 // Handler serves a Prometheus remote write receiving HTTP endpoint.
@@ -53,8 +57,11 @@ type Handler struct {
 	mtx      sync.RWMutex
 	hashring Hashring
 
+	rateLimiter *tenantRateLimiter
+
 	// Metrics
-	forwardRequestsTotal *prometheus.CounterVec
+	forwardRequestsTotal     *prometheus.CounterVec
+	rateLimitedRequestsTotal *prometheus.CounterVec
 
 	// These fields are uint32 rather than boolean to be able to use atomic functions.
 	storageReady uint32
@@ -77,12 +84,21 @@ func NewHandler(logger log.Logger, o *Options) *Handler {
 				Help: "The number of forward requests.",
 			}, []string{"result"},
 		),
+		rateLimitedRequestsTotal: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "thanos_receive_rate_limited_requests_total",
+				Help: "The number of write requests rejected because the tenant exceeded its samples rate limit. Only tenants listed in the hashring configuration are set as label.",
+			}, []string{"tenant"},
+		),
+	}
+	if o.TenantSamplesRateLimit > 0 {
+		h.rateLimiter = newTenantRateLimiter(o.TenantSamplesRateLimit)
 	}
 
 	ins := extpromhttp.NewNopInstrumentationMiddleware()
 	if o.Registry != nil {
 		ins = extpromhttp.NewInstrumentationMiddleware(o.Registry)
-		o.Registry.MustRegister(h.forwardRequestsTotal)
+		o.Registry.MustRegister(h.forwardRequestsTotal, h.rateLimitedRequestsTotal)
 	}
 
 	readyf := h.testReady
@@ -109,6 +125,18 @@ func (h *Handler) Hashring(hashring Hashring) {
 	h.hashring = hashring
 }
 
+// tenantLabel returns the tenant if it is listed in the hashring configuration and an empty string otherwise, which
+// bounds the cardinality of per tenant metrics as the tenant header can be set to anything by clients.
+func (h *Handler) tenantLabel(tenant string) string {
+	h.mtx.RLock()
+	defer h.mtx.RUnlock()
+
+	if configuredTenant(h.hashring, tenant) {
+		return tenant
+	}
+	return ""
+}
+
 // Verifies whether the server is ready or not.
 func (h *Handler) isReady() bool {
 	sr := atomic.LoadUint32(&h.storageReady)
@@ -217,6 +245,19 @@ func (h *Handler) receive(w http.ResponseWriter, r *http.Request) {
 
 	tenant := r.Header.Get(h.options.TenantHeader)
 
+	if h.rateLimiter != nil && !rep.replicated {
+		var samples int
+		for _, ts := range wreq.Timeseries {
+			samples += len(ts.Samples)
+		}
+		if ok, retryAfter := h.rateLimiter.take(tenant, samples); !ok {
+			h.rateLimitedRequestsTotal.WithLabelValues(h.tenantLabel(tenant)).Inc()
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+			http.Error(w, "samples rate limit of tenant exceeded", http.StatusTooManyRequests)
+			return
+		}
+	}
+
 	// Forward any time series as necessary. All time series
 	// destined for the local node will be written to the receiver.
 	// Time series will be replicated as necessary.
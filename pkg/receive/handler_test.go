@@ -0,0 +1,97 @@
+package receive
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/golang/snappy"
+	promtestutil "github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/prometheus/prometheus/storage/tsdb"
+	"github.com/thanos-io/thanos/pkg/testutil"
+)
+
+func TestHandler_TenantSamplesRateLimit(t *testing.T) {
+	db, err := testutil.NewTSDB()
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(db.Dir())) }()
+	defer func() { testutil.Ok(t, db.Close()) }()
+
+	s := &tsdb.ReadyStorage{}
+	s.Set(db, 0)
+
+	h := NewHandler(nil, &Options{
+		Receiver:               NewWriter(nil, s, DuplicatePolicyReject, labels.Label{}),
+		Endpoint:               "local",
+		TenantHeader:           "THANOS-TENANT",
+		ReplicaHeader:          "THANOS-REPLICA",
+		ReplicationFactor:      1,
+		TenantSamplesRateLimit: 10,
+	})
+	h.Hashring(SingleNodeHashring("local"))
+
+	now := time.Unix(0, 0)
+	h.rateLimiter.now = func() time.Time { return now }
+
+	var series int
+	write := func(tenant, replica string, samples int) *httptest.ResponseRecorder {
+		series++
+		ts := prompb.TimeSeries{Labels: []prompb.Label{{Name: "__name__", Value: "up"}, {Name: "i", Value: strconv.Itoa(series)}}}
+		for i := 0; i < samples; i++ {
+			ts.Samples = append(ts.Samples, prompb.Sample{Timestamp: int64(i), Value: 1})
+		}
+		b, err := proto.Marshal(&prompb.WriteRequest{Timeseries: []prompb.TimeSeries{ts}})
+		testutil.Ok(t, err)
+
+		req := httptest.NewRequest("POST", "/api/v1/receive", bytes.NewReader(snappy.Encode(nil, b)))
+		req.Header.Set("THANOS-TENANT", tenant)
+		if replica != "" {
+			req.Header.Set("THANOS-REPLICA", replica)
+		}
+		rec := httptest.NewRecorder()
+		h.receive(rec, req)
+		return rec
+	}
+
+	// The bucket holds one second worth of samples. A request taking more than left is still admitted.
+	testutil.Equals(t, http.StatusOK, write("a", "", 8).Code)
+	testutil.Equals(t, http.StatusOK, write("a", "", 8).Code)
+
+	rec := write("a", "", 1)
+	testutil.Equals(t, http.StatusTooManyRequests, rec.Code)
+	testutil.Equals(t, "1", rec.Header().Get("Retry-After"))
+
+	// Other tenants and requests forwarded by other receivers are not affected.
+	testutil.Equals(t, http.StatusOK, write("b", "", 8).Code)
+	testutil.Equals(t, http.StatusOK, write("a", "0", 8).Code)
+
+	// The bucket is refilled over time.
+	now = now.Add(500 * time.Millisecond)
+	testutil.Equals(t, http.StatusTooManyRequests, write("a", "", 1).Code)
+	now = now.Add(200 * time.Millisecond)
+	testutil.Equals(t, http.StatusOK, write("a", "", 1).Code)
+
+	// Tenants not listed in the hashring configuration are not set as label.
+	testutil.Equals(t, 2.0, promtestutil.ToFloat64(h.rateLimitedRequestsTotal.WithLabelValues("")))
+	testutil.Equals(t, 0.0, promtestutil.ToFloat64(h.rateLimitedRequestsTotal.WithLabelValues("a")))
+
+	h.Hashring(newMultiHashring([]HashringConfig{{Tenants: []string{"a"}, Endpoints: []string{"local"}}, {Endpoints: []string{"local"}}}))
+	testutil.Equals(t, http.StatusOK, write("b", "", 16).Code)
+	testutil.Equals(t, http.StatusTooManyRequests, write("a", "", 8).Code)
+	testutil.Equals(t, http.StatusTooManyRequests, write("b", "", 8).Code)
+	testutil.Equals(t, 1.0, promtestutil.ToFloat64(h.rateLimitedRequestsTotal.WithLabelValues("a")))
+	testutil.Equals(t, 3.0, promtestutil.ToFloat64(h.rateLimitedRequestsTotal.WithLabelValues("")))
+
+	// Buckets are evicted once they are full again.
+	testutil.Equals(t, 2, len(h.rateLimiter.buckets))
+	now = now.Add(bucketEvictInterval)
+	testutil.Equals(t, http.StatusOK, write("c", "", 1).Code)
+	testutil.Equals(t, 1, len(h.rateLimiter.buckets))
+}
@@ -136,6 +136,20 @@ func (m *multiHashring) GetN(tenant string, ts *prompb.TimeSeries, n uint64) (st
 	return "", errors.New("no matching hashring to handle tenant")
 }
 
+// configuredTenant returns true if the tenant is explicitly listed in the configuration of the given hashring.
+func configuredTenant(h Hashring, tenant string) bool {
+	m, ok := h.(*multiHashring)
+	if !ok {
+		return false
+	}
+	for _, t := range m.tenantSets {
+		if _, ok := t[tenant]; ok {
+			return true
+		}
+	}
+	return false
+}
+
 // newMultiHashring creates a multi-tenant hashring for a given slice of
 // groups.
 // Which hashring to use for a tenant is determined
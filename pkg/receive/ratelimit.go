@@ -0,0 +1,73 @@
+package receive
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// tenantRateLimiter limits the rate of samples each tenant can write with a token bucket per tenant. A bucket holds
+// up to one second worth of samples and is refilled continuously. Requests are admitted as long as the bucket is not
+// empty, even if they take more samples than left, so that requests larger than the bucket can be admitted at all.
+// Buckets that were refilled completely are evicted periodically, as they do not differ from new ones.
+type tenantRateLimiter struct {
+	samplesPerSecond float64
+	now              func() time.Time
+
+	mtx       sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastEvict time.Time
+}
+
+// bucketEvictInterval is the interval at which full buckets are evicted.
+const bucketEvictInterval = time.Minute
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newTenantRateLimiter(samplesPerSecond float64) *tenantRateLimiter {
+	return &tenantRateLimiter{
+		samplesPerSecond: samplesPerSecond,
+		now:              time.Now,
+		buckets:          map[string]*tokenBucket{},
+	}
+}
+
+// take takes the given number of samples from the bucket of the tenant. If the bucket is empty, nothing is taken and
+// the duration until it is refilled enough to admit a request again is returned instead.
+func (l *tenantRateLimiter) take(tenant string, samples int) (ok bool, retryAfter time.Duration) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	now := l.now()
+	if now.Sub(l.lastEvict) >= bucketEvictInterval {
+		l.evictFull(now)
+	}
+
+	b, found := l.buckets[tenant]
+	if !found {
+		b = &tokenBucket{tokens: l.samplesPerSecond, last: now}
+		l.buckets[tenant] = b
+	}
+	b.tokens = math.Min(l.samplesPerSecond, b.tokens+now.Sub(b.last).Seconds()*l.samplesPerSecond)
+	b.last = now
+
+	if b.tokens <= 0 {
+		// Wait a little longer to have a non-empty bucket afterwards.
+		return false, time.Duration((-b.tokens/l.samplesPerSecond)*float64(time.Second)) + time.Millisecond
+	}
+	b.tokens -= float64(samples)
+	return true, 0
+}
+
+// evictFull removes all buckets that were refilled completely by now.
+func (l *tenantRateLimiter) evictFull(now time.Time) {
+	for tenant, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.samplesPerSecond >= l.samplesPerSecond {
+			delete(l.buckets, tenant)
+		}
+	}
+	l.lastEvict = now
+}
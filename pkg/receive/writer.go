@@ -1,7 +1,10 @@
 package receive
 
 import (
+	"sort"
+
 	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
 	"github.com/pkg/errors"
 	"github.com/prometheus/prometheus/prompb"
 
@@ -9,20 +12,47 @@ import (
 	"github.com/prometheus/prometheus/storage"
 )
 
+// DuplicatePolicy defines how samples are handled that conflict with already ingested ones,
+// e.g. because a sender retried a write request after a timeout.
+type DuplicatePolicy string
+
+const (
+	// DuplicatePolicyReject fails the whole write request on the first out-of-order or duplicate sample.
+	DuplicatePolicyReject DuplicatePolicy = "reject"
+	// DuplicatePolicyIgnore drops out-of-order and duplicate samples and ingests the remaining ones.
+	DuplicatePolicyIgnore DuplicatePolicy = "ignore"
+	// DuplicatePolicyLastWins sorts the samples of each series in a write request by timestamp and ingests only the
+	// last given of those sharing a timestamp. Samples conflicting with already ingested ones are dropped like with DuplicatePolicyIgnore, as those cannot be overwritten.
+	DuplicatePolicyLastWins DuplicatePolicy = "last-wins"
+)
+
+// DuplicatePolicies are all supported duplicate policies.
+var DuplicatePolicies = []string{string(DuplicatePolicyReject), string(DuplicatePolicyIgnore), string(DuplicatePolicyLastWins)}
+
 // Appendable returns an Appender.
 type Appendable interface {
 	Appender() (storage.Appender, error)
 }
 
 type Writer struct {
-	logger log.Logger
-	append Appendable
+	logger          log.Logger
+	append          Appendable
+	duplicatePolicy DuplicatePolicy
+	replicaLabel    labels.Label
 }
 
-func NewWriter(logger log.Logger, app Appendable) *Writer {
+// NewWriter returns a Writer appending received samples to app.
+// Unless its name is empty, replicaLabel is set on all received series, replacing any label of the same name,
+// so that the data of receivers accepting the same write requests can be deduplicated along it at query time.
+func NewWriter(logger log.Logger, app Appendable, duplicatePolicy DuplicatePolicy, replicaLabel labels.Label) *Writer {
+	if logger == nil {
+		logger = log.NewNopLogger()
+	}
 	return &Writer{
-		logger: logger,
-		append: app,
+		logger:          logger,
+		append:          app,
+		duplicatePolicy: duplicatePolicy,
+		replicaLabel:    replicaLabel,
 	}
 }
 
@@ -32,6 +62,7 @@ func (r *Writer) Receive(wreq *prompb.WriteRequest) error {
 		return errors.Wrap(err, "failed to get appender")
 	}
 
+	var numOutOfOrder, numDuplicates int
 	for _, t := range wreq.Timeseries {
 		lset := make(labels.Labels, len(t.Labels))
 		for j := range t.Labels {
@@ -40,18 +71,75 @@ func (r *Writer) Receive(wreq *prompb.WriteRequest) error {
 				Value: t.Labels[j].Value,
 			}
 		}
+		if r.replicaLabel.Name != "" {
+			lset = labels.NewBuilder(lset).Set(r.replicaLabel.Name, r.replicaLabel.Value).Labels()
+		}
+
+		samples := t.Samples
+		if r.duplicatePolicy == DuplicatePolicyLastWins {
+			samples = lastSamplesPerTimestamp(samples)
+		}
 
-		for _, s := range t.Samples {
+		for _, s := range samples {
 			_, err = app.Add(lset, s.Timestamp, s.Value)
-			if err != nil {
-				return errors.Wrap(err, "failed to non-fast add")
+			if err == nil {
+				continue
 			}
+			if r.duplicatePolicy != DuplicatePolicyReject {
+				switch errors.Cause(err) {
+				case storage.ErrOutOfOrderSample:
+					numOutOfOrder++
+					continue
+				case storage.ErrDuplicateSampleForTimestamp:
+					numDuplicates++
+					continue
+				}
+			}
+			return errors.Wrap(err, "failed to non-fast add")
 		}
 	}
 
+	if numOutOfOrder > 0 {
+		level.Debug(r.logger).Log("msg", "dropped out of order samples", "num_dropped", numOutOfOrder)
+	}
+	if numDuplicates > 0 {
+		level.Debug(r.logger).Log("msg", "dropped samples with duplicate timestamp and different value", "num_dropped", numDuplicates)
+	}
+
 	if err := app.Commit(); err != nil {
 		return errors.Wrap(err, "failed to commit")
 	}
 
 	return nil
 }
+
+// lastSamplesPerTimestamp returns the given samples sorted by timestamp. Of samples sharing a timestamp, only
+// the one given last is kept.
+func lastSamplesPerTimestamp(samples []prompb.Sample) []prompb.Sample {
+	sorted := true
+	for i := 1; i < len(samples); i++ {
+		if samples[i].Timestamp <= samples[i-1].Timestamp {
+			sorted = false
+			break
+		}
+	}
+	if sorted {
+		return samples
+	}
+
+	res := make([]prompb.Sample, len(samples))
+	copy(res, samples)
+	sort.SliceStable(res, func(i, j int) bool {
+		return res[i].Timestamp < res[j].Timestamp
+	})
+
+	n := 0
+	for i, s := range res {
+		if i+1 < len(res) && res[i+1].Timestamp == s.Timestamp {
+			continue
+		}
+		res[n] = s
+		n++
+	}
+	return res[:n]
+}
@@ -0,0 +1,225 @@
+package receive
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/prometheus/prometheus/storage"
+	"github.com/prometheus/prometheus/storage/tsdb"
+	tsdblabels "github.com/prometheus/prometheus/tsdb/labels"
+	"github.com/thanos-io/thanos/pkg/component"
+	"github.com/thanos-io/thanos/pkg/query"
+	"github.com/thanos-io/thanos/pkg/store"
+	"github.com/thanos-io/thanos/pkg/store/storepb"
+	"github.com/thanos-io/thanos/pkg/testutil"
+)
+
+func TestWriter_DuplicatePolicy(t *testing.T) {
+	lset := []prompb.Label{{Name: "__name__", Value: "up"}}
+	retried := func(samples ...prompb.Sample) *prompb.WriteRequest {
+		return &prompb.WriteRequest{Timeseries: []prompb.TimeSeries{{Labels: lset, Samples: samples}}}
+	}
+
+	for _, tcase := range []struct {
+		policy DuplicatePolicy
+		// Written after samples (1, 1) and (2, 2) were ingested.
+		wreq *prompb.WriteRequest
+
+		expErr     bool
+		expSamples []prompb.Sample
+	}{
+		{
+			policy:     DuplicatePolicyReject,
+			wreq:       retried(prompb.Sample{Timestamp: 2, Value: 2}, prompb.Sample{Timestamp: 3, Value: 3}),
+			expSamples: []prompb.Sample{{Timestamp: 1, Value: 1}, {Timestamp: 2, Value: 2}, {Timestamp: 3, Value: 3}},
+		},
+		{
+			policy:     DuplicatePolicyReject,
+			wreq:       retried(prompb.Sample{Timestamp: 2, Value: 5}, prompb.Sample{Timestamp: 3, Value: 3}),
+			expErr:     true,
+			expSamples: []prompb.Sample{{Timestamp: 1, Value: 1}, {Timestamp: 2, Value: 2}},
+		},
+		{
+			policy:     DuplicatePolicyReject,
+			wreq:       retried(prompb.Sample{Timestamp: 0, Value: 0}, prompb.Sample{Timestamp: 3, Value: 3}),
+			expErr:     true,
+			expSamples: []prompb.Sample{{Timestamp: 1, Value: 1}, {Timestamp: 2, Value: 2}},
+		},
+		{
+			policy:     DuplicatePolicyIgnore,
+			wreq:       retried(prompb.Sample{Timestamp: 0, Value: 0}, prompb.Sample{Timestamp: 2, Value: 5}, prompb.Sample{Timestamp: 3, Value: 3}),
+			expSamples: []prompb.Sample{{Timestamp: 1, Value: 1}, {Timestamp: 2, Value: 2}, {Timestamp: 3, Value: 3}},
+		},
+		{
+			// Within a request, the first sample per timestamp is ingested.
+			policy:     DuplicatePolicyIgnore,
+			wreq:       retried(prompb.Sample{Timestamp: 3, Value: 3}, prompb.Sample{Timestamp: 3, Value: 4}),
+			expSamples: []prompb.Sample{{Timestamp: 1, Value: 1}, {Timestamp: 2, Value: 2}, {Timestamp: 3, Value: 3}},
+		},
+		{
+			policy:     DuplicatePolicyLastWins,
+			wreq:       retried(prompb.Sample{Timestamp: 3, Value: 3}, prompb.Sample{Timestamp: 4, Value: 4}, prompb.Sample{Timestamp: 3, Value: 5}),
+			expSamples: []prompb.Sample{{Timestamp: 1, Value: 1}, {Timestamp: 2, Value: 2}, {Timestamp: 3, Value: 5}, {Timestamp: 4, Value: 4}},
+		},
+		{
+			// Already ingested samples are not overwritten.
+			policy:     DuplicatePolicyLastWins,
+			wreq:       retried(prompb.Sample{Timestamp: 0, Value: 0}, prompb.Sample{Timestamp: 2, Value: 5}, prompb.Sample{Timestamp: 3, Value: 3}),
+			expSamples: []prompb.Sample{{Timestamp: 1, Value: 1}, {Timestamp: 2, Value: 2}, {Timestamp: 3, Value: 3}},
+		},
+	} {
+		t.Run(string(tcase.policy), func(t *testing.T) {
+			db, err := testutil.NewTSDB()
+			testutil.Ok(t, err)
+			defer func() { testutil.Ok(t, os.RemoveAll(db.Dir())) }()
+			defer func() { testutil.Ok(t, db.Close()) }()
+
+			s := &tsdb.ReadyStorage{}
+			s.Set(db, 0)
+
+			w := NewWriter(nil, s, tcase.policy, labels.Label{})
+			testutil.Ok(t, w.Receive(retried(prompb.Sample{Timestamp: 1, Value: 1}, prompb.Sample{Timestamp: 2, Value: 2})))
+
+			err = w.Receive(tcase.wreq)
+			if tcase.expErr {
+				testutil.NotOk(t, err)
+			} else {
+				testutil.Ok(t, err)
+			}
+
+			q, err := s.Querier(context.Background(), 0, 10)
+			testutil.Ok(t, err)
+			defer func() { testutil.Ok(t, q.Close()) }()
+
+			set, _, err := q.Select(&storage.SelectParams{}, &labels.Matcher{Type: labels.MatchEqual, Name: "__name__", Value: "up"})
+			testutil.Ok(t, err)
+			testutil.Assert(t, set.Next(), "expected series")
+
+			var got []prompb.Sample
+			it := set.At().Iterator()
+			for it.Next() {
+				ts, v := it.At()
+				got = append(got, prompb.Sample{Timestamp: ts, Value: v})
+			}
+			testutil.Ok(t, it.Err())
+			testutil.Equals(t, tcase.expSamples, got)
+			testutil.Assert(t, !set.Next(), "expected single series")
+		})
+	}
+}
+
+func TestWriter_ReplicaLabel(t *testing.T) {
+	wreq := &prompb.WriteRequest{Timeseries: []prompb.TimeSeries{
+		{
+			Labels:  []prompb.Label{{Name: "__name__", Value: "up"}, {Name: "job", Value: "a"}},
+			Samples: []prompb.Sample{{Timestamp: 10000, Value: 1}, {Timestamp: 20000, Value: 2}},
+		},
+		{
+			// A replica label set by the sender is replaced.
+			Labels:  []prompb.Label{{Name: "__name__", Value: "up"}, {Name: "job", Value: "b"}, {Name: "replica", Value: "sender"}},
+			Samples: []prompb.Sample{{Timestamp: 10000, Value: 3}},
+		},
+	}}
+
+	var stores []*store.TSDBStore
+	for _, replica := range []string{"receive-0", "receive-1"} {
+		db, err := testutil.NewTSDB()
+		testutil.Ok(t, err)
+		defer func() { testutil.Ok(t, os.RemoveAll(db.Dir())) }()
+		defer func() { testutil.Ok(t, db.Close()) }()
+
+		s := &tsdb.ReadyStorage{}
+		s.Set(db, 0)
+
+		w := NewWriter(nil, s, DuplicatePolicyReject, labels.Label{Name: "replica", Value: replica})
+		testutil.Ok(t, w.Receive(wreq))
+
+		q, err := s.Querier(context.Background(), 0, 30000)
+		testutil.Ok(t, err)
+		defer func() { testutil.Ok(t, q.Close()) }()
+
+		set, _, err := q.Select(&storage.SelectParams{}, &labels.Matcher{Type: labels.MatchEqual, Name: "__name__", Value: "up"})
+		testutil.Ok(t, err)
+
+		var lsets []labels.Labels
+		for set.Next() {
+			lsets = append(lsets, set.At().Labels())
+		}
+		testutil.Ok(t, set.Err())
+		testutil.Equals(t, []labels.Labels{
+			labels.FromStrings("__name__", "up", "job", "a", "replica", replica),
+			labels.FromStrings("__name__", "up", "job", "b", "replica", replica),
+		}, lsets)
+
+		stores = append(stores, store.NewTSDBStore(nil, nil, db, component.Receive, tsdblabels.FromStrings("tenant", "default")))
+	}
+
+	// Deduplicating along the replica label collapses the series of both receivers.
+	q, err := query.NewQueryableCreator(nil, &fanInStoreServer{stores: stores}, false, false, nil, nil)(true, []string{"replica"}, 0, false, false).Querier(context.Background(), 1, 30000)
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, q.Close()) }()
+
+	set, _, err := q.Select(&storage.SelectParams{}, &labels.Matcher{Type: labels.MatchEqual, Name: "__name__", Value: "up"})
+	testutil.Ok(t, err)
+
+	var lsets []labels.Labels
+	var samples [][]prompb.Sample
+	for set.Next() {
+		lsets = append(lsets, set.At().Labels())
+
+		var got []prompb.Sample
+		it := set.At().Iterator()
+		for it.Next() {
+			ts, v := it.At()
+			got = append(got, prompb.Sample{Timestamp: ts, Value: v})
+		}
+		testutil.Ok(t, it.Err())
+		samples = append(samples, got)
+	}
+	testutil.Ok(t, set.Err())
+	testutil.Equals(t, []labels.Labels{
+		labels.FromStrings("__name__", "up", "job", "a", "tenant", "default"),
+		labels.FromStrings("__name__", "up", "job", "b", "tenant", "default"),
+	}, lsets)
+	testutil.Equals(t, [][]prompb.Sample{
+		{{Timestamp: 10000, Value: 1}, {Timestamp: 20000, Value: 2}},
+		{{Timestamp: 10000, Value: 3}},
+	}, samples)
+}
+
+// fanInStoreServer sends the series of all its stores. Like gRPC, it copies responses on sending, as stores may
+// reuse their buffers afterwards.
+type fanInStoreServer struct {
+	// This field just exist to pseudo-implement the unused methods of the interface.
+	storepb.StoreServer
+
+	stores []*store.TSDBStore
+}
+
+func (s *fanInStoreServer) Series(r *storepb.SeriesRequest, srv storepb.Store_SeriesServer) error {
+	for _, st := range s.stores {
+		if err := st.Series(r, copyingSeriesServer{srv}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type copyingSeriesServer struct {
+	storepb.Store_SeriesServer
+}
+
+func (s copyingSeriesServer) Send(r *storepb.SeriesResponse) error {
+	b, err := r.Marshal()
+	if err != nil {
+		return err
+	}
+	var c storepb.SeriesResponse
+	if err := c.Unmarshal(b); err != nil {
+		return err
+	}
+	return s.Store_SeriesServer.Send(&c)
+}
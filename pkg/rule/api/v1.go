@@ -47,7 +47,7 @@ func (api *API) Register(r *route.Router, tracer opentracing.Tracer, logger log.
 			if data, warnings, err := f(r); err != nil {
 				qapi.RespondError(w, err, data)
 			} else if data != nil {
-				qapi.Respond(w, data, warnings)
+				qapi.Respond(w, r, data, warnings)
 			} else {
 				w.WriteHeader(http.StatusNoContent)
 			}
@@ -32,6 +32,7 @@ type metrics struct {
 	uploads           prometheus.Counter
 	uploadFailures    prometheus.Counter
 	uploadedCompacted prometheus.Gauge
+	uploadHighWater   prometheus.Gauge
 }
 
 func newMetrics(r prometheus.Registerer, uploadCompacted bool) *metrics {
@@ -57,6 +58,10 @@ func newMetrics(r prometheus.Registerer, uploadCompacted bool) *metrics {
 		Name: "thanos_shipper_upload_compacted_done",
 		Help: "If 1 it means shipper uploaded all compacted blocks from the filesystem.",
 	})
+	m.uploadHighWater = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "thanos_shipper_upload_high_watermark_seconds",
+		Help: "Max time of the newest block uploaded by the shipper with all older blocks uploaded as well, in Unix seconds. Blocks are uploaded oldest first, so it only moves forward.",
+	})
 
 	if r != nil {
 		r.MustRegister(
@@ -64,6 +69,7 @@ func newMetrics(r prometheus.Registerer, uploadCompacted bool) *metrics {
 			m.dirSyncFailures,
 			m.uploads,
 			m.uploadFailures,
+			m.uploadHighWater,
 		)
 		if uploadCompacted {
 			r.MustRegister(m.uploadedCompacted)
@@ -247,7 +253,9 @@ func (c *lazyOverlapChecker) IsOverlapping(ctx context.Context, newMeta tsdb.Blo
 // Sync performs a single synchronization, which ensures all non-compacted local blocks have been uploaded
 // to the object bucket once.
 //
-// If updload
+// Blocks are uploaded in time order, oldest first, so the time range available in the bucket grows forward.
+// Once a non-compacted block fails to upload, all newer blocks are held back until it succeeds, so the bucket
+// never serves data after a gap. The upload high-water mark only covers the contiguous prefix of uploaded blocks.
 //
 // It is not concurrency-safe, however it is compactor-safe (running concurrently with compactor is ok)
 func (s *Shipper) Sync(ctx context.Context) (uploaded int, err error) {
@@ -274,6 +282,11 @@ func (s *Shipper) Sync(ctx context.Context) (uploaded int, err error) {
 	var (
 		checker    = newLazyOverlapChecker(s.logger, s.bucket, s.labels)
 		uploadErrs int
+		// blockedBy is the first non-compacted block that failed to upload, holding back all newer blocks.
+		blockedBy *metadata.Meta
+		// contiguous is false once any block was not uploaded, so newer blocks do not advance the high-water mark.
+		contiguous       = true
+		highWater  int64 = math.MinInt64
 	)
 	// Sync non compacted blocks first.
 	if err := s.iterBlockMetas(func(m *metadata.Meta) error {
@@ -281,6 +294,9 @@ func (s *Shipper) Sync(ctx context.Context) (uploaded int, err error) {
 		// it was generally removed by the compaction process.
 		if _, uploaded := hasUploaded[m.ULID]; uploaded {
 			meta.Uploaded = append(meta.Uploaded, m.ULID)
+			if contiguous && m.MaxTime > highWater {
+				highWater = m.MaxTime
+			}
 			return nil
 		}
 
@@ -300,26 +316,39 @@ func (s *Shipper) Sync(ctx context.Context) (uploaded int, err error) {
 		}
 
 		// We only ship of the first compacted block level as normal flow.
-		if m.Compaction.Level > 1 {
-			if !s.uploadCompacted {
-				return nil
-			}
+		if m.Compaction.Level > 1 && !s.uploadCompacted {
+			return nil
+		}
+
+		if blockedBy != nil {
+			level.Debug(s.logger).Log("msg", "holding back block until older block is uploaded", "block", m.ULID, "older", blockedBy.ULID)
+			return nil
+		}
 
+		if m.Compaction.Level > 1 {
 			if err := checker.IsOverlapping(ctx, m.BlockMeta); err != nil {
 				level.Error(s.logger).Log("msg", "found overlap or error during sync, cannot upload compacted block", "err", err)
 				uploadErrs++
+				contiguous = false
 				return nil
 			}
 		}
 
 		if err := s.upload(ctx, m); err != nil {
 			level.Error(s.logger).Log("msg", "shipping failed", "block", m.ULID, "err", err)
-			// No error returned, just log line. This is because we want other blocks to be uploaded even
-			// though this one failed. It will be retried on second Sync iteration.
+			// No error returned, just log line. This is because we want already uploaded blocks to be
+			// recorded in the meta file. It will be retried on second Sync iteration.
 			uploadErrs++
+			contiguous = false
+			if m.Compaction.Level == 1 {
+				blockedBy = m
+			}
 			return nil
 		}
 		meta.Uploaded = append(meta.Uploaded, m.ULID)
+		if contiguous && m.MaxTime > highWater {
+			highWater = m.MaxTime
+		}
 
 		uploaded++
 		s.metrics.uploads.Inc()
@@ -334,6 +363,9 @@ func (s *Shipper) Sync(ctx context.Context) (uploaded int, err error) {
 	}
 
 	s.metrics.dirSyncs.Inc()
+	if highWater != math.MinInt64 {
+		s.metrics.uploadHighWater.Set(float64(highWater) / 1000)
+	}
 
 	if uploadErrs > 0 {
 		s.metrics.uploadFailures.Add(float64(uploadErrs))
@@ -380,14 +412,15 @@ func (s *Shipper) upload(ctx context.Context, meta *metadata.Meta) error {
 	return block.Upload(ctx, s.logger, s.bucket, updir)
 }
 
-// iterBlockMetas calls f with the block meta for each block found in dir. It logs
-// an error and continues if it cannot access a meta.json file.
+// iterBlockMetas calls f with the block meta for each block found in dir, ordered by min time
+// (oldest first). It logs an error and continues if it cannot access a meta.json file.
 // If f returns an error, the function returns with the same error.
 func (s *Shipper) iterBlockMetas(f func(m *metadata.Meta) error) error {
 	names, err := fileutil.ReadDir(s.dir)
 	if err != nil {
 		return errors.Wrap(err, "read dir")
 	}
+	var metas []*metadata.Meta
 	for _, n := range names {
 		if _, ok := block.IsBlockDir(n); !ok {
 			continue
@@ -407,6 +440,15 @@ func (s *Shipper) iterBlockMetas(f func(m *metadata.Meta) error) error {
 			level.Warn(s.logger).Log("msg", "reading meta file failed", "err", err)
 			continue
 		}
+		metas = append(metas, m)
+	}
+	sort.Slice(metas, func(i, j int) bool {
+		if metas[i].BlockMeta.MinTime == metas[j].BlockMeta.MinTime {
+			return metas[i].BlockMeta.ULID.Compare(metas[j].BlockMeta.ULID) < 0
+		}
+		return metas[i].BlockMeta.MinTime < metas[j].BlockMeta.MinTime
+	})
+	for _, m := range metas {
 		if err := f(m); err != nil {
 			return err
 		}
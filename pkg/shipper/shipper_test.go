@@ -1,6 +1,8 @@
 package shipper
 
 import (
+	"context"
+	"io"
 	"io/ioutil"
 	"math"
 	"os"
@@ -9,8 +11,15 @@ import (
 
 	"github.com/go-kit/kit/log"
 	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	promtestutil "github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/prometheus/prometheus/tsdb"
+	"github.com/prometheus/prometheus/tsdb/labels"
+	"github.com/thanos-io/thanos/pkg/block"
 	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/objstore"
+	"github.com/thanos-io/thanos/pkg/objstore/inmem"
 	"github.com/thanos-io/thanos/pkg/testutil"
 )
 
@@ -77,3 +86,139 @@ func TestShipperTimestamps(t *testing.T) {
 	testutil.Equals(t, int64(1000), mint)
 	testutil.Equals(t, int64(2000), maxt)
 }
+
+// recordingBucket records the order in which block meta files are uploaded and fails uploads of blocks in failFor.
+type recordingBucket struct {
+	objstore.Bucket
+
+	uploaded []ulid.ULID
+	failFor  map[ulid.ULID]struct{}
+}
+
+func (b *recordingBucket) Upload(ctx context.Context, name string, r io.Reader) error {
+	id, ok := block.IsBlockDir(path.Dir(name))
+	if ok {
+		if _, fail := b.failFor[id]; fail {
+			return errors.Errorf("upload of %s failed", name)
+		}
+	}
+	if err := b.Bucket.Upload(ctx, name, r); err != nil {
+		return err
+	}
+	if ok && path.Base(name) == block.MetaFilename {
+		b.uploaded = append(b.uploaded, id)
+	}
+	return nil
+}
+
+func TestShipper_SyncBlocks_OldestFirst(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shipper-test")
+	testutil.Ok(t, err)
+	defer func() {
+		testutil.Ok(t, os.RemoveAll(dir))
+	}()
+
+	ctx := context.Background()
+	bkt := &recordingBucket{Bucket: inmem.NewBucket(), failFor: map[ulid.ULID]struct{}{}}
+	reg := prometheus.NewRegistry()
+	s := New(nil, reg, dir, bkt, func() labels.Labels { return labels.FromStrings("prometheus", "prom-1") }, metadata.TestSource)
+
+	// ULIDs are in reverse time order, so iterating the directory by name would upload the newest block first.
+	var ids []ulid.ULID
+	for i := 0; i < 3; i++ {
+		id := ulid.MustNew(uint64(10-i), nil)
+		bdir := path.Join(dir, id.String())
+		testutil.Ok(t, os.MkdirAll(path.Join(bdir, block.ChunksDirname), os.ModePerm))
+		testutil.Ok(t, ioutil.WriteFile(path.Join(bdir, block.ChunksDirname, "000001"), []byte("chunkcontents"), os.ModePerm))
+		testutil.Ok(t, ioutil.WriteFile(path.Join(bdir, block.IndexFilename), []byte("indexcontents"), os.ModePerm))
+		testutil.Ok(t, metadata.Write(log.NewNopLogger(), bdir, &metadata.Meta{
+			BlockMeta: tsdb.BlockMeta{
+				ULID:       id,
+				MinTime:    int64(i) * 1000,
+				MaxTime:    int64(i+1) * 1000,
+				Version:    1,
+				Stats:      tsdb.BlockStats{NumSamples: 1},
+				Compaction: tsdb.BlockMetaCompaction{Level: 1},
+			},
+		}))
+		ids = append(ids, id)
+	}
+
+	// A failing middle block holds back the newer block, so the bucket has no gap.
+	bkt.failFor[ids[1]] = struct{}{}
+	uploaded, err := s.Sync(ctx)
+	testutil.NotOk(t, err)
+	testutil.Equals(t, 1, uploaded)
+	testutil.Equals(t, []ulid.ULID{ids[0]}, bkt.uploaded)
+	testutil.Equals(t, float64(1), promtestutil.ToFloat64(s.metrics.uploadHighWater))
+
+	delete(bkt.failFor, ids[1])
+	uploaded, err = s.Sync(ctx)
+	testutil.Ok(t, err)
+	testutil.Equals(t, 2, uploaded)
+	testutil.Equals(t, ids, bkt.uploaded)
+	testutil.Equals(t, float64(3), promtestutil.ToFloat64(s.metrics.uploadHighWater))
+
+	meta, err := ReadMetaFile(dir)
+	testutil.Ok(t, err)
+	testutil.Equals(t, ids, meta.Uploaded)
+}
+
+func TestShipper_SyncBlocks_FailureHoldsBackNewer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shipper-test")
+	testutil.Ok(t, err)
+	defer func() {
+		testutil.Ok(t, os.RemoveAll(dir))
+	}()
+
+	ctx := context.Background()
+	bkt := &recordingBucket{Bucket: inmem.NewBucket(), failFor: map[ulid.ULID]struct{}{}}
+	s := New(nil, nil, dir, bkt, func() labels.Labels { return labels.FromStrings("prometheus", "prom-1") }, metadata.TestSource)
+
+	createBlock := func(id ulid.ULID, mint, maxt int64) {
+		bdir := path.Join(dir, id.String())
+		testutil.Ok(t, os.MkdirAll(path.Join(bdir, block.ChunksDirname), os.ModePerm))
+		testutil.Ok(t, ioutil.WriteFile(path.Join(bdir, block.ChunksDirname, "000001"), []byte("chunkcontents"), os.ModePerm))
+		testutil.Ok(t, ioutil.WriteFile(path.Join(bdir, block.IndexFilename), []byte("indexcontents"), os.ModePerm))
+		testutil.Ok(t, metadata.Write(log.NewNopLogger(), bdir, &metadata.Meta{
+			BlockMeta: tsdb.BlockMeta{
+				ULID:       id,
+				MinTime:    mint,
+				MaxTime:    maxt,
+				Version:    1,
+				Stats:      tsdb.BlockStats{NumSamples: 1},
+				Compaction: tsdb.BlockMetaCompaction{Level: 1},
+			},
+		}))
+	}
+	oldest, failing, newer := ulid.MustNew(1, nil), ulid.MustNew(2, nil), ulid.MustNew(3, nil)
+	createBlock(oldest, 0, 1000)
+	createBlock(failing, 1000, 2000)
+	createBlock(newer, 2000, 3000)
+
+	// While a block keeps failing, newer blocks are held back and the high-water mark stays before it.
+	bkt.failFor[failing] = struct{}{}
+	for i := 0; i < 2; i++ {
+		_, err := s.Sync(ctx)
+		testutil.NotOk(t, err)
+	}
+	testutil.Equals(t, []ulid.ULID{oldest}, bkt.uploaded)
+	testutil.Equals(t, float64(1), promtestutil.ToFloat64(s.metrics.uploadHighWater))
+	testutil.Equals(t, float64(2), promtestutil.ToFloat64(s.metrics.uploadFailures))
+
+	// So are blocks cut later on.
+	latest := ulid.MustNew(4, nil)
+	createBlock(latest, 3000, 4000)
+	uploaded, err := s.Sync(ctx)
+	testutil.NotOk(t, err)
+	testutil.Equals(t, 0, uploaded)
+	testutil.Equals(t, []ulid.ULID{oldest}, bkt.uploaded)
+
+	// Once it succeeds, all held back blocks follow in time order.
+	delete(bkt.failFor, failing)
+	uploaded, err = s.Sync(ctx)
+	testutil.Ok(t, err)
+	testutil.Equals(t, 3, uploaded)
+	testutil.Equals(t, []ulid.ULID{oldest, failing, newer, latest}, bkt.uploaded)
+	testutil.Equals(t, float64(4), promtestutil.ToFloat64(s.metrics.uploadHighWater))
+}
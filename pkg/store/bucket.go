@@ -3,8 +3,10 @@ package store
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
 	"encoding/binary"
 	"fmt"
+	"hash/crc32"
 	"io"
 	"io/ioutil"
 	"math"
@@ -20,6 +22,7 @@ import (
 	"github.com/go-kit/kit/log/level"
 	"github.com/oklog/run"
 	"github.com/oklog/ulid"
+	"github.com/opentracing/opentracing-go"
 	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/prometheus/tsdb/chunkenc"
@@ -68,7 +71,9 @@ type bucketStoreMetrics struct {
 	resultSeriesCount     prometheus.Summary
 	chunkSizeBytes        prometheus.Histogram
 	queriesDropped        prometheus.Counter
+	queriesDroppedBlocks  prometheus.Counter
 	queriesLimit          prometheus.Gauge
+	chunkChecksumFailures prometheus.Counter
 }
 
 func newBucketStoreMetrics(reg prometheus.Registerer) *bucketStoreMetrics {
@@ -148,10 +153,18 @@ func newBucketStoreMetrics(reg prometheus.Registerer) *bucketStoreMetrics {
 		Name: "thanos_bucket_store_queries_dropped_total",
 		Help: "Number of queries that were dropped due to the sample limit.",
 	})
+	m.queriesDroppedBlocks = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "thanos_bucket_store_queries_dropped_blocks_limit_total",
+		Help: "Number of queries that were dropped due to the block limit.",
+	})
 	m.queriesLimit = prometheus.NewGauge(prometheus.GaugeOpts{
 		Name: "thanos_bucket_store_queries_concurrent_max",
 		Help: "Number of maximum concurrent queries.",
 	})
+	m.chunkChecksumFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "thanos_bucket_store_chunk_checksum_failures_total",
+		Help: "Number of chunks read from the bucket whose checksum did not match their data.",
+	})
 
 	if reg != nil {
 		reg.MustRegister(
@@ -170,7 +183,9 @@ func newBucketStoreMetrics(reg prometheus.Registerer) *bucketStoreMetrics {
 			m.resultSeriesCount,
 			m.chunkSizeBytes,
 			m.queriesDropped,
+			m.queriesDroppedBlocks,
 			m.queriesLimit,
+			m.chunkChecksumFailures,
 		)
 	}
 	return &m
@@ -181,11 +196,16 @@ type indexCache interface {
 	Postings(b ulid.ULID, l labels.Label) ([]byte, bool)
 	SetSeries(b ulid.ULID, id uint64, v []byte)
 	Series(b ulid.ULID, id uint64) ([]byte, bool)
+	SetNoMatch(b ulid.ULID, matcher string)
+	NoMatch(b ulid.ULID, matcher string) bool
+	ForgetBlock(b ulid.ULID)
 }
 
 // FilterConfig is a configuration, which Store uses for filtering metrics.
 type FilterConfig struct {
 	MinTime, MaxTime model.TimeOrDurationValue
+	// Resolutions, if not empty, are the only downsampling resolutions in milliseconds of blocks to load and serve.
+	Resolutions []int64
 }
 
 // BucketStore implements the store API backed by a bucket. It loads all index
@@ -213,9 +233,23 @@ type BucketStore struct {
 
 	// samplesLimiter limits the number of samples per each Series() call.
 	samplesLimiter *Limiter
-	partitioner    partitioner
+	// blocksLimiter limits the number of blocks touched by each Series() call.
+	blocksLimiter *Limiter
+	partitioner   partitioner
 
 	filterConfig *FilterConfig
+
+	// preferRecentBlocks skips blocks whose queried time range is covered by a more recently created block.
+	preferRecentBlocks bool
+	// postingsDecodeConcurrency is the number of goroutines decoding postings of a single block per Series() call.
+	postingsDecodeConcurrency int
+	// verifyChunkChecksums makes Series() calls fail on chunks whose checksum does not match their data.
+	verifyChunkChecksums bool
+	// syncNewestFirst makes syncs load new blocks in descending order of their max time instead of bucket order.
+	syncNewestFirst bool
+	// blockSeriesConcurrency, if positive, is the maximum number of blocks read concurrently per Series() call.
+	// Otherwise all blocks of a call are read concurrently.
+	blockSeriesConcurrency int
 }
 
 // NewBucketStore creates a new bucket backed store that implements the store API against
@@ -232,6 +266,12 @@ func NewBucketStore(
 	debugLogging bool,
 	blockSyncConcurrency int,
 	filterConf *FilterConfig,
+	preferRecentBlocks bool,
+	maxBlockCount uint64,
+	postingsDecodeConcurrency int,
+	verifyChunkChecksums bool,
+	syncNewestFirst bool,
+	blockSeriesConcurrency int,
 ) (*BucketStore, error) {
 	if logger == nil {
 		logger = log.NewNopLogger()
@@ -240,6 +280,12 @@ func NewBucketStore(
 	if maxConcurrent < 0 {
 		return nil, errors.Errorf("max concurrency value cannot be lower than 0 (got %v)", maxConcurrent)
 	}
+	if postingsDecodeConcurrency < 1 {
+		return nil, errors.Errorf("postings decode concurrency value cannot be lower than 1 (got %v)", postingsDecodeConcurrency)
+	}
+	if blockSeriesConcurrency < 0 {
+		return nil, errors.Errorf("block series concurrency value cannot be lower than 0 (got %v)", blockSeriesConcurrency)
+	}
 
 	chunkPool, err := pool.NewBytesPool(2e5, 50e6, 2, maxChunkPoolBytes)
 	if err != nil {
@@ -263,9 +309,15 @@ func NewBucketStore(
 			maxConcurrent,
 			extprom.WrapRegistererWithPrefix("thanos_bucket_store_series_", reg),
 		),
-		samplesLimiter: NewLimiter(maxSampleCount, metrics.queriesDropped),
-		partitioner:    gapBasedPartitioner{maxGapSize: maxGapSize},
-		filterConfig:   filterConf,
+		samplesLimiter:            NewLimiter(maxSampleCount, metrics.queriesDropped),
+		blocksLimiter:             NewLimiter(maxBlockCount, metrics.queriesDroppedBlocks),
+		partitioner:               gapBasedPartitioner{maxGapSize: maxGapSize},
+		filterConfig:              filterConf,
+		preferRecentBlocks:        preferRecentBlocks,
+		postingsDecodeConcurrency: postingsDecodeConcurrency,
+		verifyChunkChecksums:      verifyChunkChecksums,
+		syncNewestFirst:           syncNewestFirst,
+		blockSeriesConcurrency:    blockSeriesConcurrency,
 	}
 	s.metrics = metrics
 
@@ -295,6 +347,16 @@ func (s *BucketStore) Close() (err error) {
 // SyncBlocks synchronizes the stores state with the Bucket bucket.
 // It will reuse disk space as persistent cache based on s.dir param.
 func (s *BucketStore) SyncBlocks(ctx context.Context) error {
+	return s.syncBlocks(ctx, math.MinInt64)
+}
+
+// SyncRecentBlocks syncs like SyncBlocks, but only loads new blocks with data after mint. This allows serving
+// recent data before all blocks of a large bucket are loaded by subsequent syncs.
+func (s *BucketStore) SyncRecentBlocks(ctx context.Context, mint int64) error {
+	return s.syncBlocks(ctx, mint)
+}
+
+func (s *BucketStore) syncBlocks(ctx context.Context, mint int64) error {
 	var wg sync.WaitGroup
 	blockc := make(chan ulid.ULID)
 
@@ -310,8 +372,16 @@ func (s *BucketStore) SyncBlocks(ctx context.Context) error {
 			wg.Done()
 		}()
 	}
+	load := func(id ulid.ULID) {
+		select {
+		case <-ctx.Done():
+		case blockc <- id:
+		}
+	}
 
 	allIDs := map[ulid.ULID]struct{}{}
+	// pending holds the metas of new blocks to load once all are known, if they are loaded newest first.
+	var pending []*metadata.Meta
 
 	err := s.bucket.Iter(ctx, "", func(name string) error {
 		// Strip trailing slash indicating a directory.
@@ -320,28 +390,36 @@ func (s *BucketStore) SyncBlocks(ctx context.Context) error {
 			return nil
 		}
 
-		inRange, err := s.isBlockInMinMaxRange(ctx, id)
+		err, meta := loadMeta(ctx, s.logger, s.bucket, filepath.Join(s.dir, id.String()), id)
 		if err != nil {
 			level.Warn(s.logger).Log("msg", "error parsing block range", "block", id, "err", err)
 			return nil
 		}
 
-		if !inRange {
+		if !s.isMetaSelected(meta) {
 			return nil
 		}
 
 		allIDs[id] = struct{}{}
 
-		if b := s.getBlock(id); b != nil {
+		if b := s.getBlock(id); b != nil || meta.MaxTime <= mint {
 			return nil
 		}
-		select {
-		case <-ctx.Done():
-		case blockc <- id:
+		if s.syncNewestFirst {
+			pending = append(pending, meta)
+			return nil
 		}
+		load(id)
 		return nil
 	})
 
+	sort.SliceStable(pending, func(i, j int) bool {
+		return pending[i].MaxTime > pending[j].MaxTime
+	})
+	for _, m := range pending {
+		load(m.ULID)
+	}
+
 	close(blockc)
 	wg.Wait()
 
@@ -392,30 +470,84 @@ func (s *BucketStore) InitialSync(ctx context.Context) error {
 	return nil
 }
 
+// Warmup fetches the postings and series index entries matching any of the given selectors from all blocks, so that
+// they are in the index cache before the first queries need them. Chunks are not fetched.
+func (s *BucketStore) Warmup(ctx context.Context, selectors [][]storepb.LabelMatcher) error {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	for _, sel := range selectors {
+		matchers, err := translateMatchers(sel)
+		if err != nil {
+			return errors.Wrap(err, "translate matchers")
+		}
+
+		for _, bs := range s.blockSets {
+			blockMatchers, ok := bs.labelMatchers(matchers...)
+			if !ok {
+				continue
+			}
+			for _, blocks := range bs.blocks {
+				for _, b := range blocks {
+					if err := s.warmupBlock(ctx, b, blockMatchers); err != nil {
+						return errors.Wrapf(err, "warm up block %s", b.meta.ULID)
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (s *BucketStore) warmupBlock(ctx context.Context, b *bucketBlock, matchers []labels.Matcher) error {
+	indexr := b.indexReader(ctx)
+	indexr.postingsDecodeConcurrency = s.postingsDecodeConcurrency
+	defer runutil.CloseWithLogOnErr(s.logger, indexr, "warmup block")
+
+	ps, err := indexr.ExpandedPostings(matchers)
+	if err != nil {
+		return errors.Wrap(err, "expanded matching posting")
+	}
+	return errors.Wrap(indexr.PreloadSeries(ps), "preload series")
+}
+
 func (s *BucketStore) numBlocks() int {
 	s.mtx.RLock()
 	defer s.mtx.RUnlock()
 	return len(s.blocks)
 }
 
-func (s *BucketStore) isBlockInMinMaxRange(ctx context.Context, id ulid.ULID) (bool, error) {
+// isBlockSelected returns true if the block is within the configured time range and of one of the configured resolutions.
+func (s *BucketStore) isBlockSelected(ctx context.Context, id ulid.ULID) (bool, error) {
 	dir := filepath.Join(s.dir, id.String())
 
 	err, meta := loadMeta(ctx, s.logger, s.bucket, dir, id)
 	if err != nil {
 		return false, err
 	}
+	return s.isMetaSelected(meta), nil
+}
 
+// isMetaSelected returns true if the block of the given meta matches the filter config.
+func (s *BucketStore) isMetaSelected(meta *metadata.Meta) bool {
 	// We check for blocks in configured minTime, maxTime range.
 	switch {
 	case meta.MaxTime <= s.filterConfig.MinTime.PrometheusTimestamp():
-		return false, nil
+		return false
 
 	case meta.MinTime >= s.filterConfig.MaxTime.PrometheusTimestamp():
-		return false, nil
+		return false
 	}
 
-	return true, nil
+	if len(s.filterConfig.Resolutions) == 0 {
+		return true
+	}
+	for _, res := range s.filterConfig.Resolutions {
+		if meta.Thanos.Downsample.Resolution == res {
+			return true
+		}
+	}
+	return false
 }
 
 func (s *BucketStore) getBlock(id ulid.ULID) *bucketBlock {
@@ -487,6 +619,7 @@ func (s *BucketStore) removeBlock(id ulid.ULID) error {
 	}
 
 	s.metrics.blocksLoaded.Dec()
+	s.indexCache.ForgetBlock(id)
 	if err := b.Close(); err != nil {
 		return errors.Wrap(err, "close block")
 	}
@@ -516,14 +649,28 @@ func (s *BucketStore) TimeRange() (mint, maxt int64) {
 	return mint, maxt
 }
 
+// BlockSetID returns an identifier of the blocks loaded by the store, which changes whenever blocks are added or removed.
+func (s *BucketStore) BlockSetID() string {
+	s.mtx.RLock()
+	ids := make([]string, 0, len(s.blocks))
+	for id := range s.blocks {
+		ids = append(ids, id.String())
+	}
+	s.mtx.RUnlock()
+
+	sort.Strings(ids)
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(strings.Join(ids, ","))))
+}
+
 // Info implements the storepb.StoreServer interface.
 func (s *BucketStore) Info(context.Context, *storepb.InfoRequest) (*storepb.InfoResponse, error) {
 	mint, maxt := s.TimeRange()
 	// Store nodes hold global data and thus have no labels.
 	return &storepb.InfoResponse{
-		StoreType: component.Store.ToProto(),
-		MinTime:   mint,
-		MaxTime:   maxt,
+		StoreType:  component.Store.ToProto(),
+		MinTime:    mint,
+		MaxTime:    maxt,
+		BlockSetId: s.BlockSetID(),
 	}, nil
 }
 
@@ -591,7 +738,9 @@ func blockSeries(
 	matchers []labels.Matcher,
 	req *storepb.SeriesRequest,
 	samplesLimiter *Limiter,
+	recordMatcherCardinality bool,
 ) (storepb.SeriesSet, *queryStats, error) {
+	indexr.recordMatcherCardinality = recordMatcherCardinality
 	ps, err := indexr.ExpandedPostings(matchers)
 	if err != nil {
 		return nil, nil, errors.Wrap(err, "expanded matching posting")
@@ -645,6 +794,14 @@ func blockSeries(
 			return s.lset[i].Name < s.lset[j].Name
 		})
 
+		if req.SkipChunks {
+			// Return only the labels of series having data in the requested time range.
+			if hasChunkInRange(chks, req.MinTime, req.MaxTime) {
+				res = append(res, seriesEntry{lset: s.lset})
+			}
+			continue
+		}
+
 		for _, meta := range chks {
 			if meta.MaxTime < req.MinTime {
 				continue
@@ -667,6 +824,10 @@ func blockSeries(
 		}
 	}
 
+	if req.SkipChunks {
+		return newBucketSeriesSet(res), indexr.stats, nil
+	}
+
 	// Preload all chunks that were marked in the previous stage.
 	if err := chunkr.preload(samplesLimiter); err != nil {
 		return nil, nil, errors.Wrap(err, "preload chunks")
@@ -688,6 +849,16 @@ func blockSeries(
 	return newBucketSeriesSet(res), indexr.stats.merge(chunkr.stats), nil
 }
 
+// hasChunkInRange returns true if any of the given chunks overlaps [mint, maxt].
+func hasChunkInRange(chks []chunks.Meta, mint, maxt int64) bool {
+	for _, meta := range chks {
+		if meta.MaxTime >= mint && meta.MinTime <= maxt {
+			return true
+		}
+	}
+	return false
+}
+
 func populateChunk(out *storepb.AggrChunk, in chunkenc.Chunk, aggrs []storepb.Aggr) error {
 	if in.Encoding() == chunkenc.EncXOR {
 		out.Raw = &storepb.Chunk{Type: storepb.Chunk_XOR, Data: in.Bytes()}
@@ -731,6 +902,16 @@ func populateChunk(out *storepb.AggrChunk, in chunkenc.Chunk, aggrs []storepb.Ag
 				return errors.Errorf("aggregate %s does not exist", downsample.AggrCounter)
 			}
 			out.Counter = &storepb.Chunk{Type: storepb.Chunk_XOR, Data: x.Bytes()}
+		case storepb.Aggr_SUM_SQUARES:
+			// The sum of squares is optional, queriers fall back to other aggregates if it is missing.
+			x, err := ac.Get(downsample.AggrSumSquares)
+			if err == downsample.ErrAggrNotExist {
+				continue
+			}
+			if err != nil {
+				return errors.Wrapf(err, "get aggregate %s", downsample.AggrSumSquares)
+			}
+			out.SumSquares = &storepb.Chunk{Type: storepb.Chunk_XOR, Data: x.Bytes()}
 		}
 	}
 	return nil
@@ -795,7 +976,12 @@ func (s *BucketStore) Series(req *storepb.SeriesRequest, srv storepb.Store_Serie
 		g     run.Group
 		res   []storepb.SeriesSet
 		mtx   sync.Mutex
+		// blockSlots bounds the number of blocks read at once, if not nil.
+		blockSlots chan struct{}
 	)
+	if s.blockSeriesConcurrency > 0 {
+		blockSlots = make(chan struct{}, s.blockSeriesConcurrency)
+	}
 	s.mtx.RLock()
 
 	for _, bs := range s.blockSets {
@@ -804,11 +990,19 @@ func (s *BucketStore) Series(req *storepb.SeriesRequest, srv storepb.Store_Serie
 			continue
 		}
 		blocks := bs.getFor(req.MinTime, req.MaxTime, req.MaxResolutionWindow)
+		if s.preferRecentBlocks {
+			blocks = preferRecentBlocks(blocks, req.MinTime, req.MaxTime)
+		}
 
 		if s.debugLogging {
 			debugFoundBlockSetOverview(s.logger, req.MinTime, req.MaxTime, req.MaxResolutionWindow, bs.labels, blocks)
 		}
 
+		if err := s.blocksLimiter.Check(uint64(stats.blocksQueried + len(blocks))); err != nil {
+			s.mtx.RUnlock()
+			return status.Error(codes.ResourceExhausted, errors.Wrap(err, "exceeded blocks limit").Error())
+		}
+
 		for _, b := range blocks {
 			stats.blocksQueried++
 
@@ -817,13 +1011,24 @@ func (s *BucketStore) Series(req *storepb.SeriesRequest, srv storepb.Store_Serie
 
 			// We must keep the readers open until all their data has been sent.
 			indexr := b.indexReader(ctx)
+			indexr.postingsDecodeConcurrency = s.postingsDecodeConcurrency
 			chunkr := b.chunkReader(ctx)
+			chunkr.verifyChecksums = s.verifyChunkChecksums
 
 			// Defer all closes to the end of Series method.
 			defer runutil.CloseWithLogOnErr(s.logger, indexr, "series block")
 			defer runutil.CloseWithLogOnErr(s.logger, chunkr, "series block")
 
 			g.Add(func() error {
+				if blockSlots != nil {
+					select {
+					case blockSlots <- struct{}{}:
+					case <-ctx.Done():
+						return ctx.Err()
+					}
+					defer func() { <-blockSlots }()
+				}
+
 				part, pstats, err := blockSeries(ctx,
 					b.meta.ULID,
 					b.meta.Thanos.Labels,
@@ -832,8 +1037,13 @@ func (s *BucketStore) Series(req *storepb.SeriesRequest, srv storepb.Store_Serie
 					blockMatchers,
 					req,
 					s.samplesLimiter,
+					s.debugLogging,
 				)
 				if err != nil {
+					if _, ok := errors.Cause(err).(chunkChecksumError); ok {
+						s.metrics.chunkChecksumFailures.Inc()
+						level.Error(s.logger).Log("msg", "chunk checksum mismatch, the block may be corrupted", "block", b.meta.ULID, "err", err)
+					}
 					return errors.Wrapf(err, "fetch series for block %s", b.meta.ULID)
 				}
 
@@ -867,6 +1077,7 @@ func (s *BucketStore) Series(req *storepb.SeriesRequest, srv storepb.Store_Serie
 		s.metrics.seriesDataSizeTouched.WithLabelValues("chunks").Observe(float64(stats.chunksTouchedSizeSum))
 		s.metrics.seriesDataSizeFetched.WithLabelValues("chunks").Observe(float64(stats.chunksFetchedSizeSum))
 		s.metrics.resultSeriesCount.Observe(float64(stats.mergedSeriesCount))
+		stats.tagSpan(srv.Context())
 
 		level.Debug(s.logger).Log("msg", "stats query processed",
 			"stats", fmt.Sprintf("%+v", stats), "err", err)
@@ -1099,6 +1310,42 @@ func (s *bucketBlockSet) getFor(mint, maxt, maxResolutionMillis int64) (bs []*bu
 	return bs
 }
 
+// preferRecentBlocks drops blocks whose data within [mint, maxt] is fully covered by a
+// more recently created block of the same resolution, e.g. an older block overlapping a backfilled one.
+// The order of the remaining blocks is preserved.
+func preferRecentBlocks(bs []*bucketBlock, mint, maxt int64) []*bucketBlock {
+	res := make([]*bucketBlock, 0, len(bs))
+	for _, b := range bs {
+		if !coveredByNewerBlock(b, bs, mint, maxt) {
+			res = append(res, b)
+		}
+	}
+	return res
+}
+
+func coveredByNewerBlock(b *bucketBlock, bs []*bucketBlock, mint, maxt int64) bool {
+	start, end := b.meta.MinTime, b.meta.MaxTime
+	if start < mint {
+		start = mint
+	}
+	if end > maxt {
+		end = maxt
+	}
+	for _, o := range bs {
+		if o.meta.Thanos.Downsample.Resolution != b.meta.Thanos.Downsample.Resolution {
+			continue
+		}
+		// ULIDs are sortable by creation time.
+		if o.meta.ULID.Compare(b.meta.ULID) <= 0 {
+			continue
+		}
+		if o.meta.MinTime <= start && o.meta.MaxTime >= end {
+			return true
+		}
+	}
+	return false
+}
+
 // labelMatchers verifies whether the block set matches the given matchers and returns a new
 // set of matchers that is equivalent when querying data within the block.
 func (s *bucketBlockSet) labelMatchers(matchers ...labels.Matcher) ([]labels.Matcher, bool) {
@@ -1314,6 +1561,11 @@ type bucketIndexReader struct {
 	stats  *queryStats
 	cache  indexCache
 
+	// recordMatcherCardinality enables recording the number of postings each matcher selects into stats.
+	recordMatcherCardinality bool
+	// postingsDecodeConcurrency enables decoding postings with that many goroutines if greater than 1.
+	postingsDecodeConcurrency int
+
 	mtx          sync.Mutex
 	loadedSeries map[uint64][]byte
 }
@@ -1356,7 +1608,7 @@ func (r *bucketIndexReader) ExpandedPostings(ms []labels.Matcher) ([]uint64, err
 	// NOTE: Derived from tsdb.PostingsForMatchers.
 	for _, m := range ms {
 		// Each group is separate to tell later what postings are intersecting with what.
-		postingGroups = append(postingGroups, toPostingGroup(r.LabelValues, m))
+		postingGroups = append(postingGroups, r.postingGroup(m))
 	}
 
 	if len(postingGroups) == 0 {
@@ -1367,9 +1619,29 @@ func (r *bucketIndexReader) ExpandedPostings(ms []labels.Matcher) ([]uint64, err
 		return nil, errors.Wrap(err, "get postings")
 	}
 
+	if r.postingsDecodeConcurrency > 1 {
+		if err := decodePostings(r.ctx, postingGroups, r.postingsDecodeConcurrency); err != nil {
+			return nil, errors.Wrap(err, "decode postings")
+		}
+	}
+
 	var postings []index.Postings
-	for _, g := range postingGroups {
-		postings = append(postings, g.Postings())
+	for i, g := range postingGroups {
+		if !r.recordMatcherCardinality {
+			postings = append(postings, g.Postings())
+			continue
+		}
+
+		// Expand each group on its own to know how broad the matcher is before intersecting.
+		gps, err := index.ExpandPostings(g.Postings())
+		if err != nil {
+			return nil, errors.Wrapf(err, "expand postings for matcher %s", ms[i])
+		}
+		if r.stats.matcherPostings == nil {
+			r.stats.matcherPostings = map[string]int{}
+		}
+		r.stats.matcherPostings[ms[i].String()] += len(gps)
+		postings = append(postings, index.NewListPostings(gps))
 	}
 
 	ps, err := index.ExpandPostings(index.Intersect(postings...))
@@ -1388,9 +1660,26 @@ func (r *bucketIndexReader) ExpandedPostings(ms []labels.Matcher) ([]uint64, err
 	return ps, nil
 }
 
+// postingGroup returns the posting group of the given matcher. Matchers selecting no label values of the block are
+// remembered in the cache, so repeated requests for absent values do not scan all values of the label again.
+func (r *bucketIndexReader) postingGroup(m labels.Matcher) *postingGroup {
+	key := m.String()
+	if r.cache.NoMatch(r.block.meta.ULID, key) {
+		return newPostingGroup(nil, merge)
+	}
+
+	g := toPostingGroup(r.LabelValues, m)
+	if len(g.keys) == 0 {
+		r.cache.SetNoMatch(r.block.meta.ULID, key)
+	}
+	return g
+}
+
 type postingGroup struct {
 	keys     labels.Labels
 	postings []index.Postings
+	// decoded holds the expanded postings to aggregate instead, if they were decoded upfront.
+	decoded []index.Postings
 
 	aggregate func(postings []index.Postings) index.Postings
 }
@@ -1419,9 +1708,76 @@ func (p *postingGroup) Postings() index.Postings {
 		}
 	}
 
+	if p.decoded != nil {
+		return p.aggregate(p.decoded)
+	}
 	return p.aggregate(p.postings)
 }
 
+// decodePostings expands the fetched postings of all groups into lists using up to concurrency goroutines, so
+// decoding and merging postings of wide matchers is not bound to a single CPU.
+// All but the first postings of a group are merged in shards. This yields the same result as both group
+// aggregations merge them, while allWithout excludes the first one.
+func decodePostings(ctx context.Context, groups []*postingGroup, concurrency int) error {
+	type shard struct {
+		group *postingGroup
+		i     int
+		ps    []index.Postings
+	}
+	var shards []shard
+
+Groups:
+	for _, g := range groups {
+		if len(g.keys) == 0 {
+			continue
+		}
+		for _, p := range g.postings {
+			if p == nil {
+				// Postings() reports the error.
+				continue Groups
+			}
+		}
+
+		rest := g.postings[1:]
+		n := concurrency
+		if len(rest) < n {
+			n = len(rest)
+		}
+		g.decoded = make([]index.Postings, n+1)
+		shards = append(shards, shard{group: g, i: 0, ps: g.postings[:1]})
+		for i := 0; i < n; i++ {
+			shards = append(shards, shard{group: g, i: i + 1, ps: rest[i*len(rest)/n : (i+1)*len(rest)/n]})
+		}
+	}
+
+	eg, ctx := errgroup.WithContext(ctx)
+	work := make(chan shard)
+	for i := 0; i < concurrency; i++ {
+		eg.Go(func() error {
+			for s := range work {
+				ps, err := index.ExpandPostings(index.Merge(s.ps...))
+				if err != nil {
+					return errors.Wrapf(err, "expand postings for %s", s.group.keys)
+				}
+				s.group.decoded[s.i] = index.NewListPostings(ps)
+			}
+			return nil
+		})
+	}
+
+Feed:
+	for _, s := range shards {
+		select {
+		case <-ctx.Done():
+			break Feed
+		case work <- s:
+		}
+	}
+	close(work)
+
+	return eg.Wait()
+}
+
 func merge(p []index.Postings) index.Postings {
 	return index.Merge(p...)
 }
@@ -1488,6 +1844,7 @@ func (r *bucketIndexReader) fetchPostings(groups []*postingGroup) error {
 		for j, key := range g.keys {
 			// Get postings for the given key from cache first.
 			if b, ok := r.cache.Postings(r.block.meta.ULID, key); ok {
+				r.stats.postingsCacheHits++
 				r.stats.postingsTouched++
 				r.stats.postingsTouchedSizeSum += len(b)
 
@@ -1583,6 +1940,7 @@ func (r *bucketIndexReader) PreloadSeries(ids []uint64) error {
 
 	for _, id := range ids {
 		if b, ok := r.cache.Series(r.block.meta.ULID, id); ok {
+			r.stats.seriesCacheHits++
 			r.loadedSeries[id] = b
 			continue
 		}
@@ -1738,6 +2096,8 @@ type bucketChunkReader struct {
 	preloads [][]uint32
 	mtx      sync.Mutex
 	chunks   map[uint64]chunkenc.Chunk
+	// verifyChecksums makes preloading fail with a chunkChecksumError on chunks whose CRC32 does not match their data.
+	verifyChecksums bool
 
 	// Byte slice to return to the chunk pool on close.
 	chunkBytes []*[]byte
@@ -1838,11 +2198,33 @@ func (r *bucketChunkReader) loadChunks(ctx context.Context, offs []uint32, seq i
 			return errors.Errorf("preloaded chunk too small, expecting %d", n+int(l)+1)
 		}
 		cid := uint64(seq<<32) | uint64(o)
+		if r.verifyChecksums {
+			if len(cb) < n+int(l)+1+crc32.Size {
+				return errors.Errorf("preloaded chunk too small to verify, expecting %d", n+int(l)+1+crc32.Size)
+			}
+			exp := binary.BigEndian.Uint32(cb[n+int(l)+1:])
+			if got := crc32.Checksum(cb[n:n+int(l)+1], castagnoliTable); got != exp {
+				return chunkChecksumError{ref: cid, expected: exp, actual: got}
+			}
+		}
 		r.chunks[cid] = rawChunk(cb[n : n+int(l)+1])
 	}
 	return nil
 }
 
+// castagnoliTable is the CRC32 table TSDB computes the checksums of chunks with.
+var castagnoliTable = crc32.MakeTable(crc32.Castagnoli)
+
+// chunkChecksumError is returned for a chunk whose data does not match its checksum.
+type chunkChecksumError struct {
+	ref              uint64
+	expected, actual uint32
+}
+
+func (e chunkChecksumError) Error() string {
+	return fmt.Sprintf("checksum mismatch of chunk %d, expected %08x, got %08x", e.ref, e.expected, e.actual)
+}
+
 func (r *bucketChunkReader) Chunk(id uint64) (chunkenc.Chunk, error) {
 	c, ok := r.chunks[id]
 	if !ok {
@@ -1899,6 +2281,7 @@ type queryStats struct {
 	postingsFetchedSizeSum   int
 	postingsFetchCount       int
 	postingsFetchDurationSum time.Duration
+	postingsCacheHits        int
 
 	seriesTouched          int
 	seriesTouchedSizeSum   int
@@ -1906,6 +2289,7 @@ type queryStats struct {
 	seriesFetchedSizeSum   int
 	seriesFetchCount       int
 	seriesFetchDurationSum time.Duration
+	seriesCacheHits        int
 
 	chunksTouched          int
 	chunksTouchedSizeSum   int
@@ -1918,6 +2302,10 @@ type queryStats struct {
 	mergedSeriesCount int
 	mergedChunksCount int
 	mergeDuration     time.Duration
+
+	// matcherPostings holds the number of postings selected by each matcher, summed over all queried blocks.
+	// It is only filled when matcher cardinality recording is enabled.
+	matcherPostings map[string]int
 }
 
 func (s queryStats) merge(o *queryStats) *queryStats {
@@ -1929,6 +2317,7 @@ func (s queryStats) merge(o *queryStats) *queryStats {
 	s.postingsFetchedSizeSum += o.postingsFetchedSizeSum
 	s.postingsFetchCount += o.postingsFetchCount
 	s.postingsFetchDurationSum += o.postingsFetchDurationSum
+	s.postingsCacheHits += o.postingsCacheHits
 
 	s.seriesTouched += o.seriesTouched
 	s.seriesTouchedSizeSum += o.seriesTouchedSizeSum
@@ -1936,6 +2325,7 @@ func (s queryStats) merge(o *queryStats) *queryStats {
 	s.seriesFetchedSizeSum += o.seriesFetchedSizeSum
 	s.seriesFetchCount += o.seriesFetchCount
 	s.seriesFetchDurationSum += o.seriesFetchDurationSum
+	s.seriesCacheHits += o.seriesCacheHits
 
 	s.chunksTouched += o.chunksTouched
 	s.chunksTouchedSizeSum += o.chunksTouchedSizeSum
@@ -1949,5 +2339,31 @@ func (s queryStats) merge(o *queryStats) *queryStats {
 	s.mergedChunksCount += o.mergedChunksCount
 	s.mergeDuration += o.mergeDuration
 
+	if len(o.matcherPostings) > 0 {
+		mp := make(map[string]int, len(s.matcherPostings)+len(o.matcherPostings))
+		for m, n := range s.matcherPostings {
+			mp[m] = n
+		}
+		for m, n := range o.matcherPostings {
+			mp[m] += n
+		}
+		s.matcherPostings = mp
+	}
+
 	return &s
 }
+
+// tagSpan tags the span of the request the given context belongs to, if any, with the resources used to serve it.
+func (s queryStats) tagSpan(ctx context.Context) {
+	span := opentracing.SpanFromContext(ctx)
+	if span == nil {
+		return
+	}
+	span.SetTag("blocks_queried", s.blocksQueried)
+	span.SetTag("postings_fetched", s.postingsFetched)
+	span.SetTag("postings_cache_hits", s.postingsCacheHits)
+	span.SetTag("series_touched", s.seriesTouched)
+	span.SetTag("series_cache_hits", s.seriesCacheHits)
+	span.SetTag("chunks_fetched", s.chunksFetched)
+	span.SetTag("bytes_fetched", s.postingsFetchedSizeSum+s.seriesFetchedSizeSum+s.chunksFetchedSizeSum)
+}
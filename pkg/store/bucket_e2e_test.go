@@ -2,16 +2,22 @@ package store
 
 import (
 	"context"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
 	"testing"
 	"time"
 
 	"github.com/go-kit/kit/log"
 	"github.com/oklog/ulid"
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/mocktracer"
 	"github.com/pkg/errors"
+	promtestutil "github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/prometheus/prometheus/pkg/timestamp"
 	"github.com/prometheus/prometheus/tsdb/labels"
 	"github.com/thanos-io/thanos/pkg/block"
@@ -24,6 +30,8 @@ import (
 	storecache "github.com/thanos-io/thanos/pkg/store/cache"
 	"github.com/thanos-io/thanos/pkg/store/storepb"
 	"github.com/thanos-io/thanos/pkg/testutil"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 var (
@@ -43,6 +51,9 @@ func (noopCache) SetPostings(b ulid.ULID, l labels.Label, v []byte)   {}
 func (noopCache) Postings(b ulid.ULID, l labels.Label) ([]byte, bool) { return nil, false }
 func (noopCache) SetSeries(b ulid.ULID, id uint64, v []byte)          {}
 func (noopCache) Series(b ulid.ULID, id uint64) ([]byte, bool)        { return nil, false }
+func (noopCache) SetNoMatch(b ulid.ULID, matcher string)              {}
+func (noopCache) NoMatch(b ulid.ULID, matcher string) bool            { return false }
+func (noopCache) ForgetBlock(b ulid.ULID)                             {}
 
 type swappableCache struct {
 	ptr indexCache
@@ -68,6 +79,18 @@ func (c *swappableCache) Series(b ulid.ULID, id uint64) ([]byte, bool) {
 	return c.ptr.Series(b, id)
 }
 
+func (c *swappableCache) SetNoMatch(b ulid.ULID, matcher string) {
+	c.ptr.SetNoMatch(b, matcher)
+}
+
+func (c *swappableCache) NoMatch(b ulid.ULID, matcher string) bool {
+	return c.ptr.NoMatch(b, matcher)
+}
+
+func (c *swappableCache) ForgetBlock(b ulid.ULID) {
+	c.ptr.ForgetBlock(b)
+}
+
 type storeSuite struct {
 	cancel context.CancelFunc
 	wg     sync.WaitGroup
@@ -150,7 +173,7 @@ func prepareStoreWithTestBlocks(t testing.TB, dir string, bkt objstore.Bucket, m
 		maxTime: maxTime,
 	}
 
-	store, err := NewBucketStore(s.logger, nil, bkt, dir, s.cache, 0, maxSampleCount, 20, false, 20, filterConf)
+	store, err := NewBucketStore(s.logger, nil, bkt, dir, s.cache, 0, maxSampleCount, 20, false, 20, filterConf, false, 0, 1, true, false, 0)
 	testutil.Ok(t, err)
 	s.store = store
 
@@ -355,6 +378,23 @@ func testBucketStore_e2e(t testing.TB, ctx context.Context, s *storeSuite) {
 				{{Name: "a", Value: "2"}, {Name: "c", Value: "2"}, {Name: "ext2", Value: "value2"}},
 			},
 		},
+		// Only labels are returned if chunks are skipped.
+		{
+			req: &storepb.SeriesRequest{
+				Matchers: []storepb.LabelMatcher{
+					{Type: storepb.LabelMatcher_EQ, Name: "a", Value: "1"},
+				},
+				MinTime:    mint,
+				MaxTime:    maxt,
+				SkipChunks: true,
+			},
+			expected: [][]storepb.Label{
+				{{Name: "a", Value: "1"}, {Name: "b", Value: "1"}, {Name: "ext1", Value: "value1"}},
+				{{Name: "a", Value: "1"}, {Name: "b", Value: "2"}, {Name: "ext1", Value: "value1"}},
+				{{Name: "a", Value: "1"}, {Name: "c", Value: "1"}, {Name: "ext2", Value: "value2"}},
+				{{Name: "a", Value: "1"}, {Name: "c", Value: "2"}, {Name: "ext2", Value: "value2"}},
+			},
+		},
 		// Regression https://github.com/thanos-io/thanos/issues/833.
 		// Problem: Matcher that was selecting NO series, was ignored instead of passed as emptyPosting to Intersect.
 		{
@@ -377,6 +417,10 @@ func testBucketStore_e2e(t testing.TB, ctx context.Context, s *storeSuite) {
 
 		for i, s := range srv.SeriesSet {
 			testutil.Equals(t, tcase.expected[i], s.Labels)
+			if tcase.req.SkipChunks {
+				testutil.Equals(t, 0, len(s.Chunks))
+				continue
+			}
 			testutil.Equals(t, 3, len(s.Chunks))
 		}
 	}
@@ -418,6 +462,228 @@ func TestBucketStore_e2e(t *testing.T) {
 	})
 }
 
+func TestBucketStore_Series_BlockLimit_e2e(t *testing.T) {
+	objtesting.ForeachStore(t, func(t testing.TB, bkt objstore.Bucket) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		dir, err := ioutil.TempDir("", "test_bucketstore_block_limit_e2e")
+		testutil.Ok(t, err)
+		defer func() { testutil.Ok(t, os.RemoveAll(dir)) }()
+
+		s := prepareStoreWithTestBlocks(t, dir, bkt, false, 0)
+		defer s.Close()
+		s.cache.SwapWith(noopCache{})
+
+		mint, maxt := s.store.TimeRange()
+		req := &storepb.SeriesRequest{
+			Matchers: []storepb.LabelMatcher{
+				{Type: storepb.LabelMatcher_EQ, Name: "a", Value: "1"},
+			},
+			MinTime: mint,
+			MaxTime: maxt,
+		}
+
+		// The query spans all 3 time slots of both block label sets, so it touches 6 blocks.
+		s.store.blocksLimiter = NewLimiter(6, s.store.metrics.queriesDroppedBlocks)
+		testutil.Ok(t, s.store.Series(req, newStoreSeriesServer(ctx)))
+
+		s.store.blocksLimiter = NewLimiter(5, s.store.metrics.queriesDroppedBlocks)
+		err = s.store.Series(req, newStoreSeriesServer(ctx))
+		testutil.NotOk(t, err)
+		testutil.Equals(t, codes.ResourceExhausted, status.Code(err))
+		testutil.Equals(t, float64(1), promtestutil.ToFloat64(s.store.metrics.queriesDroppedBlocks))
+
+		// Narrowing the time range to a single slot stays within the limit.
+		req.MaxTime = mint + 1
+		testutil.Ok(t, s.store.Series(req, newStoreSeriesServer(ctx)))
+	})
+}
+
+// blockReadsBucket delays range reads by latency and records the maximum number of blocks read from at once.
+type blockReadsBucket struct {
+	objstore.Bucket
+	latency time.Duration
+
+	mtx      sync.Mutex
+	inFlight map[string]int
+	maxSeen  int
+}
+
+func (b *blockReadsBucket) GetRange(ctx context.Context, name string, off, length int64) (io.ReadCloser, error) {
+	id := strings.Split(name, "/")[0]
+
+	b.mtx.Lock()
+	if b.inFlight == nil {
+		b.inFlight = map[string]int{}
+	}
+	b.inFlight[id]++
+	if len(b.inFlight) > b.maxSeen {
+		b.maxSeen = len(b.inFlight)
+	}
+	b.mtx.Unlock()
+
+	defer func() {
+		b.mtx.Lock()
+		defer b.mtx.Unlock()
+		if b.inFlight[id]--; b.inFlight[id] == 0 {
+			delete(b.inFlight, id)
+		}
+	}()
+
+	time.Sleep(b.latency)
+	return b.Bucket.GetRange(ctx, name, off, length)
+}
+
+func (b *blockReadsBucket) reset() {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	b.maxSeen = 0
+}
+
+func TestBucketStore_Series_BlockConcurrency_e2e(t *testing.T) {
+	objtesting.ForeachStore(t, func(t testing.TB, bkt objstore.Bucket) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		dir, err := ioutil.TempDir("", "test_bucketstore_block_concurrency_e2e")
+		testutil.Ok(t, err)
+		defer func() { testutil.Ok(t, os.RemoveAll(dir)) }()
+
+		rbkt := &blockReadsBucket{Bucket: bkt, latency: 5 * time.Millisecond}
+		s := prepareStoreWithTestBlocks(t, dir, rbkt, false, 0)
+		defer s.Close()
+		s.cache.SwapWith(noopCache{})
+
+		mint, maxt := s.store.TimeRange()
+		req := &storepb.SeriesRequest{
+			Matchers: []storepb.LabelMatcher{
+				{Type: storepb.LabelMatcher_EQ, Name: "a", Value: "1"},
+			},
+			MinTime: mint,
+			MaxTime: maxt,
+		}
+
+		// All 6 blocks are read concurrently by default.
+		srv := newStoreSeriesServer(ctx)
+		testutil.Ok(t, s.store.Series(req, srv))
+		testutil.Equals(t, 4, len(srv.SeriesSet))
+
+		for _, concurrency := range []int{1, 2} {
+			s.store.blockSeriesConcurrency = concurrency
+			rbkt.reset()
+
+			bsrv := newStoreSeriesServer(ctx)
+			testutil.Ok(t, s.store.Series(req, bsrv))
+			// Chunks of a series are in the order their blocks were read in.
+			testutil.Equals(t, len(srv.SeriesSet), len(bsrv.SeriesSet))
+			for i, series := range bsrv.SeriesSet {
+				testutil.Equals(t, srv.SeriesSet[i].Labels, series.Labels)
+				testutil.Equals(t, len(srv.SeriesSet[i].Chunks), len(series.Chunks))
+			}
+			testutil.Assert(t, rbkt.maxSeen <= concurrency, "read %d blocks at once with concurrency %d", rbkt.maxSeen, concurrency)
+		}
+	})
+}
+
+func BenchmarkBucketStore_Series_BlockConcurrency(b *testing.B) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dir, err := ioutil.TempDir("", "bucketstore-block-concurrency-bench")
+	testutil.Ok(b, err)
+	defer func() { testutil.Ok(b, os.RemoveAll(dir)) }()
+
+	// Range reads of object storage take a few milliseconds each.
+	bkt := &blockReadsBucket{Bucket: inmem.NewBucket(), latency: 2 * time.Millisecond}
+	s := prepareStoreWithTestBlocks(b, dir, bkt, false, 0)
+	defer s.Close()
+	s.cache.SwapWith(noopCache{})
+
+	// A query over the whole range touching all 6 blocks.
+	mint, maxt := s.store.TimeRange()
+	req := &storepb.SeriesRequest{
+		Matchers: []storepb.LabelMatcher{
+			{Type: storepb.LabelMatcher_RE, Name: "a", Value: ".+"},
+		},
+		MinTime: mint,
+		MaxTime: maxt,
+	}
+	for _, concurrency := range []int{1, 2, 0} {
+		b.Run(fmt.Sprintf("concurrency=%d", concurrency), func(b *testing.B) {
+			s.store.blockSeriesConcurrency = concurrency
+			b.ReportAllocs()
+			for n := 0; n < b.N; n++ {
+				srv := newStoreSeriesServer(ctx)
+				testutil.Ok(b, s.store.Series(req, srv))
+				testutil.Equals(b, 8, len(srv.SeriesSet))
+			}
+		})
+	}
+}
+
+func TestBucketStore_Series_SpanTags_e2e(t *testing.T) {
+	objtesting.ForeachStore(t, func(t testing.TB, bkt objstore.Bucket) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		dir, err := ioutil.TempDir("", "test_bucketstore_span_tags_e2e")
+		testutil.Ok(t, err)
+		defer func() { testutil.Ok(t, os.RemoveAll(dir)) }()
+
+		s := prepareStoreWithTestBlocks(t, dir, bkt, false, 0)
+		defer s.Close()
+
+		indexCache, err := storecache.NewIndexCache(s.logger, nil, storecache.Opts{
+			MaxItemSizeBytes: 1e5,
+			MaxSizeBytes:     2e5,
+		})
+		testutil.Ok(t, err)
+		s.cache.SwapWith(indexCache)
+
+		mint, maxt := s.store.TimeRange()
+		req := &storepb.SeriesRequest{
+			Matchers: []storepb.LabelMatcher{
+				{Type: storepb.LabelMatcher_EQ, Name: "a", Value: "1"},
+			},
+			MinTime: mint,
+			MaxTime: maxt,
+		}
+
+		tracer := mocktracer.New()
+		series := func() map[string]interface{} {
+			span := tracer.StartSpan("series")
+			testutil.Ok(t, s.store.Series(req, newStoreSeriesServer(opentracing.ContextWithSpan(ctx, span))))
+			span.Finish()
+
+			tags := span.(*mocktracer.MockSpan).Tags()
+			testutil.Assert(t, tags["bytes_fetched"].(int) > 0, "expected bytes to be fetched")
+			delete(tags, "bytes_fetched")
+			return tags
+		}
+
+		// The query touches 2 series with a chunk each in all 6 blocks.
+		testutil.Equals(t, map[string]interface{}{
+			"blocks_queried":      6,
+			"postings_fetched":    6,
+			"postings_cache_hits": 0,
+			"series_touched":      12,
+			"series_cache_hits":   0,
+			"chunks_fetched":      12,
+		}, series())
+
+		// Repeating it hits the index cache, but chunks are still fetched.
+		testutil.Equals(t, map[string]interface{}{
+			"blocks_queried":      6,
+			"postings_fetched":    0,
+			"postings_cache_hits": 6,
+			"series_touched":      12,
+			"series_cache_hits":   12,
+			"chunks_fetched":      12,
+		}, series())
+	})
+}
+
 type naivePartitioner struct{}
 
 func (g naivePartitioner) Partition(length int, rng func(int) (uint64, uint64)) (parts []part) {
@@ -484,7 +750,7 @@ func TestBucketStore_TimePartitioning_e2e(t *testing.T) {
 		&FilterConfig{
 			MinTime: minTimeDuration,
 			MaxTime: filterMaxTime,
-		})
+		}, false, 0, 1, false, false, 0)
 	testutil.Ok(t, err)
 
 	err = store.SyncBlocks(ctx)
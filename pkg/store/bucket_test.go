@@ -1,10 +1,17 @@
 package store
 
 import (
+	"bytes"
 	"context"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"math"
+	"os"
+	"path"
 	"path/filepath"
+	"strconv"
+	"sync"
 	"testing"
 	"time"
 
@@ -14,13 +21,19 @@ import (
 	"github.com/leanovate/gopter/gen"
 	"github.com/leanovate/gopter/prop"
 	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
 	prommodel "github.com/prometheus/common/model"
 	"github.com/prometheus/prometheus/pkg/timestamp"
 	"github.com/prometheus/prometheus/tsdb/labels"
+	"github.com/thanos-io/thanos/pkg/block"
 	"github.com/thanos-io/thanos/pkg/block/metadata"
 	"github.com/thanos-io/thanos/pkg/compact/downsample"
 	"github.com/thanos-io/thanos/pkg/model"
+	"github.com/thanos-io/thanos/pkg/objstore"
 	"github.com/thanos-io/thanos/pkg/objstore/inmem"
+	"github.com/thanos-io/thanos/pkg/pool"
+	storecache "github.com/thanos-io/thanos/pkg/store/cache"
 	"github.com/thanos-io/thanos/pkg/store/storepb"
 	"github.com/thanos-io/thanos/pkg/testutil"
 )
@@ -254,6 +267,73 @@ func TestBucketBlockSet_addGet(t *testing.T) {
 	}
 }
 
+func TestPreferRecentBlocks(t *testing.T) {
+	defer leaktest.CheckTimeout(t, 10*time.Second)()
+
+	newBlock := func(id uint64, window, mint, maxt int64) *bucketBlock {
+		var m metadata.Meta
+		m.ULID = ulid.MustNew(id, nil)
+		m.Thanos.Downsample.Resolution = window
+		m.MinTime = mint
+		m.MaxTime = maxt
+		return &bucketBlock{meta: &m}
+	}
+
+	var (
+		old         = newBlock(1, downsample.ResLevel0, 0, 200)
+		backfilled  = newBlock(5, downsample.ResLevel0, 0, 200)
+		partial     = newBlock(6, downsample.ResLevel0, 100, 300)
+		oldNext     = newBlock(2, downsample.ResLevel0, 200, 400)
+		downsampled = newBlock(7, downsample.ResLevel1, 0, 400)
+	)
+
+	for _, c := range []struct {
+		mint, maxt int64
+		input      []*bucketBlock
+		exp        []*bucketBlock
+	}{
+		{
+			// Identical ranges, the recently created block wins regardless of order.
+			mint: 0, maxt: 200,
+			input: []*bucketBlock{old, backfilled},
+			exp:   []*bucketBlock{backfilled},
+		},
+		{
+			mint: 0, maxt: 200,
+			input: []*bucketBlock{backfilled, old},
+			exp:   []*bucketBlock{backfilled},
+		},
+		{
+			// The recent block only covers part of the older one.
+			mint: 0, maxt: 300,
+			input: []*bucketBlock{old, partial},
+			exp:   []*bucketBlock{old, partial},
+		},
+		{
+			// It covers all of the queried range of the older one though.
+			mint: 150, maxt: 300,
+			input: []*bucketBlock{old, partial},
+			exp:   []*bucketBlock{partial},
+		},
+		{
+			// Older blocks are never preferred.
+			mint: 0, maxt: 400,
+			input: []*bucketBlock{partial, oldNext},
+			exp:   []*bucketBlock{partial, oldNext},
+		},
+		{
+			// Blocks of other resolutions are not considered.
+			mint: 0, maxt: 400,
+			input: []*bucketBlock{old, oldNext, downsampled},
+			exp:   []*bucketBlock{old, oldNext, downsampled},
+		},
+	} {
+		t.Run("", func(t *testing.T) {
+			testutil.Equals(t, c.exp, preferRecentBlocks(c.input, c.mint, c.maxt))
+		})
+	}
+}
+
 func TestBucketBlockSet_remove(t *testing.T) {
 	defer leaktest.CheckTimeout(t, 10*time.Second)()
 
@@ -422,7 +502,7 @@ func TestBucketStore_Info(t *testing.T) {
 	dir, err := ioutil.TempDir("", "bucketstore-test")
 	testutil.Ok(t, err)
 
-	bucketStore, err := NewBucketStore(nil, nil, nil, dir, noopCache{}, 2e5, 0, 0, false, 20, filterConf)
+	bucketStore, err := NewBucketStore(nil, nil, nil, dir, noopCache{}, 2e5, 0, 0, false, 20, filterConf, false, 0, 1, false, false, 0)
 	testutil.Ok(t, err)
 
 	resp, err := bucketStore.Info(ctx, &storepb.InfoRequest{})
@@ -431,9 +511,207 @@ func TestBucketStore_Info(t *testing.T) {
 	testutil.Equals(t, storepb.StoreType_STORE, resp.StoreType)
 	testutil.Equals(t, int64(math.MaxInt64), resp.MinTime)
 	testutil.Equals(t, int64(math.MinInt64), resp.MaxTime)
+	testutil.Assert(t, resp.BlockSetId != "", "expected block set ID")
+
+	// Replacing a block, e.g. by compaction, changes the block set ID even though the time range stays the same.
+	newBlock := func(id uint64) *bucketBlock {
+		m := &metadata.Meta{}
+		m.ULID = ulid.MustNew(id, nil)
+		m.MinTime, m.MaxTime = 0, 1000
+		return &bucketBlock{meta: m}
+	}
+	b1, b2 := newBlock(1), newBlock(2)
+	bucketStore.blocks[b1.meta.ULID] = b1
+	resp1, err := bucketStore.Info(ctx, &storepb.InfoRequest{})
+	testutil.Ok(t, err)
+	testutil.Assert(t, resp1.BlockSetId != resp.BlockSetId, "expected block set ID to change")
+
+	delete(bucketStore.blocks, b1.meta.ULID)
+	bucketStore.blocks[b2.meta.ULID] = b2
+	resp2, err := bucketStore.Info(ctx, &storepb.InfoRequest{})
+	testutil.Ok(t, err)
+	testutil.Equals(t, resp1.MinTime, resp2.MinTime)
+	testutil.Equals(t, resp1.MaxTime, resp2.MaxTime)
+	testutil.Assert(t, resp2.BlockSetId != resp1.BlockSetId, "expected block set ID to change")
+}
+
+type recordingCache struct {
+	noopCache
+
+	mtx      sync.Mutex
+	postings map[labels.Label]struct{}
+	series   map[uint64]struct{}
 }
 
-func TestBucketStore_isBlockInMinMaxRange(t *testing.T) {
+func newRecordingCache() *recordingCache {
+	return &recordingCache{postings: map[labels.Label]struct{}{}, series: map[uint64]struct{}{}}
+}
+
+func (c *recordingCache) SetPostings(_ ulid.ULID, l labels.Label, _ []byte) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.postings[l] = struct{}{}
+}
+
+func (c *recordingCache) SetSeries(_ ulid.ULID, id uint64, _ []byte) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.series[id] = struct{}{}
+}
+
+func TestBucketStore_Warmup(t *testing.T) {
+	defer leaktest.CheckTimeout(t, 10*time.Second)()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dir, err := ioutil.TempDir("", "bucketstore-warmup-test")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(dir)) }()
+
+	var series []labels.Labels
+	for i := 0; i < 10; i++ {
+		for j := 0; j < 10; j++ {
+			series = append(series, labels.FromStrings("i", strconv.Itoa(i), "j", strconv.Itoa(j)))
+		}
+	}
+	id, err := testutil.CreateBlock(ctx, dir, series, 1, 0, 1000, labels.FromStrings("ext1", "value1"), 0)
+	testutil.Ok(t, err)
+
+	bkt := inmem.NewBucket()
+	testutil.Ok(t, block.Upload(ctx, log.NewNopLogger(), bkt, filepath.Join(dir, id.String())))
+
+	cache := newRecordingCache()
+	bucketStore, err := NewBucketStore(nil, nil, bkt, filepath.Join(dir, "store"), cache, 2e5, 0, 0, false, 20, filterConf, false, 0, 1, false, false, 0)
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, bucketStore.Close()) }()
+	testutil.Ok(t, bucketStore.InitialSync(ctx))
+
+	// Syncing does not populate the cache.
+	testutil.Equals(t, 0, len(cache.postings))
+	testutil.Equals(t, 0, len(cache.series))
+
+	var selectors [][]storepb.LabelMatcher
+	for _, s := range []string{`{i="1"}`, `{i=~"2|3", j="0"}`, `{ext1="other"}`} {
+		sel, err := ParseSelector(s)
+		testutil.Ok(t, err)
+		selectors = append(selectors, sel)
+	}
+	testutil.Ok(t, bucketStore.Warmup(ctx, selectors))
+
+	testutil.Equals(t, map[labels.Label]struct{}{
+		{Name: "i", Value: "1"}: {},
+		{Name: "i", Value: "2"}: {},
+		{Name: "i", Value: "3"}: {},
+		{Name: "j", Value: "0"}: {},
+	}, cache.postings)
+	// All series with i="1" and those with i="2" or i="3" and j="0".
+	testutil.Equals(t, 12, len(cache.series))
+}
+
+// loadOrderBucket records the order in which blocks are first read from beyond their meta files, i.e. loaded.
+type loadOrderBucket struct {
+	objstore.BucketReader
+
+	mtx    sync.Mutex
+	loaded []ulid.ULID
+}
+
+func (b *loadOrderBucket) record(name string) {
+	id, err := ulid.Parse(path.Dir(name))
+	if err != nil || path.Base(name) == block.MetaFilename {
+		return
+	}
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	for _, l := range b.loaded {
+		if l == id {
+			return
+		}
+	}
+	b.loaded = append(b.loaded, id)
+}
+
+func (b *loadOrderBucket) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	b.record(name)
+	return b.BucketReader.Get(ctx, name)
+}
+
+func (b *loadOrderBucket) GetRange(ctx context.Context, name string, off, length int64) (io.ReadCloser, error) {
+	b.record(name)
+	return b.BucketReader.GetRange(ctx, name, off, length)
+}
+
+func TestBucketStore_SyncBlocks_NewestFirst(t *testing.T) {
+	defer leaktest.CheckTimeout(t, 10*time.Second)()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dir, err := ioutil.TempDir("", "bucketstore-sync-order-test")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(dir)) }()
+
+	// Blocks of consecutive days, uploaded in a shuffled order of their time ranges.
+	now := time.Now()
+	series := []labels.Labels{labels.FromStrings("a", "1")}
+	ids := map[int]ulid.ULID{}
+	bkt := inmem.NewBucket()
+	for _, day := range []int{3, 0, 4, 1, 2} {
+		mint := timestamp.FromTime(now.Add(-time.Duration(day+1) * 24 * time.Hour))
+		maxt := timestamp.FromTime(now.Add(-time.Duration(day) * 24 * time.Hour))
+		id, err := testutil.CreateBlock(ctx, dir, series, 10, mint, maxt, labels.FromStrings("ext1", "value1"), 0)
+		testutil.Ok(t, err)
+		testutil.Ok(t, block.Upload(ctx, log.NewNopLogger(), bkt, filepath.Join(dir, id.String())))
+		ids[day] = id
+	}
+
+	for _, tcase := range []struct {
+		newestFirst bool
+		exp         []ulid.ULID
+	}{
+		{newestFirst: false, exp: nil},
+		{newestFirst: true, exp: []ulid.ULID{ids[0], ids[1], ids[2], ids[3], ids[4]}},
+	} {
+		t.Run(fmt.Sprintf("newestFirst=%v", tcase.newestFirst), func(t *testing.T) {
+			storeDir, err := ioutil.TempDir(dir, "store")
+			testutil.Ok(t, err)
+
+			lbkt := &loadOrderBucket{BucketReader: bkt}
+			bucketStore, err := NewBucketStore(nil, nil, lbkt, storeDir, noopCache{}, 2e5, 0, 0, false, 1, filterConf, false, 0, 1, false, tcase.newestFirst, 0)
+			testutil.Ok(t, err)
+			defer func() { testutil.Ok(t, bucketStore.Close()) }()
+
+			testutil.Ok(t, bucketStore.SyncBlocks(ctx))
+			testutil.Equals(t, 5, len(lbkt.loaded))
+			if tcase.exp != nil {
+				testutil.Equals(t, tcase.exp, lbkt.loaded)
+			}
+		})
+	}
+
+	t.Run("recent", func(t *testing.T) {
+		storeDir, err := ioutil.TempDir(dir, "store")
+		testutil.Ok(t, err)
+
+		bucketStore, err := NewBucketStore(nil, nil, bkt, storeDir, noopCache{}, 2e5, 0, 0, false, 1, filterConf, false, 0, 1, false, true, 0)
+		testutil.Ok(t, err)
+		defer func() { testutil.Ok(t, bucketStore.Close()) }()
+
+		// Only blocks with data within the last 36 hours are loaded at first.
+		testutil.Ok(t, bucketStore.SyncRecentBlocks(ctx, timestamp.FromTime(now.Add(-36*time.Hour))))
+		for day, id := range ids {
+			testutil.Equals(t, day <= 1, bucketStore.getBlock(id) != nil)
+		}
+
+		testutil.Ok(t, bucketStore.InitialSync(ctx))
+		for _, id := range ids {
+			testutil.Assert(t, bucketStore.getBlock(id) != nil, "expected block %s to be loaded", id)
+		}
+	})
+}
+
+func TestBucketStore_isBlockSelected(t *testing.T) {
 	ctx := context.TODO()
 	dir, err := ioutil.TempDir("", "block-min-max-test")
 	testutil.Ok(t, err)
@@ -480,18 +758,332 @@ func TestBucketStore_isBlockInMinMaxRange(t *testing.T) {
 		&FilterConfig{
 			MinTime: minTimeDuration,
 			MaxTime: hourBefore,
-		})
+		}, false, 0, 1, false, false, 0)
 	testutil.Ok(t, err)
 
-	inRange, err := bucketStore.isBlockInMinMaxRange(context.TODO(), id1)
+	inRange, err := bucketStore.isBlockSelected(context.TODO(), id1)
 	testutil.Ok(t, err)
 	testutil.Equals(t, true, inRange)
 
-	inRange, err = bucketStore.isBlockInMinMaxRange(context.TODO(), id2)
+	inRange, err = bucketStore.isBlockSelected(context.TODO(), id2)
 	testutil.Ok(t, err)
 	testutil.Equals(t, true, inRange)
 
-	inRange, err = bucketStore.isBlockInMinMaxRange(context.TODO(), id3)
+	inRange, err = bucketStore.isBlockSelected(context.TODO(), id3)
 	testutil.Ok(t, err)
 	testutil.Equals(t, false, inRange)
 }
+
+func TestBucketStore_isBlockSelected_Resolutions(t *testing.T) {
+	ctx := context.TODO()
+	dir, err := ioutil.TempDir("", "block-resolution-test")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(dir)) }()
+
+	series := []labels.Labels{labels.FromStrings("a", "1", "b", "1")}
+	extLset := labels.FromStrings("ext1", "value1")
+	mint := timestamp.FromTime(time.Now().Add(-7 * 24 * time.Hour))
+	maxt := timestamp.FromTime(time.Now().Add(-1 * 24 * time.Hour))
+
+	var ids []ulid.ULID
+	for _, res := range []int64{downsample.ResLevel0, downsample.ResLevel1, downsample.ResLevel2} {
+		id, err := testutil.CreateBlock(ctx, dir, series, 10, mint, maxt, extLset, res)
+		testutil.Ok(t, err)
+		ids = append(ids, id)
+	}
+
+	for _, tcase := range []struct {
+		resolutions []int64
+		expected    []bool
+	}{
+		{
+			resolutions: nil,
+			expected:    []bool{true, true, true},
+		},
+		{
+			resolutions: []int64{downsample.ResLevel0},
+			expected:    []bool{true, false, false},
+		},
+		{
+			resolutions: []int64{downsample.ResLevel1, downsample.ResLevel2},
+			expected:    []bool{false, true, true},
+		},
+	} {
+		t.Run("", func(t *testing.T) {
+			bucketStore, err := NewBucketStore(nil, nil, inmem.NewBucket(), dir, noopCache{}, 0, 0, 20, false, 20,
+				&FilterConfig{
+					MinTime:     minTimeDuration,
+					MaxTime:     maxTimeDuration,
+					Resolutions: tcase.resolutions,
+				}, false, 0, 1, false, false, 0)
+			testutil.Ok(t, err)
+
+			for i, id := range ids {
+				selected, err := bucketStore.isBlockSelected(ctx, id)
+				testutil.Ok(t, err)
+				testutil.Equals(t, tcase.expected[i], selected)
+			}
+		})
+	}
+}
+
+func TestBlockSeries_MatcherCardinality(t *testing.T) {
+	defer leaktest.CheckTimeout(t, 10*time.Second)()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dir, err := ioutil.TempDir("", "block-series-cardinality-test")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(dir)) }()
+
+	var series []labels.Labels
+	for _, a := range []string{"1", "2", "3", "4"} {
+		for _, b := range []string{"x", "y"} {
+			series = append(series, labels.FromStrings("a", a, "b", b))
+		}
+	}
+	id, err := testutil.CreateBlock(ctx, dir, series, 10, 0, 1000, labels.FromStrings("ext1", "value1"), 0)
+	testutil.Ok(t, err)
+
+	bkt := inmem.NewBucket()
+	testutil.Ok(t, block.Upload(ctx, log.NewNopLogger(), bkt, filepath.Join(dir, id.String())))
+
+	chunkPool, err := pool.NewBytesPool(2e5, 50e6, 2, 1e9)
+	testutil.Ok(t, err)
+	b, err := newBucketBlock(ctx, log.NewNopLogger(), bkt, id, filepath.Join(dir, "store", id.String()), noopCache{}, chunkPool, gapBasedPartitioner{maxGapSize: 512 * 1024})
+	testutil.Ok(t, err)
+
+	matchers := []labels.Matcher{
+		labels.NewMustRegexpMatcher("a", "1|2"),
+		labels.NewEqualMatcher("b", "x"),
+		labels.Not(labels.NewEqualMatcher("a", "1")),
+	}
+	for _, record := range []bool{false, true} {
+		indexr := b.indexReader(ctx)
+		chunkr := b.chunkReader(ctx)
+
+		set, stats, err := blockSeries(ctx, id, b.meta.Thanos.Labels, indexr, chunkr, matchers,
+			&storepb.SeriesRequest{MinTime: 0, MaxTime: 1000}, NewLimiter(0, prometheus.NewCounter(prometheus.CounterOpts{})), record)
+		testutil.Ok(t, err)
+
+		var got [][]storepb.Label
+		for set.Next() {
+			lset, _ := set.At()
+			got = append(got, lset)
+		}
+		testutil.Ok(t, set.Err())
+		// Only the intersection is returned regardless of recording.
+		testutil.Equals(t, [][]storepb.Label{{{Name: "a", Value: "2"}, {Name: "b", Value: "x"}, {Name: "ext1", Value: "value1"}}}, got)
+
+		if !record {
+			testutil.Equals(t, 0, len(stats.matcherPostings))
+		} else {
+			testutil.Equals(t, map[string]int{
+				`a=~"1|2"`:   4,
+				`b="x"`:      4,
+				`not(a="1")`: 6,
+			}, stats.matcherPostings)
+		}
+
+		testutil.Ok(t, indexr.Close())
+		testutil.Ok(t, chunkr.Close())
+	}
+}
+
+func TestBucketChunkReader_VerifyChecksums(t *testing.T) {
+	defer leaktest.CheckTimeout(t, 10*time.Second)()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dir, err := ioutil.TempDir("", "chunk-checksum-test")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(dir)) }()
+
+	id, err := testutil.CreateBlock(ctx, dir, []labels.Labels{labels.FromStrings("a", "1")}, 100, 0, 1000, labels.FromStrings("ext1", "value1"), 0)
+	testutil.Ok(t, err)
+
+	bkt := inmem.NewBucket()
+	testutil.Ok(t, block.Upload(ctx, log.NewNopLogger(), bkt, filepath.Join(dir, id.String())))
+
+	chunkPool, err := pool.NewBytesPool(2e5, 50e6, 2, 1e9)
+	testutil.Ok(t, err)
+
+	// The first chunk of a segment file follows its 8 byte header.
+	const firstChunkRef = 8
+	preload := func(b *bucketBlock, verify bool) error {
+		chunkr := b.chunkReader(ctx)
+		defer func() { testutil.Ok(t, chunkr.Close()) }()
+
+		chunkr.verifyChecksums = verify
+		testutil.Ok(t, chunkr.addPreload(firstChunkRef))
+		return chunkr.preload(NewLimiter(0, prometheus.NewCounter(prometheus.CounterOpts{})))
+	}
+
+	b, err := newBucketBlock(ctx, log.NewNopLogger(), bkt, id, filepath.Join(dir, "store", id.String()), noopCache{}, chunkPool, gapBasedPartitioner{maxGapSize: 512 * 1024})
+	testutil.Ok(t, err)
+	testutil.Ok(t, preload(b, true))
+
+	// Flip a bit in the data of the first chunk.
+	segment := path.Join(id.String(), block.ChunksDirname, "000001")
+	rc, err := bkt.Get(ctx, segment)
+	testutil.Ok(t, err)
+	data, err := ioutil.ReadAll(rc)
+	testutil.Ok(t, err)
+	testutil.Ok(t, rc.Close())
+	data[firstChunkRef+2] ^= 0x01
+	testutil.Ok(t, bkt.Upload(ctx, segment, bytes.NewReader(data)))
+
+	testutil.Ok(t, preload(b, false))
+
+	err = preload(b, true)
+	testutil.NotOk(t, err)
+	cerr, ok := errors.Cause(err).(chunkChecksumError)
+	testutil.Assert(t, ok, "expected checksum error, got %v", err)
+	testutil.Equals(t, uint64(firstChunkRef), cerr.ref)
+	testutil.Assert(t, cerr.expected != cerr.actual, "expected checksums to differ")
+}
+
+func TestBucketIndexReader_ExpandedPostings_DecodeConcurrency(t *testing.T) {
+	defer leaktest.CheckTimeout(t, 10*time.Second)()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dir, err := ioutil.TempDir("", "expanded-postings-decode-test")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(dir)) }()
+
+	b := prepareWideBucketBlock(ctx, t, dir, 100, 10)
+
+	for _, matchers := range [][]labels.Matcher{
+		{labels.NewMustRegexpMatcher("i", ".+")},
+		{labels.NewMustRegexpMatcher("i", "1.*"), labels.NewEqualMatcher("j", "3")},
+		{labels.Not(labels.NewEqualMatcher("i", "1")), labels.NewMustRegexpMatcher("j", "1|2|3")},
+		{labels.NewEqualMatcher("i", "1"), labels.NewEqualMatcher("j", "not-existing")},
+		{labels.NewEqualMatcher("j", "")},
+	} {
+		t.Run("", func(t *testing.T) {
+			indexr := b.indexReader(ctx)
+			exp, err := indexr.ExpandedPostings(matchers)
+			testutil.Ok(t, err)
+			testutil.Ok(t, indexr.Close())
+
+			for _, concurrency := range []int{2, 3, 16} {
+				indexr := b.indexReader(ctx)
+				indexr.postingsDecodeConcurrency = concurrency
+				got, err := indexr.ExpandedPostings(matchers)
+				testutil.Ok(t, err)
+				testutil.Equals(t, exp, got)
+				testutil.Ok(t, indexr.Close())
+			}
+		})
+	}
+}
+
+// countingMatcher counts the label values it was matched against.
+type countingMatcher struct {
+	labels.Matcher
+	calls int
+}
+
+func (m *countingMatcher) Matches(v string) bool {
+	m.calls++
+	return m.Matcher.Matches(v)
+}
+
+func TestBucketIndexReader_ExpandedPostings_NoMatchCache(t *testing.T) {
+	defer leaktest.CheckTimeout(t, 10*time.Second)()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dir, err := ioutil.TempDir("", "expanded-postings-no-match-test")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(dir)) }()
+
+	b := prepareWideBucketBlock(ctx, t, dir, 10, 10)
+	b.indexCache, err = storecache.NewIndexCache(log.NewNopLogger(), nil, storecache.Opts{
+		MaxSizeBytes:     1024 * 1024,
+		MaxItemSizeBytes: 1024 * 1024,
+		NoMatchTTL:       time.Minute,
+	})
+	testutil.Ok(t, err)
+
+	expand := func(ms ...labels.Matcher) []uint64 {
+		indexr := b.indexReader(ctx)
+		defer func() { testutil.Ok(t, indexr.Close()) }()
+
+		ps, err := indexr.ExpandedPostings(ms)
+		testutil.Ok(t, err)
+		return ps
+	}
+
+	// A repeated miss does not scan the label values again.
+	miss := &countingMatcher{Matcher: labels.NewMustRegexpMatcher("i", "not-existing.*")}
+	testutil.Equals(t, 0, len(expand(miss, labels.NewEqualMatcher("j", "1"))))
+	calls := miss.calls
+	testutil.Assert(t, calls > 0, "expected label values to be scanned")
+
+	testutil.Equals(t, 0, len(expand(miss, labels.NewEqualMatcher("j", "1"))))
+	testutil.Equals(t, calls, miss.calls)
+
+	// Matchers selecting values are evaluated every time.
+	hit := &countingMatcher{Matcher: labels.NewMustRegexpMatcher("i", "1.*")}
+	testutil.Equals(t, 10, len(expand(hit)))
+	calls = hit.calls
+	testutil.Equals(t, 10, len(expand(hit)))
+	testutil.Equals(t, 2*calls, hit.calls)
+}
+
+func BenchmarkBucketIndexReader_ExpandedPostings_DecodeConcurrency(b *testing.B) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dir, err := ioutil.TempDir("", "expanded-postings-decode-bench")
+	testutil.Ok(b, err)
+	defer func() { testutil.Ok(b, os.RemoveAll(dir)) }()
+
+	bb := prepareWideBucketBlock(ctx, b, dir, 1000, 100)
+
+	// A wide query selecting all series through many postings lists.
+	matchers := []labels.Matcher{
+		labels.NewMustRegexpMatcher("i", ".+"),
+		labels.NewMustRegexpMatcher("j", ".+"),
+	}
+	for _, concurrency := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("concurrency=%d", concurrency), func(b *testing.B) {
+			b.ReportAllocs()
+			for n := 0; n < b.N; n++ {
+				indexr := bb.indexReader(ctx)
+				indexr.postingsDecodeConcurrency = concurrency
+				ps, err := indexr.ExpandedPostings(matchers)
+				testutil.Ok(b, err)
+				testutil.Equals(b, 1000*100, len(ps))
+				testutil.Ok(b, indexr.Close())
+			}
+		})
+	}
+}
+
+// prepareWideBucketBlock creates and loads a block with series for all combinations of i and j label values.
+func prepareWideBucketBlock(ctx context.Context, t testing.TB, dir string, numI, numJ int) *bucketBlock {
+	var series []labels.Labels
+	for i := 0; i < numI; i++ {
+		for j := 0; j < numJ; j++ {
+			series = append(series, labels.FromStrings("i", strconv.Itoa(i), "j", strconv.Itoa(j)))
+		}
+	}
+	id, err := testutil.CreateBlock(ctx, dir, series, 1, 0, 1000, labels.FromStrings("ext1", "value1"), 0)
+	testutil.Ok(t, err)
+
+	bkt := inmem.NewBucket()
+	testutil.Ok(t, block.Upload(ctx, log.NewNopLogger(), bkt, filepath.Join(dir, id.String())))
+
+	chunkPool, err := pool.NewBytesPool(2e5, 50e6, 2, 1e9)
+	testutil.Ok(t, err)
+	b, err := newBucketBlock(ctx, log.NewNopLogger(), bkt, id, filepath.Join(dir, "store", id.String()), noopCache{}, chunkPool, gapBasedPartitioner{maxGapSize: 512 * 1024})
+	testutil.Ok(t, err)
+	return b
+}
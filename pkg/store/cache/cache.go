@@ -1,8 +1,10 @@
 package storecache
 
 import (
+	"encoding/binary"
 	"math"
 	"sync"
+	"time"
 
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
@@ -16,6 +18,7 @@ import (
 const (
 	cacheTypePostings string = "Postings"
 	cacheTypeSeries   string = "Series"
+	cacheTypeNoMatch  string = "NoMatch"
 
 	sliceHeaderSize = 16
 )
@@ -31,6 +34,8 @@ func (c cacheKey) keyType() string {
 		return cacheTypePostings
 	case cacheKeySeries:
 		return cacheTypeSeries
+	case cacheKeyNoMatch:
+		return cacheTypeNoMatch
 	}
 	return "<unknown>"
 }
@@ -42,12 +47,16 @@ func (c cacheKey) size() uint64 {
 		return 16 + 2*sliceHeaderSize + uint64(len(k.Value)+len(k.Name))
 	case cacheKeySeries:
 		return 16 + 8 // ULID + uint64
+	case cacheKeyNoMatch:
+		// ULID + string header + number of chars in matcher.
+		return 16 + sliceHeaderSize + uint64(len(k))
 	}
 	return 0
 }
 
 type cacheKeyPostings labels.Label
 type cacheKeySeries uint64
+type cacheKeyNoMatch string
 
 type IndexCache struct {
 	mtx sync.Mutex
@@ -56,6 +65,7 @@ type IndexCache struct {
 	lru              *lru.LRU
 	maxSizeBytes     uint64
 	maxItemSizeBytes uint64
+	noMatchTTL       time.Duration
 
 	curSize uint64
 
@@ -67,6 +77,10 @@ type IndexCache struct {
 	currentSize      *prometheus.GaugeVec
 	totalCurrentSize *prometheus.GaugeVec
 	overflow         *prometheus.CounterVec
+	blockHits        *prometheus.CounterVec
+	blockMisses      *prometheus.CounterVec
+
+	now func() time.Time
 }
 
 type Opts struct {
@@ -74,6 +88,8 @@ type Opts struct {
 	MaxSizeBytes uint64
 	// MaxItemSizeBytes represents maximum size of single item.
 	MaxItemSizeBytes uint64
+	// NoMatchTTL is how long matchers selecting no label values of a block are remembered. 0 disables it.
+	NoMatchTTL time.Duration
 }
 
 // NewIndexCache creates a new thread-safe LRU cache for index entries and ensures the total cache
@@ -87,6 +103,8 @@ func NewIndexCache(logger log.Logger, reg prometheus.Registerer, opts Opts) (*In
 		logger:           logger,
 		maxSizeBytes:     opts.MaxSizeBytes,
 		maxItemSizeBytes: opts.MaxItemSizeBytes,
+		noMatchTTL:       opts.NoMatchTTL,
+		now:              time.Now,
 	}
 
 	c.evicted = prometheus.NewCounterVec(prometheus.CounterOpts{
@@ -95,6 +113,7 @@ func NewIndexCache(logger log.Logger, reg prometheus.Registerer, opts Opts) (*In
 	}, []string{"item_type"})
 	c.evicted.WithLabelValues(cacheTypePostings)
 	c.evicted.WithLabelValues(cacheTypeSeries)
+	c.evicted.WithLabelValues(cacheTypeNoMatch)
 
 	c.added = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Name: "thanos_store_index_cache_items_added_total",
@@ -102,6 +121,7 @@ func NewIndexCache(logger log.Logger, reg prometheus.Registerer, opts Opts) (*In
 	}, []string{"item_type"})
 	c.added.WithLabelValues(cacheTypePostings)
 	c.added.WithLabelValues(cacheTypeSeries)
+	c.added.WithLabelValues(cacheTypeNoMatch)
 
 	c.requests = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Name: "thanos_store_index_cache_requests_total",
@@ -109,6 +129,7 @@ func NewIndexCache(logger log.Logger, reg prometheus.Registerer, opts Opts) (*In
 	}, []string{"item_type"})
 	c.requests.WithLabelValues(cacheTypePostings)
 	c.requests.WithLabelValues(cacheTypeSeries)
+	c.requests.WithLabelValues(cacheTypeNoMatch)
 
 	c.overflow = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Name: "thanos_store_index_cache_items_overflowed_total",
@@ -116,6 +137,7 @@ func NewIndexCache(logger log.Logger, reg prometheus.Registerer, opts Opts) (*In
 	}, []string{"item_type"})
 	c.overflow.WithLabelValues(cacheTypePostings)
 	c.overflow.WithLabelValues(cacheTypeSeries)
+	c.overflow.WithLabelValues(cacheTypeNoMatch)
 
 	c.hits = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Name: "thanos_store_index_cache_hits_total",
@@ -123,6 +145,17 @@ func NewIndexCache(logger log.Logger, reg prometheus.Registerer, opts Opts) (*In
 	}, []string{"item_type"})
 	c.hits.WithLabelValues(cacheTypePostings)
 	c.hits.WithLabelValues(cacheTypeSeries)
+	c.hits.WithLabelValues(cacheTypeNoMatch)
+
+	c.blockHits = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "thanos_store_index_cache_block_hits_total",
+		Help: "Total number of requests to the cache that were a hit, per block.",
+	}, []string{"block", "item_type"})
+
+	c.blockMisses = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "thanos_store_index_cache_block_misses_total",
+		Help: "Total number of requests to the cache that were a miss, per block.",
+	}, []string{"block", "item_type"})
 
 	c.current = prometheus.NewGaugeVec(prometheus.GaugeOpts{
 		Name: "thanos_store_index_cache_items",
@@ -130,6 +163,7 @@ func NewIndexCache(logger log.Logger, reg prometheus.Registerer, opts Opts) (*In
 	}, []string{"item_type"})
 	c.current.WithLabelValues(cacheTypePostings)
 	c.current.WithLabelValues(cacheTypeSeries)
+	c.current.WithLabelValues(cacheTypeNoMatch)
 
 	c.currentSize = prometheus.NewGaugeVec(prometheus.GaugeOpts{
 		Name: "thanos_store_index_cache_items_size_bytes",
@@ -137,6 +171,7 @@ func NewIndexCache(logger log.Logger, reg prometheus.Registerer, opts Opts) (*In
 	}, []string{"item_type"})
 	c.currentSize.WithLabelValues(cacheTypePostings)
 	c.currentSize.WithLabelValues(cacheTypeSeries)
+	c.currentSize.WithLabelValues(cacheTypeNoMatch)
 
 	c.totalCurrentSize = prometheus.NewGaugeVec(prometheus.GaugeOpts{
 		Name: "thanos_store_index_cache_total_size_bytes",
@@ -144,6 +179,7 @@ func NewIndexCache(logger log.Logger, reg prometheus.Registerer, opts Opts) (*In
 	}, []string{"item_type"})
 	c.totalCurrentSize.WithLabelValues(cacheTypePostings)
 	c.totalCurrentSize.WithLabelValues(cacheTypeSeries)
+	c.totalCurrentSize.WithLabelValues(cacheTypeNoMatch)
 
 	if reg != nil {
 		reg.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
@@ -158,7 +194,7 @@ func NewIndexCache(logger log.Logger, reg prometheus.Registerer, opts Opts) (*In
 		}, func() float64 {
 			return float64(c.maxItemSizeBytes)
 		}))
-		reg.MustRegister(c.requests, c.hits, c.added, c.evicted, c.current, c.currentSize, c.totalCurrentSize, c.overflow)
+		reg.MustRegister(c.requests, c.hits, c.added, c.evicted, c.current, c.currentSize, c.totalCurrentSize, c.overflow, c.blockHits, c.blockMisses)
 	}
 
 	// Initialize LRU cache with a high size limit since we will manage evictions ourselves
@@ -198,9 +234,11 @@ func (c *IndexCache) get(typ string, key cacheKey) ([]byte, bool) {
 
 	v, ok := c.lru.Get(key)
 	if !ok {
+		c.blockMisses.WithLabelValues(key.block.String(), typ).Inc()
 		return nil, false
 	}
 	c.hits.WithLabelValues(typ).Inc()
+	c.blockHits.WithLabelValues(key.block.String(), typ).Inc()
 	return v.([]byte), true
 }
 
@@ -290,3 +328,46 @@ func (c *IndexCache) SetSeries(b ulid.ULID, id uint64, v []byte) {
 func (c *IndexCache) Series(b ulid.ULID, id uint64) ([]byte, bool) {
 	return c.get(cacheTypeSeries, cacheKey{b, cacheKeySeries(id)})
 }
+
+// SetNoMatch remembers that the given matcher selects no label values of the block for the configured TTL.
+func (c *IndexCache) SetNoMatch(b ulid.ULID, matcher string) {
+	if c.noMatchTTL <= 0 {
+		return
+	}
+	v := make([]byte, 8)
+	binary.BigEndian.PutUint64(v, uint64(c.now().Add(c.noMatchTTL).UnixNano()))
+	c.set(cacheTypeNoMatch, cacheKey{b, cacheKeyNoMatch(matcher)}, v)
+}
+
+// NoMatch reports whether the given matcher was remembered to select no label values of the block within the TTL.
+func (c *IndexCache) NoMatch(b ulid.ULID, matcher string) bool {
+	if c.noMatchTTL <= 0 {
+		return false
+	}
+	key := cacheKey{b, cacheKeyNoMatch(matcher)}
+	c.requests.WithLabelValues(cacheTypeNoMatch).Inc()
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	v, ok := c.lru.Get(key)
+	if ok && c.now().UnixNano() >= int64(binary.BigEndian.Uint64(v.([]byte))) {
+		c.lru.Remove(key)
+		ok = false
+	}
+	if !ok {
+		c.blockMisses.WithLabelValues(b.String(), cacheTypeNoMatch).Inc()
+		return false
+	}
+	c.hits.WithLabelValues(cacheTypeNoMatch).Inc()
+	c.blockHits.WithLabelValues(b.String(), cacheTypeNoMatch).Inc()
+	return true
+}
+
+// ForgetBlock removes the per-block hit and miss metrics of the given block, e.g. once it is no longer served.
+func (c *IndexCache) ForgetBlock(b ulid.ULID) {
+	for _, typ := range []string{cacheTypePostings, cacheTypeSeries, cacheTypeNoMatch} {
+		c.blockHits.DeleteLabelValues(b.String(), typ)
+		c.blockMisses.DeleteLabelValues(b.String(), typ)
+	}
+}
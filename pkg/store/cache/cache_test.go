@@ -365,3 +365,94 @@ func TestIndexCache_Eviction_WithMetrics(t *testing.T) {
 	testutil.Equals(t, float64(5), promtest.ToFloat64(cache.hits.WithLabelValues(cacheTypePostings)))
 	testutil.Equals(t, float64(1), promtest.ToFloat64(cache.hits.WithLabelValues(cacheTypeSeries)))
 }
+
+func TestIndexCache_BlockMetrics(t *testing.T) {
+	defer leaktest.CheckTimeout(t, 10*time.Second)()
+
+	metrics := prometheus.NewRegistry()
+	cache, err := NewIndexCache(log.NewNopLogger(), metrics, Opts{
+		MaxItemSizeBytes: 1024,
+		MaxSizeBytes:     1024,
+	})
+	testutil.Ok(t, err)
+
+	id1 := ulid.MustNew(0, nil)
+	id2 := ulid.MustNew(1, nil)
+	lbls := labels.Label{Name: "test", Value: "123"}
+
+	_, ok := cache.Postings(id1, lbls)
+	testutil.Assert(t, !ok, "unexpected hit")
+	cache.SetPostings(id1, lbls, []byte{1})
+	_, ok = cache.Postings(id1, lbls)
+	testutil.Assert(t, ok, "expected hit")
+	_, ok = cache.Postings(id1, lbls)
+	testutil.Assert(t, ok, "expected hit")
+
+	_, ok = cache.Series(id2, 1234)
+	testutil.Assert(t, !ok, "unexpected hit")
+
+	testutil.Equals(t, float64(2), promtest.ToFloat64(cache.blockHits.WithLabelValues(id1.String(), cacheTypePostings)))
+	testutil.Equals(t, float64(1), promtest.ToFloat64(cache.blockMisses.WithLabelValues(id1.String(), cacheTypePostings)))
+	testutil.Equals(t, float64(0), promtest.ToFloat64(cache.blockHits.WithLabelValues(id1.String(), cacheTypeSeries)))
+	testutil.Equals(t, float64(0), promtest.ToFloat64(cache.blockHits.WithLabelValues(id2.String(), cacheTypeSeries)))
+	testutil.Equals(t, float64(1), promtest.ToFloat64(cache.blockMisses.WithLabelValues(id2.String(), cacheTypeSeries)))
+
+	// Forgetting a block resets its counters.
+	cache.ForgetBlock(id1)
+	testutil.Equals(t, float64(0), promtest.ToFloat64(cache.blockHits.WithLabelValues(id1.String(), cacheTypePostings)))
+	testutil.Equals(t, float64(0), promtest.ToFloat64(cache.blockMisses.WithLabelValues(id1.String(), cacheTypePostings)))
+	testutil.Equals(t, float64(1), promtest.ToFloat64(cache.blockMisses.WithLabelValues(id2.String(), cacheTypeSeries)))
+}
+
+func TestIndexCache_NoMatch(t *testing.T) {
+	defer leaktest.CheckTimeout(t, 10*time.Second)()
+
+	metrics := prometheus.NewRegistry()
+	cache, err := NewIndexCache(log.NewNopLogger(), metrics, Opts{
+		MaxItemSizeBytes: 1024,
+		MaxSizeBytes:     1024,
+		NoMatchTTL:       time.Minute,
+	})
+	testutil.Ok(t, err)
+
+	now := time.Unix(0, 0)
+	cache.now = func() time.Time { return now }
+
+	id := ulid.MustNew(0, nil)
+	testutil.Equals(t, false, cache.NoMatch(id, `a=~"x.*"`))
+
+	cache.SetNoMatch(id, `a=~"x.*"`)
+	testutil.Equals(t, true, cache.NoMatch(id, `a=~"x.*"`))
+	testutil.Equals(t, false, cache.NoMatch(id, `a=~"y.*"`))
+	testutil.Equals(t, false, cache.NoMatch(ulid.MustNew(1, nil), `a=~"x.*"`))
+	testutil.Equals(t, float64(1), promtest.ToFloat64(cache.current.WithLabelValues(cacheTypeNoMatch)))
+	testutil.Equals(t, float64(1), promtest.ToFloat64(cache.hits.WithLabelValues(cacheTypeNoMatch)))
+
+	// Still remembered until the TTL passed.
+	now = now.Add(time.Minute - time.Nanosecond)
+	testutil.Equals(t, true, cache.NoMatch(id, `a=~"x.*"`))
+
+	now = now.Add(time.Nanosecond)
+	testutil.Equals(t, false, cache.NoMatch(id, `a=~"x.*"`))
+	testutil.Equals(t, float64(0), promtest.ToFloat64(cache.current.WithLabelValues(cacheTypeNoMatch)))
+	testutil.Equals(t, uint64(0), cache.curSize)
+
+	// Remembered again once set after expiry.
+	cache.SetNoMatch(id, `a=~"x.*"`)
+	testutil.Equals(t, true, cache.NoMatch(id, `a=~"x.*"`))
+}
+
+func TestIndexCache_NoMatch_Disabled(t *testing.T) {
+	defer leaktest.CheckTimeout(t, 10*time.Second)()
+
+	cache, err := NewIndexCache(log.NewNopLogger(), nil, Opts{
+		MaxItemSizeBytes: 1024,
+		MaxSizeBytes:     1024,
+	})
+	testutil.Ok(t, err)
+
+	id := ulid.MustNew(0, nil)
+	cache.SetNoMatch(id, `a=~"x.*"`)
+	testutil.Equals(t, false, cache.NoMatch(id, `a=~"x.*"`))
+	testutil.Equals(t, 0, cache.lru.Len())
+}
@@ -2,6 +2,8 @@ package store
 
 import (
 	"github.com/pkg/errors"
+	promlabels "github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/promql"
 	"github.com/prometheus/prometheus/tsdb/labels"
 	"github.com/thanos-io/thanos/pkg/store/storepb"
 )
@@ -37,3 +39,30 @@ func translateMatchers(ms []storepb.LabelMatcher) (res []labels.Matcher, err err
 	}
 	return res, nil
 }
+
+// ParseSelector parses a PromQL series selector, e.g. `up{job="node"}`, into label matchers.
+func ParseSelector(s string) ([]storepb.LabelMatcher, error) {
+	ms, err := promql.ParseMetricSelector(s)
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([]storepb.LabelMatcher, 0, len(ms))
+	for _, m := range ms {
+		var t storepb.LabelMatcher_Type
+		switch m.Type {
+		case promlabels.MatchEqual:
+			t = storepb.LabelMatcher_EQ
+		case promlabels.MatchNotEqual:
+			t = storepb.LabelMatcher_NEQ
+		case promlabels.MatchRegexp:
+			t = storepb.LabelMatcher_RE
+		case promlabels.MatchNotRegexp:
+			t = storepb.LabelMatcher_NRE
+		default:
+			return nil, errors.Errorf("unknown label matcher type %d", m.Type)
+		}
+		res = append(res, storepb.LabelMatcher{Type: t, Name: m.Name, Value: m.Value})
+	}
+	return res, nil
+}
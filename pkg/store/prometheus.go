@@ -2,6 +2,7 @@ package store
 
 import (
 	"bytes"
+	"container/list"
 	"context"
 	"encoding/json"
 	"fmt"
@@ -14,6 +15,7 @@ import (
 	"sort"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
@@ -50,11 +52,15 @@ type PrometheusStore struct {
 	component      component.StoreAPI
 	externalLabels func() labels.Labels
 	timestamps     func() (mint int64, maxt int64)
+
+	seriesCache *seriesCache
 }
 
 // NewPrometheusStore returns a new PrometheusStore that uses the given HTTP client
 // to talk to Prometheus.
 // It attaches the provided external labels to all results.
+// If seriesCacheTTL and seriesCacheMaxBytes are positive, results of identical Series requests are served from memory
+// for that long, keeping at most seriesCacheMaxBytes of them. Results of requests with warnings are not cached.
 func NewPrometheusStore(
 	logger log.Logger,
 	client *http.Client,
@@ -62,6 +68,8 @@ func NewPrometheusStore(
 	component component.StoreAPI,
 	externalLabels func() labels.Labels,
 	timestamps func() (mint int64, maxt int64),
+	seriesCacheTTL time.Duration,
+	seriesCacheMaxBytes uint64,
 ) (*PrometheusStore, error) {
 	if logger == nil {
 		logger = log.NewNopLogger()
@@ -79,6 +87,9 @@ func NewPrometheusStore(
 		externalLabels: externalLabels,
 		timestamps:     timestamps,
 	}
+	if seriesCacheTTL > 0 && seriesCacheMaxBytes > 0 {
+		p.seriesCache = newSeriesCache(seriesCacheTTL, seriesCacheMaxBytes)
+	}
 	return p, nil
 }
 
@@ -163,6 +174,36 @@ func (p *PrometheusStore) Series(r *storepb.SeriesRequest, s storepb.Store_Serie
 		q.Matchers = append(q.Matchers, pm)
 	}
 
+	if r.SkipChunks {
+		// Remote read has no way to return only labels, so chunks are dropped before sending the series.
+		s = &skipChunksSeriesServer{Store_SeriesServer: s}
+	}
+
+	if p.seriesCache == nil {
+		return p.queryPrometheus(s, q, externalLabels)
+	}
+
+	key := q.String() + externalLabels.String()
+	if series, ok := p.seriesCache.get(key); ok {
+		for _, series := range series {
+			if err := s.Send(storepb.NewSeriesResponse(series)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	cs := &cachingSeriesServer{Store_SeriesServer: s}
+	if err := p.queryPrometheus(cs, q, externalLabels); err != nil {
+		return err
+	}
+	if !cs.warned {
+		p.seriesCache.set(key, cs.series)
+	}
+	return nil
+}
+
+func (p *PrometheusStore) queryPrometheus(s storepb.Store_SeriesServer, q *prompb.Query, externalLabels labels.Labels) error {
 	queryPrometheusSpan, ctx := tracing.StartSpan(s.Context(), "query_prometheus")
 
 	httpResp, err := p.startPromSeries(ctx, q)
@@ -184,6 +225,114 @@ func (p *PrometheusStore) Series(r *storepb.SeriesRequest, s storepb.Store_Serie
 	return p.handleStreamedPrometheusResponse(s, httpResp, queryPrometheusSpan, externalLabels)
 }
 
+// cachingSeriesServer records all series sent through it, so they can be cached once the request succeeds.
+type cachingSeriesServer struct {
+	storepb.Store_SeriesServer
+
+	series []*storepb.Series
+	// warned is true if any warning was sent, in which case the series must not be cached.
+	warned bool
+}
+
+func (c *cachingSeriesServer) Send(r *storepb.SeriesResponse) error {
+	if s := r.GetSeries(); s != nil {
+		c.series = append(c.series, s)
+	}
+	if r.GetWarning() != "" {
+		c.warned = true
+	}
+	return c.Store_SeriesServer.Send(r)
+}
+
+// skipChunksSeriesServer sends only the labels of series sent through it.
+type skipChunksSeriesServer struct {
+	storepb.Store_SeriesServer
+}
+
+func (c *skipChunksSeriesServer) Send(r *storepb.SeriesResponse) error {
+	if s := r.GetSeries(); s != nil {
+		// Send a copy, the series might be cached.
+		return c.Store_SeriesServer.Send(storepb.NewSeriesResponse(&storepb.Series{Labels: s.Labels}))
+	}
+	return c.Store_SeriesServer.Send(r)
+}
+
+// seriesCache keeps the series of recent remote read requests in memory for a short TTL. It holds at most maxBytes
+// of series, evicting the least recently used entries first.
+type seriesCache struct {
+	mtx      sync.Mutex
+	ttl      time.Duration
+	maxBytes uint64
+	curBytes uint64
+	lru      *list.List
+	entries  map[string]*list.Element
+
+	now func() time.Time
+}
+
+type seriesCacheEntry struct {
+	key     string
+	series  []*storepb.Series
+	size    uint64
+	expires time.Time
+}
+
+func newSeriesCache(ttl time.Duration, maxBytes uint64) *seriesCache {
+	return &seriesCache{
+		ttl:      ttl,
+		maxBytes: maxBytes,
+		lru:      list.New(),
+		entries:  map[string]*list.Element{},
+		now:      time.Now,
+	}
+}
+
+func (c *seriesCache) get(key string) ([]*storepb.Series, bool) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	e, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := e.Value.(*seriesCacheEntry)
+	if !c.now().Before(entry.expires) {
+		c.remove(e)
+		return nil, false
+	}
+	c.lru.MoveToFront(e)
+	return entry.series, true
+}
+
+func (c *seriesCache) set(key string, series []*storepb.Series) {
+	size := uint64(len(key))
+	for _, s := range series {
+		size += uint64(s.Size())
+	}
+	// Results larger than the whole cache would only evict everything else.
+	if size > c.maxBytes {
+		return
+	}
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if e, ok := c.entries[key]; ok {
+		c.remove(e)
+	}
+	for c.curBytes+size > c.maxBytes {
+		c.remove(c.lru.Back())
+	}
+	c.entries[key] = c.lru.PushFront(&seriesCacheEntry{key: key, series: series, size: size, expires: c.now().Add(c.ttl)})
+	c.curBytes += size
+}
+
+func (c *seriesCache) remove(e *list.Element) {
+	entry := c.lru.Remove(e).(*seriesCacheEntry)
+	delete(c.entries, entry.key)
+	c.curBytes -= entry.size
+}
+
 func (p *PrometheusStore) handleSampledPrometheusResponse(s storepb.Store_SeriesServer, httpResp *http.Response, querySpan opentracing.Span, externalLabels labels.Labels) error {
 	ctx := s.Context()
 
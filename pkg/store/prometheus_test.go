@@ -4,12 +4,19 @@ import (
 	"context"
 	"fmt"
 	"math"
+	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/fortytw2/leaktest"
+	"github.com/gogo/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/pkg/errors"
 	"github.com/prometheus/prometheus/pkg/timestamp"
+	"github.com/prometheus/prometheus/prompb"
 	"github.com/prometheus/prometheus/tsdb"
 	"github.com/prometheus/prometheus/tsdb/chunkenc"
 	"github.com/prometheus/prometheus/tsdb/labels"
@@ -58,7 +65,7 @@ func testPrometheusStoreSeriesE2e(t *testing.T, prefix string) {
 	proxy, err := NewPrometheusStore(nil, nil, u, component.Sidecar,
 		func() labels.Labels {
 			return labels.FromStrings("region", "eu-west")
-		}, nil)
+		}, nil, 0, 0)
 	testutil.Ok(t, err)
 
 	{
@@ -151,7 +158,7 @@ func TestPrometheusStore_LabelValues_e2e(t *testing.T) {
 	u, err := url.Parse(fmt.Sprintf("http://%s", p.Addr()))
 	testutil.Ok(t, err)
 
-	proxy, err := NewPrometheusStore(nil, nil, u, component.Sidecar, getExternalLabels, nil)
+	proxy, err := NewPrometheusStore(nil, nil, u, component.Sidecar, getExternalLabels, nil, 0, 0)
 	testutil.Ok(t, err)
 
 	resp, err := proxy.LabelValues(ctx, &storepb.LabelValuesRequest{
@@ -185,7 +192,7 @@ func TestPrometheusStore_ExternalLabelValues_e2e(t *testing.T) {
 	u, err := url.Parse(fmt.Sprintf("http://%s", p.Addr()))
 	testutil.Ok(t, err)
 
-	proxy, err := NewPrometheusStore(nil, nil, u, component.Sidecar, getExternalLabels, nil)
+	proxy, err := NewPrometheusStore(nil, nil, u, component.Sidecar, getExternalLabels, nil, 0, 0)
 	testutil.Ok(t, err)
 
 	resp, err := proxy.LabelValues(ctx, &storepb.LabelValuesRequest{
@@ -232,7 +239,7 @@ func TestPrometheusStore_Series_MatchExternalLabel_e2e(t *testing.T) {
 	proxy, err := NewPrometheusStore(nil, nil, u, component.Sidecar,
 		func() labels.Labels {
 			return labels.FromStrings("region", "eu-west")
-		}, nil)
+		}, nil, 0, 0)
 	testutil.Ok(t, err)
 	srv := newStoreSeriesServer(ctx)
 
@@ -281,7 +288,7 @@ func TestPrometheusStore_Info(t *testing.T) {
 		},
 		func() (int64, int64) {
 			return 123, 456
-		})
+		}, 0, 0)
 	testutil.Ok(t, err)
 
 	resp, err := proxy.Info(ctx, &storepb.InfoRequest{})
@@ -293,6 +300,137 @@ func TestPrometheusStore_Info(t *testing.T) {
 	testutil.Equals(t, int64(456), resp.MaxTime)
 }
 
+func TestPrometheusStore_Series_Cache(t *testing.T) {
+	defer leaktest.CheckTimeout(t, 10*time.Second)()
+
+	var requests int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&requests, 1)
+
+		b, err := proto.Marshal(&prompb.ReadResponse{
+			Results: []*prompb.QueryResult{{
+				Timeseries: []*prompb.TimeSeries{{
+					Labels:  []prompb.Label{{Name: "a", Value: "b"}},
+					Samples: []prompb.Sample{{Timestamp: 100, Value: 1}, {Timestamp: 200, Value: 2}},
+				}},
+			}},
+		})
+		testutil.Ok(t, err)
+
+		w.Header().Set("Content-Type", "application/x-protobuf")
+		_, err = w.Write(snappy.Encode(nil, b))
+		testutil.Ok(t, err)
+	}))
+	defer srv.Close()
+
+	u, err := url.Parse(srv.URL)
+	testutil.Ok(t, err)
+
+	proxy, err := NewPrometheusStore(nil, nil, u, component.Sidecar,
+		func() labels.Labels {
+			return labels.FromStrings("region", "eu-west")
+		}, nil, time.Minute, 1e6)
+	testutil.Ok(t, err)
+
+	now := time.Now()
+	proxy.seriesCache.now = func() time.Time { return now }
+
+	req := &storepb.SeriesRequest{
+		MinTime: 0,
+		MaxTime: 300,
+		Matchers: []storepb.LabelMatcher{
+			{Type: storepb.LabelMatcher_EQ, Name: "a", Value: "b"},
+		},
+	}
+	expected := []storepb.Label{{Name: "a", Value: "b"}, {Name: "region", Value: "eu-west"}}
+
+	// Two identical requests within the TTL should hit Prometheus only once.
+	for i := 0; i < 2; i++ {
+		s := newStoreSeriesServer(context.Background())
+		testutil.Ok(t, proxy.Series(req, s))
+		testutil.Equals(t, 1, len(s.SeriesSet))
+		testutil.Equals(t, expected, s.SeriesSet[0].Labels)
+		testutil.Equals(t, 1, len(s.SeriesSet[0].Chunks))
+	}
+	testutil.Equals(t, int64(1), atomic.LoadInt64(&requests))
+
+	// Different request is not served from cache.
+	s := newStoreSeriesServer(context.Background())
+	testutil.Ok(t, proxy.Series(&storepb.SeriesRequest{
+		MinTime:  0,
+		MaxTime:  200,
+		Matchers: req.Matchers,
+	}, s))
+	testutil.Equals(t, 1, len(s.SeriesSet))
+	testutil.Equals(t, int64(2), atomic.LoadInt64(&requests))
+
+	// Once the TTL passed, Prometheus is queried again.
+	now = now.Add(time.Minute)
+	s = newStoreSeriesServer(context.Background())
+	testutil.Ok(t, proxy.Series(req, s))
+	testutil.Equals(t, 1, len(s.SeriesSet))
+	testutil.Equals(t, int64(3), atomic.LoadInt64(&requests))
+
+	// The least recently used results are evicted once the cache is full.
+	proxy.seriesCache.maxBytes = proxy.seriesCache.curBytes
+	s = newStoreSeriesServer(context.Background())
+	testutil.Ok(t, proxy.Series(&storepb.SeriesRequest{MinTime: 0, MaxTime: 100, Matchers: req.Matchers}, s))
+	testutil.Equals(t, int64(4), atomic.LoadInt64(&requests))
+
+	s = newStoreSeriesServer(context.Background())
+	testutil.Ok(t, proxy.Series(&storepb.SeriesRequest{MinTime: 0, MaxTime: 200, Matchers: req.Matchers}, s))
+	testutil.Equals(t, 1, len(s.SeriesSet))
+	testutil.Equals(t, int64(5), atomic.LoadInt64(&requests))
+	testutil.Equals(t, 2, len(proxy.seriesCache.entries))
+	testutil.Assert(t, proxy.seriesCache.curBytes <= proxy.seriesCache.maxBytes, "cache exceeds its size")
+}
+
+func TestSeriesCache_Set(t *testing.T) {
+	series := []*storepb.Series{{Labels: []storepb.Label{{Name: "a", Value: "b"}}}}
+	size := uint64(series[0].Size()) + 1
+
+	c := newSeriesCache(time.Minute, 2*size)
+	c.set("1", series)
+	c.set("2", series)
+	_, ok := c.get("1")
+	testutil.Assert(t, ok, "expected cached series")
+
+	// The least recently used entry is evicted.
+	c.set("3", series)
+	_, ok = c.get("2")
+	testutil.Assert(t, !ok, "expected evicted series")
+	_, ok = c.get("1")
+	testutil.Assert(t, ok, "expected cached series")
+	testutil.Equals(t, 2*size, c.curBytes)
+
+	// Results larger than the cache are not cached.
+	c.set("4", append(series, series[0], series[0]))
+	_, ok = c.get("4")
+	testutil.Assert(t, !ok, "expected too large series not to be cached")
+	testutil.Equals(t, 2, len(c.entries))
+}
+
+func TestCachingSeriesServer_Warnings(t *testing.T) {
+	cs := &cachingSeriesServer{Store_SeriesServer: newStoreSeriesServer(context.Background())}
+	testutil.Ok(t, cs.Send(storepb.NewSeriesResponse(&storepb.Series{})))
+	testutil.Assert(t, !cs.warned, "expected no warning")
+	testutil.Ok(t, cs.Send(storepb.NewWarnSeriesResponse(errors.New("partial"))))
+	testutil.Assert(t, cs.warned, "expected warning")
+}
+
+func TestSkipChunksSeriesServer(t *testing.T) {
+	srv := newStoreSeriesServer(context.Background())
+	s := &storepb.Series{
+		Labels: []storepb.Label{{Name: "a", Value: "1"}},
+		Chunks: []storepb.AggrChunk{{MinTime: 1, MaxTime: 2}},
+	}
+	testutil.Ok(t, (&skipChunksSeriesServer{Store_SeriesServer: srv}).Send(storepb.NewSeriesResponse(s)))
+
+	testutil.Equals(t, []storepb.Series{{Labels: s.Labels}}, srv.SeriesSet)
+	// The sent series must not be modified, as it might be cached.
+	testutil.Equals(t, 1, len(s.Chunks))
+}
+
 func testSeries_SplitSamplesIntoChunksWithMaxSizeOfUint16_e2e(t *testing.T, appender tsdb.Appender, newStore func() storepb.StoreServer) {
 	baseT := timestamp.FromTime(time.Now().AddDate(0, 0, -2)) / 1000 * 1000
 
@@ -360,7 +498,7 @@ func TestPrometheusStore_Series_SplitSamplesIntoChunksWithMaxSizeOfUint16_e2e(t
 		proxy, err := NewPrometheusStore(nil, nil, u, component.Sidecar,
 			func() labels.Labels {
 				return labels.FromStrings("region", "eu-west")
-			}, nil)
+			}, nil, 0, 0)
 		testutil.Ok(t, err)
 
 		return proxy
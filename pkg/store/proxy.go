@@ -36,6 +36,9 @@ type Client interface {
 	// Minimum and maximum time range of data in the store.
 	TimeRange() (mint int64, maxt int64)
 
+	// BlockSetID identifies the blocks the store serves as reported by it, empty if it cannot tell.
+	BlockSetID() string
+
 	String() string
 	// Addr returns address of a Client.
 	Addr() string
@@ -212,6 +215,7 @@ func (s *ProxyStore) Series(r *storepb.SeriesRequest, srv storepb.Store_SeriesSe
 				Aggregates:              r.Aggregates,
 				MaxResolutionWindow:     r.MaxResolutionWindow,
 				PartialResponseDisabled: r.PartialResponseDisabled,
+				SkipChunks:              r.SkipChunks,
 			}
 			wg = &sync.WaitGroup{}
 		)
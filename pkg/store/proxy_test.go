@@ -40,6 +40,10 @@ func (c *testClient) TimeRange() (int64, int64) {
 	return c.minTime, c.maxTime
 }
 
+func (c *testClient) BlockSetID() string {
+	return ""
+}
+
 func (c *testClient) String() string {
 	return "test"
 }
@@ -65,7 +65,7 @@ func (StoreType) EnumDescriptor() ([]byte, []int) {
 	return fileDescriptor_77a6da22d6a3feb1, []int{0}
 }
 
-/// PartialResponseStrategy controls partial response handling.
+// / PartialResponseStrategy controls partial response handling.
 type PartialResponseStrategy int32
 
 const (
@@ -102,12 +102,13 @@ func (PartialResponseStrategy) EnumDescriptor() ([]byte, []int) {
 type Aggr int32
 
 const (
-	Aggr_RAW     Aggr = 0
-	Aggr_COUNT   Aggr = 1
-	Aggr_SUM     Aggr = 2
-	Aggr_MIN     Aggr = 3
-	Aggr_MAX     Aggr = 4
-	Aggr_COUNTER Aggr = 5
+	Aggr_RAW         Aggr = 0
+	Aggr_COUNT       Aggr = 1
+	Aggr_SUM         Aggr = 2
+	Aggr_MIN         Aggr = 3
+	Aggr_MAX         Aggr = 4
+	Aggr_COUNTER     Aggr = 5
+	Aggr_SUM_SQUARES Aggr = 6
 )
 
 var Aggr_name = map[int32]string{
@@ -117,15 +118,17 @@ var Aggr_name = map[int32]string{
 	3: "MIN",
 	4: "MAX",
 	5: "COUNTER",
+	6: "SUM_SQUARES",
 }
 
 var Aggr_value = map[string]int32{
-	"RAW":     0,
-	"COUNT":   1,
-	"SUM":     2,
-	"MIN":     3,
-	"MAX":     4,
-	"COUNTER": 5,
+	"RAW":         0,
+	"COUNT":       1,
+	"SUM":         2,
+	"MIN":         3,
+	"MAX":         4,
+	"COUNTER":     5,
+	"SUM_SQUARES": 6,
 }
 
 func (x Aggr) String() string {
@@ -183,6 +186,7 @@ type InfoResponse struct {
 	StoreType StoreType `protobuf:"varint,4,opt,name=storeType,proto3,enum=thanos.StoreType" json:"storeType,omitempty"`
 	// label_sets is an unsorted list of `LabelSet`s.
 	LabelSets            []LabelSet `protobuf:"bytes,5,rep,name=label_sets,json=labelSets,proto3" json:"label_sets"`
+	BlockSetId           string     `protobuf:"bytes,6,opt,name=block_set_id,json=blockSetId,proto3" json:"block_set_id,omitempty"`
 	XXX_NoUnkeyedLiteral struct{}   `json:"-"`
 	XXX_unrecognized     []byte     `json:"-"`
 	XXX_sizecache        int32      `json:"-"`
@@ -271,9 +275,11 @@ type SeriesRequest struct {
 	PartialResponseDisabled bool `protobuf:"varint,6,opt,name=partial_response_disabled,json=partialResponseDisabled,proto3" json:"partial_response_disabled,omitempty"`
 	// TODO(bwplotka): Move Thanos components to use strategy instead. Including QueryAPI.
 	PartialResponseStrategy PartialResponseStrategy `protobuf:"varint,7,opt,name=partial_response_strategy,json=partialResponseStrategy,proto3,enum=thanos.PartialResponseStrategy" json:"partial_response_strategy,omitempty"`
-	XXX_NoUnkeyedLiteral    struct{}                `json:"-"`
-	XXX_unrecognized        []byte                  `json:"-"`
-	XXX_sizecache           int32                   `json:"-"`
+	// skip_chunks controls whether chunks are sent in series responses. If true, only the labels of the series are sent.
+	SkipChunks           bool     `protobuf:"varint,8,opt,name=skip_chunks,json=skipChunks,proto3" json:"skip_chunks,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
 }
 
 func (m *SeriesRequest) Reset()         { *m = SeriesRequest{} }
@@ -644,56 +650,59 @@ func init() {
 func init() { proto.RegisterFile("rpc.proto", fileDescriptor_77a6da22d6a3feb1) }
 
 var fileDescriptor_77a6da22d6a3feb1 = []byte{
-	// 772 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0xa4, 0x55, 0x4f, 0x6f, 0xfa, 0x46,
-	0x10, 0x65, 0x6d, 0x30, 0x78, 0x48, 0x90, 0xb3, 0x21, 0x89, 0x71, 0x25, 0x82, 0x38, 0xa1, 0xb4,
-	0x22, 0x2d, 0x55, 0x5b, 0xb5, 0x37, 0x20, 0x8e, 0x82, 0x9a, 0x40, 0xbb, 0x40, 0xe8, 0x9f, 0x03,
-	0x35, 0xc9, 0xd6, 0xb1, 0x64, 0x6c, 0xea, 0x35, 0x4d, 0x72, 0xed, 0xe7, 0xe9, 0xb7, 0xe8, 0x25,
-	0xc7, 0x5e, 0x7b, 0xa9, 0xda, 0x7c, 0x8a, 0x1e, 0x2b, 0xaf, 0xd7, 0x80, 0xdb, 0x24, 0xd2, 0x4f,
-	0xdc, 0x76, 0xde, 0x1b, 0xcf, 0xec, 0x7b, 0x3b, 0xbb, 0x06, 0x35, 0x58, 0xdc, 0x34, 0x17, 0x81,
-	0x1f, 0xfa, 0x58, 0x09, 0xef, 0x2c, 0xcf, 0x67, 0x46, 0x31, 0x7c, 0x5c, 0x50, 0x16, 0x83, 0x46,
-	0xd9, 0xf6, 0x6d, 0x9f, 0x2f, 0x4f, 0xa3, 0x55, 0x8c, 0xd6, 0x77, 0xa1, 0xd8, 0xf3, 0x7e, 0xf4,
-	0x09, 0xfd, 0x69, 0x49, 0x59, 0x58, 0xff, 0x03, 0xc1, 0x4e, 0x1c, 0xb3, 0x85, 0xef, 0x31, 0x8a,
-	0xdf, 0x07, 0xc5, 0xb5, 0x66, 0xd4, 0x65, 0x3a, 0xaa, 0xc9, 0x8d, 0x62, 0x6b, 0xb7, 0x19, 0xd7,
-	0x6e, 0x5e, 0x46, 0x68, 0x27, 0xfb, 0xf4, 0xe7, 0x71, 0x86, 0x88, 0x14, 0x5c, 0x81, 0xc2, 0xdc,
-	0xf1, 0xa6, 0xa1, 0x33, 0xa7, 0xba, 0x54, 0x43, 0x0d, 0x99, 0xe4, 0xe7, 0x8e, 0x37, 0x72, 0xe6,
-	0x94, 0x53, 0xd6, 0x43, 0x4c, 0xc9, 0x82, 0xb2, 0x1e, 0x38, 0x75, 0x0a, 0x2a, 0x0b, 0xfd, 0x80,
-	0x8e, 0x1e, 0x17, 0x54, 0xcf, 0xd6, 0x50, 0xa3, 0xd4, 0xda, 0x4b, 0xba, 0x0c, 0x13, 0x82, 0xac,
-	0x73, 0xf0, 0x27, 0x00, 0xbc, 0xe1, 0x94, 0xd1, 0x90, 0xe9, 0x39, 0xbe, 0x2f, 0x2d, 0xb5, 0xaf,
-	0x21, 0x0d, 0xc5, 0xd6, 0x54, 0x57, 0xc4, 0xac, 0xfe, 0x19, 0x14, 0x12, 0xf2, 0x9d, 0x64, 0xd5,
-	0xff, 0x91, 0x60, 0x77, 0x48, 0x03, 0x87, 0x32, 0x61, 0x53, 0x4a, 0x28, 0x7a, 0x5d, 0xa8, 0x94,
-	0x16, 0xfa, 0x69, 0x44, 0x85, 0x37, 0x77, 0x34, 0x60, 0xba, 0xcc, 0xdb, 0x96, 0x53, 0x6d, 0xaf,
-	0x62, 0x52, 0x74, 0x5f, 0xe5, 0xe2, 0x16, 0x1c, 0x44, 0x25, 0x03, 0xca, 0x7c, 0x77, 0x19, 0x3a,
-	0xbe, 0x37, 0xbd, 0x77, 0xbc, 0x5b, 0xff, 0x9e, 0x9b, 0x25, 0x93, 0xfd, 0xb9, 0xf5, 0x40, 0x56,
-	0xdc, 0x84, 0x53, 0xf8, 0x03, 0x00, 0xcb, 0xb6, 0x03, 0x6a, 0x5b, 0x21, 0x8d, 0x3d, 0x2a, 0xb5,
-	0x76, 0x92, 0x6e, 0x6d, 0xdb, 0x0e, 0xc8, 0x06, 0x8f, 0xbf, 0x80, 0xca, 0xc2, 0x0a, 0x42, 0xc7,
-	0x72, 0xa3, 0x2e, 0xfc, 0xe4, 0xa7, 0xb7, 0x0e, 0xb3, 0x66, 0x2e, 0xbd, 0xd5, 0x95, 0x1a, 0x6a,
-	0x14, 0xc8, 0x91, 0x48, 0x48, 0x26, 0xe3, 0x4c, 0xd0, 0xf8, 0xfb, 0x17, 0xbe, 0x65, 0x61, 0x60,
-	0x85, 0xd4, 0x7e, 0xd4, 0xf3, 0xfc, 0x38, 0x8f, 0x93, 0xc6, 0x5f, 0xa5, 0x6b, 0x0c, 0x45, 0xda,
-	0xff, 0x8a, 0x27, 0x44, 0xfd, 0x07, 0x28, 0x25, 0xce, 0x8b, 0x81, 0x6c, 0x80, 0xc2, 0x38, 0xc2,
-	0x8d, 0x2f, 0xb6, 0x4a, 0xab, 0x51, 0xe1, 0xe8, 0x45, 0x86, 0x08, 0x1e, 0x1b, 0x90, 0xbf, 0xb7,
-	0x02, 0xcf, 0xf1, 0x6c, 0x7e, 0x10, 0xea, 0x45, 0x86, 0x24, 0x40, 0xa7, 0x00, 0x4a, 0x40, 0xd9,
-	0xd2, 0x0d, 0xeb, 0xbf, 0x22, 0xd8, 0xe3, 0xee, 0xf7, 0xad, 0xf9, 0xfa, 0x80, 0xdf, 0x34, 0x04,
-	0x6d, 0x61, 0x88, 0xb4, 0xa5, 0x21, 0xe7, 0x80, 0x37, 0x77, 0x2b, 0x4c, 0x29, 0x43, 0xce, 0x8b,
-	0x00, 0x3e, 0xcd, 0x2a, 0x89, 0x03, 0x6c, 0x40, 0x41, 0xe8, 0x65, 0xba, 0xc4, 0x89, 0x55, 0x5c,
-	0xff, 0x0d, 0x89, 0x42, 0xd7, 0x96, 0xbb, 0x5c, 0xeb, 0x2e, 0x43, 0x8e, 0x0f, 0x3d, 0xd7, 0xa8,
-	0x92, 0x38, 0x78, 0xdb, 0x0d, 0x69, 0x0b, 0x37, 0xe4, 0x2d, 0xdd, 0xe8, 0xc1, 0x7e, 0x4a, 0x84,
-	0xb0, 0xe3, 0x10, 0x94, 0x9f, 0x39, 0x22, 0xfc, 0x10, 0xd1, 0x5b, 0x86, 0x9c, 0x10, 0x50, 0x57,
-	0x8f, 0x0d, 0x2e, 0x42, 0x7e, 0xdc, 0xff, 0xb2, 0x3f, 0x98, 0xf4, 0xb5, 0x0c, 0x56, 0x21, 0xf7,
-	0xf5, 0xd8, 0x24, 0xdf, 0x6a, 0x08, 0x17, 0x20, 0x4b, 0xc6, 0x97, 0xa6, 0x26, 0x45, 0x19, 0xc3,
-	0xde, 0x99, 0xd9, 0x6d, 0x13, 0x4d, 0x8e, 0x32, 0x86, 0xa3, 0x01, 0x31, 0xb5, 0x6c, 0x84, 0x13,
-	0xb3, 0x6b, 0xf6, 0xae, 0x4d, 0x2d, 0x77, 0xd2, 0x84, 0xa3, 0x57, 0x24, 0x45, 0x95, 0x26, 0x6d,
-	0x22, 0xca, 0xb7, 0x3b, 0x03, 0x32, 0xd2, 0xd0, 0x49, 0x07, 0xb2, 0xd1, 0xd5, 0xc4, 0x79, 0x90,
-	0x49, 0x7b, 0x12, 0x73, 0xdd, 0xc1, 0xb8, 0x3f, 0xd2, 0x50, 0x84, 0x0d, 0xc7, 0x57, 0x9a, 0x14,
-	0x2d, 0xae, 0x7a, 0x7d, 0x4d, 0xe6, 0x8b, 0xf6, 0x37, 0x71, 0x4f, 0x9e, 0x65, 0x12, 0x2d, 0xd7,
-	0xfa, 0x45, 0x82, 0x1c, 0x17, 0x82, 0x3f, 0x82, 0x6c, 0xf4, 0x94, 0xe3, 0xfd, 0xc4, 0xde, 0x8d,
-	0x87, 0xde, 0x28, 0xa7, 0x41, 0x61, 0xdc, 0xe7, 0xa0, 0xc4, 0xd7, 0x08, 0x1f, 0xa4, 0xaf, 0x55,
-	0xf2, 0xd9, 0xe1, 0x7f, 0xe1, 0xf8, 0xc3, 0x0f, 0x11, 0xee, 0x02, 0xac, 0x07, 0x13, 0x57, 0x52,
-	0x0f, 0xdb, 0xe6, 0xd5, 0x32, 0x8c, 0x97, 0x28, 0xd1, 0xff, 0x1c, 0x8a, 0x1b, 0xe7, 0x89, 0xd3,
-	0xa9, 0xa9, 0x49, 0x35, 0xde, 0x7b, 0x91, 0x8b, 0xeb, 0x74, 0x2a, 0x4f, 0x7f, 0x57, 0x33, 0x4f,
-	0xcf, 0x55, 0xf4, 0xfb, 0x73, 0x15, 0xfd, 0xf5, 0x5c, 0x45, 0xdf, 0xe5, 0xf9, 0xef, 0x63, 0x31,
-	0x9b, 0x29, 0xfc, 0xbf, 0xf7, 0xf1, 0xbf, 0x01, 0x00, 0x00, 0xff, 0xff, 0xe8, 0xcb, 0x18, 0x01,
-	0x2f, 0x07, 0x00, 0x00,
+	// 830 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0xa4, 0x55, 0xcd, 0x72, 0xe3, 0x44,
+	0x10, 0xf6, 0x58, 0xb6, 0x6c, 0xb5, 0x92, 0xa0, 0x9d, 0x78, 0x77, 0x15, 0x51, 0x95, 0xb8, 0x74,
+	0x72, 0x05, 0x2a, 0x0b, 0xa6, 0x80, 0x82, 0x9b, 0xe3, 0xd5, 0xd6, 0xba, 0xd8, 0x38, 0xec, 0xc8,
+	0xde, 0xf0, 0x73, 0x10, 0x72, 0x32, 0x28, 0xaa, 0xc8, 0x92, 0xd0, 0x8c, 0x49, 0x72, 0xe5, 0x2d,
+	0x78, 0x07, 0xde, 0x82, 0x4b, 0x8e, 0x3c, 0x01, 0x05, 0x79, 0x0d, 0x2e, 0x94, 0x46, 0x23, 0xc7,
+	0x82, 0x6c, 0xaa, 0xb6, 0x7c, 0x9b, 0xfe, 0xbe, 0x9e, 0xee, 0xe9, 0xaf, 0x7b, 0x66, 0x40, 0xcb,
+	0xd2, 0xd3, 0x83, 0x34, 0x4b, 0x78, 0x82, 0x55, 0x7e, 0xee, 0xc7, 0x09, 0xb3, 0x74, 0x7e, 0x9d,
+	0x52, 0x56, 0x80, 0x56, 0x27, 0x48, 0x82, 0x44, 0x2c, 0x9f, 0xe5, 0xab, 0x02, 0xb5, 0x37, 0x41,
+	0x1f, 0xc5, 0x3f, 0x26, 0x84, 0xfe, 0xb4, 0xa0, 0x8c, 0xdb, 0xff, 0x20, 0xd8, 0x28, 0x6c, 0x96,
+	0x26, 0x31, 0xa3, 0xf8, 0x03, 0x50, 0x23, 0x7f, 0x46, 0x23, 0x66, 0xa2, 0xae, 0xd2, 0xd3, 0xfb,
+	0x9b, 0x07, 0x45, 0xec, 0x83, 0x57, 0x39, 0x7a, 0xd8, 0xb8, 0xf9, 0x73, 0xaf, 0x46, 0xa4, 0x0b,
+	0xde, 0x81, 0xf6, 0x3c, 0x8c, 0x3d, 0x1e, 0xce, 0xa9, 0x59, 0xef, 0xa2, 0x9e, 0x42, 0x5a, 0xf3,
+	0x30, 0x9e, 0x84, 0x73, 0x2a, 0x28, 0xff, 0xaa, 0xa0, 0x14, 0x49, 0xf9, 0x57, 0x82, 0x7a, 0x06,
+	0x1a, 0xe3, 0x49, 0x46, 0x27, 0xd7, 0x29, 0x35, 0x1b, 0x5d, 0xd4, 0xdb, 0xea, 0x3f, 0x2a, 0xb3,
+	0xb8, 0x25, 0x41, 0xee, 0x7c, 0xf0, 0xa7, 0x00, 0x22, 0xa1, 0xc7, 0x28, 0x67, 0x66, 0x53, 0x9c,
+	0xcb, 0xa8, 0x9c, 0xcb, 0xa5, 0x5c, 0x1e, 0x4d, 0x8b, 0xa4, 0xcd, 0x70, 0x17, 0x36, 0x66, 0x51,
+	0x72, 0x7a, 0x91, 0x6f, 0xf3, 0xc2, 0x33, 0x53, 0xed, 0xa2, 0x9e, 0x46, 0x40, 0x60, 0x2e, 0xe5,
+	0xa3, 0x33, 0xfb, 0x73, 0x68, 0x97, 0xdb, 0xdf, 0xa9, 0x70, 0xfb, 0x57, 0x05, 0x36, 0x5d, 0x9a,
+	0x85, 0x94, 0x49, 0x21, 0x2b, 0x52, 0xa0, 0xb7, 0x4b, 0x51, 0xaf, 0x4a, 0xf1, 0x59, 0x4e, 0xf1,
+	0xd3, 0x73, 0x9a, 0x31, 0x53, 0x11, 0x69, 0x3b, 0x95, 0xb4, 0x47, 0x05, 0x29, 0xb3, 0x2f, 0x7d,
+	0x71, 0x1f, 0x1e, 0xe7, 0x21, 0x33, 0xca, 0x92, 0x68, 0xc1, 0xc3, 0x24, 0xf6, 0x2e, 0xc3, 0xf8,
+	0x2c, 0xb9, 0x14, 0x72, 0x2a, 0x64, 0x7b, 0xee, 0x5f, 0x91, 0x25, 0x77, 0x22, 0x28, 0xfc, 0x21,
+	0x80, 0x1f, 0x04, 0x19, 0x0d, 0x7c, 0x4e, 0x0b, 0x15, 0xb7, 0xfa, 0x1b, 0x65, 0xb6, 0x41, 0x10,
+	0x64, 0x64, 0x85, 0xc7, 0x5f, 0xc2, 0x4e, 0xea, 0x67, 0x3c, 0xf4, 0x23, 0x2f, 0x93, 0xb3, 0xe1,
+	0x9d, 0x85, 0xcc, 0x9f, 0x45, 0xb4, 0x50, 0xb2, 0x4d, 0x9e, 0x4a, 0x87, 0x72, 0x76, 0x9e, 0x4b,
+	0x1a, 0x7f, 0x7f, 0xcf, 0x5e, 0xc6, 0x33, 0x9f, 0xd3, 0xe0, 0xda, 0x6c, 0x89, 0x86, 0xef, 0x95,
+	0x89, 0xbf, 0xae, 0xc6, 0x70, 0xa5, 0xdb, 0xff, 0x82, 0x97, 0x04, 0xde, 0x03, 0x9d, 0x5d, 0x84,
+	0xa9, 0x77, 0x7a, 0xbe, 0x88, 0x2f, 0x98, 0xd9, 0x16, 0x47, 0x81, 0x1c, 0x1a, 0x0a, 0xc4, 0xfe,
+	0x01, 0xb6, 0xca, 0xd6, 0xc8, 0x99, 0xee, 0x81, 0xca, 0x04, 0x22, 0x3a, 0xa3, 0xf7, 0xb7, 0x96,
+	0xd3, 0x26, 0xd0, 0x97, 0x35, 0x22, 0x79, 0x6c, 0x41, 0xeb, 0xd2, 0xcf, 0xe2, 0x30, 0x0e, 0x44,
+	0xa7, 0xb4, 0x97, 0x35, 0x52, 0x02, 0x87, 0x6d, 0x50, 0x33, 0xca, 0x16, 0x11, 0xb7, 0x7f, 0x43,
+	0xf0, 0x48, 0xb4, 0x67, 0xec, 0xcf, 0xef, 0x26, 0xe0, 0x41, 0xc5, 0xd0, 0x1a, 0x8a, 0xd5, 0xd7,
+	0x53, 0xcc, 0x7e, 0x01, 0x78, 0xf5, 0xb4, 0x52, 0x94, 0x0e, 0x34, 0xe3, 0x1c, 0x10, 0xe3, 0xae,
+	0x91, 0xc2, 0xc0, 0x16, 0xb4, 0x65, 0xbd, 0xcc, 0xac, 0x0b, 0x62, 0x69, 0xdb, 0xbf, 0x23, 0x19,
+	0xe8, 0x8d, 0x1f, 0x2d, 0xee, 0xea, 0xee, 0x40, 0x53, 0xdc, 0x0a, 0x51, 0xa3, 0x46, 0x0a, 0xe3,
+	0x61, 0x35, 0xea, 0x6b, 0xa8, 0xa1, 0xac, 0xa9, 0xc6, 0x08, 0xb6, 0x2b, 0x45, 0x48, 0x39, 0x9e,
+	0x80, 0xfa, 0xb3, 0x40, 0xa4, 0x1e, 0xd2, 0x7a, 0x48, 0x90, 0x7d, 0x02, 0xda, 0xf2, 0xbd, 0xc2,
+	0x3a, 0xb4, 0xa6, 0xe3, 0xaf, 0xc6, 0xc7, 0x27, 0x63, 0xa3, 0x86, 0x35, 0x68, 0xbe, 0x9e, 0x3a,
+	0xe4, 0x5b, 0x03, 0xe1, 0x36, 0x34, 0xc8, 0xf4, 0x95, 0x63, 0xd4, 0x73, 0x0f, 0x77, 0xf4, 0xdc,
+	0x19, 0x0e, 0x88, 0xa1, 0xe4, 0x1e, 0xee, 0xe4, 0x98, 0x38, 0x46, 0x23, 0xc7, 0x89, 0x33, 0x74,
+	0x46, 0x6f, 0x1c, 0xa3, 0xb9, 0x7f, 0x00, 0x4f, 0xdf, 0x52, 0x52, 0x1e, 0xe9, 0x64, 0x40, 0x64,
+	0xf8, 0xc1, 0xe1, 0x31, 0x99, 0x18, 0x68, 0xdf, 0x85, 0x46, 0x7e, 0x77, 0x71, 0x0b, 0x14, 0x32,
+	0x38, 0x29, 0xb8, 0xe1, 0xf1, 0x74, 0x3c, 0x31, 0x50, 0x8e, 0xb9, 0xd3, 0x23, 0xa3, 0x9e, 0x2f,
+	0x8e, 0x46, 0x63, 0x43, 0x11, 0x8b, 0xc1, 0x37, 0x45, 0x4e, 0xe1, 0xe5, 0x10, 0xa3, 0x89, 0xdf,
+	0x03, 0xdd, 0x9d, 0x1e, 0x79, 0xee, 0xeb, 0xe9, 0x80, 0x38, 0xae, 0xa1, 0xf6, 0x7f, 0xa9, 0x43,
+	0x53, 0x54, 0x86, 0x3f, 0x86, 0x46, 0xfe, 0x3d, 0xe0, 0xed, 0x52, 0xef, 0x95, 0xcf, 0xc3, 0xea,
+	0x54, 0x41, 0xa9, 0xe4, 0x17, 0xa0, 0x16, 0xf7, 0x0a, 0x3f, 0xae, 0xde, 0xb3, 0x72, 0xdb, 0x93,
+	0xff, 0xc2, 0xc5, 0xc6, 0x8f, 0x10, 0x1e, 0x02, 0xdc, 0x4d, 0x2a, 0xde, 0xa9, 0x3c, 0x85, 0xab,
+	0x77, 0xcd, 0xb2, 0xee, 0xa3, 0x64, 0xfe, 0x17, 0xa0, 0xaf, 0x34, 0x18, 0x57, 0x5d, 0x2b, 0xa3,
+	0x6b, 0xbd, 0x7f, 0x2f, 0x57, 0xc4, 0x39, 0xdc, 0xb9, 0xf9, 0x7b, 0xb7, 0x76, 0x73, 0xbb, 0x8b,
+	0xfe, 0xb8, 0xdd, 0x45, 0x7f, 0xdd, 0xee, 0xa2, 0xef, 0x5a, 0xe2, 0x4b, 0x4a, 0x67, 0x33, 0x55,
+	0xfc, 0xa5, 0x9f, 0xfc, 0x3b, 0x00, 0x3e, 0xa6, 0x51, 0xa5, 0x83, 0x07, 0x00, 0x00,
 }
 
 // Reference imports to suppress errors if they are not otherwise used.
@@ -985,6 +994,13 @@ func (m *InfoResponse) MarshalToSizedBuffer(dAtA []byte) (int, error) {
 		i -= len(m.XXX_unrecognized)
 		copy(dAtA[i:], m.XXX_unrecognized)
 	}
+	if len(m.BlockSetId) > 0 {
+		i -= len(m.BlockSetId)
+		copy(dAtA[i:], m.BlockSetId)
+		i = encodeVarintRpc(dAtA, i, uint64(len(m.BlockSetId)))
+		i--
+		dAtA[i] = 0x32
+	}
 	if len(m.LabelSets) > 0 {
 		for iNdEx := len(m.LabelSets) - 1; iNdEx >= 0; iNdEx-- {
 			{
@@ -1096,6 +1112,16 @@ func (m *SeriesRequest) MarshalToSizedBuffer(dAtA []byte) (int, error) {
 		i -= len(m.XXX_unrecognized)
 		copy(dAtA[i:], m.XXX_unrecognized)
 	}
+	if m.SkipChunks {
+		i--
+		if m.SkipChunks {
+			dAtA[i] = 1
+		} else {
+			dAtA[i] = 0
+		}
+		i--
+		dAtA[i] = 0x40
+	}
 	if m.PartialResponseStrategy != 0 {
 		i = encodeVarintRpc(dAtA, i, uint64(m.PartialResponseStrategy))
 		i--
@@ -1461,6 +1487,10 @@ func (m *InfoResponse) Size() (n int) {
 			n += 1 + l + sovRpc(uint64(l))
 		}
 	}
+	l = len(m.BlockSetId)
+	if l > 0 {
+		n += 1 + l + sovRpc(uint64(l))
+	}
 	if m.XXX_unrecognized != nil {
 		n += len(m.XXX_unrecognized)
 	}
@@ -1519,6 +1549,9 @@ func (m *SeriesRequest) Size() (n int) {
 	if m.PartialResponseStrategy != 0 {
 		n += 1 + sovRpc(uint64(m.PartialResponseStrategy))
 	}
+	if m.SkipChunks {
+		n += 2
+	}
 	if m.XXX_unrecognized != nil {
 		n += len(m.XXX_unrecognized)
 	}
@@ -1864,6 +1897,38 @@ func (m *InfoResponse) Unmarshal(dAtA []byte) error {
 				return err
 			}
 			iNdEx = postIndex
+		case 6:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field BlockSetId", wireType)
+			}
+			var stringLen uint64
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowRpc
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				stringLen |= uint64(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			intStringLen := int(stringLen)
+			if intStringLen < 0 {
+				return ErrInvalidLengthRpc
+			}
+			postIndex := iNdEx + intStringLen
+			if postIndex < 0 {
+				return ErrInvalidLengthRpc
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.BlockSetId = string(dAtA[iNdEx:postIndex])
+			iNdEx = postIndex
 		default:
 			iNdEx = preIndex
 			skippy, err := skipRpc(dAtA[iNdEx:])
@@ -2205,6 +2270,26 @@ func (m *SeriesRequest) Unmarshal(dAtA []byte) error {
 					break
 				}
 			}
+		case 8:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field SkipChunks", wireType)
+			}
+			var v int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowRpc
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				v |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			m.SkipChunks = bool(v != 0)
 		default:
 			iNdEx = preIndex
 			skippy, err := skipRpc(dAtA[iNdEx:])
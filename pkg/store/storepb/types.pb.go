@@ -209,6 +209,7 @@ type AggrChunk struct {
 	Min                  *Chunk   `protobuf:"bytes,6,opt,name=min,proto3" json:"min,omitempty"`
 	Max                  *Chunk   `protobuf:"bytes,7,opt,name=max,proto3" json:"max,omitempty"`
 	Counter              *Chunk   `protobuf:"bytes,8,opt,name=counter,proto3" json:"counter,omitempty"`
+	SumSquares           *Chunk   `protobuf:"bytes,9,opt,name=sum_squares,json=sumSquares,proto3" json:"sum_squares,omitempty"`
 	XXX_NoUnkeyedLiteral struct{} `json:"-"`
 	XXX_unrecognized     []byte   `json:"-"`
 	XXX_sizecache        int32    `json:"-"`
@@ -303,34 +304,36 @@ func init() {
 func init() { proto.RegisterFile("types.proto", fileDescriptor_d938547f84707355) }
 
 var fileDescriptor_d938547f84707355 = []byte{
-	// 432 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x6c, 0x92, 0xdd, 0x6e, 0xd3, 0x30,
-	0x14, 0xc7, 0xeb, 0x7c, 0x76, 0x67, 0x03, 0x05, 0x33, 0x21, 0x97, 0x8b, 0xae, 0x0a, 0x17, 0x54,
-	0x20, 0x32, 0x31, 0x9e, 0x80, 0xa1, 0xdc, 0xf1, 0xa1, 0x99, 0x5d, 0x20, 0x84, 0x84, 0xdc, 0xce,
-	0xa4, 0x11, 0x8d, 0x5d, 0xc5, 0x0e, 0x74, 0x8f, 0x81, 0x78, 0xa9, 0x5e, 0xf2, 0x04, 0x08, 0xfa,
-	0x24, 0xc8, 0x27, 0x0d, 0x5b, 0xa5, 0xdc, 0x1d, 0x9f, 0xff, 0xef, 0x7c, 0xc8, 0xe7, 0x0f, 0x87,
-	0xf6, 0x7a, 0x25, 0x4d, 0xb6, 0xaa, 0xb5, 0xd5, 0x34, 0xb2, 0x0b, 0xa1, 0xb4, 0x79, 0x78, 0x5c,
-	0xe8, 0x42, 0x63, 0xea, 0xd4, 0x45, 0xad, 0x9a, 0x3e, 0x87, 0xf0, 0xb5, 0x98, 0xc9, 0x25, 0xa5,
-	0x10, 0x28, 0x51, 0x49, 0x46, 0x26, 0x64, 0x7a, 0xc0, 0x31, 0xa6, 0xc7, 0x10, 0x7e, 0x13, 0xcb,
-	0x46, 0x32, 0x0f, 0x93, 0xed, 0x23, 0xfd, 0x04, 0xe1, 0xab, 0x45, 0xa3, 0xbe, 0xd2, 0x27, 0x10,
-	0xb8, 0x41, 0x58, 0x72, 0xf7, 0xec, 0x41, 0xd6, 0x0e, 0xca, 0x50, 0xcc, 0x72, 0x35, 0xd7, 0x57,
-	0xa5, 0x2a, 0x38, 0x32, 0xae, 0xfd, 0x95, 0xb0, 0x02, 0x3b, 0x1d, 0x71, 0x8c, 0xd3, 0xfb, 0x30,
-	0xec, 0x28, 0x1a, 0x83, 0xff, 0xe1, 0x1d, 0x4f, 0x06, 0xe9, 0x17, 0x88, 0xde, 0xcb, 0xba, 0x94,
-	0x86, 0x3e, 0x85, 0x68, 0xe9, 0x56, 0x33, 0x8c, 0x4c, 0xfc, 0xe9, 0xe1, 0xd9, 0x9d, 0x6e, 0x00,
-	0x2e, 0x7c, 0x1e, 0x6c, 0x7e, 0x9f, 0x0c, 0xf8, 0x0e, 0xa1, 0xa7, 0x10, 0xcd, 0xdd, 0x5c, 0xc3,
-	0x3c, 0x84, 0xef, 0x75, 0xf0, 0xcb, 0xa2, 0xa8, 0x71, 0xa3, 0xae, 0xa0, 0xc5, 0xd2, 0x9f, 0x1e,
-	0x1c, 0xfc, 0xd7, 0xe8, 0x08, 0x86, 0x55, 0xa9, 0x3e, 0xdb, 0x72, 0xf7, 0x03, 0x3e, 0x8f, 0xab,
-	0x52, 0x5d, 0x96, 0x95, 0x44, 0x49, 0xac, 0x5b, 0xc9, 0xdb, 0x49, 0x62, 0x8d, 0xd2, 0x09, 0xf8,
-	0xb5, 0xf8, 0xce, 0xfc, 0x09, 0xb9, 0xbd, 0x1e, 0x76, 0xe4, 0x4e, 0xa1, 0x8f, 0x20, 0x9c, 0xeb,
-	0x46, 0x59, 0x16, 0xf4, 0x21, 0xad, 0xe6, 0xba, 0x98, 0xa6, 0x62, 0x61, 0x6f, 0x17, 0xd3, 0x54,
-	0x0e, 0xa8, 0x4a, 0xc5, 0xa2, 0x5e, 0xa0, 0x2a, 0x15, 0x02, 0x62, 0xcd, 0xe2, 0x7e, 0x40, 0xac,
-	0xe9, 0x63, 0x88, 0x71, 0x96, 0xac, 0xd9, 0xb0, 0x0f, 0xea, 0xd4, 0xf4, 0x07, 0x81, 0x23, 0xfc,
-	0xde, 0x37, 0xc2, 0xce, 0x17, 0xb2, 0xa6, 0xcf, 0xf6, 0x6e, 0x3c, 0xda, 0x3b, 0xc1, 0x8e, 0xc9,
-	0x2e, 0xaf, 0x57, 0xf2, 0xe6, 0xcc, 0xe8, 0x22, 0xaf, 0xcf, 0x45, 0xfe, 0x6d, 0x17, 0x4d, 0x21,
-	0x70, 0x75, 0x34, 0x02, 0x2f, 0xbf, 0x48, 0x06, 0xce, 0x00, 0x6f, 0xf3, 0x8b, 0x84, 0xb8, 0x04,
-	0xcf, 0x13, 0x0f, 0x13, 0x3c, 0x4f, 0xfc, 0xf3, 0xd1, 0xe6, 0xef, 0x78, 0xb0, 0xd9, 0x8e, 0xc9,
-	0xaf, 0xed, 0x98, 0xfc, 0xd9, 0x8e, 0xc9, 0xc7, 0xd8, 0x58, 0x5d, 0xcb, 0xd5, 0x6c, 0x16, 0xa1,
-	0x89, 0x5f, 0xfc, 0x0b, 0x00, 0x00, 0xff, 0xff, 0x46, 0x5a, 0xe2, 0x68, 0xf1, 0x02, 0x00, 0x00,
+	// 452 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x6c, 0x92, 0xcd, 0x6e, 0xd3, 0x4e,
+	0x14, 0xc5, 0x33, 0xfe, 0x4c, 0x6e, 0xfa, 0xff, 0xcb, 0x0c, 0x15, 0x9a, 0xb0, 0x48, 0x23, 0xb3,
+	0x20, 0x02, 0xe1, 0x8a, 0xf2, 0x04, 0x14, 0x79, 0xc7, 0x87, 0x3a, 0xed, 0x02, 0x21, 0xa4, 0x6a,
+	0x92, 0x0e, 0x8e, 0x45, 0x66, 0x1c, 0x3c, 0x36, 0xa4, 0x8f, 0xc1, 0x33, 0xb1, 0xc9, 0x92, 0x27,
+	0x40, 0x90, 0x27, 0x41, 0x73, 0x6d, 0x43, 0x2b, 0xbc, 0xbb, 0xbe, 0xe7, 0x77, 0xef, 0xb9, 0xf2,
+	0x1c, 0x18, 0x57, 0xd7, 0x1b, 0x69, 0x92, 0x4d, 0x59, 0x54, 0x05, 0x0d, 0xaa, 0x95, 0xd0, 0x85,
+	0xb9, 0x7f, 0x98, 0x15, 0x59, 0x81, 0xad, 0x63, 0x5b, 0x35, 0x6a, 0xfc, 0x14, 0xfc, 0x97, 0x62,
+	0x21, 0xd7, 0x94, 0x82, 0xa7, 0x85, 0x92, 0x8c, 0xcc, 0xc8, 0x7c, 0xc4, 0xb1, 0xa6, 0x87, 0xe0,
+	0x7f, 0x16, 0xeb, 0x5a, 0x32, 0x07, 0x9b, 0xcd, 0x47, 0xfc, 0x1e, 0xfc, 0x17, 0xab, 0x5a, 0x7f,
+	0xa4, 0x8f, 0xc0, 0xb3, 0x46, 0x38, 0xf2, 0xff, 0xc9, 0xbd, 0xa4, 0x31, 0x4a, 0x50, 0x4c, 0x52,
+	0xbd, 0x2c, 0xae, 0x72, 0x9d, 0x71, 0x64, 0xec, 0xfa, 0x2b, 0x51, 0x09, 0xdc, 0x74, 0xc0, 0xb1,
+	0x8e, 0xef, 0xc2, 0xb0, 0xa3, 0x68, 0x08, 0xee, 0xdb, 0x37, 0x3c, 0x1a, 0xc4, 0x1f, 0x20, 0x38,
+	0x97, 0x65, 0x2e, 0x0d, 0x7d, 0x0c, 0xc1, 0xda, 0x9e, 0x66, 0x18, 0x99, 0xb9, 0xf3, 0xf1, 0xc9,
+	0x7f, 0x9d, 0x01, 0x1e, 0x7c, 0xea, 0xed, 0x7e, 0x1c, 0x0d, 0x78, 0x8b, 0xd0, 0x63, 0x08, 0x96,
+	0xd6, 0xd7, 0x30, 0x07, 0xe1, 0x3b, 0x1d, 0xfc, 0x3c, 0xcb, 0x4a, 0xbc, 0xa8, 0x1b, 0x68, 0xb0,
+	0xf8, 0x9b, 0x03, 0xa3, 0x3f, 0x1a, 0x9d, 0xc0, 0x50, 0xe5, 0xfa, 0xb2, 0xca, 0xdb, 0x3f, 0xe0,
+	0xf2, 0x50, 0xe5, 0xfa, 0x22, 0x57, 0x12, 0x25, 0xb1, 0x6d, 0x24, 0xa7, 0x95, 0xc4, 0x16, 0xa5,
+	0x23, 0x70, 0x4b, 0xf1, 0x85, 0xb9, 0x33, 0x72, 0xf3, 0x3c, 0xdc, 0xc8, 0xad, 0x42, 0x1f, 0x80,
+	0xbf, 0x2c, 0x6a, 0x5d, 0x31, 0xaf, 0x0f, 0x69, 0x34, 0xbb, 0xc5, 0xd4, 0x8a, 0xf9, 0xbd, 0x5b,
+	0x4c, 0xad, 0x2c, 0xa0, 0x72, 0xcd, 0x82, 0x5e, 0x40, 0xe5, 0x1a, 0x01, 0xb1, 0x65, 0x61, 0x3f,
+	0x20, 0xb6, 0xf4, 0x21, 0x84, 0xe8, 0x25, 0x4b, 0x36, 0xec, 0x83, 0x3a, 0x95, 0x26, 0x30, 0x36,
+	0xb5, 0xba, 0x34, 0x9f, 0x6a, 0x51, 0x4a, 0xc3, 0x46, 0x7d, 0x30, 0x98, 0x5a, 0x9d, 0x37, 0x40,
+	0xfc, 0x95, 0xc0, 0x01, 0x3e, 0xc7, 0x2b, 0x51, 0x2d, 0x57, 0xb2, 0xa4, 0x4f, 0x6e, 0x65, 0x62,
+	0x72, 0xeb, 0xc9, 0x5a, 0x26, 0xb9, 0xb8, 0xde, 0xc8, 0xbf, 0xb1, 0xd0, 0xa2, 0xfd, 0xb1, 0xff,
+	0xa4, 0xce, 0xbd, 0x99, 0xba, 0x39, 0x78, 0x76, 0x8e, 0x06, 0xe0, 0xa4, 0x67, 0xd1, 0xc0, 0x06,
+	0xe6, 0x75, 0x7a, 0x16, 0x11, 0xdb, 0xe0, 0x69, 0xe4, 0x60, 0x83, 0xa7, 0x91, 0x7b, 0x3a, 0xd9,
+	0xfd, 0x9a, 0x0e, 0x76, 0xfb, 0x29, 0xf9, 0xbe, 0x9f, 0x92, 0x9f, 0xfb, 0x29, 0x79, 0x17, 0x9a,
+	0xaa, 0x28, 0xe5, 0x66, 0xb1, 0x08, 0x30, 0xf4, 0xcf, 0x7e, 0x0f, 0x00, 0x16, 0x23, 0xd8, 0x75,
+	0x21, 0x03, 0x00, 0x00,
 }
 
 func (m *Label) Marshal() (dAtA []byte, err error) {
@@ -492,6 +495,18 @@ func (m *AggrChunk) MarshalToSizedBuffer(dAtA []byte) (int, error) {
 		i -= len(m.XXX_unrecognized)
 		copy(dAtA[i:], m.XXX_unrecognized)
 	}
+	if m.SumSquares != nil {
+		{
+			size, err := m.SumSquares.MarshalToSizedBuffer(dAtA[:i])
+			if err != nil {
+				return 0, err
+			}
+			i -= size
+			i = encodeVarintTypes(dAtA, i, uint64(size))
+		}
+		i--
+		dAtA[i] = 0x4a
+	}
 	if m.Counter != nil {
 		{
 			size, err := m.Counter.MarshalToSizedBuffer(dAtA[:i])
@@ -733,6 +748,10 @@ func (m *AggrChunk) Size() (n int) {
 		l = m.Counter.Size()
 		n += 1 + l + sovTypes(uint64(l))
 	}
+	if m.SumSquares != nil {
+		l = m.SumSquares.Size()
+		n += 1 + l + sovTypes(uint64(l))
+	}
 	if m.XXX_unrecognized != nil {
 		n += len(m.XXX_unrecognized)
 	}
@@ -1398,6 +1417,42 @@ func (m *AggrChunk) Unmarshal(dAtA []byte) error {
 				return err
 			}
 			iNdEx = postIndex
+		case 9:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field SumSquares", wireType)
+			}
+			var msglen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowTypes
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				msglen |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if msglen < 0 {
+				return ErrInvalidLengthTypes
+			}
+			postIndex := iNdEx + msglen
+			if postIndex < 0 {
+				return ErrInvalidLengthTypes
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			if m.SumSquares == nil {
+				m.SumSquares = &Chunk{}
+			}
+			if err := m.SumSquares.Unmarshal(dAtA[iNdEx:postIndex]); err != nil {
+				return err
+			}
+			iNdEx = postIndex
 		default:
 			iNdEx = preIndex
 			skippy, err := skipTypes(dAtA[iNdEx:])
@@ -34,6 +34,39 @@ func TestTSDBStore_Info(t *testing.T) {
 	testutil.Equals(t, int64(math.MaxInt64), resp.MaxTime)
 }
 
+func TestTSDBStore_Series_SkipChunks(t *testing.T) {
+	defer leaktest.CheckTimeout(t, 10*time.Second)()
+
+	db, err := testutil.NewTSDB()
+	defer func() { testutil.Ok(t, db.Close()) }()
+	testutil.Ok(t, err)
+
+	app := db.Appender()
+	_, err = app.Add(labels.FromStrings("a", "1"), 1, 1)
+	testutil.Ok(t, err)
+	testutil.Ok(t, app.Commit())
+
+	tsdbStore := NewTSDBStore(nil, nil, db, component.Rule, labels.FromStrings("region", "eu-west"))
+
+	for _, skipChunks := range []bool{false, true} {
+		srv := newStoreSeriesServer(context.Background())
+		testutil.Ok(t, tsdbStore.Series(&storepb.SeriesRequest{
+			MinTime:    0,
+			MaxTime:    10,
+			Matchers:   []storepb.LabelMatcher{{Type: storepb.LabelMatcher_EQ, Name: "a", Value: "1"}},
+			SkipChunks: skipChunks,
+		}, srv))
+
+		testutil.Equals(t, 1, len(srv.SeriesSet))
+		testutil.Equals(t, []storepb.Label{{Name: "a", Value: "1"}, {Name: "region", Value: "eu-west"}}, srv.SeriesSet[0].Labels)
+		if skipChunks {
+			testutil.Equals(t, 0, len(srv.SeriesSet[0].Chunks))
+		} else {
+			testutil.Equals(t, 1, len(srv.SeriesSet[0].Chunks))
+		}
+	}
+}
+
 // Regression test for https://github.com/thanos-io/thanos/issues/1038.
 func TestTSDBStore_Series_SplitSamplesIntoChunksWithMaxSizeOfUint16_e2e(t *testing.T) {
 	defer leaktest.CheckTimeout(t, 10*time.Second)()